@@ -0,0 +1,333 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package adb implements the ADB format of apk-tools 3, which is used by
+// APKv3 packages and their Packages.adb indexes.
+//
+// An ADB file is a sequence of blocks.  The ADB block holds a tree of values
+// described by a schema, and is followed by the signature blocks and, in
+// packages, a data block for each file.
+package adb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Val is a value of an ADB block.  The top four bits are the type of the
+// value, and the remaining bits are either the value itself for small
+// integers, or the offset of the value from the start of the block.
+type Val uint32
+
+// Null is the value of unset object fields and empty blobs.
+const Null Val = 0
+
+const (
+	typeInt    Val = 0x10000000
+	typeInt32  Val = 0x20000000
+	typeInt64  Val = 0x30000000
+	typeBlob8  Val = 0x80000000
+	typeBlob16 Val = 0x90000000
+	typeBlob32 Val = 0xa0000000
+	typeArray  Val = 0xd0000000
+	typeObject Val = 0xe0000000
+	typeMask   Val = 0xf0000000
+	valueMask  Val = 0x0fffffff
+
+	// hdrSize is the size of the header at the start of the ADB block: the
+	// compatible and current versions of the format, two reserved bytes and
+	// the root value.
+	hdrSize = 8
+)
+
+var errTooLarge = errors.New("ADB block is too large")
+
+func (v Val) typ() Val {
+	return v & typeMask
+}
+
+func (v Val) value() uint32 {
+	return uint32(v & valueMask)
+}
+
+// Builder builds the ADB block of a file.  Values are appended to the block
+// as they are created, and objects and arrays refer to values which have
+// been created before them.
+type Builder struct {
+	buf []byte
+	err error
+}
+
+// NewBuilder returns a Builder for an empty ADB block.
+func NewBuilder() *Builder {
+	return &Builder{buf: make([]byte, hdrSize)}
+}
+
+// write appends data to the block at the given alignment and returns its
+// offset.
+func (b *Builder) write(data []byte, align int) Val {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+
+	off := len(b.buf)
+	if off > int(valueMask) {
+		b.err = errTooLarge
+		return Null
+	}
+
+	b.buf = append(b.buf, data...)
+	return Val(off)
+}
+
+// Int returns an integer value.
+func (b *Builder) Int(v uint64) Val {
+	switch {
+	case v <= uint64(valueMask):
+		return typeInt | Val(v)
+	case v <= math.MaxUint32:
+		return typeInt32 | b.write(binary.LittleEndian.AppendUint32(nil, uint32(v)), 4)
+	default:
+		return typeInt64 | b.write(binary.LittleEndian.AppendUint64(nil, v), 8)
+	}
+}
+
+// optInt returns an integer value, or Null if v is 0.
+func (b *Builder) optInt(v uint64) Val {
+	if v == 0 {
+		return Null
+	}
+	return b.Int(v)
+}
+
+// Blob returns a value holding data, or Null if data is empty.
+func (b *Builder) Blob(data []byte) Val {
+	switch {
+	case len(data) == 0:
+		return Null
+	case len(data) <= math.MaxUint8:
+		return typeBlob8 | b.write(append([]byte{byte(len(data))}, data...), 1)
+	case len(data) <= math.MaxUint16:
+		return typeBlob16 | b.write(append(binary.LittleEndian.AppendUint16(nil, uint16(len(data))), data...), 2)
+	default:
+		return typeBlob32 | b.write(append(binary.LittleEndian.AppendUint32(nil, uint32(len(data))), data...), 4)
+	}
+}
+
+// String returns a value holding s, or Null if s is empty.
+func (b *Builder) String(s string) Val {
+	return b.Blob([]byte(s))
+}
+
+// vector writes the slots of an object or array.  The first slot holds the
+// number of slots, including itself.
+func (b *Builder) vector(typ Val, vals []Val) Val {
+	data := binary.LittleEndian.AppendUint32(nil, uint32(len(vals)+1))
+	for _, v := range vals {
+		data = binary.LittleEndian.AppendUint32(data, uint32(v))
+	}
+	return typ | b.write(data, 4)
+}
+
+// Object returns an object whose fields, numbered from one, are set to
+// fields.  An object without any field set is Null.
+func (b *Builder) Object(fields ...Val) Val {
+	n := len(fields)
+	for n > 0 && fields[n-1] == Null {
+		n--
+	}
+	if n == 0 {
+		return Null
+	}
+	return b.vector(typeObject, fields[:n])
+}
+
+// Array returns an array of the items which are not Null.  An empty array
+// is Null.
+func (b *Builder) Array(items ...Val) Val {
+	vals := []Val{}
+	for _, v := range items {
+		if v != Null {
+			vals = append(vals, v)
+		}
+	}
+	if len(vals) == 0 {
+		return Null
+	}
+	return b.vector(typeArray, vals)
+}
+
+// Finish sets the root value of the block and returns the block.
+func (b *Builder) Finish(root Val) ([]byte, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	// Both versions of the format are 0.
+	binary.LittleEndian.PutUint32(b.buf[4:], uint32(root))
+	return b.buf, nil
+}
+
+// DB reads the values of an ADB block.
+type DB struct {
+	data []byte
+}
+
+// Open returns a DB reading the ADB block data.
+func Open(data []byte) (*DB, error) {
+	if len(data) < hdrSize {
+		return nil, fmt.Errorf("ADB block is truncated")
+	}
+	if data[0] != 0 {
+		return nil, fmt.Errorf("unsupported ADB version %d", data[0])
+	}
+	return &DB{data: data}, nil
+}
+
+// Root returns the root value of the block.
+func (db *DB) Root() Val {
+	return Val(binary.LittleEndian.Uint32(db.data[4:]))
+}
+
+func (db *DB) deref(v Val, size int) ([]byte, error) {
+	off := int(v.value())
+	if off < hdrSize || off+size > len(db.data) {
+		return nil, fmt.Errorf("ADB value %#x is out of bounds", uint32(v))
+	}
+	return db.data[off : off+size], nil
+}
+
+// Int returns the integer held by v.  Null is 0.
+func (db *DB) Int(v Val) (uint64, error) {
+	switch v.typ() {
+	case 0:
+		if v != Null {
+			return 0, fmt.Errorf("ADB value %#x is not an integer", uint32(v))
+		}
+		return 0, nil
+	case typeInt:
+		return uint64(v.value()), nil
+	case typeInt32:
+		data, err := db.deref(v, 4)
+		if err != nil {
+			return 0, err
+		}
+		return uint64(binary.LittleEndian.Uint32(data)), nil
+	case typeInt64:
+		data, err := db.deref(v, 8)
+		if err != nil {
+			return 0, err
+		}
+		return binary.LittleEndian.Uint64(data), nil
+	}
+	return 0, fmt.Errorf("ADB value %#x is not an integer", uint32(v))
+}
+
+// Blob returns the data held by v.  Null is an empty blob.
+func (db *DB) Blob(v Val) ([]byte, error) {
+	var size, n int
+	switch v.typ() {
+	case 0:
+		if v != Null {
+			return nil, fmt.Errorf("ADB value %#x is not a blob", uint32(v))
+		}
+		return nil, nil
+	case typeBlob8:
+		data, err := db.deref(v, 1)
+		if err != nil {
+			return nil, err
+		}
+		size, n = 1, int(data[0])
+	case typeBlob16:
+		data, err := db.deref(v, 2)
+		if err != nil {
+			return nil, err
+		}
+		size, n = 2, int(binary.LittleEndian.Uint16(data))
+	case typeBlob32:
+		data, err := db.deref(v, 4)
+		if err != nil {
+			return nil, err
+		}
+		size, n = 4, int(binary.LittleEndian.Uint32(data))
+	default:
+		return nil, fmt.Errorf("ADB value %#x is not a blob", uint32(v))
+	}
+
+	data, err := db.deref(v, size+n)
+	if err != nil {
+		return nil, err
+	}
+	return data[size:], nil
+}
+
+// String returns the string held by v.  Null is an empty string.
+func (db *DB) String(v Val) (string, error) {
+	data, err := db.Blob(v)
+	return string(data), err
+}
+
+// Object is an object or array of an ADB block.
+type Object struct {
+	vals []Val
+}
+
+// Object returns the object or array held by v.  Null is an empty object.
+func (db *DB) Object(v Val) (Object, error) {
+	if v == Null {
+		return Object{}, nil
+	}
+	if v.typ() != typeObject && v.typ() != typeArray {
+		return Object{}, fmt.Errorf("ADB value %#x is not an object or array", uint32(v))
+	}
+
+	data, err := db.deref(v, 4)
+	if err != nil {
+		return Object{}, err
+	}
+	n := int(binary.LittleEndian.Uint32(data))
+	if n == 0 {
+		return Object{}, fmt.Errorf("ADB value %#x has no slots", uint32(v))
+	}
+
+	data, err = db.deref(v, 4*n)
+	if err != nil {
+		return Object{}, err
+	}
+
+	o := Object{vals: make([]Val, n)}
+	for i := range o.vals {
+		o.vals[i] = Val(binary.LittleEndian.Uint32(data[4*i:]))
+	}
+	return o, nil
+}
+
+// Len returns the number of fields of the object, or items of the array.
+func (o Object) Len() int {
+	if len(o.vals) == 0 {
+		return 0
+	}
+	return len(o.vals) - 1
+}
+
+// Field returns the field i of the object, or item i of the array, numbered
+// from one.  Fields which are not set are Null.
+func (o Object) Field(i int) Val {
+	if i < 1 || i >= len(o.vals) {
+		return Null
+	}
+	return o.vals[i]
+}
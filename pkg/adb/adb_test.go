@@ -0,0 +1,204 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValues(t *testing.T) {
+	b := NewBuilder()
+
+	ints := []uint64{0, 42, uint64(valueMask), uint64(valueMask) + 1, 1 << 40}
+	blobs := [][]byte{nil, []byte("x"), bytes.Repeat([]byte("a"), 300), bytes.Repeat([]byte("b"), 70000)}
+
+	vals := []Val{}
+	for _, i := range ints {
+		vals = append(vals, b.Int(i))
+	}
+	for _, blob := range blobs {
+		vals = append(vals, b.Blob(blob))
+	}
+
+	data, err := b.Finish(b.Object(b.Array(vals[:len(ints)]...), b.Array(vals[len(ints):]...)))
+	require.NoError(t, err)
+
+	db, err := Open(data)
+	require.NoError(t, err)
+	root, err := db.Object(db.Root())
+	require.NoError(t, err)
+	require.Equal(t, 2, root.Len())
+
+	arr, err := db.Object(root.Field(1))
+	require.NoError(t, err)
+	require.Equal(t, len(ints), arr.Len())
+	for i, want := range ints {
+		got, err := db.Int(arr.Field(i + 1))
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	// The empty blob is Null, which is left out of arrays.
+	arr, err = db.Object(root.Field(2))
+	require.NoError(t, err)
+	require.Equal(t, len(blobs)-1, arr.Len())
+	for i, want := range blobs[1:] {
+		got, err := db.Blob(arr.Field(i + 1))
+		require.NoError(t, err)
+		require.Equal(t, want, got)
+	}
+
+	require.Equal(t, Null, root.Field(3))
+	_, err = db.Int(root.Field(1))
+	require.Error(t, err)
+}
+
+func TestParseDependency(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want Dependency
+	}{
+		{"so:libc.so.6", Dependency{Name: "so:libc.so.6"}},
+		{"foo=1.0-r0", Dependency{Name: "foo", Version: "1.0-r0", Match: VersionEqual}},
+		{"foo>=1.0", Dependency{Name: "foo", Version: "1.0", Match: VersionGreater | VersionEqual}},
+		{"foo<2", Dependency{Name: "foo", Version: "2", Match: VersionLess}},
+		{"foo~1.2", Dependency{Name: "foo", Version: "1.2", Match: VersionFuzzy | VersionEqual}},
+		{"!bar", Dependency{Name: "bar", Match: VersionConflict}},
+		{"!bar<1", Dependency{Name: "bar", Version: "1", Match: VersionConflict | VersionLess}},
+	} {
+		t.Run(tt.in, func(t *testing.T) {
+			got := ParseDependency(tt.in)
+			require.Equal(t, tt.want, got)
+			require.Equal(t, tt.in, got.String())
+		})
+	}
+}
+
+func TestPackage(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	content := "#!/bin/sh\necho hello\n"
+	hash := sha256.Sum256([]byte(content))
+
+	pkg := &Package{
+		Info: PackageInfo{
+			Name:          "hello",
+			Version:       "1.0-r0",
+			Description:   "says hello",
+			Arch:          "x86_64",
+			License:       "Apache-2.0",
+			Origin:        "hello",
+			BuildTime:     1700000000,
+			InstalledSize: uint64(len(content)),
+			Depends:       []string{"cmd:sh", "!goodbye"},
+			Provides:      []string{"cmd:hello=1.0-r0"},
+			Replaces:      []string{},
+			InstallIf:     []string{},
+		},
+		Paths: []Dir{
+			{ACL: ACL{Mode: 0o755, User: "root", Group: "root"}},
+			{Name: "usr/bin", ACL: ACL{Mode: 0o755, User: "root", Group: "root"}, Files: []File{
+				{Name: "hello", ACL: ACL{Mode: 0o755, User: "root", Group: "root"}, Size: uint64(len(content)), MTime: 1700000000, Hash: hash[:]},
+				{Name: "hi", ACL: ACL{Mode: 0o777, User: "root", Group: "root"}, MTime: 1700000000, Target: SymlinkTarget("hello")},
+			}},
+		},
+		Scripts:  Scripts{PostInstall: "#!/bin/sh\ntrue\n"},
+		Triggers: []string{"/usr/share/hello"},
+	}
+
+	adbBlock, err := pkg.Marshal()
+	require.NoError(t, err)
+	sig, err := Sign(SchemaPackage, adbBlock, key)
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf, SchemaPackage)
+	require.NoError(t, err)
+	require.NoError(t, w.WriteBlock(BlockADB, adbBlock))
+	require.NoError(t, w.WriteBlock(BlockSig, sig))
+	require.NoError(t, w.WriteFileData(2, 1, int64(len(content)), strings.NewReader(content)))
+	require.NoError(t, w.Close())
+
+	r, err := NewReader(&buf)
+	require.NoError(t, err)
+	require.Equal(t, SchemaPackage, r.Schema)
+
+	gotBlock, err := r.ReadADB()
+	require.NoError(t, err)
+	require.Equal(t, adbBlock, gotBlock)
+
+	typ, _, err := r.Next()
+	require.NoError(t, err)
+	require.Equal(t, BlockSig, typ)
+	gotSig, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, Verify(SchemaPackage, gotBlock, gotSig, &key.PublicKey))
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	require.Error(t, Verify(SchemaPackage, gotBlock, gotSig, &other.PublicKey))
+	require.Error(t, Verify(SchemaIndex, gotBlock, gotSig, &key.PublicKey))
+
+	typ, size, err := r.Next()
+	require.NoError(t, err)
+	require.Equal(t, BlockData, typ)
+	require.Equal(t, int64(8+len(content)), size)
+	pathIdx, fileIdx, err := r.ReadFileDataHeader()
+	require.NoError(t, err)
+	require.Equal(t, []uint32{2, 1}, []uint32{pathIdx, fileIdx})
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, content, string(data))
+
+	_, _, err = r.Next()
+	require.ErrorIs(t, err, io.EOF)
+
+	got, err := UnmarshalPackage(gotBlock)
+	require.NoError(t, err)
+	require.Equal(t, pkg, got)
+}
+
+func TestIndex(t *testing.T) {
+	idx := &Index{
+		Description: "test repository",
+		Packages: []*PackageInfo{{
+			Name:      "hello",
+			Version:   "1.0-r0",
+			Arch:      "x86_64",
+			UniqueID:  bytes.Repeat([]byte{1}, 32),
+			FileSize:  1234,
+			Depends:   []string{"so:libc.so.6"},
+			Provides:  []string{},
+			Replaces:  []string{},
+			InstallIf: []string{},
+		}},
+	}
+
+	data, err := idx.Marshal()
+	require.NoError(t, err)
+
+	got, err := UnmarshalIndex(data)
+	require.NoError(t, err)
+	require.Equal(t, idx, got)
+}
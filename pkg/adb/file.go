@@ -0,0 +1,236 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/flate"
+)
+
+const (
+	// SchemaPackage is the schema of APKv3 packages.
+	SchemaPackage uint32 = 0x676b6370 // "pckg"
+	// SchemaIndex is the schema of APKv3 repository indexes.
+	SchemaIndex uint32 = 0x78646e69 // "indx"
+)
+
+// The types of the blocks of an ADB file.
+const (
+	BlockADB  uint32 = 0
+	BlockSig  uint32 = 1
+	BlockData uint32 = 2
+	blockExt  uint32 = 3
+)
+
+const (
+	magic        = "ADB."
+	magicDeflate = "ADBd"
+
+	blockAlign = 8
+	// maxBlockSize is the largest size, including the header, of a block
+	// which does not need the extended header.
+	maxBlockSize = 1<<30 - 1
+)
+
+func padding(size int64) int64 {
+	return (blockAlign - size%blockAlign) % blockAlign
+}
+
+// Writer writes a deflate compressed ADB file.
+type Writer struct {
+	zw *flate.Writer
+}
+
+// NewWriter writes the header of an ADB file with the given schema to w.
+func NewWriter(w io.Writer, schema uint32) (*Writer, error) {
+	if _, err := io.WriteString(w, magicDeflate); err != nil {
+		return nil, err
+	}
+
+	zw, err := flate.NewWriter(w, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+
+	hdr := binary.LittleEndian.AppendUint32([]byte(magic), schema)
+	if _, err := zw.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	return &Writer{zw: zw}, nil
+}
+
+// WriteBlock writes a block holding data.
+func (w *Writer) WriteBlock(typ uint32, data []byte) error {
+	return w.WriteBlockFrom(typ, int64(len(data)), bytes.NewReader(data))
+}
+
+// WriteBlockFrom writes a block holding the size bytes read from r.
+func (w *Writer) WriteBlockFrom(typ uint32, size int64, r io.Reader) error {
+	var hdr []byte
+	raw := 4 + size
+	if raw > maxBlockSize {
+		raw = 16 + size
+		hdr = binary.LittleEndian.AppendUint32(hdr, blockExt<<30|typ)
+		hdr = binary.LittleEndian.AppendUint32(hdr, 0)
+		hdr = binary.LittleEndian.AppendUint64(hdr, uint64(raw))
+	} else {
+		hdr = binary.LittleEndian.AppendUint32(hdr, typ<<30|uint32(raw))
+	}
+
+	if _, err := w.zw.Write(hdr); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w.zw, r, size); err != nil {
+		return fmt.Errorf("writing block: %w", err)
+	}
+	if _, err := w.zw.Write(make([]byte, padding(raw))); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WriteFileData writes the data block of a package file, identified by the
+// indexes, numbered from one, of its directory in the paths of the package
+// and of the file in the directory.
+func (w *Writer) WriteFileData(pathIdx, fileIdx uint32, size int64, r io.Reader) error {
+	hdr := binary.LittleEndian.AppendUint32(nil, pathIdx)
+	hdr = binary.LittleEndian.AppendUint32(hdr, fileIdx)
+	return w.WriteBlockFrom(BlockData, int64(len(hdr))+size, io.MultiReader(bytes.NewReader(hdr), r))
+}
+
+// Close flushes the compressed stream.  It does not close the underlying
+// writer.
+func (w *Writer) Close() error {
+	return w.zw.Close()
+}
+
+// Reader reads the blocks of an ADB file, which may be deflate compressed.
+type Reader struct {
+	// Schema is the schema of the file.
+	Schema uint32
+
+	r         *bufio.Reader
+	remaining int64
+	padding   int64
+}
+
+// NewReader reads the header of the ADB file in r.
+func NewReader(r io.Reader) (*Reader, error) {
+	br := bufio.NewReader(r)
+
+	m := make([]byte, 4)
+	if _, err := io.ReadFull(br, m); err != nil {
+		return nil, fmt.Errorf("reading ADB header: %w", err)
+	}
+	switch string(m) {
+	case magicDeflate:
+		br = bufio.NewReader(flate.NewReader(br))
+		if _, err := io.ReadFull(br, m); err != nil {
+			return nil, fmt.Errorf("reading ADB header: %w", err)
+		}
+		if string(m) != magic {
+			return nil, fmt.Errorf("not an ADB file")
+		}
+	case magic:
+	default:
+		return nil, fmt.Errorf("not an ADB file or unsupported compression")
+	}
+
+	schema := make([]byte, 4)
+	if _, err := io.ReadFull(br, schema); err != nil {
+		return nil, fmt.Errorf("reading ADB header: %w", err)
+	}
+
+	return &Reader{Schema: binary.LittleEndian.Uint32(schema), r: br}, nil
+}
+
+// Next advances to the next block and returns its type and size.  It
+// returns io.EOF at the end of the file.
+func (r *Reader) Next() (uint32, int64, error) {
+	if _, err := io.CopyN(io.Discard, r.r, r.remaining+r.padding); err != nil {
+		return 0, 0, fmt.Errorf("skipping block: %w", err)
+	}
+	r.remaining, r.padding = 0, 0
+
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r.r, hdr); errors.Is(err, io.EOF) {
+		return 0, 0, io.EOF
+	} else if err != nil {
+		return 0, 0, fmt.Errorf("reading block header: %w", err)
+	}
+
+	typeSize := binary.LittleEndian.Uint32(hdr)
+	typ, raw, hdrLen := typeSize>>30, int64(typeSize&maxBlockSize), int64(4)
+	if typ == blockExt {
+		ext := make([]byte, 12)
+		if _, err := io.ReadFull(r.r, ext); err != nil {
+			return 0, 0, fmt.Errorf("reading block header: %w", err)
+		}
+		typ, raw, hdrLen = typeSize&maxBlockSize, int64(binary.LittleEndian.Uint64(ext[4:])), 16
+	}
+	if raw < hdrLen {
+		return 0, 0, fmt.Errorf("block size %d is invalid", raw)
+	}
+
+	r.remaining, r.padding = raw-hdrLen, padding(raw)
+	return typ, r.remaining, nil
+}
+
+// Read reads from the current block.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.remaining == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.remaining {
+		p = p[:r.remaining]
+	}
+
+	n, err := r.r.Read(p)
+	r.remaining -= int64(n)
+	if errors.Is(err, io.EOF) && r.remaining != 0 {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// ReadADB reads the ADB block, which is the first block of the file.
+func (r *Reader) ReadADB() ([]byte, error) {
+	typ, _, err := r.Next()
+	if err != nil {
+		return nil, fmt.Errorf("reading ADB block: %w", err)
+	}
+	if typ != BlockADB {
+		return nil, fmt.Errorf("first block is of type %d, not an ADB block", typ)
+	}
+	return io.ReadAll(r)
+}
+
+// ReadFileDataHeader reads the indexes of the directory and file at the start
+// of a data block, the rest of which is the content of the file.
+func (r *Reader) ReadFileDataHeader() (uint32, uint32, error) {
+	hdr := make([]byte, 8)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return 0, 0, fmt.Errorf("reading data block header: %w", err)
+	}
+	return binary.LittleEndian.Uint32(hdr), binary.LittleEndian.Uint32(hdr[4:]), nil
+}
@@ -0,0 +1,657 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// The fields of the objects of the package and index schemas, as numbered by
+// apk-tools 3.
+const (
+	pkgInfo     = 1
+	pkgPaths    = 2
+	pkgScripts  = 3
+	pkgTriggers = 4
+
+	piName             = 1
+	piVersion          = 2
+	piUniqueID         = 3
+	piDescription      = 4
+	piArch             = 5
+	piLicense          = 6
+	piOrigin           = 7
+	piMaintainer       = 8
+	piURL              = 9
+	piRepoCommit       = 10
+	piBuildTime        = 11
+	piInstalledSize    = 12
+	piFileSize         = 13
+	piProviderPriority = 14
+	piDepends          = 15
+	piProvides         = 16
+	piReplaces         = 17
+	piInstallIf        = 18
+	piMax              = 21
+
+	depName    = 1
+	depVersion = 2
+	depMatch   = 3
+
+	diName  = 1
+	diACL   = 2
+	diFiles = 3
+
+	aclMode  = 1
+	aclUser  = 2
+	aclGroup = 3
+
+	fiName   = 1
+	fiACL    = 2
+	fiSize   = 3
+	fiMTime  = 4
+	fiHashes = 5
+	fiTarget = 6
+
+	ndxDescription = 1
+	ndxPackages    = 2
+)
+
+// The version comparisons of a dependency.
+const (
+	VersionEqual    = 1
+	VersionLess     = 2
+	VersionGreater  = 4
+	VersionFuzzy    = 8
+	VersionConflict = 16
+)
+
+var versionOperators = []struct {
+	op    string
+	match uint64
+}{
+	// Operators which are a prefix of another come last, and ~ is preferred
+	// to =~ when formatting.
+	{"<=", VersionLess | VersionEqual},
+	{">=", VersionGreater | VersionEqual},
+	{"~", VersionFuzzy | VersionEqual},
+	{"=~", VersionFuzzy | VersionEqual},
+	{"<", VersionLess},
+	{">", VersionGreater},
+	{"=", VersionEqual},
+}
+
+// Dependency is a dependency, provide or replace of a package.
+type Dependency struct {
+	Name    string
+	Version string
+	Match   uint64
+}
+
+// ParseDependency parses a dependency as written in .PKGINFO, such as
+// so:libc.so.6, foo>=1.2-r0 or !bar.
+func ParseDependency(s string) Dependency {
+	d := Dependency{}
+	if rest, ok := strings.CutPrefix(s, "!"); ok {
+		d.Match |= VersionConflict
+		s = rest
+	}
+
+	i := strings.IndexAny(s, "<>=~")
+	if i == -1 {
+		d.Name = s
+		return d
+	}
+
+	d.Name = s[:i]
+	for _, op := range versionOperators {
+		if v, ok := strings.CutPrefix(s[i:], op.op); ok {
+			d.Match |= op.match
+			d.Version = v
+			break
+		}
+	}
+
+	return d
+}
+
+// String formats the dependency as written in .PKGINFO.
+func (d Dependency) String() string {
+	s := d.Name
+	if d.Match&VersionConflict != 0 {
+		s = "!" + s
+	}
+	if d.Version == "" {
+		return s
+	}
+
+	match := d.Match &^ VersionConflict
+	if match == 0 {
+		match = VersionEqual
+	}
+	for _, op := range versionOperators {
+		if op.match == match {
+			return s + op.op + d.Version
+		}
+	}
+	return s + "=" + d.Version
+}
+
+func (b *Builder) dependency(s string) Val {
+	d := ParseDependency(s)
+
+	// Equality is implied when a version is set.
+	match := Null
+	if d.Match != VersionEqual && d.Match != 0 {
+		match = b.Int(d.Match)
+	}
+
+	return b.Object(b.String(d.Name), b.String(d.Version), match)
+}
+
+func (b *Builder) dependencies(deps []string) Val {
+	vals := make([]Val, len(deps))
+	for i, d := range deps {
+		vals[i] = b.dependency(d)
+	}
+	return b.Array(vals...)
+}
+
+func (b *Builder) strings(ss []string) Val {
+	vals := make([]Val, len(ss))
+	for i, s := range ss {
+		vals[i] = b.String(s)
+	}
+	return b.Array(vals...)
+}
+
+func (db *DB) dependencies(v Val) ([]string, error) {
+	arr, err := db.Object(v)
+	if err != nil {
+		return nil, err
+	}
+
+	deps := []string{}
+	for i := 1; i <= arr.Len(); i++ {
+		o, err := db.Object(arr.Field(i))
+		if err != nil {
+			return nil, err
+		}
+
+		d := Dependency{}
+		if d.Name, err = db.String(o.Field(depName)); err != nil {
+			return nil, err
+		}
+		if d.Version, err = db.String(o.Field(depVersion)); err != nil {
+			return nil, err
+		}
+		if d.Match, err = db.Int(o.Field(depMatch)); err != nil {
+			return nil, err
+		}
+		deps = append(deps, d.String())
+	}
+
+	return deps, nil
+}
+
+func (db *DB) strings(v Val) ([]string, error) {
+	arr, err := db.Object(v)
+	if err != nil {
+		return nil, err
+	}
+
+	ss := []string{}
+	for i := 1; i <= arr.Len(); i++ {
+		s, err := db.String(arr.Field(i))
+		if err != nil {
+			return nil, err
+		}
+		ss = append(ss, s)
+	}
+
+	return ss, nil
+}
+
+// PackageInfo is the metadata of a package, which is stored in the package
+// and in the repository index.
+type PackageInfo struct {
+	Name        string
+	Version     string
+	Description string
+	Arch        string
+	License     string
+	Origin      string
+	Maintainer  string
+	URL         string
+	RepoCommit  string
+
+	// UniqueID identifies the package in an index.  It is the SHA-256 digest
+	// of the ADB block of the package.
+	UniqueID []byte
+
+	BuildTime        uint64
+	InstalledSize    uint64
+	FileSize         uint64
+	ProviderPriority uint64
+
+	Depends   []string
+	Provides  []string
+	Replaces  []string
+	InstallIf []string
+}
+
+func (b *Builder) packageInfo(pi *PackageInfo) Val {
+	fields := make([]Val, piMax)
+	set := func(i int, v Val) { fields[i-1] = v }
+
+	set(piName, b.String(pi.Name))
+	set(piVersion, b.String(pi.Version))
+	set(piUniqueID, b.Blob(pi.UniqueID))
+	set(piDescription, b.String(pi.Description))
+	set(piArch, b.String(pi.Arch))
+	set(piLicense, b.String(pi.License))
+	set(piOrigin, b.String(pi.Origin))
+	set(piMaintainer, b.String(pi.Maintainer))
+	set(piURL, b.String(pi.URL))
+	set(piRepoCommit, b.String(pi.RepoCommit))
+	set(piBuildTime, b.optInt(pi.BuildTime))
+	set(piInstalledSize, b.optInt(pi.InstalledSize))
+	set(piFileSize, b.optInt(pi.FileSize))
+	set(piProviderPriority, b.optInt(pi.ProviderPriority))
+	set(piDepends, b.dependencies(pi.Depends))
+	set(piProvides, b.dependencies(pi.Provides))
+	set(piReplaces, b.dependencies(pi.Replaces))
+	set(piInstallIf, b.dependencies(pi.InstallIf))
+
+	return b.Object(fields...)
+}
+
+func (db *DB) packageInfo(v Val) (*PackageInfo, error) {
+	o, err := db.Object(v)
+	if err != nil {
+		return nil, err
+	}
+
+	pi := &PackageInfo{}
+	for _, f := range []struct {
+		field int
+		s     *string
+	}{
+		{piName, &pi.Name},
+		{piVersion, &pi.Version},
+		{piDescription, &pi.Description},
+		{piArch, &pi.Arch},
+		{piLicense, &pi.License},
+		{piOrigin, &pi.Origin},
+		{piMaintainer, &pi.Maintainer},
+		{piURL, &pi.URL},
+		{piRepoCommit, &pi.RepoCommit},
+	} {
+		if *f.s, err = db.String(o.Field(f.field)); err != nil {
+			return nil, fmt.Errorf("reading field %d of package info: %w", f.field, err)
+		}
+	}
+
+	for _, f := range []struct {
+		field int
+		i     *uint64
+	}{
+		{piBuildTime, &pi.BuildTime},
+		{piInstalledSize, &pi.InstalledSize},
+		{piFileSize, &pi.FileSize},
+		{piProviderPriority, &pi.ProviderPriority},
+	} {
+		if *f.i, err = db.Int(o.Field(f.field)); err != nil {
+			return nil, fmt.Errorf("reading field %d of package info: %w", f.field, err)
+		}
+	}
+
+	for _, f := range []struct {
+		field int
+		deps  *[]string
+	}{
+		{piDepends, &pi.Depends},
+		{piProvides, &pi.Provides},
+		{piReplaces, &pi.Replaces},
+		{piInstallIf, &pi.InstallIf},
+	} {
+		if *f.deps, err = db.dependencies(o.Field(f.field)); err != nil {
+			return nil, fmt.Errorf("reading field %d of package info: %w", f.field, err)
+		}
+	}
+
+	if pi.UniqueID, err = db.Blob(o.Field(piUniqueID)); err != nil {
+		return nil, fmt.Errorf("reading unique id of package info: %w", err)
+	}
+
+	return pi, nil
+}
+
+// ACL is the mode and ownership of a file or directory.
+type ACL struct {
+	Mode  uint32
+	User  string
+	Group string
+}
+
+func (b *Builder) acl(a ACL) Val {
+	fields := make([]Val, aclGroup)
+	fields[aclMode-1] = b.optInt(uint64(a.Mode))
+	fields[aclUser-1] = b.String(a.User)
+	fields[aclGroup-1] = b.String(a.Group)
+	return b.Object(fields...)
+}
+
+func (db *DB) acl(v Val) (ACL, error) {
+	o, err := db.Object(v)
+	if err != nil {
+		return ACL{}, err
+	}
+
+	a := ACL{}
+	mode, err := db.Int(o.Field(aclMode))
+	if err != nil {
+		return ACL{}, err
+	}
+	a.Mode = uint32(mode)
+	if a.User, err = db.String(o.Field(aclUser)); err != nil {
+		return ACL{}, err
+	}
+	if a.Group, err = db.String(o.Field(aclGroup)); err != nil {
+		return ACL{}, err
+	}
+	return a, nil
+}
+
+// File is a file in a directory of a package.
+type File struct {
+	Name  string
+	ACL   ACL
+	Size  uint64
+	MTime uint64
+	// Hash is the SHA-256 digest of the content of a regular file.
+	Hash []byte
+	// Target is set for special files, see SymlinkTarget.
+	Target []byte
+}
+
+// sIFLNK is the file type of symbolic links in st_mode.
+const sIFLNK = 0o120000
+
+// SymlinkTarget returns the Target of a symbolic link to target: the type of
+// the file followed by the target.
+func SymlinkTarget(target string) []byte {
+	return append(binary.LittleEndian.AppendUint16(nil, sIFLNK), target...)
+}
+
+// Dir is a directory of a package and the files in it, but not the
+// directories.  The root directory has an empty name.
+type Dir struct {
+	Name  string
+	ACL   ACL
+	Files []File
+}
+
+// Scripts are the scripts run by apk when the package is installed, upgraded
+// or removed, or when one of its triggers fires.
+type Scripts struct {
+	Trigger       string
+	PreInstall    string
+	PostInstall   string
+	PreDeinstall  string
+	PostDeinstall string
+	PreUpgrade    string
+	PostUpgrade   string
+}
+
+// Package is the content of the ADB block of a package.  The content of the
+// files is stored in the data blocks which follow it.
+type Package struct {
+	Info     PackageInfo
+	Paths    []Dir
+	Scripts  Scripts
+	Triggers []string
+}
+
+// scriptFields returns pointers to the scripts, in the order of the fields
+// of the scripts object.
+func (s *Scripts) scriptFields() []*string {
+	return []*string{
+		&s.Trigger,
+		&s.PreInstall,
+		&s.PostInstall,
+		&s.PreDeinstall,
+		&s.PostDeinstall,
+		&s.PreUpgrade,
+		&s.PostUpgrade,
+	}
+}
+
+func (b *Builder) file(f *File) Val {
+	fields := make([]Val, fiTarget)
+	fields[fiName-1] = b.String(f.Name)
+	fields[fiACL-1] = b.acl(f.ACL)
+	fields[fiSize-1] = b.optInt(f.Size)
+	fields[fiMTime-1] = b.optInt(f.MTime)
+	fields[fiHashes-1] = b.Blob(f.Hash)
+	fields[fiTarget-1] = b.Blob(f.Target)
+	return b.Object(fields...)
+}
+
+func (db *DB) file(v Val) (File, error) {
+	o, err := db.Object(v)
+	if err != nil {
+		return File{}, err
+	}
+
+	f := File{}
+	if f.Name, err = db.String(o.Field(fiName)); err != nil {
+		return File{}, err
+	}
+	if f.ACL, err = db.acl(o.Field(fiACL)); err != nil {
+		return File{}, err
+	}
+	if f.Size, err = db.Int(o.Field(fiSize)); err != nil {
+		return File{}, err
+	}
+	if f.MTime, err = db.Int(o.Field(fiMTime)); err != nil {
+		return File{}, err
+	}
+	if f.Hash, err = db.Blob(o.Field(fiHashes)); err != nil {
+		return File{}, err
+	}
+	if f.Target, err = db.Blob(o.Field(fiTarget)); err != nil {
+		return File{}, err
+	}
+	return f, nil
+}
+
+func (b *Builder) dir(d *Dir) Val {
+	files := make([]Val, len(d.Files))
+	for i := range d.Files {
+		files[i] = b.file(&d.Files[i])
+	}
+
+	fields := make([]Val, diFiles)
+	fields[diName-1] = b.String(d.Name)
+	fields[diACL-1] = b.acl(d.ACL)
+	fields[diFiles-1] = b.Array(files...)
+	return b.Object(fields...)
+}
+
+func (db *DB) dir(v Val) (Dir, error) {
+	o, err := db.Object(v)
+	if err != nil {
+		return Dir{}, err
+	}
+
+	d := Dir{}
+	if d.Name, err = db.String(o.Field(diName)); err != nil {
+		return Dir{}, err
+	}
+	if d.ACL, err = db.acl(o.Field(diACL)); err != nil {
+		return Dir{}, err
+	}
+
+	files, err := db.Object(o.Field(diFiles))
+	if err != nil {
+		return Dir{}, err
+	}
+	for i := 1; i <= files.Len(); i++ {
+		f, err := db.file(files.Field(i))
+		if err != nil {
+			return Dir{}, err
+		}
+		d.Files = append(d.Files, f)
+	}
+	return d, nil
+}
+
+// Marshal returns the ADB block of the package.
+func (p *Package) Marshal() ([]byte, error) {
+	b := NewBuilder()
+
+	paths := make([]Val, len(p.Paths))
+	for i := range p.Paths {
+		paths[i] = b.dir(&p.Paths[i])
+	}
+
+	scripts := []Val{}
+	for _, s := range p.Scripts.scriptFields() {
+		scripts = append(scripts, b.String(*s))
+	}
+
+	fields := make([]Val, pkgTriggers)
+	fields[pkgInfo-1] = b.packageInfo(&p.Info)
+	fields[pkgPaths-1] = b.Array(paths...)
+	fields[pkgScripts-1] = b.Object(scripts...)
+	fields[pkgTriggers-1] = b.strings(p.Triggers)
+	return b.Finish(b.Object(fields...))
+}
+
+// UnmarshalPackage reads the ADB block of a package.
+func UnmarshalPackage(adbBlock []byte) (*Package, error) {
+	db, err := Open(adbBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := db.Object(db.Root())
+	if err != nil {
+		return nil, err
+	}
+
+	pi, err := db.packageInfo(root.Field(pkgInfo))
+	if err != nil {
+		return nil, err
+	}
+	p := &Package{Info: *pi}
+
+	paths, err := db.Object(root.Field(pkgPaths))
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i <= paths.Len(); i++ {
+		d, err := db.dir(paths.Field(i))
+		if err != nil {
+			return nil, fmt.Errorf("reading path %d: %w", i, err)
+		}
+		p.Paths = append(p.Paths, d)
+	}
+
+	scripts, err := db.Object(root.Field(pkgScripts))
+	if err != nil {
+		return nil, err
+	}
+	for i, s := range p.Scripts.scriptFields() {
+		if *s, err = db.String(scripts.Field(i + 1)); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Triggers, err = db.strings(root.Field(pkgTriggers)); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// UnmarshalPackageInfo reads the package info from the ADB block of a
+// package.
+func UnmarshalPackageInfo(adbBlock []byte) (*PackageInfo, error) {
+	db, err := Open(adbBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := db.Object(db.Root())
+	if err != nil {
+		return nil, err
+	}
+
+	return db.packageInfo(root.Field(pkgInfo))
+}
+
+// Index is the content of the ADB block of a repository index.
+type Index struct {
+	Description string
+	Packages    []*PackageInfo
+}
+
+// Marshal returns the ADB block of the index.
+func (idx *Index) Marshal() ([]byte, error) {
+	b := NewBuilder()
+
+	pkgs := make([]Val, len(idx.Packages))
+	for i, pi := range idx.Packages {
+		pkgs[i] = b.packageInfo(pi)
+	}
+
+	return b.Finish(b.Object(b.String(idx.Description), b.Array(pkgs...)))
+}
+
+// UnmarshalIndex reads the ADB block of a repository index.
+func UnmarshalIndex(adbBlock []byte) (*Index, error) {
+	db, err := Open(adbBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := db.Object(db.Root())
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index{}
+	if idx.Description, err = db.String(root.Field(ndxDescription)); err != nil {
+		return nil, err
+	}
+
+	pkgs, err := db.Object(root.Field(ndxPackages))
+	if err != nil {
+		return nil, err
+	}
+	for i := 1; i <= pkgs.Len(); i++ {
+		pi, err := db.packageInfo(pkgs.Field(i))
+		if err != nil {
+			return nil, err
+		}
+		idx.Packages = append(idx.Packages, pi)
+	}
+
+	return idx, nil
+}
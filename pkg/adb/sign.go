@@ -0,0 +1,134 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package adb
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"fmt"
+	"os"
+)
+
+const (
+	// sigVersion is the version of the signature block format.
+	sigVersion = 0
+	// hashSHA512 identifies SHA-512 in apk-tools 3.
+	hashSHA512 = 4
+
+	keyIDSize = 16
+	// sigHdrSize is the size of the signature block before the signature:
+	// the version, the hash algorithm and the key ID.
+	sigHdrSize = 2 + keyIDSize
+)
+
+// KeyID returns the ID apk-tools 3 uses to find the key a block was signed
+// with, the first 16 bytes of the SHA-512 digest of the PKCS #1 encoding of
+// the public key.
+func KeyID(pub *rsa.PublicKey) []byte {
+	sum := sha512.Sum512(x509.MarshalPKCS1PublicKey(pub))
+	return sum[:keyIDSize]
+}
+
+// signedDigest returns the digest signed by a signature block: the schema of
+// the file, the header of the signature block and the digest of the ADB
+// block.
+func signedDigest(schema uint32, sigHdr, adbBlock []byte) []byte {
+	md := sha512.Sum512(adbBlock)
+
+	h := sha512.New()
+	h.Write(binary.LittleEndian.AppendUint32(nil, schema))
+	h.Write(sigHdr)
+	h.Write(md[:])
+	return h.Sum(nil)
+}
+
+// Sign returns a signature block over the ADB block of a file with the given
+// schema.
+func Sign(schema uint32, adbBlock []byte, key *rsa.PrivateKey) ([]byte, error) {
+	hdr := append([]byte{sigVersion, hashSHA512}, KeyID(&key.PublicKey)...)
+
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA512, signedDigest(schema, hdr, adbBlock))
+	if err != nil {
+		return nil, fmt.Errorf("signing: %w", err)
+	}
+
+	return append(hdr, sig...), nil
+}
+
+// Verify checks that the signature block was made over the ADB block by the
+// key.
+func Verify(schema uint32, adbBlock, sigBlock []byte, pub *rsa.PublicKey) error {
+	if len(sigBlock) < sigHdrSize {
+		return fmt.Errorf("signature block is truncated")
+	}
+	if sigBlock[0] != sigVersion || sigBlock[1] != hashSHA512 {
+		return fmt.Errorf("unsupported signature version %d or hash %d", sigBlock[0], sigBlock[1])
+	}
+	if !bytes.Equal(sigBlock[2:sigHdrSize], KeyID(pub)) {
+		return fmt.Errorf("signature was made by another key")
+	}
+
+	hdr := sigBlock[:sigHdrSize]
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA512, signedDigest(schema, hdr, adbBlock), sigBlock[sigHdrSize:]); err != nil {
+		return fmt.Errorf("verifying signature: %w", err)
+	}
+
+	return nil
+}
+
+// LoadPrivateKey reads a PEM encoded RSA private key, as used to sign APKv2
+// packages, decrypting it with passphrase if it is encrypted.
+func LoadPrivateKey(keyFile, passphrase string) (*rsa.PrivateKey, error) {
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", keyFile)
+	}
+
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) { //nolint:staticcheck
+		if passphrase == "" {
+			return nil, fmt.Errorf("key %s is encrypted but no passphrase was provided", keyFile)
+		}
+		if der, err = x509.DecryptPEMBlock(block, []byte(passphrase)); err != nil { //nolint:staticcheck
+			return nil, fmt.Errorf("decrypting key %s: %w", keyFile, err)
+		}
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key %s: %w", keyFile, err)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("key %s is not an RSA key", keyFile)
+	}
+
+	return rsaKey, nil
+}
@@ -0,0 +1,374 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apkdiff loads the sections of APKv2 packages and compares them
+// file by file.
+package apkdiff
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/klauspost/compress/gzip"
+	"go.opentelemetry.io/otel"
+)
+
+// Section identifies one of the gzip streams an APKv2 package is made of.
+type Section string
+
+const (
+	SignatureSection Section = "signature"
+	ControlSection   Section = "control"
+	DataSection      Section = "data"
+)
+
+// Sections lists the package sections in the order they appear in an apk.
+var Sections = []Section{SignatureSection, ControlSection, DataSection}
+
+// ContentSections lists the sections holding the contents of a package, which
+// its signatures sign.  Unlike the signature section, they do not depend on
+// the signer, whose signatures can differ for the same contents, as keyless
+// signatures do.
+var ContentSections = []Section{ControlSection, DataSection}
+
+const xattrPrefix = "SCHILY.xattr."
+
+// Entry describes a single tar entry from a package section.
+type Entry struct {
+	Name     string
+	Type     byte
+	Linkname string
+	Mode     int64
+	Uid      int
+	Gid      int
+	Uname    string
+	Gname    string
+	ModTime  time.Time
+	Size     int64
+	// Digest is the hex encoded SHA-256 of the entry contents.
+	Digest string
+	Xattrs map[string]string
+}
+
+// Package holds the parsed sections of an apk.
+type Package struct {
+	Path string
+	// Digests holds the hex encoded SHA-256 of each compressed section.
+	Digests map[Section]string
+	Entries map[Section][]*Entry
+	// Control holds the contents of the files in the control section, such
+	// as .PKGINFO and the scriptlets.
+	Control map[string][]byte
+}
+
+// Entry returns the entry at name in the given section, or nil.
+func (p *Package) Entry(section Section, name string) *Entry {
+	for _, e := range p.Entries[section] {
+		if e.Name == name {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Open expands the apk at path and reads the entries of each section.
+func Open(ctx context.Context, path string) (*Package, error) {
+	ctx, span := otel.Tracer("melange").Start(ctx, "apkdiff.Open")
+	defer span.End()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	eapk, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return nil, fmt.Errorf("expanding apk %s: %w", path, err)
+	}
+	defer eapk.Close()
+
+	pkg := &Package{
+		Path:    path,
+		Digests: map[Section]string{},
+		Entries: map[Section][]*Entry{},
+		Control: map[string][]byte{},
+	}
+
+	files := map[Section]string{
+		SignatureSection: eapk.SignatureFile,
+		ControlSection:   eapk.ControlFile,
+		DataSection:      eapk.PackageFile,
+	}
+
+	for _, section := range Sections {
+		if files[section] == "" {
+			continue
+		}
+
+		var contents map[string][]byte
+		if section == ControlSection {
+			contents = pkg.Control
+		}
+
+		digest, entries, err := readSection(files[section], contents)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s section of %s: %w", section, path, err)
+		}
+
+		pkg.Digests[section] = digest
+		pkg.Entries[section] = entries
+	}
+
+	return pkg, nil
+}
+
+// readSection reads the entries of a gzipped tar section.  When contents is
+// not nil, the contents of regular files are stored in it.
+func readSection(path string, contents map[string][]byte) (string, []*Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+
+	sectionDigest := sha256.New()
+	zr, err := gzip.NewReader(io.TeeReader(f, sectionDigest))
+	if err != nil {
+		return "", nil, err
+	}
+	defer zr.Close()
+
+	entries := []*Entry{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return "", nil, err
+		}
+
+		digest := sha256.New()
+		var buf bytes.Buffer
+		w := io.Writer(digest)
+		if contents != nil && hdr.Typeflag == tar.TypeReg {
+			w = io.MultiWriter(digest, &buf)
+		}
+		if _, err := io.Copy(w, tr); err != nil {
+			return "", nil, err
+		}
+
+		entry := &Entry{
+			Name:     strings.TrimPrefix(hdr.Name, "./"),
+			Type:     hdr.Typeflag,
+			Linkname: hdr.Linkname,
+			Mode:     hdr.Mode,
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			Uname:    hdr.Uname,
+			Gname:    hdr.Gname,
+			ModTime:  hdr.ModTime,
+			Size:     hdr.Size,
+			Digest:   hex.EncodeToString(digest.Sum(nil)),
+			Xattrs:   map[string]string{},
+		}
+
+		for k, v := range hdr.PAXRecords {
+			if name, ok := strings.CutPrefix(k, xattrPrefix); ok {
+				entry.Xattrs[name] = v
+			}
+		}
+
+		if contents != nil && hdr.Typeflag == tar.TypeReg {
+			contents[entry.Name] = buf.Bytes()
+		}
+
+		entries = append(entries, entry)
+	}
+
+	// The signature and control sections are not terminated, so drain the
+	// rest of the stream to include any padding in the section digest.
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return "", nil, err
+	}
+
+	return hex.EncodeToString(sectionDigest.Sum(nil)), entries, nil
+}
+
+// Difference describes a single mismatch between two packages.
+type Difference struct {
+	Section Section
+	// Path is empty when the difference concerns the section as a whole.
+	Path  string
+	Field string
+	Old   string
+	New   string
+}
+
+func (d Difference) String() string {
+	if d.Path == "" {
+		return fmt.Sprintf("%s section: %s differs (%s != %s)", d.Section, d.Field, d.Old, d.New)
+	}
+
+	return fmt.Sprintf("%s section: %s: %s differs (%s != %s)", d.Section, d.Path, d.Field, d.Old, d.New)
+}
+
+// Compare reports every difference between the sections of a and b,
+// including metadata such as timestamps and ownership.  Two packages
+// produced by a reproducible build have no differences.
+func Compare(a, b *Package) []Difference {
+	return CompareSections(a, b, Sections)
+}
+
+// CompareSections reports every difference between the given sections of a
+// and b.
+func CompareSections(a, b *Package, sections []Section) []Difference {
+	diffs := []Difference{}
+
+	for _, section := range sections {
+		ae, be := a.Entries[section], b.Entries[section]
+		if ae == nil && be == nil {
+			continue
+		}
+
+		sectionDiffs := compareEntries(section, ae, be)
+
+		// A section can differ without any per-file differences, for example
+		// when entries are stored in a different order.
+		if len(sectionDiffs) == 0 && a.Digests[section] != b.Digests[section] {
+			sectionDiffs = append(sectionDiffs, Difference{
+				Section: section,
+				Field:   "digest",
+				Old:     a.Digests[section],
+				New:     b.Digests[section],
+			})
+		}
+
+		diffs = append(diffs, sectionDiffs...)
+	}
+
+	return diffs
+}
+
+// CompareFiles opens the apks at a and b and compares the given sections, or
+// every section if none are given.
+func CompareFiles(ctx context.Context, a, b string, sections ...Section) ([]Difference, error) {
+	ap, err := Open(ctx, a)
+	if err != nil {
+		return nil, err
+	}
+
+	bp, err := Open(ctx, b)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(sections) == 0 {
+		sections = Sections
+	}
+
+	return CompareSections(ap, bp, sections), nil
+}
+
+func entryMap(entries []*Entry) map[string]*Entry {
+	m := make(map[string]*Entry, len(entries))
+	for _, e := range entries {
+		m[e.Name] = e
+	}
+	return m
+}
+
+func compareEntries(section Section, a, b []*Entry) []Difference {
+	am, bm := entryMap(a), entryMap(b)
+
+	names := make([]string, 0, len(am)+len(bm))
+	for name := range am {
+		names = append(names, name)
+	}
+	for name := range bm {
+		if _, ok := am[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	diffs := []Difference{}
+	for _, name := range names {
+		ae, aok := am[name]
+		be, bok := bm[name]
+
+		switch {
+		case !aok:
+			diffs = append(diffs, Difference{Section: section, Path: name, Field: "presence", Old: "missing", New: "present"})
+			continue
+		case !bok:
+			diffs = append(diffs, Difference{Section: section, Path: name, Field: "presence", Old: "present", New: "missing"})
+			continue
+		}
+
+		diffs = append(diffs, compareEntry(section, ae, be)...)
+	}
+
+	return diffs
+}
+
+func compareEntry(section Section, a, b *Entry) []Difference {
+	diffs := []Difference{}
+	add := func(field, old, new string) {
+		if old != new {
+			diffs = append(diffs, Difference{Section: section, Path: a.Name, Field: field, Old: old, New: new})
+		}
+	}
+
+	add("type", string(a.Type), string(b.Type))
+	add("link", a.Linkname, b.Linkname)
+	add("content", a.Digest, b.Digest)
+	add("size", fmt.Sprint(a.Size), fmt.Sprint(b.Size))
+	add("mode", fmt.Sprintf("%04o", a.Mode), fmt.Sprintf("%04o", b.Mode))
+	add("owner", fmt.Sprintf("%d:%d", a.Uid, a.Gid), fmt.Sprintf("%d:%d", b.Uid, b.Gid))
+	add("owner name", a.Uname+":"+a.Gname, b.Uname+":"+b.Gname)
+	add("mtime", a.ModTime.UTC().Format(time.RFC3339), b.ModTime.UTC().Format(time.RFC3339))
+	add("xattrs", formatXattrs(a.Xattrs), formatXattrs(b.Xattrs))
+
+	return diffs
+}
+
+func formatXattrs(xattrs map[string]string) string {
+	keys := make([]string, 0, len(xattrs))
+	for k := range xattrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, fmt.Sprintf("%s=%x", k, xattrs[k]))
+	}
+
+	return "[" + strings.Join(parts, " ") + "]"
+}
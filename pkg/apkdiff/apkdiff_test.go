@@ -0,0 +1,192 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apkdiff
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/internal/apktest"
+)
+
+type testFile struct {
+	name    string
+	content string
+	mode    int64
+	mtime   time.Time
+	xattrs  map[string]string
+}
+
+func writeSection(t *testing.T, w *bytes.Buffer, files []testFile, terminate bool) {
+	t.Helper()
+
+	hdrs := []*tar.Header{}
+	contents := map[string]string{}
+	for _, f := range files {
+		hdr := &tar.Header{
+			Name:     f.name,
+			Typeflag: tar.TypeReg,
+			Mode:     f.mode,
+			ModTime:  f.mtime,
+			Format:   tar.FormatPAX,
+		}
+		if len(f.xattrs) > 0 {
+			hdr.PAXRecords = map[string]string{}
+			for k, v := range f.xattrs {
+				hdr.PAXRecords[xattrPrefix+k] = v
+			}
+		}
+		hdrs = append(hdrs, hdr)
+		contents[f.name] = f.content
+	}
+	apktest.WriteSection(t, w, hdrs, contents, terminate)
+}
+
+const testPkgInfo = "pkgname = test\npkgver = 1.0.0-r0\n"
+
+func writeTestApk(t *testing.T, dir, name string, data []testFile) string {
+	t.Helper()
+
+	return writeTestApkWithControl(t, dir, name, []testFile{{
+		name:    ".PKGINFO",
+		content: testPkgInfo,
+		mode:    0644,
+		mtime:   time.Unix(0, 0),
+	}}, data)
+}
+
+func writeTestApkWithControl(t *testing.T, dir, name string, control, data []testFile) string {
+	t.Helper()
+
+	var buf bytes.Buffer
+	writeSection(t, &buf, control, false)
+	writeSection(t, &buf, data, true)
+
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, buf.Bytes(), 0644))
+	return path
+}
+
+func TestCompare(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	epoch := time.Unix(1234, 0)
+
+	base := []testFile{
+		{name: "usr/bin/hello", content: "hello", mode: 0755, mtime: epoch},
+		{name: "etc/hello.conf", content: "greeting=hi", mode: 0644, mtime: epoch},
+	}
+
+	a := writeTestApk(t, dir, "a.apk", base)
+	b := writeTestApk(t, dir, "b.apk", base)
+
+	diffs, err := CompareFiles(ctx, a, b)
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+
+	changed := []testFile{
+		{name: "usr/bin/hello", content: "hello", mode: 0755, mtime: epoch.Add(time.Hour)},
+		{name: "etc/hello.conf", content: "greeting=hey", mode: 0600, mtime: epoch, xattrs: map[string]string{"user.test": "1"}},
+		{name: "etc/extra", content: "", mode: 0644, mtime: epoch},
+	}
+	c := writeTestApk(t, dir, "c.apk", changed)
+
+	diffs, err = CompareFiles(ctx, a, c)
+	require.NoError(t, err)
+
+	got := map[string][]string{}
+	for _, d := range diffs {
+		require.Equal(t, DataSection, d.Section)
+		got[d.Path] = append(got[d.Path], d.Field)
+	}
+
+	require.Equal(t, map[string][]string{
+		"etc/extra":      {"presence"},
+		"etc/hello.conf": {"content", "size", "mode", "xattrs"},
+		"usr/bin/hello":  {"mtime"},
+	}, got)
+}
+
+func TestDiff(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	a := writeTestApkWithControl(t, dir, "a.apk", []testFile{
+		{name: ".PKGINFO", content: "pkgname = foo\npkgver = 1.0.0-r0\ndepend = so:libc.musl-x86_64.so.1\ndepend = so:libfoo.so.1\nprovides = cmd:foo=1.0.0-r0\n", mode: 0644},
+		{name: ".post-install", content: "#!/bin/sh\necho hi\n", mode: 0755},
+	}, []testFile{
+		{name: "usr/bin/foo", content: "foo", mode: 0755},
+		{name: "usr/lib/libfoo.so.1", content: "libfoo-one", mode: 0755},
+		{name: "etc/foo.conf", content: "a=b", mode: 0644},
+	})
+	b := writeTestApkWithControl(t, dir, "b.apk", []testFile{
+		{name: ".PKGINFO", content: "pkgname = foo\npkgver = 1.1.0-r0\ndepend = so:libc.musl-x86_64.so.1\ndepend = so:libfoo.so.2\nprovides = cmd:foo=1.1.0-r0\n", mode: 0644},
+		{name: ".post-install", content: "#!/bin/sh\necho hello\n", mode: 0755},
+	}, []testFile{
+		{name: "usr/bin/foo", content: "foofoo", mode: 0755, mtime: time.Unix(99, 0)},
+		{name: "usr/lib/libfoo.so.2", content: "libfoo-two", mode: 0755},
+		{name: "etc/foo.conf", content: "a=b", mode: 0600},
+	})
+
+	from, err := Open(ctx, a)
+	require.NoError(t, err)
+	to, err := Open(ctx, b)
+	require.NoError(t, err)
+
+	r, err := Diff(from, to)
+	require.NoError(t, err)
+
+	files := map[string]string{}
+	for _, fc := range r.Files {
+		switch {
+		case fc.Added():
+			files[fc.Path] = "added"
+		case fc.Removed():
+			files[fc.Path] = "removed"
+		case fc.ContentChanged():
+			files[fc.Path] = "content"
+		case fc.ModeChanged():
+			files[fc.Path] = "mode"
+		}
+	}
+	require.Equal(t, map[string]string{
+		"etc/foo.conf":        "mode",
+		"usr/bin/foo":         "content",
+		"usr/lib/libfoo.so.1": "removed",
+		"usr/lib/libfoo.so.2": "added",
+	}, files)
+	require.Equal(t, int64(3), r.SizeDelta())
+
+	require.Equal(t, []FieldChange{
+		{Field: "depend", Removed: []string{"so:libfoo.so.1"}, Added: []string{"so:libfoo.so.2"}},
+		{Field: "provides", Removed: []string{"cmd:foo=1.0.0-r0"}, Added: []string{"cmd:foo=1.1.0-r0"}},
+		{Field: "pkgver", Removed: []string{"1.0.0-r0"}, Added: []string{"1.1.0-r0"}},
+	}, r.Fields)
+
+	require.Len(t, r.Scriptlets, 1)
+	require.Equal(t, ".post-install", r.Scriptlets[0].Name)
+
+	var out bytes.Buffer
+	require.NoError(t, r.Write(&out))
+	require.Contains(t, out.String(), "  - depend = so:libfoo.so.1\n  + depend = so:libfoo.so.2\n")
+	require.Contains(t, out.String(), "   #!/bin/sh\n  -echo hi\n  +echo hello\n")
+}
@@ -0,0 +1,340 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package apkdiff
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// PkgInfo maps each .PKGINFO field to its values, in the order they appear.
+type PkgInfo map[string][]string
+
+// ParsePkgInfo parses the contents of a .PKGINFO file.  Comments are ignored.
+func ParsePkgInfo(data []byte) (PkgInfo, error) {
+	info := PkgInfo{}
+
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("malformed .PKGINFO line %q", line)
+		}
+
+		key = strings.TrimSpace(key)
+		info[key] = append(info[key], strings.TrimSpace(value))
+	}
+
+	return info, s.Err()
+}
+
+// PkgInfo parses the .PKGINFO file of the package.
+func (p *Package) PkgInfo() (PkgInfo, error) {
+	data, ok := p.Control[".PKGINFO"]
+	if !ok {
+		return nil, fmt.Errorf("%s has no .PKGINFO", p.Path)
+	}
+
+	return ParsePkgInfo(data)
+}
+
+// FileChange describes a data section entry that was added, removed or
+// changed.  Old is nil for added files and New is nil for removed files.
+type FileChange struct {
+	Path string
+	Old  *Entry
+	New  *Entry
+}
+
+func (fc FileChange) Added() bool   { return fc.Old == nil }
+func (fc FileChange) Removed() bool { return fc.New == nil }
+
+// ContentChanged reports whether the type, link target or contents changed.
+func (fc FileChange) ContentChanged() bool {
+	return fc.Old != nil && fc.New != nil &&
+		(fc.Old.Digest != fc.New.Digest || fc.Old.Type != fc.New.Type || fc.Old.Linkname != fc.New.Linkname)
+}
+
+func (fc FileChange) ModeChanged() bool {
+	return fc.Old != nil && fc.New != nil && fc.Old.Mode != fc.New.Mode
+}
+
+func (fc FileChange) OwnerChanged() bool {
+	return fc.Old != nil && fc.New != nil && (fc.Old.Uid != fc.New.Uid || fc.Old.Gid != fc.New.Gid)
+}
+
+// SizeDelta returns the change in size of the file, in bytes.
+func (fc FileChange) SizeDelta() int64 {
+	var delta int64
+	if fc.New != nil {
+		delta += fc.New.Size
+	}
+	if fc.Old != nil {
+		delta -= fc.Old.Size
+	}
+	return delta
+}
+
+// FieldChange describes the values of a .PKGINFO field that were removed
+// and added.
+type FieldChange struct {
+	Field   string
+	Removed []string
+	Added   []string
+}
+
+// ScriptletChange describes a scriptlet that was added, removed or changed.
+type ScriptletChange struct {
+	Name string
+	Old  string
+	New  string
+}
+
+// Report summarizes the differences between two packages which are relevant
+// when reviewing a version bump.  Timestamps are not considered.
+type Report struct {
+	Old        string
+	New        string
+	Files      []FileChange
+	Fields     []FieldChange
+	Scriptlets []ScriptletChange
+}
+
+// Empty reports whether no differences were found.
+func (r *Report) Empty() bool {
+	return len(r.Files) == 0 && len(r.Fields) == 0 && len(r.Scriptlets) == 0
+}
+
+// SizeDelta returns the total change in size of the data section files.
+func (r *Report) SizeDelta() int64 {
+	var delta int64
+	for _, fc := range r.Files {
+		delta += fc.SizeDelta()
+	}
+	return delta
+}
+
+// importantFields are listed first in reports, in this order.
+var importantFields = []string{"depend", "provides", "replaces"}
+
+// Diff builds a Report of the differences between from and to.
+func Diff(from, to *Package) (*Report, error) {
+	r := &Report{Old: from.Path, New: to.Path}
+
+	om, nm := entryMap(from.Entries[DataSection]), entryMap(to.Entries[DataSection])
+	for _, name := range unionKeys(om, nm) {
+		fc := FileChange{Path: name, Old: om[name], New: nm[name]}
+		if fc.Added() || fc.Removed() || fc.ContentChanged() || fc.ModeChanged() || fc.OwnerChanged() {
+			r.Files = append(r.Files, fc)
+		}
+	}
+
+	oi, err := from.PkgInfo()
+	if err != nil {
+		return nil, err
+	}
+	ni, err := to.PkgInfo()
+	if err != nil {
+		return nil, err
+	}
+
+	fields := unionKeys(oi, ni)
+	sort.SliceStable(fields, func(i, j int) bool {
+		return fieldRank(fields[i]) < fieldRank(fields[j])
+	})
+	for _, field := range fields {
+		removed, added := setDiff(oi[field], ni[field])
+		if len(removed) != 0 || len(added) != 0 {
+			r.Fields = append(r.Fields, FieldChange{Field: field, Removed: removed, Added: added})
+		}
+	}
+
+	for _, name := range unionKeys(from.Control, to.Control) {
+		if name == ".PKGINFO" {
+			continue
+		}
+
+		o, n := string(from.Control[name]), string(to.Control[name])
+		if o != n {
+			r.Scriptlets = append(r.Scriptlets, ScriptletChange{Name: name, Old: o, New: n})
+		}
+	}
+
+	return r, nil
+}
+
+func fieldRank(field string) int {
+	for i, f := range importantFields {
+		if f == field {
+			return i
+		}
+	}
+	return len(importantFields)
+}
+
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for k := range a {
+		keys = append(keys, k)
+	}
+	for k := range b {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// setDiff returns the values only present in from, and only present in to.
+func setDiff(from, to []string) (removed, added []string) {
+	in := func(s []string, v string) bool {
+		for _, x := range s {
+			if x == v {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, v := range from {
+		if !in(to, v) {
+			removed = append(removed, v)
+		}
+	}
+	for _, v := range to {
+		if !in(from, v) {
+			added = append(added, v)
+		}
+	}
+	return removed, added
+}
+
+// Write renders the report as human-readable text.
+func (r *Report) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "--- %s\n+++ %s\n", r.Old, r.New)
+
+	if r.Empty() {
+		fmt.Fprintln(bw, "packages are equivalent")
+		return bw.Flush()
+	}
+
+	if len(r.Files) != 0 {
+		fmt.Fprintf(bw, "\nfiles (size delta %+d bytes):\n", r.SizeDelta())
+		for _, fc := range r.Files {
+			switch {
+			case fc.Added():
+				fmt.Fprintf(bw, "  + %s (%d bytes)\n", fc.Path, fc.New.Size)
+			case fc.Removed():
+				fmt.Fprintf(bw, "  - %s (%d bytes)\n", fc.Path, fc.Old.Size)
+			default:
+				changes := []string{}
+				if fc.ContentChanged() {
+					changes = append(changes, fmt.Sprintf("content %d -> %d bytes (%+d)", fc.Old.Size, fc.New.Size, fc.SizeDelta()))
+				}
+				if fc.ModeChanged() {
+					changes = append(changes, fmt.Sprintf("mode %04o -> %04o", fc.Old.Mode, fc.New.Mode))
+				}
+				if fc.OwnerChanged() {
+					changes = append(changes, fmt.Sprintf("owner %d:%d -> %d:%d", fc.Old.Uid, fc.Old.Gid, fc.New.Uid, fc.New.Gid))
+				}
+				fmt.Fprintf(bw, "  ~ %s: %s\n", fc.Path, strings.Join(changes, ", "))
+			}
+		}
+	}
+
+	if len(r.Fields) != 0 {
+		fmt.Fprintln(bw, "\n.PKGINFO:")
+		for _, fc := range r.Fields {
+			for _, v := range fc.Removed {
+				fmt.Fprintf(bw, "  - %s = %s\n", fc.Field, v)
+			}
+			for _, v := range fc.Added {
+				fmt.Fprintf(bw, "  + %s = %s\n", fc.Field, v)
+			}
+		}
+	}
+
+	for _, sc := range r.Scriptlets {
+		fmt.Fprintf(bw, "\n%s:\n", sc.Name)
+		for _, l := range lineDiff(splitLines(sc.Old), splitLines(sc.New)) {
+			fmt.Fprintf(bw, "  %s\n", l)
+		}
+	}
+
+	return bw.Flush()
+}
+
+func splitLines(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// lineDiff returns a minimal line based diff of a and b, with each line
+// prefixed by " ", "-" or "+".
+func lineDiff(a, b []string) []string {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	out := []string{}
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			out = append(out, " "+a[i])
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			out = append(out, "-"+a[i])
+			i++
+		default:
+			out = append(out, "+"+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		out = append(out, "-"+a[i])
+	}
+	for ; j < len(b); j++ {
+		out = append(out, "+"+b[j])
+	}
+
+	return out
+}
@@ -0,0 +1,293 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+
+	apkofs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/adb"
+)
+
+const (
+	// ApkFormatV2 emits APKv2 packages, the concatenated gzipped tarballs
+	// installed by apk-tools 2.
+	ApkFormatV2 = "v2"
+	// ApkFormatV3 emits APKv3 packages, the ADB files installed by apk-tools 3.
+	ApkFormatV3 = "v3"
+	// ApkFormatBoth emits both formats.  The APKv3 packages and their index
+	// are written to the v3 subdirectory of the output directory.
+	ApkFormatBoth = "both"
+)
+
+func (b *Build) emitsV2() bool {
+	return b.ApkFormat != ApkFormatV3
+}
+
+func (b *Build) emitsV3() bool {
+	return b.ApkFormat == ApkFormatV3 || b.ApkFormat == ApkFormatBoth
+}
+
+// PackageDirV3 returns the directory the APKv3 packages of the architecture
+// being built, and their Packages.adb index, are written to.
+func (b *Build) PackageDirV3() string {
+	if b.ApkFormat == ApkFormatBoth {
+		return filepath.Join(b.OutDir, "v3", b.Arch.ToAPK())
+	}
+	return filepath.Join(b.OutDir, b.Arch.ToAPK())
+}
+
+// FilenameV3 returns the path the APKv3 package is written to.
+func (pc *PackageBuild) FilenameV3() string {
+	return filepath.Join(pc.Build.PackageDirV3(), pc.Identity()+".apk")
+}
+
+// dataFile is a file whose content is stored in a data block of an APKv3
+// package.
+type dataFile struct {
+	path    string
+	size    int64
+	pathIdx uint32
+	fileIdx uint32
+}
+
+// aclMode converts the permissions of a file to the mode bits stored by apk.
+func aclMode(mode fs.FileMode) uint32 {
+	m := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		m |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		m |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		m |= 0o1000
+	}
+	return m
+}
+
+// packageV3 returns the ADB representation of the package, and the files of
+// the package which need a data block.  As in the data section of APKv2
+// packages, files are owned by root and their mtime is the source date epoch.
+func (pc *PackageBuild) packageV3(fsys apkofs.ReadLinkFS) (*adb.Package, []dataFile, error) {
+	var mtime uint64
+	if sde := pc.Build.SourceDateEpoch.Unix(); sde > 0 {
+		mtime = uint64(sde)
+	}
+
+	dirs := map[string]*adb.Dir{}
+	if err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		acl := adb.ACL{Mode: aclMode(fi.Mode()), User: "root", Group: "root"}
+
+		if d.IsDir() {
+			name := p
+			if p == "." {
+				name = ""
+			}
+			dirs[p] = &adb.Dir{Name: name, ACL: acl}
+			return nil
+		}
+
+		f := adb.File{Name: path.Base(p), ACL: acl, MTime: mtime}
+		switch {
+		case fi.Mode().IsRegular():
+			f.Size = uint64(fi.Size())
+
+			r, err := fsys.Open(p)
+			if err != nil {
+				return err
+			}
+			defer r.Close()
+
+			h := sha256.New()
+			if _, err := io.Copy(h, r); err != nil {
+				return fmt.Errorf("hashing %s: %w", p, err)
+			}
+			f.Hash = h.Sum(nil)
+		case fi.Mode()&fs.ModeSymlink != 0:
+			target, err := fsys.Readlink(p)
+			if err != nil {
+				return err
+			}
+			f.Target = adb.SymlinkTarget(target)
+		default:
+			pc.Logger.Warnf("skipping %s, special files are not supported in APKv3 packages", p)
+			return nil
+		}
+
+		dir := dirs[path.Dir(p)]
+		dir.Files = append(dir.Files, f)
+		return nil
+	}); err != nil {
+		return nil, nil, fmt.Errorf("unable to walk package: %w", err)
+	}
+
+	paths := make([]adb.Dir, 0, len(dirs))
+	for _, d := range dirs {
+		paths = append(paths, *d)
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return paths[i].Name < paths[j].Name
+	})
+
+	files := []dataFile{}
+	for i, d := range paths {
+		for j, f := range d.Files {
+			if f.Size == 0 {
+				continue
+			}
+			files = append(files, dataFile{
+				path:    path.Join(d.Name, f.Name),
+				size:    int64(f.Size),
+				pathIdx: uint32(i + 1),
+				fileIdx: uint32(j + 1),
+			})
+		}
+	}
+
+	pkg := &adb.Package{
+		Info: adb.PackageInfo{
+			Name:             pc.PackageName,
+			Version:          fmt.Sprintf("%s-r%d", pc.Origin.Package.Version, pc.Origin.Package.Epoch),
+			Description:      pc.Description,
+			Arch:             pc.Arch,
+			License:          pc.Origin.Package.LicenseExpression(),
+			Origin:           pc.OriginName,
+			URL:              pc.URL,
+			RepoCommit:       pc.Commit,
+			BuildTime:        mtime,
+			InstalledSize:    uint64(pc.InstalledSize),
+			ProviderPriority: uint64(pc.Dependencies.ProviderPriority),
+			Depends:          pc.Dependencies.Runtime,
+			Provides:         pc.Dependencies.Provides,
+			Replaces:         pc.Dependencies.Replaces,
+		},
+		Paths: paths,
+		Scripts: adb.Scripts{
+			Trigger:       pc.Scriptlets.Trigger.Script,
+			PreInstall:    pc.Scriptlets.PreInstall,
+			PostInstall:   pc.Scriptlets.PostInstall,
+			PreDeinstall:  pc.Scriptlets.PreDeinstall,
+			PostDeinstall: pc.Scriptlets.PostDeinstall,
+			PreUpgrade:    pc.Scriptlets.PreUpgrade,
+			PostUpgrade:   pc.Scriptlets.PostUpgrade,
+		},
+		Triggers: pc.Scriptlets.Trigger.Paths,
+	}
+
+	return pkg, files, nil
+}
+
+// emitPackageV3 writes the package as an APKv3 package: the ADB block with
+// the package metadata and the hashes of its files, the signature block if a
+// signing key is set, and a data block for each file which is not empty.
+// Signing helpers and keyless signatures are not supported.
+func (pc *PackageBuild) emitPackageV3(ctx context.Context, fsys apkofs.ReadLinkFS) error {
+	_, span := otel.Tracer("melange").Start(ctx, "emitPackageV3")
+	defer span.End()
+
+	pkg, files, err := pc.packageV3(fsys)
+	if err != nil {
+		return err
+	}
+
+	adbBlock, err := pkg.Marshal()
+	if err != nil {
+		return fmt.Errorf("unable to encode package: %w", err)
+	}
+
+	var sig []byte
+	if pc.Build.SigningKey == "" && pc.wantSignature() {
+		return fmt.Errorf("APKv3 packages can only be signed with a signing key")
+	}
+	if pc.wantSignature() {
+		key, err := adb.LoadPrivateKey(pc.Build.SigningKey, pc.Build.SigningPassphrase)
+		if err != nil {
+			return fmt.Errorf("loading signing key: %w", err)
+		}
+		if sig, err = adb.Sign(adb.SchemaPackage, adbBlock, key); err != nil {
+			return fmt.Errorf("emitting signature: %w", err)
+		}
+	}
+
+	if err := os.MkdirAll(pc.Build.PackageDirV3(), 0755); err != nil {
+		return fmt.Errorf("unable to create output directory: %w", err)
+	}
+
+	outFile, err := os.Create(pc.FilenameV3())
+	if err != nil {
+		return fmt.Errorf("unable to create apk file: %w", err)
+	}
+	defer outFile.Close()
+
+	w, err := adb.NewWriter(outFile, adb.SchemaPackage)
+	if err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+	if err := w.WriteBlock(adb.BlockADB, adbBlock); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+	if sig != nil {
+		if err := w.WriteBlock(adb.BlockSig, sig); err != nil {
+			return fmt.Errorf("unable to write apk file: %w", err)
+		}
+	}
+
+	for _, f := range files {
+		if err := pc.writeDataBlock(w, fsys, f); err != nil {
+			return err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("unable to write apk file: %w", err)
+	}
+
+	pc.Logger.Printf("wrote %s", outFile.Name())
+
+	return nil
+}
+
+func (pc *PackageBuild) writeDataBlock(w *adb.Writer, fsys fs.FS, f dataFile) error {
+	r, err := fsys.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	if err := w.WriteFileData(f.pathIdx, f.fileIdx, f.size, r); err != nil {
+		return fmt.Errorf("unable to write %s: %w", f.path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	apko_log "chainguard.dev/apko/pkg/log"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/adb"
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/index"
+)
+
+func TestEmitPackageV3(t *testing.T) {
+	ctx := context.Background()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "test.rsa")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600))
+
+	pkgctx, err := NewPackageContext(&config.Package{
+		Name:      "hello",
+		Version:   "1.0",
+		Epoch:     1,
+		Copyright: []config.Copyright{{License: "Apache-2.0"}},
+	})
+	require.NoError(t, err)
+
+	workspace := t.TempDir()
+	content := "#!/bin/sh\necho hello\n"
+	bin := filepath.Join(workspace, "melange-out", "hello", "usr", "bin")
+	require.NoError(t, os.MkdirAll(bin, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "hello"), []byte(content), 0755))
+	require.NoError(t, os.Symlink("hello", filepath.Join(bin, "hi")))
+
+	outDir := t.TempDir()
+	b := &Build{
+		WorkspaceDir:    workspace,
+		OutDir:          outDir,
+		Arch:            apko_types.ParseArchitecture("x86_64"),
+		SourceDateEpoch: time.Unix(1700000000, 0),
+		SigningKey:      keyFile,
+		ApkFormat:       ApkFormatBoth,
+	}
+	pb := &PackageBuild{
+		Build:       b,
+		Origin:      pkgctx,
+		PackageName: "hello",
+		OriginName:  "hello",
+		OutDir:      filepath.Join(outDir, "x86_64"),
+		Arch:        "x86_64",
+		Logger:      &apko_log.Adapter{Out: io.Discard, Level: apko_log.InfoLevel},
+		Scriptlets:  config.Scriptlets{PostInstall: "#!/bin/sh\ntrue\n"},
+	}
+
+	require.NoError(t, pb.EmitPackage(ctx))
+
+	// Both formats are emitted, the APKv3 package under the v3 directory.
+	require.FileExists(t, filepath.Join(outDir, "x86_64", "hello-1.0-r1.apk"))
+	require.Equal(t, filepath.Join(outDir, "v3", "x86_64", "hello-1.0-r1.apk"), pb.FilenameV3())
+
+	f, err := os.Open(pb.FilenameV3())
+	require.NoError(t, err)
+	defer f.Close()
+
+	r, err := adb.NewReader(f)
+	require.NoError(t, err)
+	require.Equal(t, adb.SchemaPackage, r.Schema)
+
+	adbBlock, err := r.ReadADB()
+	require.NoError(t, err)
+
+	typ, _, err := r.Next()
+	require.NoError(t, err)
+	require.Equal(t, adb.BlockSig, typ)
+	sig, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.NoError(t, adb.Verify(adb.SchemaPackage, adbBlock, sig, &key.PublicKey))
+
+	pkg, err := adb.UnmarshalPackage(adbBlock)
+	require.NoError(t, err)
+	require.Equal(t, "hello", pkg.Info.Name)
+	require.Equal(t, "1.0-r1", pkg.Info.Version)
+	require.Equal(t, "Apache-2.0", pkg.Info.License)
+	require.Equal(t, uint64(1700000000), pkg.Info.BuildTime)
+	require.Equal(t, []string{"cmd:sh"}, pkg.Info.Depends)
+	require.Equal(t, "#!/bin/sh\ntrue\n", pkg.Scripts.PostInstall)
+
+	require.Equal(t, []string{"", "usr", "usr/bin"}, []string{pkg.Paths[0].Name, pkg.Paths[1].Name, pkg.Paths[2].Name})
+	files := pkg.Paths[2].Files
+	require.Len(t, files, 2)
+
+	hash := sha256.Sum256([]byte(content))
+	require.Equal(t, adb.File{
+		Name:  "hello",
+		ACL:   adb.ACL{Mode: 0755, User: "root", Group: "root"},
+		Size:  uint64(len(content)),
+		MTime: 1700000000,
+		Hash:  hash[:],
+	}, files[0])
+	require.Equal(t, "hi", files[1].Name)
+	require.Equal(t, adb.SymlinkTarget("hello"), files[1].Target)
+
+	// Only the regular file has a data block.
+	typ, _, err = r.Next()
+	require.NoError(t, err)
+	require.Equal(t, adb.BlockData, typ)
+	pathIdx, fileIdx, err := r.ReadFileDataHeader()
+	require.NoError(t, err)
+	require.Equal(t, []uint32{3, 1}, []uint32{pathIdx, fileIdx})
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, content, string(data))
+	_, _, err = r.Next()
+	require.ErrorIs(t, err, io.EOF)
+
+	// The APKv3 index lists the package by the digest of its ADB block.
+	indexFile := filepath.Join(b.PackageDirV3(), index.IndexFileV3)
+	idx, err := index.New(
+		index.WithFormat(index.FormatV3),
+		index.WithPackageFiles([]string{pb.FilenameV3()}),
+		index.WithIndexFile(indexFile),
+	)
+	require.NoError(t, err)
+	require.NoError(t, idx.GenerateIndex(ctx))
+
+	merged, err := index.New(
+		index.WithFormat(index.FormatV3),
+		index.WithIndexFile(indexFile),
+		index.WithMergeIndexFileFlag(true),
+	)
+	require.NoError(t, err)
+	require.NoError(t, merged.LoadIndex(indexFile))
+	require.Len(t, merged.Index.Packages, 1)
+
+	got := merged.Index.Packages[0]
+	sum := sha256.Sum256(adbBlock)
+	fi, err := f.Stat()
+	require.NoError(t, err)
+	require.Equal(t, "hello", got.Name)
+	require.Equal(t, "1.0-r1", got.Version)
+	require.Equal(t, sum[:], got.Checksum)
+	require.Equal(t, uint64(fi.Size()), got.Size)
+}
@@ -23,6 +23,7 @@ import (
 	"io"
 	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
@@ -33,16 +34,14 @@ import (
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	apko_iocomb "chainguard.dev/apko/pkg/iocomb"
 	apko_log "chainguard.dev/apko/pkg/log"
-	"cloud.google.com/go/storage"
 	apkofs "github.com/chainguard-dev/go-apk/pkg/fs"
 	"github.com/google/go-containerregistry/pkg/logs"
 	"github.com/yookoala/realpath"
 	"github.com/zealic/xignore"
 	"go.opentelemetry.io/otel"
-	"google.golang.org/api/iterator"
-	"google.golang.org/api/option"
 	"k8s.io/kube-openapi/pkg/util/sets"
 
+	"chainguard.dev/melange/pkg/cache"
 	"chainguard.dev/melange/pkg/cond"
 	"chainguard.dev/melange/pkg/config"
 	"chainguard.dev/melange/pkg/container"
@@ -92,6 +91,20 @@ type Build struct {
 	DebugRunner        bool
 	LogPolicy          []string
 	FailOnLintWarning  bool
+	VerifyReproducible bool
+	ConflictIndex      string
+	FailOnFileConflict bool
+	VerifyDependencies string
+	ApkFormat          string
+	SigningHelper      string
+	SigningAlgorithm   string
+	ExtraSigningKeys   []string
+	Keyless            bool
+	FulcioURL          string
+	OIDCTokenFile      string
+	fulcioSigner       *FulcioApkSigner
+
+	SigningHelperTimeout time.Duration
 
 	EnabledBuildOptions []string
 }
@@ -261,6 +274,62 @@ func WithFailOnLintWarning(fail bool) Option {
 	}
 }
 
+// WithConflictIndex sets an APKINDEX.tar.gz whose packages are checked for
+// files which conflict with the packages being built.
+func WithConflictIndex(index string) Option {
+	return func(b *Build) error {
+		b.ConflictIndex = index
+		return nil
+	}
+}
+
+// WithFailOnFileConflict sets whether files shipped by more than one package
+// fail the build rather than being reported as warnings.
+func WithFailOnFileConflict(fail bool) Option {
+	return func(b *Build) error {
+		b.FailOnFileConflict = fail
+		return nil
+	}
+}
+
+// WithVerifyDependencies sets whether the runtime dependencies of the packages
+// are checked against the build environment repositories and the output
+// directory before they are emitted, one of "off", "warn" or "error".
+func WithVerifyDependencies(mode string) Option {
+	return func(b *Build) error {
+		switch mode {
+		case "", VerifyDependenciesOff, VerifyDependenciesWarn, VerifyDependenciesError:
+		default:
+			return fmt.Errorf("invalid dependency verification mode %q, must be off, warn or error", mode)
+		}
+		b.VerifyDependencies = mode
+		return nil
+	}
+}
+
+// WithApkFormat sets the format of the packages to emit, one of "v2", "v3"
+// or "both".
+func WithApkFormat(format string) Option {
+	return func(b *Build) error {
+		switch format {
+		case "", ApkFormatV2, ApkFormatV3, ApkFormatBoth:
+		default:
+			return fmt.Errorf("invalid apk format %q, must be v2, v3 or both", format)
+		}
+		b.ApkFormat = format
+		return nil
+	}
+}
+
+// WithVerifyReproducible sets whether the package should be built a second
+// time in a separate workspace and compared against the first build.
+func WithVerifyReproducible(verify bool) Option {
+	return func(b *Build) error {
+		b.VerifyReproducible = verify
+		return nil
+	}
+}
+
 // WithBuildDate sets the timestamps for the build context.
 // The string is parsed according to RFC3339.
 // An empty string is a special case and will default to
@@ -347,8 +416,9 @@ func WithCacheDir(cacheDir string) Option {
 	}
 }
 
-// WithCacheSource sets the cache source directory to use.  The cache will be
-// pre-populated from this source directory.
+// WithCacheSource sets the cache source to use: a directory, the URL of an
+// http(s) mirror, or a gs:// or s3:// bucket.  The cache will be
+// pre-populated from this source.
 func WithCacheSource(sourceDir string) Option {
 	return func(b *Build) error {
 		b.CacheSource = sourceDir
@@ -370,6 +440,92 @@ func WithSigningKey(signingKey string) Option {
 	}
 }
 
+// WithSigningAlgorithm sets the digest algorithm of RSA signatures, "sha1"
+// (the default) or "sha256".
+func WithSigningAlgorithm(algorithm string) Option {
+	return func(b *Build) error {
+		switch algorithm {
+		case "", SignatureSHA1, SignatureSHA256:
+		default:
+			return fmt.Errorf("invalid signing algorithm %q, must be sha1 or sha256", algorithm)
+		}
+		b.SigningAlgorithm = algorithm
+		return nil
+	}
+}
+
+// WithExtraSigningKeys sets keys to sign APKv2 packages and the index with in
+// addition to the signing key, such as the new key while rotating keys.
+func WithExtraSigningKeys(keys []string) Option {
+	return func(b *Build) error {
+		for _, key := range keys {
+			if _, err := os.Stat(key); err != nil {
+				return fmt.Errorf("could not open signing key: %w", err)
+			}
+		}
+
+		b.ExtraSigningKeys = keys
+		return nil
+	}
+}
+
+// WithSigningHelper sets the signing helper used to sign packages and the
+// index when no signing key is set.
+func WithSigningHelper(signingHelper string) Option {
+	return func(b *Build) error {
+		if signingHelper != "" {
+			if _, err := exec.LookPath(signingHelper); err != nil {
+				return fmt.Errorf("could not find signing helper: %w", err)
+			}
+		}
+
+		b.SigningHelper = signingHelper
+		return nil
+	}
+}
+
+// WithSigningHelperTimeout sets how long the signing helper may take for each
+// signature.
+func WithSigningHelperTimeout(timeout time.Duration) Option {
+	return func(b *Build) error {
+		if timeout < 0 {
+			return fmt.Errorf("signing helper timeout must not be negative, got %s", timeout)
+		}
+
+		b.SigningHelperTimeout = timeout
+		return nil
+	}
+}
+
+// WithKeyless sets whether packages and the index are signed keylessly, with
+// a short-lived certificate issued by a Fulcio compatible certificate
+// authority, when no signing key is set.
+func WithKeyless(keyless bool) Option {
+	return func(b *Build) error {
+		b.Keyless = keyless
+		return nil
+	}
+}
+
+// WithFulcioURL sets the URL of the certificate authority used for keyless
+// signing.
+func WithFulcioURL(fulcioURL string) Option {
+	return func(b *Build) error {
+		b.FulcioURL = fulcioURL
+		return nil
+	}
+}
+
+// WithOIDCTokenFile sets the file the OIDC token exchanged for the keyless
+// signing certificate is read from.  If not set, the token is taken from the
+// environment.
+func WithOIDCTokenFile(tokenFile string) Option {
+	return func(b *Build) error {
+		b.OIDCTokenFile = tokenFile
+		return nil
+	}
+}
+
 // WithGenerateIndex sets whether or not the apk index should be generated.
 func WithGenerateIndex(generateIndex bool) Option {
 	return func(b *Build) error {
@@ -756,51 +912,33 @@ func (b *Build) OverlayBinSh() error {
 	return nil
 }
 
-func (b *Build) fetchBucket(ctx context.Context, cmm CacheMembershipMap) (string, error) {
+// fetchBucket copies the objects of the cache source which the build uses to
+// a temporary directory.
+func (b *Build) fetchBucket(ctx context.Context, backend cache.Backend, cmm CacheMembershipMap) (string, error) {
 	tmp, err := os.MkdirTemp("", "melange-cache")
 	if err != nil {
 		return "", err
 	}
-	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(b.CacheSource, "gs://"), "/")
-
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		b.Logger.Printf("downgrading to anonymous mode: %s", err)
-
-		client, err = storage.NewClient(ctx, option.WithoutAuthentication())
-		if err != nil {
-			return "", fmt.Errorf("failed to get storage client: %w", err)
-		}
-	}
 
-	bh := client.Bucket(bucket)
-	it := bh.Objects(ctx, &storage.Query{Prefix: prefix})
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		} else if err != nil {
-			return tmp, fmt.Errorf("failed to get next remote cache object: %w", err)
-		}
-		on := attrs.Name
-		if !cmm[on] {
+	for on := range cmm {
+		rc, err := backend.Get(ctx, on)
+		if errors.Is(err, fs.ErrNotExist) {
 			continue
-		}
-		rc, err := bh.Object(on).NewReader(ctx)
-		if err != nil {
-			return tmp, fmt.Errorf("failed to get reader for next remote cache object %s: %w", on, err)
+		} else if err != nil {
+			return tmp, fmt.Errorf("failed to get reader for remote cache object %s: %w", on, err)
 		}
 		w, err := os.Create(filepath.Join(tmp, on))
 		if err != nil {
+			rc.Close()
 			return tmp, err
 		}
-		if _, err := io.Copy(w, rc); err != nil {
+		_, err = io.Copy(w, rc)
+		rc.Close()
+		w.Close()
+		if err != nil {
 			return tmp, fmt.Errorf("failed to copy remote cache object %s: %w", on, err)
 		}
-		if err := rc.Close(); err != nil {
-			return tmp, fmt.Errorf("failed to close remote cache object %s: %w", on, err)
-		}
-		b.Logger.Printf("cached gs://%s/%s -> %s", bucket, on, w.Name())
+		b.Logger.Printf("cached %s/%s -> %s", backend, on, w.Name())
 	}
 
 	return tmp, nil
@@ -817,7 +955,7 @@ func (b *Build) PopulateCache(ctx context.Context) error {
 	ctx, span := otel.Tracer("melange").Start(ctx, "PopulateCache")
 	defer span.End()
 
-	if b.CacheDir == "" {
+	if b.CacheDir == "" || b.CacheSource == "" {
 		return nil
 	}
 
@@ -828,62 +966,64 @@ func (b *Build) PopulateCache(ctx context.Context) error {
 
 	b.Logger.Printf("populating cache from %s", b.CacheSource)
 
-	// --cache-dir=gs://bucket/path/to/cache first pulls all found objects to a
-	// tmp dir which is subsequently used as the cache.
-	if strings.HasPrefix(b.CacheSource, "gs://") {
-		tmp, err := b.fetchBucket(ctx, cmm)
+	// --cache-source=gs://bucket/path/to/cache, or any other cache backend,
+	// first pulls all found objects to a tmp dir which is subsequently used
+	// as the cache.
+	backend, err := cache.NewBackend(ctx, b.CacheSource)
+	if err != nil {
+		return fmt.Errorf("opening cache source: %w", err)
+	}
+
+	tmp, err := b.fetchBucket(ctx, backend, cmm)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	b.Logger.Printf("cache bucket copied to %s", tmp)
+
+	fsys := os.DirFS(tmp)
+
+	// mkdir /var/cache/melange
+	if err := os.MkdirAll(b.CacheDir, 0o755); err != nil {
+		return err
+	}
+
+	// --cache-dir doesn't exist, nothing to do.
+	if _, err := fs.Stat(fsys, "."); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-		defer os.RemoveAll(tmp)
-		b.Logger.Printf("cache bucket copied to %s", tmp)
-
-		fsys := os.DirFS(tmp)
 
-		// mkdir /var/cache/melange
-		if err := os.MkdirAll(b.CacheDir, 0o755); err != nil {
+		fi, err := d.Info()
+		if err != nil {
 			return err
 		}
 
-		// --cache-dir doesn't exist, nothing to do.
-		if _, err := fs.Stat(fsys, "."); errors.Is(err, fs.ErrNotExist) {
+		mode := fi.Mode()
+		if !mode.IsRegular() {
 			return nil
 		}
 
-		return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
-			if err != nil {
-				return err
-			}
-
-			fi, err := d.Info()
-			if err != nil {
-				return err
-			}
-
-			mode := fi.Mode()
-			if !mode.IsRegular() {
-				return nil
-			}
-
-			// Skip files in the cache that aren't named like sha256:... or sha512:...
-			// This is likely a bug, and won't be matched by any fetch.
-			base := filepath.Base(fi.Name())
-			if !strings.HasPrefix(base, "sha256:") &&
-				!strings.HasPrefix(base, "sha512:") {
-				return nil
-			}
-
-			b.Logger.Printf("  -> %s", path)
+		// Skip files in the cache that aren't named like sha256:... or sha512:...
+		// This is likely a bug, and won't be matched by any fetch.
+		base := filepath.Base(fi.Name())
+		if !strings.HasPrefix(base, "sha256:") &&
+			!strings.HasPrefix(base, "sha512:") {
+			return nil
+		}
 
-			if err := copyFile(tmp, path, b.CacheDir, mode.Perm()); err != nil {
-				return err
-			}
+		b.Logger.Printf("  -> %s", path)
 
-			return nil
-		})
-	}
+		if err := copyFile(tmp, path, b.CacheDir, mode.Perm()); err != nil {
+			return err
+		}
 
-	return nil
+		return nil
+	})
 }
 
 func (b *Build) PopulateWorkspace(ctx context.Context) error {
@@ -1067,6 +1207,7 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		// add the main package to the linter queue
 		lintTarget := linterTarget{
 			pkgName: b.Configuration.Package.Name,
+			checks:  b.Configuration.Package.Checks,
 		}
 		linterQueue = append(linterQueue, lintTarget)
 	}
@@ -1117,9 +1258,10 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 			return err
 		}
 
-		// add the main package to the linter queue
+		// add the subpackage to the linter queue
 		lintTarget := linterTarget{
 			pkgName: sp.Name,
+			checks:  sp.Checks,
 		}
 		linterQueue = append(linterQueue, lintTarget)
 	}
@@ -1137,24 +1279,48 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 
 		path := filepath.Join(b.WorkspaceDir, "melange-out", lt.pkgName)
 		fsys := os.DirFS(path)
-		lctx := linter.NewLinterContext(lt.pkgName, fsys)
-		linters := lt.checks.GetLinters()
+		outfs := os.DirFS(filepath.Join(b.WorkspaceDir, "melange-out"))
+		lctx := linter.NewLinterContext(lt.pkgName, fsys).WithOutputFS(outfs)
 
-		var innerErr error
-		err = lctx.LintPackageFs(fsys, func(err error) {
-			if b.FailOnLintWarning {
-				innerErr = err
-			} else {
-				b.Logger.Warnf("WARNING: %v", err)
-			}
-		}, linters)
+		findings, err := lctx.LintPackageFs(fsys, lt.checks)
 		if err != nil {
 			return fmt.Errorf("package linter error: %w", err)
-		} else if innerErr != nil {
-			return fmt.Errorf("package linter warning: %w", err)
+		}
+
+		failed := 0
+		for _, f := range findings {
+			if f.Severity == linter.SeverityError || b.FailOnLintWarning {
+				b.Logger.Warnf("ERROR: %s", f)
+				failed++
+			} else {
+				b.Logger.Warnf("WARNING: %s", f)
+			}
+		}
+		if failed != 0 {
+			return fmt.Errorf("package linter reported %d errors for %s", failed, lt.pkgName)
 		}
 	}
 
+	// check for files shipped by more than one package
+	pkgNames := []string{}
+	for _, lt := range linterQueue {
+		pkgNames = append(pkgNames, lt.pkgName)
+	}
+	conflicts, err := b.FindFileConflicts(ctx, pkgNames)
+	if err != nil {
+		return fmt.Errorf("checking for file conflicts: %w", err)
+	}
+	for _, c := range conflicts {
+		if b.FailOnFileConflict {
+			b.Logger.Warnf("ERROR: %s", c)
+		} else {
+			b.Logger.Warnf("WARNING: %s", c)
+		}
+	}
+	if len(conflicts) != 0 && b.FailOnFileConflict {
+		return fmt.Errorf("found %d files shipped by more than one package", len(conflicts))
+	}
+
 	// generate SBOMs for subpackages
 	for _, sp := range b.Configuration.Subpackages {
 		langs := []string{}
@@ -1207,12 +1373,13 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 		return fmt.Errorf("writing SBOMs: %w", err)
 	}
 
-	// emit main package
-	if err := pkg.Emit(ctx, &pb); err != nil {
-		return fmt.Errorf("unable to emit package: %w", err)
+	// prepare the main package and subpackages for emitting
+	mainpc, err := pkg.subpackageContext().PackageBuild(&pb)
+	if err != nil {
+		return err
 	}
+	pkgBuilds := []*PackageBuild{mainpc}
 
-	// emit subpackages
 	for _, sp := range b.Configuration.Subpackages {
 		spctx, err := NewSubpackageContext(&sp)
 		if err != nil {
@@ -1228,7 +1395,36 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 			continue
 		}
 
-		if err := spctx.Emit(ctx, &pb); err != nil {
+		pc, err := spctx.PackageBuild(&pb)
+		if err != nil {
+			return err
+		}
+		pkgBuilds = append(pkgBuilds, pc)
+	}
+
+	for _, pc := range pkgBuilds {
+		if err := pc.GenerateDependencies(); err != nil {
+			return fmt.Errorf("unable to build final dependencies set for %s: %w", pc.PackageName, err)
+		}
+	}
+
+	if b.DependencyLog != "" {
+		b.Logger.Printf("writing dependency log")
+		if err := b.writeDependencyLog(pkgBuilds); err != nil {
+			return err
+		}
+	}
+
+	// check that the runtime dependencies can be installed
+	if b.VerifyDependencies != "" && b.VerifyDependencies != VerifyDependenciesOff {
+		if err := b.verifyDependencies(ctx, pkgBuilds); err != nil {
+			return err
+		}
+	}
+
+	// emit main package and subpackages
+	for _, pc := range pkgBuilds {
+		if err := pc.EmitPackage(ctx); err != nil {
 			return fmt.Errorf("unable to emit package: %w", err)
 		}
 	}
@@ -1247,12 +1443,8 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 
 	// generate APKINDEX.tar.gz and sign it
 	if b.GenerateIndex {
-		packageDir := filepath.Join(pb.Build.OutDir, pb.Build.Arch.ToAPK())
-		b.Logger.Printf("generating apk index from packages in %s", packageDir)
-
-		var apkFiles []string
-		pkgFileName := fmt.Sprintf("%s-%s-r%d.apk", b.Configuration.Package.Name, b.Configuration.Package.Version, b.Configuration.Package.Epoch)
-		apkFiles = append(apkFiles, filepath.Join(packageDir, pkgFileName))
+		var pkgFileNames []string
+		pkgFileNames = append(pkgFileNames, fmt.Sprintf("%s-%s-r%d.apk", b.Configuration.Package.Name, b.Configuration.Package.Version, b.Configuration.Package.Epoch))
 
 		for _, subpkg := range b.Configuration.Subpackages {
 			spctx, err := NewSubpackageContext(&subpkg)
@@ -1269,28 +1461,73 @@ func (b *Build) BuildPackage(ctx context.Context) error {
 				continue
 			}
 
-			subpkgFileName := fmt.Sprintf("%s-%s-r%d.apk", subpkg.Name, b.Configuration.Package.Version, b.Configuration.Package.Epoch)
-			apkFiles = append(apkFiles, filepath.Join(packageDir, subpkgFileName))
+			pkgFileNames = append(pkgFileNames, fmt.Sprintf("%s-%s-r%d.apk", subpkg.Name, b.Configuration.Package.Version, b.Configuration.Package.Epoch))
 		}
 
-		opts := []index.Option{
-			index.WithPackageFiles(apkFiles),
-			index.WithSigningKey(b.SigningKey),
-			index.WithMergeIndexFileFlag(true),
-			index.WithIndexFile(filepath.Join(packageDir, "APKINDEX.tar.gz")),
-		}
+		if b.emitsV2() {
+			packageDir := filepath.Join(pb.Build.OutDir, pb.Build.Arch.ToAPK())
+			b.Logger.Printf("generating apk index from packages in %s", packageDir)
 
-		b, err := index.New(opts...)
-		if err != nil {
-			return fmt.Errorf("unable to create index b: %w", err)
+			var apkFiles []string
+			for _, name := range pkgFileNames {
+				apkFiles = append(apkFiles, filepath.Join(packageDir, name))
+			}
+
+			opts := []index.Option{
+				index.WithPackageFiles(apkFiles),
+				index.WithSigningKey(b.SigningKey),
+				index.WithMergeIndexFileFlag(true),
+				index.WithIndexFile(filepath.Join(packageDir, "APKINDEX.tar.gz")),
+			}
+			if signer := b.indexSigner(); signer != nil {
+				opts = append(opts, index.WithSigner(signer))
+			}
+
+			idx, err := index.New(opts...)
+			if err != nil {
+				return fmt.Errorf("unable to create index b: %w", err)
+			}
+
+			if err := idx.GenerateIndex(ctx); err != nil {
+				return fmt.Errorf("unable to generate index: %w", err)
+			}
+
+			if err := idx.WriteJSONIndex(filepath.Join(packageDir, "APKINDEX.json")); err != nil {
+				return fmt.Errorf("unable to generate JSON index: %w", err)
+			}
 		}
 
-		if err := b.GenerateIndex(ctx); err != nil {
-			return fmt.Errorf("unable to generate index: %w", err)
+		if b.emitsV3() {
+			packageDir := b.PackageDirV3()
+			b.Logger.Printf("generating APKv3 index from packages in %s", packageDir)
+
+			var apkFiles []string
+			for _, name := range pkgFileNames {
+				apkFiles = append(apkFiles, filepath.Join(packageDir, name))
+			}
+
+			opts := []index.Option{
+				index.WithFormat(index.FormatV3),
+				index.WithPackageFiles(apkFiles),
+				index.WithSigningKey(b.SigningKey),
+				index.WithMergeIndexFileFlag(true),
+				index.WithIndexFile(filepath.Join(packageDir, index.IndexFileV3)),
+			}
+
+			idx, err := index.New(opts...)
+			if err != nil {
+				return fmt.Errorf("unable to create index: %w", err)
+			}
+
+			if err := idx.GenerateIndex(ctx); err != nil {
+				return fmt.Errorf("unable to generate APKv3 index: %w", err)
+			}
 		}
+	}
 
-		if err := b.WriteJSONIndex(filepath.Join(packageDir, "APKINDEX.json")); err != nil {
-			return fmt.Errorf("unable to generate JSON index: %w", err)
+	if b.VerifyReproducible {
+		if err := b.verifyReproducible(ctx); err != nil {
+			return err
 		}
 	}
 
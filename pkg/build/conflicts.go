@@ -0,0 +1,218 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"go.opentelemetry.io/otel"
+
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// FileConflict is a path which is shipped by more than one package.
+type FileConflict struct {
+	Path     string
+	Packages []string
+}
+
+func (c FileConflict) String() string {
+	return fmt.Sprintf("%s is shipped by %s", c.Path, strings.Join(c.Packages, ", "))
+}
+
+// fileOwners maps the paths of files to the packages which ship them.
+type fileOwners map[string][]string
+
+// addFS records every file, symlink or other non-directory entry of fsys as
+// shipped by pkg.
+func (o fileOwners) addFS(pkg string, fsys fs.FS) error {
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() {
+			o[path] = append(o[path], pkg)
+		}
+		return nil
+	})
+}
+
+// addApk records the files of the data section of the apk at path as shipped
+// by pkg.  Only paths which are already known are recorded, as those are the
+// only ones which can conflict.
+func (o fileOwners) addApk(ctx context.Context, pkg, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	eapk, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return fmt.Errorf("expanding %s: %w", path, err)
+	}
+	defer eapk.Close()
+
+	data, err := eapk.PackageData()
+	if err != nil {
+		return err
+	}
+	defer data.Close()
+
+	tr := tar.NewReader(data)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("reading %s: %w", path, err)
+		}
+
+		name := strings.TrimSuffix(strings.TrimPrefix(hdr.Name, "./"), "/")
+		if hdr.Typeflag == tar.TypeDir || o[name] == nil {
+			continue
+		}
+		o[name] = append(o[name], pkg)
+	}
+}
+
+// conflicts returns the paths shipped by more than one package, ignoring
+// packages which declare that they replace one another.
+func (o fileOwners) conflicts(replaces map[string][]string) []FileConflict {
+	replaced := func(a, b string) bool {
+		for _, r := range replaces[a] {
+			if r == b {
+				return true
+			}
+		}
+		return false
+	}
+
+	conflicts := []FileConflict{}
+	for path, pkgs := range o {
+		conflicting := false
+		for i := range pkgs {
+			for j := i + 1; j < len(pkgs); j++ {
+				if !replaced(pkgs[i], pkgs[j]) && !replaced(pkgs[j], pkgs[i]) {
+					conflicting = true
+				}
+			}
+		}
+
+		if conflicting {
+			conflicts = append(conflicts, FileConflict{Path: path, Packages: pkgs})
+		}
+	}
+
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].Path < conflicts[j].Path
+	})
+
+	return conflicts
+}
+
+// FindFileConflicts compares the files of the packages produced by the build,
+// and those of the packages in the conflict index if one is set, and returns
+// every path shipped by more than one of them.
+func (b *Build) FindFileConflicts(ctx context.Context, pkgNames []string) ([]FileConflict, error) {
+	ctx, span := otel.Tracer("melange").Start(ctx, "FindFileConflicts")
+	defer span.End()
+
+	replaces := map[string][]string{}
+	for _, r := range b.Configuration.Package.Dependencies.Replaces {
+		replaces[b.Configuration.Package.Name] = append(replaces[b.Configuration.Package.Name], dependencyName(r))
+	}
+	for _, sp := range b.Configuration.Subpackages {
+		for _, r := range sp.Dependencies.Replaces {
+			replaces[sp.Name] = append(replaces[sp.Name], dependencyName(r))
+		}
+	}
+
+	owners := fileOwners{}
+	built := map[string]bool{}
+	for _, name := range pkgNames {
+		built[name] = true
+		if err := owners.addFS(name, os.DirFS(filepath.Join(b.WorkspaceDir, "melange-out", name))); err != nil {
+			return nil, fmt.Errorf("listing files of %s: %w", name, err)
+		}
+	}
+
+	if b.ConflictIndex != "" {
+		if err := b.addIndexFileOwners(ctx, owners, built); err != nil {
+			return nil, err
+		}
+	}
+
+	return owners.conflicts(replaces), nil
+}
+
+// addIndexFileOwners records the files of the packages in the conflict index.
+// APKINDEX does not record file lists, so they are read from the packages,
+// which are expected next to the index.  Older versions of the packages being
+// built are skipped, as they are replaced rather than installed alongside.
+// Packages which cannot be found are reported, and fail the check when
+// FailOnFileConflict is set, as their files could not be compared.
+func (b *Build) addIndexFileOwners(ctx context.Context, owners fileOwners, built map[string]bool) error {
+	f, err := os.Open(b.ConflictIndex)
+	if err != nil {
+		return fmt.Errorf("opening conflict index: %w", err)
+	}
+	defer f.Close()
+
+	idx, err := apkrepo.IndexFromArchive(f)
+	if err != nil {
+		return fmt.Errorf("parsing conflict index %s: %w", b.ConflictIndex, err)
+	}
+
+	dir := filepath.Dir(b.ConflictIndex)
+	missing := 0
+	for _, pkg := range idx.Packages {
+		if built[pkg.Name] || pkg.Origin == b.Configuration.Package.Name {
+			continue
+		}
+		if pkg.Arch != b.Arch.ToAPK() && pkg.Arch != "noarch" {
+			continue
+		}
+
+		path := filepath.Join(dir, pkg.Filename())
+		if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) {
+			b.Logger.Warnf("%s of %s was not found next to it, its files cannot be checked for conflicts", pkg.Filename(), b.ConflictIndex)
+			missing++
+			continue
+		} else if err != nil {
+			return fmt.Errorf("checking %s for conflicts: %w", pkg.Filename(), err)
+		}
+
+		if err := owners.addApk(ctx, fmt.Sprintf("%s-%s", pkg.Name, pkg.Version), path); err != nil {
+			return err
+		}
+	}
+
+	if missing != 0 && b.FailOnFileConflict {
+		return fmt.Errorf("%d packages of %s were not found next to it, their files cannot be checked for conflicts", missing, b.ConflictIndex)
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	apko_log "chainguard.dev/apko/pkg/log"
+	"github.com/stretchr/testify/require"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/internal/apktest"
+)
+
+func TestFindFileConflicts(t *testing.T) {
+	workspace := t.TempDir()
+	for _, p := range []string{
+		"melange-out/foo/usr/bin/foo",
+		"melange-out/foo/usr/share/foo/data",
+		"melange-out/foo-dev/usr/include/foo.h",
+		"melange-out/foo-dev/usr/bin/foo",
+		"melange-out/foo-compat/usr/share/foo/data",
+		"melange-out/foo-extra/etc/bar.conf",
+	} {
+		require.NoError(t, os.MkdirAll(filepath.Join(workspace, filepath.Dir(p)), 0755))
+		require.NoError(t, os.WriteFile(filepath.Join(workspace, p), nil, 0644))
+	}
+
+	repo := t.TempDir()
+	apktest.WriteApk(t, filepath.Join(repo, "bar-1.0-r0.apk"), "pkgname = bar\npkgver = 1.0-r0\narch = x86_64\n",
+		apktest.Files("etc/bar.conf", "usr/bin/bar"), nil)
+	apktest.WriteApk(t, filepath.Join(repo, "foo-0.9-r0.apk"), "pkgname = foo\npkgver = 0.9-r0\narch = x86_64\n",
+		apktest.Files("usr/bin/foo"), nil)
+
+	idx := &apkrepo.ApkIndex{}
+	for _, name := range []string{"bar-1.0-r0.apk", "foo-0.9-r0.apk"} {
+		f, err := os.Open(filepath.Join(repo, name))
+		require.NoError(t, err)
+		pkg, err := apkrepo.ParsePackage(f)
+		f.Close()
+		require.NoError(t, err)
+		idx.Packages = append(idx.Packages, pkg)
+	}
+	archive, err := apkrepo.ArchiveFromIndex(idx)
+	require.NoError(t, err)
+	data, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	indexPath := filepath.Join(repo, "APKINDEX.tar.gz")
+	require.NoError(t, os.WriteFile(indexPath, data, 0644))
+
+	b := Build{
+		WorkspaceDir: workspace,
+		Arch:         apko_types.ParseArchitecture("x86_64"),
+		Logger:       &apko_log.Adapter{Out: io.Discard, Level: apko_log.InfoLevel},
+		Configuration: config.Configuration{
+			Package: config.Package{Name: "foo"},
+			Subpackages: []config.Subpackage{
+				{Name: "foo-dev"},
+				{Name: "foo-compat", Dependencies: config.Dependencies{Replaces: []string{"foo=1.0-r0"}}},
+				{Name: "foo-extra"},
+			},
+		},
+	}
+	pkgs := []string{"foo", "foo-dev", "foo-compat", "foo-extra"}
+
+	conflicts, err := b.FindFileConflicts(context.Background(), pkgs)
+	require.NoError(t, err)
+	require.Equal(t, []FileConflict{
+		{Path: "usr/bin/foo", Packages: []string{"foo", "foo-dev"}},
+	}, conflicts)
+
+	// Older versions of the packages being built are not conflicts.
+	b.ConflictIndex = indexPath
+	conflicts, err = b.FindFileConflicts(context.Background(), pkgs)
+	require.NoError(t, err)
+	require.Equal(t, []FileConflict{
+		{Path: "etc/bar.conf", Packages: []string{"foo-extra", "bar-1.0-r0"}},
+		{Path: "usr/bin/foo", Packages: []string{"foo", "foo-dev"}},
+	}, conflicts)
+
+	// Indexed packages which cannot be read are reported, and fail the check
+	// when conflicts are errors.
+	require.NoError(t, os.Remove(filepath.Join(repo, "bar-1.0-r0.apk")))
+	var log bytes.Buffer
+	b.Logger = &apko_log.Adapter{Out: &log, Level: apko_log.InfoLevel}
+	conflicts, err = b.FindFileConflicts(context.Background(), pkgs)
+	require.NoError(t, err)
+	require.Equal(t, []FileConflict{
+		{Path: "usr/bin/foo", Packages: []string{"foo", "foo-dev"}},
+	}, conflicts)
+	require.Contains(t, log.String(), "bar-1.0-r0.apk of "+indexPath+" was not found next to it")
+
+	b.FailOnFileConflict = true
+	_, err = b.FindFileConflicts(context.Background(), pkgs)
+	require.ErrorContains(t, err, "1 packages of "+indexPath+" were not found next to it")
+}
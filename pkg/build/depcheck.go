@@ -0,0 +1,122 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"go.opentelemetry.io/otel"
+)
+
+const (
+	// VerifyDependenciesOff skips checking that runtime dependencies resolve.
+	VerifyDependenciesOff = "off"
+	// VerifyDependenciesWarn logs the runtime dependencies which do not resolve.
+	VerifyDependenciesWarn = "warn"
+	// VerifyDependenciesError fails the build if a runtime dependency does not
+	// resolve.
+	VerifyDependenciesError = "error"
+)
+
+// UnresolvedDependency is a runtime dependency which no package provides.
+type UnresolvedDependency struct {
+	Package    string
+	Dependency string
+}
+
+func (u UnresolvedDependency) String() string {
+	return fmt.Sprintf("%s depends on %s, which nothing provides", u.Package, u.Dependency)
+}
+
+// dependencyName returns the name of a dependency without its version
+// constraint or repository pin.
+func dependencyName(dep string) string {
+	if i := strings.IndexAny(dep, "<>=~@"); i != -1 {
+		return dep[:i]
+	}
+	return dep
+}
+
+// FindUnresolvedDependencies returns the runtime dependencies of the packages
+// which are neither provided by one of the packages themselves, nor by a
+// package in the build environment repositories or the output directory.
+// Signatures of the repository indexes are not verified, as only the names
+// of the packages and what they provide are used.
+func (b *Build) FindUnresolvedDependencies(ctx context.Context, pkgs []*PackageBuild) ([]UnresolvedDependency, error) {
+	ctx, span := otel.Tracer("melange").Start(ctx, "FindUnresolvedDependencies")
+	defer span.End()
+
+	// Packages built together may depend on each other.
+	provided := map[string]bool{}
+	for _, pc := range pkgs {
+		provided[pc.PackageName] = true
+		for _, p := range pc.Dependencies.Provides {
+			provided[dependencyName(p)] = true
+		}
+	}
+
+	repos := slices.Clone(b.Configuration.Environment.Contents.Repositories)
+	repos = append(repos, b.ExtraRepos...)
+	repos = append(repos, b.OutDir)
+
+	indexes, err := apk.GetRepositoryIndexes(ctx, repos, nil, b.Arch.ToAPK(), apk.WithIgnoreSignatures(true))
+	if err != nil {
+		return nil, fmt.Errorf("fetching repository indexes: %w", err)
+	}
+	resolver := apk.NewPkgResolver(ctx, indexes)
+
+	unresolved := []UnresolvedDependency{}
+	for _, pc := range pkgs {
+		for _, dep := range pc.Dependencies.Runtime {
+			// Conflicts do not need a provider.
+			if strings.HasPrefix(dep, "!") || provided[dependencyName(dep)] {
+				continue
+			}
+
+			if _, err := resolver.ResolvePackage(dep); err != nil {
+				unresolved = append(unresolved, UnresolvedDependency{Package: pc.PackageName, Dependency: dep})
+			}
+		}
+	}
+
+	return unresolved, nil
+}
+
+// verifyDependencies reports the runtime dependencies of the packages which
+// do not resolve, and fails if the build is configured to.
+func (b *Build) verifyDependencies(ctx context.Context, pkgs []*PackageBuild) error {
+	unresolved, err := b.FindUnresolvedDependencies(ctx, pkgs)
+	if err != nil {
+		return err
+	}
+
+	for _, u := range unresolved {
+		if b.VerifyDependencies == VerifyDependenciesError {
+			b.Logger.Warnf("ERROR: %s", u)
+		} else {
+			b.Logger.Warnf("WARNING: %s", u)
+		}
+	}
+
+	if len(unresolved) != 0 && b.VerifyDependencies == VerifyDependenciesError {
+		return fmt.Errorf("%d runtime dependencies cannot be resolved", len(unresolved))
+	}
+
+	return nil
+}
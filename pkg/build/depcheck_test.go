@@ -0,0 +1,94 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	apko_log "chainguard.dev/apko/pkg/log"
+	"github.com/stretchr/testify/require"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestFindUnresolvedDependencies(t *testing.T) {
+	outDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(outDir, "x86_64"), 0755))
+
+	archive, err := apkrepo.ArchiveFromIndex(&apkrepo.ApkIndex{Packages: []*apkrepo.Package{{
+		Name:     "libbar",
+		Version:  "1.0-r0",
+		Arch:     "x86_64",
+		Provides: []string{"so:libbar.so.1=1", "cmd:bar=1.0-r0"},
+	}}})
+	require.NoError(t, err)
+	data, err := io.ReadAll(archive)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(outDir, "x86_64", "APKINDEX.tar.gz"), data, 0644))
+
+	b := &Build{
+		OutDir: outDir,
+		Arch:   apko_types.ParseArchitecture("x86_64"),
+		Logger: &apko_log.Adapter{Out: io.Discard, Level: apko_log.InfoLevel},
+	}
+	pkgs := []*PackageBuild{{
+		PackageName: "foo",
+		Dependencies: config.Dependencies{
+			Runtime:  []string{"so:libbar.so.1", "cmd:bar", "libbar>=1.0", "foo-libs", "!foo-old", "so:libmissing.so.2", "pc:missing>=1.0"},
+			Provides: []string{"cmd:foo=1.0-r0"},
+		},
+	}, {
+		PackageName: "foo-libs",
+		Dependencies: config.Dependencies{
+			Runtime:  []string{"cmd:foo"},
+			Provides: []string{"so:libfoo.so.1=1"},
+		},
+	}}
+
+	unresolved, err := b.FindUnresolvedDependencies(context.Background(), pkgs)
+	require.NoError(t, err)
+	require.Equal(t, []UnresolvedDependency{
+		{Package: "foo", Dependency: "so:libmissing.so.2"},
+		{Package: "foo", Dependency: "pc:missing>=1.0"},
+	}, unresolved)
+
+	b.VerifyDependencies = VerifyDependenciesWarn
+	require.NoError(t, b.verifyDependencies(context.Background(), pkgs))
+
+	b.VerifyDependencies = VerifyDependenciesError
+	require.ErrorContains(t, b.verifyDependencies(context.Background(), pkgs), "2 runtime dependencies cannot be resolved")
+}
+
+func TestDependencyName(t *testing.T) {
+	for dep, want := range map[string]string{
+		"foo":                 "foo",
+		"foo=1.0-r0":          "foo",
+		"foo>=1.0":            "foo",
+		"foo<2":               "foo",
+		"foo~1.2":             "foo",
+		"foo@local":           "foo",
+		"pc:glib-2.0>=2.70":   "pc:glib-2.0",
+		"so:libfoo.so.3=3":    "so:libfoo.so.3",
+		"cmd:foo@testing=1.0": "cmd:foo",
+	} {
+		require.Equal(t, want, dependencyName(dep), dep)
+	}
+}
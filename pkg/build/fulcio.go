@@ -0,0 +1,524 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultFulcioURL is the public Fulcio instance of the Sigstore project.
+const DefaultFulcioURL = "https://fulcio.sigstore.dev"
+
+// OIDCTokenSource returns an OIDC identity token, which is exchanged with the
+// certificate authority for a short-lived signing certificate.
+type OIDCTokenSource func(ctx context.Context) (string, error)
+
+// StaticTokenSource returns the token.
+func StaticTokenSource(token string) OIDCTokenSource {
+	return func(context.Context) (string, error) {
+		return token, nil
+	}
+}
+
+// FileTokenSource reads the token from a file each time one is needed, such
+// as a projected service account token which is rotated.
+func FileTokenSource(path string) OIDCTokenSource {
+	return func(context.Context) (string, error) {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("reading OIDC token: %w", err)
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+}
+
+// GitHubActionsTokenSource requests a token for the audience from the OIDC
+// provider of GitHub Actions.  The workflow needs the id-token: write
+// permission.
+func GitHubActionsTokenSource(audience string) OIDCTokenSource {
+	return func(ctx context.Context) (string, error) {
+		reqURL, reqToken := os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL"), os.Getenv("ACTIONS_ID_TOKEN_REQUEST_TOKEN")
+		if reqURL == "" || reqToken == "" {
+			return "", errors.New("not running in GitHub Actions with the id-token: write permission")
+		}
+
+		u, err := url.Parse(reqURL)
+		if err != nil {
+			return "", err
+		}
+		q := u.Query()
+		q.Set("audience", audience)
+		u.RawQuery = q.Encode()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("Authorization", "Bearer "+reqToken)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return "", fmt.Errorf("requesting OIDC token: %w", err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return "", fmt.Errorf("requesting OIDC token: %s", resp.Status)
+		}
+
+		var body struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return "", fmt.Errorf("parsing OIDC token response: %w", err)
+		}
+		return body.Value, nil
+	}
+}
+
+// DefaultTokenSource uses the token in the SIGSTORE_ID_TOKEN environment
+// variable if it is set, or else requests one from GitHub Actions.
+func DefaultTokenSource() OIDCTokenSource {
+	return func(ctx context.Context) (string, error) {
+		if token := os.Getenv("SIGSTORE_ID_TOKEN"); token != "" {
+			return token, nil
+		}
+		if os.Getenv("ACTIONS_ID_TOKEN_REQUEST_URL") != "" {
+			return GitHubActionsTokenSource("sigstore")(ctx)
+		}
+		return "", errors.New("no OIDC token available: set SIGSTORE_ID_TOKEN, use an OIDC token file or run in GitHub Actions")
+	}
+}
+
+// tokenSubject returns the identity a token is issued for, which the
+// certificate authority expects the proof of possession of the key to sign.
+// The token is not verified, that is done by the certificate authority.
+func tokenSubject(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("OIDC token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "="))
+	if err != nil {
+		return "", fmt.Errorf("decoding OIDC token: %w", err)
+	}
+
+	var claims struct {
+		Subject string `json:"sub"`
+		Email   string `json:"email"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", fmt.Errorf("decoding OIDC token: %w", err)
+	}
+
+	if claims.Email != "" {
+		return claims.Email, nil
+	}
+	if claims.Subject != "" {
+		return claims.Subject, nil
+	}
+	return "", errors.New("OIDC token has no subject")
+}
+
+// fulcioSigningCertRequest is the request of the v2 signingCert API of Fulcio.
+type fulcioSigningCertRequest struct {
+	Credentials struct {
+		OIDCIdentityToken string `json:"oidcIdentityToken"`
+	} `json:"credentials"`
+	PublicKeyRequest struct {
+		PublicKey struct {
+			Algorithm string `json:"algorithm"`
+			Content   string `json:"content"`
+		} `json:"publicKey"`
+		ProofOfPossession []byte `json:"proofOfPossession"`
+	} `json:"publicKeyRequest"`
+}
+
+type fulcioCertificateChain struct {
+	Chain struct {
+		Certificates []string `json:"certificates"`
+	} `json:"chain"`
+}
+
+// fulcioSigningCertResponse is the response of the v2 signingCert API.  The
+// certificate transparency timestamp is either embedded in the certificate,
+// or returned alongside it.
+type fulcioSigningCertResponse struct {
+	EmbeddedSCT *fulcioCertificateChain `json:"signedCertificateEmbeddedSct"`
+	DetachedSCT *fulcioCertificateChain `json:"signedCertificateDetachedSct"`
+}
+
+// APKv2+Fulcio style signature is an ECDSA signature over the SHA-256 digest
+// of the control section, made with an ephemeral key.  The key is certified
+// by a Fulcio compatible certificate authority for the identity of an OIDC
+// token, and the signature file holds the signature followed by the
+// certificate chain, PEM encoded.
+type FulcioApkSigner struct {
+	// FulcioURL is the base URL of the certificate authority, DefaultFulcioURL
+	// if empty.
+	FulcioURL string
+	// TokenSource provides the OIDC token exchanged for the certificate,
+	// DefaultTokenSource if nil.
+	TokenSource OIDCTokenSource
+	// HTTPClient talks to the certificate authority, http.DefaultClient if
+	// nil.
+	HTTPClient *http.Client
+
+	mu    sync.Mutex
+	key   *ecdsa.PrivateKey
+	chain []*x509.Certificate
+}
+
+// certificate returns the key and certificate chain to sign with, requesting
+// a new certificate if there is none yet or it is about to expire.  The
+// certificate is shared by the packages of a build.
+func (s *FulcioApkSigner) certificate(ctx context.Context) (*ecdsa.PrivateKey, []*x509.Certificate, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.key != nil && time.Until(s.chain[0].NotAfter) > time.Minute {
+		return s.key, s.chain, nil
+	}
+
+	tokens := s.TokenSource
+	if tokens == nil {
+		tokens = DefaultTokenSource()
+	}
+	token, err := tokens(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	subject, err := tokenSubject(token)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	digest := sha256.Sum256([]byte(subject))
+	proof, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var certReq fulcioSigningCertRequest
+	certReq.Credentials.OIDCIdentityToken = token
+	certReq.PublicKeyRequest.PublicKey.Algorithm = "ECDSA"
+	certReq.PublicKeyRequest.PublicKey.Content = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+	certReq.PublicKeyRequest.ProofOfPossession = proof
+
+	chain, err := s.requestCertificate(ctx, &certReq)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	s.key, s.chain = key, chain
+	return key, chain, nil
+}
+
+func (s *FulcioApkSigner) requestCertificate(ctx context.Context, certReq *fulcioSigningCertRequest) ([]*x509.Certificate, error) {
+	base := s.FulcioURL
+	if base == "" {
+		base = DefaultFulcioURL
+	}
+	client := s.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	body, err := json.Marshal(certReq)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, strings.TrimSuffix(base, "/")+"/api/v2/signingCert", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting signing certificate: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("requesting signing certificate: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+
+	var certResp fulcioSigningCertResponse
+	if err := json.NewDecoder(resp.Body).Decode(&certResp); err != nil {
+		return nil, fmt.Errorf("parsing signing certificate response: %w", err)
+	}
+
+	issued := certResp.EmbeddedSCT
+	if issued == nil {
+		issued = certResp.DetachedSCT
+	}
+	if issued == nil || len(issued.Chain.Certificates) == 0 {
+		return nil, errors.New("certificate authority returned no certificate")
+	}
+
+	chain := []*x509.Certificate{}
+	for _, c := range issued.Chain.Certificates {
+		block, _ := pem.Decode([]byte(c))
+		if block == nil {
+			return nil, errors.New("certificate authority returned an invalid certificate")
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("parsing signing certificate: %w", err)
+		}
+		chain = append(chain, cert)
+	}
+
+	return chain, nil
+}
+
+// Sign implements ApkSigner.
+func (s *FulcioApkSigner) Sign(control []byte) ([]byte, error) {
+	key, chain, err := s.certificate(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("obtaining signing certificate: %w", err)
+	}
+
+	digest := sha256.Sum256(control)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := pem.Encode(&buf, &pem.Block{Type: "SIGNATURE", Bytes: sig}); err != nil {
+		return nil, err
+	}
+	for _, cert := range chain {
+		if err := pem.Encode(&buf, &pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}); err != nil {
+			return nil, err
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+var unsafeSignatureNameChars = regexp.MustCompile(`[^A-Za-z0-9@._-]+`)
+
+// certificateIdentity returns the identity the certificate was issued for:
+// its email address, URI or common name.
+func certificateIdentity(cert *x509.Certificate) string {
+	switch {
+	case len(cert.EmailAddresses) != 0:
+		return cert.EmailAddresses[0]
+	case len(cert.URIs) != 0:
+		return cert.URIs[0].String()
+	default:
+		return cert.Subject.CommonName
+	}
+}
+
+// SignatureName implements ApkSigner.  The name holds the identity of the
+// signing certificate, for information only, as the signature is verified
+// with the certificate rather than a key known by name.
+func (s *FulcioApkSigner) SignatureName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.chain == nil {
+		return ".SIGN.FULCIO.pem"
+	}
+
+	identity := unsafeSignatureNameChars.ReplaceAllString(certificateIdentity(s.chain[0]), "_")
+	return fmt.Sprintf(".SIGN.FULCIO.%s.pem", identity)
+}
+
+// FulcioIdentity is the identity a keyless signing certificate must have been
+// issued for.
+type FulcioIdentity struct {
+	// Subject is the email address or URI of the identity, as found in the
+	// subject alternative names of the certificate.
+	Subject string
+	// Issuer is the URL of the OIDC issuer which authenticated the identity.
+	Issuer string
+}
+
+var (
+	// oidIssuerV2 is the Fulcio extension holding the OIDC issuer as a DER
+	// encoded string.
+	oidIssuerV2 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+	// oidIssuerV1 is the deprecated Fulcio extension holding the OIDC issuer
+	// as raw bytes.
+	oidIssuerV1 = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+)
+
+// certificateIssuer returns the OIDC issuer recorded in a Fulcio certificate.
+func certificateIssuer(cert *x509.Certificate) (string, error) {
+	v1 := ""
+	for _, ext := range cert.Extensions {
+		switch {
+		case ext.Id.Equal(oidIssuerV2):
+			var issuer string
+			if _, err := asn1.Unmarshal(ext.Value, &issuer); err != nil {
+				return "", fmt.Errorf("parsing OIDC issuer extension: %w", err)
+			}
+			return issuer, nil
+		case ext.Id.Equal(oidIssuerV1):
+			v1 = string(ext.Value)
+		}
+	}
+	if v1 == "" {
+		return "", errors.New("certificate has no OIDC issuer extension")
+	}
+	return v1, nil
+}
+
+// verify checks that the certificate was issued to the identity.
+func (id FulcioIdentity) verify(cert *x509.Certificate) error {
+	subjects := append([]string{}, cert.EmailAddresses...)
+	for _, u := range cert.URIs {
+		subjects = append(subjects, u.String())
+	}
+	found := false
+	for _, s := range subjects {
+		if s == id.Subject {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("certificate was issued to %s, not %s", strings.Join(subjects, ", "), id.Subject)
+	}
+
+	issuer, err := certificateIssuer(cert)
+	if err != nil {
+		return err
+	}
+	if issuer != id.Issuer {
+		return fmt.Errorf("certificate identity was authenticated by %s, not %s", issuer, id.Issuer)
+	}
+
+	return nil
+}
+
+// VerifyFulcioSignature verifies an APKv2+Fulcio signature over data, that
+// its certificate chains to one of the roots, and that the certificate was
+// issued to the identity, which must be set.  As the certificate is
+// short-lived, its chain is verified at the time it was issued.  It returns
+// the signing certificate.
+func VerifyFulcioSignature(data, signature []byte, roots *x509.CertPool, identity FulcioIdentity) (*x509.Certificate, error) {
+	if identity.Subject == "" || identity.Issuer == "" {
+		return nil, errors.New("keyless signatures are only trusted for a certificate identity and OIDC issuer")
+	}
+
+	var sig []byte
+	var chain []*x509.Certificate
+	for rest := signature; ; {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+
+		switch block.Type {
+		case "SIGNATURE":
+			sig = block.Bytes
+		case "CERTIFICATE":
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return nil, fmt.Errorf("parsing certificate: %w", err)
+			}
+			chain = append(chain, cert)
+		}
+	}
+	if sig == nil || len(chain) == 0 {
+		return nil, errors.New("signature does not hold a signature and certificate")
+	}
+
+	leaf := chain[0]
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   leaf.NotBefore,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return nil, fmt.Errorf("verifying certificate: %w", err)
+	}
+	if err := identity.verify(leaf); err != nil {
+		return nil, err
+	}
+
+	pub, ok := leaf.PublicKey.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("signing certificate does not hold an ECDSA key")
+	}
+	digest := sha256.Sum256(data)
+	if !ecdsa.VerifyASN1(pub, digest[:], sig) {
+		return nil, errors.New("signature does not match")
+	}
+
+	return leaf, nil
+}
+
+// NewFulcioApkSigner returns a keyless signer requesting its certificate from
+// the certificate authority at fulcioURL, DefaultFulcioURL if empty, for the
+// OIDC token read from tokenFile, or taken from the environment if empty.
+func NewFulcioApkSigner(fulcioURL, tokenFile string) *FulcioApkSigner {
+	tokens := DefaultTokenSource()
+	if tokenFile != "" {
+		tokens = FileTokenSource(tokenFile)
+	}
+	return &FulcioApkSigner{FulcioURL: fulcioURL, TokenSource: tokens}
+}
+
+// keylessSigner returns the keyless signer of the build, which is shared by
+// its packages and index so a single certificate is requested.
+func (b *Build) keylessSigner() *FulcioApkSigner {
+	if b.fulcioSigner == nil {
+		b.fulcioSigner = NewFulcioApkSigner(b.FulcioURL, b.OIDCTokenFile)
+	}
+	return b.fulcioSigner
+}
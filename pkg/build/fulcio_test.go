@@ -0,0 +1,287 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	apko_log "chainguard.dev/apko/pkg/log"
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/apkdiff"
+	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/config"
+)
+
+// testIssuer is the OIDC issuer of the test tokens.
+const testIssuer = "https://oidc.example.com"
+
+// testCA is a minimal Fulcio compatible certificate authority, which issues
+// certificates for the email and issuer claims of unsigned tokens.
+type testCA struct {
+	t        *testing.T
+	key      *ecdsa.PrivateKey
+	root     *x509.Certificate
+	requests int
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test-ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	root, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+
+	return &testCA{t: t, key: key, root: root}
+}
+
+func (ca *testCA) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	t := ca.t
+	require.Equal(t, "/api/v2/signingCert", r.URL.Path)
+	ca.requests++
+
+	var req struct {
+		Credentials struct {
+			OIDCIdentityToken string `json:"oidcIdentityToken"`
+		} `json:"credentials"`
+		PublicKeyRequest struct {
+			PublicKey struct {
+				Content string `json:"content"`
+			} `json:"publicKey"`
+			ProofOfPossession []byte `json:"proofOfPossession"`
+		} `json:"publicKeyRequest"`
+	}
+	require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+
+	var claims struct {
+		Email  string `json:"email"`
+		Issuer string `json:"iss"`
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(strings.Split(req.Credentials.OIDCIdentityToken, ".")[1])
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(payload, &claims))
+
+	block, _ := pem.Decode([]byte(req.PublicKeyRequest.PublicKey.Content))
+	require.NotNil(t, block)
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	require.NoError(t, err)
+
+	digest := sha256.Sum256([]byte(claims.Email))
+	if !ecdsa.VerifyASN1(pub.(*ecdsa.PublicKey), digest[:], req.PublicKeyRequest.ProofOfPossession) {
+		http.Error(w, "invalid proof of possession", http.StatusBadRequest)
+		return
+	}
+
+	issuer, err := asn1.MarshalWithParams(claims.Issuer, "utf8")
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(int64(ca.requests + 1)),
+		NotBefore:      time.Now().Add(-time.Minute),
+		NotAfter:       time.Now().Add(10 * time.Minute),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses: []string{claims.Email},
+		ExtraExtensions: []pkix.Extension{
+			{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}, Value: issuer},
+		},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.root, pub, ca.key)
+	require.NoError(t, err)
+
+	var resp struct {
+		SignedCertificateEmbeddedSct struct {
+			Chain struct {
+				Certificates []string `json:"certificates"`
+			} `json:"chain"`
+		} `json:"signedCertificateEmbeddedSct"`
+	}
+	resp.SignedCertificateEmbeddedSct.Chain.Certificates = []string{
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.root.Raw})),
+	}
+	w.WriteHeader(http.StatusCreated)
+	require.NoError(t, json.NewEncoder(w).Encode(resp))
+}
+
+func testToken(email string) string {
+	enc := base64.RawURLEncoding.EncodeToString
+	return enc([]byte(`{"alg":"none"}`)) + "." + enc([]byte(`{"iss":"`+testIssuer+`","sub":"1234","email":"`+email+`"}`)) + "."
+}
+
+func TestFulcioApkSigner(t *testing.T) {
+	ca := newTestCA(t)
+	srv := httptest.NewServer(ca)
+	defer srv.Close()
+
+	signer := &build.FulcioApkSigner{
+		FulcioURL:   srv.URL,
+		TokenSource: build.StaticTokenSource(testToken("builder@example.com")),
+	}
+
+	control := []byte("control section")
+	sigData, err := build.EmitSignature(context.Background(), signer, control, time.Unix(0, 0))
+	require.NoError(t, err)
+
+	// The second signature reuses the certificate.
+	_, err = signer.Sign([]byte("another control section"))
+	require.NoError(t, err)
+	require.Equal(t, 1, ca.requests)
+
+	gr, err := gzip.NewReader(bytes.NewReader(sigData))
+	require.NoError(t, err)
+	tr := tar.NewReader(gr)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	require.Equal(t, ".SIGN.FULCIO.builder@example.com.pem", hdr.Name)
+	sig, err := io.ReadAll(tr)
+	require.NoError(t, err)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.root)
+
+	identity := build.FulcioIdentity{Subject: "builder@example.com", Issuer: testIssuer}
+	cert, err := build.VerifyFulcioSignature(control, sig, roots, identity)
+	require.NoError(t, err)
+	require.Equal(t, []string{"builder@example.com"}, cert.EmailAddresses)
+
+	_, err = build.VerifyFulcioSignature([]byte("tampered"), sig, roots, identity)
+	require.Error(t, err)
+
+	_, err = build.VerifyFulcioSignature(control, sig, x509.NewCertPool(), identity)
+	require.Error(t, err)
+
+	// The certificate must have been issued to the pinned identity.
+	_, err = build.VerifyFulcioSignature(control, sig, roots, build.FulcioIdentity{})
+	require.ErrorContains(t, err, "only trusted for a certificate identity and OIDC issuer")
+
+	_, err = build.VerifyFulcioSignature(control, sig, roots, build.FulcioIdentity{Subject: "attacker@example.com", Issuer: testIssuer})
+	require.ErrorContains(t, err, "certificate was issued to builder@example.com, not attacker@example.com")
+
+	_, err = build.VerifyFulcioSignature(control, sig, roots, build.FulcioIdentity{Subject: "builder@example.com", Issuer: "https://accounts.example.com"})
+	require.ErrorContains(t, err, "authenticated by "+testIssuer+", not https://accounts.example.com")
+}
+
+func TestFulcioApkSignerErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "token rejected", http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	signer := &build.FulcioApkSigner{
+		FulcioURL:   srv.URL,
+		TokenSource: build.StaticTokenSource(testToken("builder@example.com")),
+	}
+	_, err := signer.Sign([]byte("control section"))
+	require.ErrorContains(t, err, "token rejected")
+
+	signer.TokenSource = build.StaticTokenSource("not a token")
+	_, err = signer.Sign([]byte("control section"))
+	require.ErrorContains(t, err, "not a JWT")
+}
+
+func TestKeylessRebuildIsReproducible(t *testing.T) {
+	ca := newTestCA(t)
+	srv := httptest.NewServer(ca)
+	defer srv.Close()
+
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte(testToken("builder@example.com")), 0o600))
+
+	pkgctx, err := build.NewPackageContext(&config.Package{
+		Name:      "hello",
+		Version:   "1.0",
+		Copyright: []config.Copyright{{License: "Apache-2.0"}},
+	})
+	require.NoError(t, err)
+
+	// Build the same package twice, each build requesting its own
+	// certificate, as a rebuild verifying reproducibility does.
+	emit := func() string {
+		workspace := t.TempDir()
+		bin := filepath.Join(workspace, "melange-out", "hello", "usr", "bin")
+		require.NoError(t, os.MkdirAll(bin, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(bin, "hello"), []byte("#!/bin/sh\necho hello\n"), 0o755))
+
+		outDir := t.TempDir()
+		pb := &build.PackageBuild{
+			Build: &build.Build{
+				WorkspaceDir:    workspace,
+				OutDir:          outDir,
+				Arch:            apko_types.ParseArchitecture("x86_64"),
+				SourceDateEpoch: time.Unix(1700000000, 0),
+				Keyless:         true,
+				FulcioURL:       srv.URL,
+				OIDCTokenFile:   tokenFile,
+			},
+			Origin:      pkgctx,
+			PackageName: "hello",
+			OriginName:  "hello",
+			OutDir:      filepath.Join(outDir, "x86_64"),
+			Arch:        "x86_64",
+			Logger:      &apko_log.Adapter{Out: io.Discard, Level: apko_log.InfoLevel},
+		}
+		require.NoError(t, pb.EmitPackage(context.Background()))
+		return pb.Filename()
+	}
+	first, second := emit(), emit()
+	require.Equal(t, 2, ca.requests)
+
+	// The signatures differ, but the contents they sign do not.
+	diffs, err := apkdiff.CompareFiles(context.Background(), first, second)
+	require.NoError(t, err)
+	require.NotEmpty(t, diffs)
+	for _, d := range diffs {
+		require.Equal(t, apkdiff.SignatureSection, d.Section, d.String())
+	}
+
+	diffs, err = apkdiff.CompareFiles(context.Background(), first, second, apkdiff.ContentSections...)
+	require.NoError(t, err)
+	require.Empty(t, diffs)
+}
@@ -15,12 +15,13 @@
 package build
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"crypto/sha256"
 	"debug/elf"
 	"encoding/hex"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
@@ -28,8 +29,10 @@ import (
 	"path/filepath"
 	"regexp"
 	"runtime"
+	"slices"
 	"sort"
 	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/chainguard-dev/go-pkgconfig"
@@ -101,12 +104,26 @@ type PackageBuild struct {
 	Description   string
 	URL           string
 	Commit        string
+
+	// dependenciesGenerated is set once GenerateDependencies has run, so
+	// that EmitPackage does not scan the package again.
+	dependenciesGenerated bool
+	// provenance records why each dependency was added, and generator is the
+	// name of the dependency generator which is running.
+	provenance []DependencyProvenance
+	generator  string
 }
 
 func (pkg *PackageContext) Emit(ctx context.Context, pb *PipelineBuild) error {
 	ctx, span := otel.Tracer("melange").Start(ctx, "Emit")
 	defer span.End()
 
+	return pkg.subpackageContext().Emit(ctx, pb)
+}
+
+// subpackageContext returns a subpackage context for the package, so that it
+// can be emitted like any other subpackage.
+func (pkg *PackageContext) subpackageContext() *SubpackageContext {
 	fakesp := config.Subpackage{
 		Name:         pkg.Package.Name,
 		Dependencies: pkg.Package.Dependencies,
@@ -116,18 +133,27 @@ func (pkg *PackageContext) Emit(ctx context.Context, pb *PipelineBuild) error {
 		URL:          pkg.Package.URL,
 		Commit:       pkg.Package.Commit,
 	}
-	fakespctx := SubpackageContext{
+	return &SubpackageContext{
 		Subpackage: &fakesp,
 	}
-	return fakespctx.Emit(ctx, pb)
 }
 
 func (spkg *SubpackageContext) Emit(ctx context.Context, pb *PipelineBuild) error {
-	pkgctx, err := NewPackageContext(&pb.Build.Configuration.Package)
+	pc, err := spkg.PackageBuild(pb)
 	if err != nil {
 		return err
 	}
 
+	return pc.EmitPackage(ctx)
+}
+
+// PackageBuild returns the context used to emit the subpackage.
+func (spkg *SubpackageContext) PackageBuild(pb *PipelineBuild) (*PackageBuild, error) {
+	pkgctx, err := NewPackageContext(&pb.Build.Configuration.Package)
+	if err != nil {
+		return nil, err
+	}
+
 	pc := PackageBuild{
 		Build:        pb.Build,
 		Origin:       pkgctx,
@@ -148,7 +174,7 @@ func (spkg *SubpackageContext) Emit(ctx context.Context, pb *PipelineBuild) erro
 		pc.OriginName = pc.Origin.Package.Name
 	}
 
-	return pc.EmitPackage(ctx)
+	return &pc, nil
 }
 
 // AppendBuildLog will create or append a list of packages that were built by melange build
@@ -366,7 +392,7 @@ func generateCmdProviders(pc *PackageBuild, generated *config.Dependencies) erro
 		if mode.Perm()&0555 == 0555 {
 			if allowedPrefix(path, cmdPrefixes) {
 				basename := filepath.Base(path)
-				generated.Provides = append(generated.Provides, fmt.Sprintf("cmd:%s=%s-r%d", basename, pc.Origin.Package.Version, pc.Origin.Package.Epoch))
+				pc.addGenerated(generated, DependencyProvides, fmt.Sprintf("cmd:%s=%s-r%d", basename, pc.Origin.Package.Version, pc.Origin.Package.Epoch), path)
 			}
 		}
 
@@ -378,6 +404,81 @@ func generateCmdProviders(pc *PackageBuild, generated *config.Dependencies) erro
 	return nil
 }
 
+// shebangInterpreter returns the name of the command which runs a script, from
+// its #! line.  For scripts run through env, such as #!/usr/bin/env python3,
+// it is the command env looks up.
+func shebangInterpreter(r io.Reader) string {
+	line, err := bufio.NewReader(io.LimitReader(r, 256)).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return ""
+	}
+
+	line, ok := strings.CutPrefix(line, "#!")
+	if !ok {
+		return ""
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	interp := filepath.Base(fields[0])
+	if interp != "env" {
+		return interp
+	}
+
+	// Skip the options of env, like -S, and variable assignments.
+	for _, arg := range fields[1:] {
+		if strings.HasPrefix(arg, "-") || strings.Contains(arg, "=") {
+			continue
+		}
+		return filepath.Base(arg)
+	}
+
+	return ""
+}
+
+// generateShebangDeps generates cmd: runtime dependencies for the interpreters
+// of the executable scripts in the package.
+func generateShebangDeps(pc *PackageBuild, generated *config.Dependencies) error {
+	if pc.Options.NoDepends {
+		return nil
+	}
+
+	pc.Logger.Printf("scanning for shebang interpreters...")
+
+	fsys := readlinkFS(pc.WorkspaceSubdir())
+	return fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		mode := fi.Mode()
+		if !mode.IsRegular() || mode.Perm()&0111 == 0 {
+			return nil
+		}
+
+		f, err := fsys.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		if interp := shebangInterpreter(f); interp != "" {
+			pc.Logger.Printf("interpreter for %s => %s", path, interp)
+			pc.addGenerated(generated, DependencyRuntime, fmt.Sprintf("cmd:%s", interp), path)
+		}
+
+		return nil
+	})
+}
+
 // findInterpreter looks for the PT_INTERP header and extracts the interpreter so that it
 // may be used as a dependency.
 func findInterpreter(bin *elf.File) (string, error) {
@@ -432,8 +533,6 @@ func (pc *PackageBuild) dereferenceCrossPackageSymlink(path string) (string, err
 func generateSharedObjectNameDeps(pc *PackageBuild, generated *config.Dependencies) error {
 	pc.Logger.Printf("scanning for shared object dependencies...")
 
-	depends := map[string][]string{}
-
 	fsys := readlinkFS(pc.WorkspaceSubdir())
 	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -473,7 +572,7 @@ func generateSharedObjectNameDeps(pc *PackageBuild, generated *config.Dependenci
 				}
 
 				for _, soname := range sonames {
-					generated.Runtime = append(generated.Runtime, fmt.Sprintf("so:%s", soname))
+					pc.addGenerated(generated, DependencyRuntime, fmt.Sprintf("so:%s", soname), path)
 				}
 			}
 
@@ -508,7 +607,7 @@ func generateSharedObjectNameDeps(pc *PackageBuild, generated *config.Dependenci
 				// the dependency.
 				interpName := fmt.Sprintf("so:%s", filepath.Base(interp))
 				interpName = strings.ReplaceAll(interpName, "so:ld-musl", "so:libc.musl")
-				generated.Runtime = append(generated.Runtime, interpName)
+				pc.addGenerated(generated, DependencyRuntime, interpName, path)
 			}
 
 			libs, err := ef.ImportedLibraries()
@@ -520,8 +619,7 @@ func generateSharedObjectNameDeps(pc *PackageBuild, generated *config.Dependenci
 			if !pc.Options.NoDepends {
 				for _, lib := range libs {
 					if strings.Contains(lib, ".so.") {
-						generated.Runtime = append(generated.Runtime, fmt.Sprintf("so:%s", lib))
-						depends[lib] = append(depends[lib], path)
+						pc.addGenerated(generated, DependencyRuntime, fmt.Sprintf("so:%s", lib), path)
 					}
 				}
 			}
@@ -551,9 +649,9 @@ func generateSharedObjectNameDeps(pc *PackageBuild, generated *config.Dependenci
 					}
 
 					if allowedPrefix(path, libDirs) {
-						generated.Provides = append(generated.Provides, fmt.Sprintf("so:%s=%s", soname, libver))
+						pc.addGenerated(generated, DependencyProvides, fmt.Sprintf("so:%s=%s", soname, libver), path)
 					} else {
-						generated.Vendored = append(generated.Vendored, fmt.Sprintf("so:%s=%s", soname, libver))
+						pc.addGenerated(generated, DependencyVendored, fmt.Sprintf("so:%s=%s", soname, libver), path)
 					}
 				}
 			}
@@ -564,28 +662,34 @@ func generateSharedObjectNameDeps(pc *PackageBuild, generated *config.Dependenci
 		return err
 	}
 
-	if pc.Build.DependencyLog != "" {
-		pc.Logger.Printf("writing dependency log")
-
-		logFile, err := os.Create(fmt.Sprintf("%s.%s", pc.Build.DependencyLog, pc.Arch))
-		if err != nil {
-			pc.Logger.Warnf("Unable to open dependency log: %v", err)
-		}
-		defer logFile.Close()
-
-		je := json.NewEncoder(logFile)
-		if err := je.Encode(depends); err != nil {
-			return err
-		}
-	}
-
 	return nil
 }
 
 var pkgConfigVersionRegexp = regexp.MustCompile("-(alpha|beta|rc|pre)")
 
-// TODO(kaniini): Turn this feature on once enough of Wolfi is built with provider data.
-var generateRuntimePkgConfigDeps = false
+// pkgConfigVersionOperators maps pkg-config version comparisons to apk
+// dependency operators.
+//
+// N.B. go-pkgconfig parses ">" as VersionGreaterThanEqual and ">=" as
+// VersionGreaterThan, so those two are mapped back to what was written.
+var pkgConfigVersionOperators = map[pkgconfig.VersionCompare]string{
+	pkgconfig.VersionEqual:            "=",
+	pkgconfig.VersionLessThan:         "<",
+	pkgconfig.VersionLessThanEqual:    "<=",
+	pkgconfig.VersionGreaterThanEqual: ">",
+	pkgconfig.VersionGreaterThan:      ">=",
+}
+
+// pkgConfigDependency returns the pc: dependency for a pkg-config
+// requirement, including its version constraint if it has one.
+func pkgConfigDependency(dep pkgconfig.Dependency) string {
+	if dep.Version == "" {
+		return fmt.Sprintf("pc:%s", dep.Identifier)
+	}
+
+	apkVersion := pkgConfigVersionRegexp.ReplaceAllString(dep.Version, "_$1")
+	return fmt.Sprintf("pc:%s%s%s", dep.Identifier, pkgConfigVersionOperators[dep.VersionCompare], apkVersion)
+}
 
 // generatePkgConfigDeps generates a list of provided pkg-config package names and versions,
 // as well as dependency relationships.
@@ -626,22 +730,21 @@ func generatePkgConfigDeps(pc *PackageBuild, generated *config.Dependencies) err
 
 		apkVersion := pkgConfigVersionRegexp.ReplaceAllString(pkg.Version, "_$1")
 		if !pc.Options.NoProvides {
-			generated.Provides = append(generated.Provides, fmt.Sprintf("pc:%s=%s", pcName, apkVersion))
+			pc.addGenerated(generated, DependencyProvides, fmt.Sprintf("pc:%s=%s", pcName, apkVersion), path)
 		}
 
-		if generateRuntimePkgConfigDeps {
-			// TODO(kaniini): Capture version relationships here too.  In practice, this does not matter
-			// so much though for us.
+		// TODO(kaniini): Turn this on by default once enough of Wolfi is built with provider data.
+		if pc.Options.PkgConfigDepends && !pc.Options.NoDepends {
 			for _, dep := range pkg.Requires {
-				generated.Runtime = append(generated.Runtime, fmt.Sprintf("pc:%s", dep.Identifier))
+				pc.addGenerated(generated, DependencyRuntime, pkgConfigDependency(dep), path)
 			}
 
 			for _, dep := range pkg.RequiresPrivate {
-				generated.Runtime = append(generated.Runtime, fmt.Sprintf("pc:%s", dep.Identifier))
+				pc.addGenerated(generated, DependencyRuntime, pkgConfigDependency(dep), path)
 			}
 
 			for _, dep := range pkg.RequiresInternal {
-				generated.Runtime = append(generated.Runtime, fmt.Sprintf("pc:%s", dep.Identifier))
+				pc.addGenerated(generated, DependencyRuntime, pkgConfigDependency(dep), path)
 			}
 		}
 
@@ -658,13 +761,13 @@ func removeSelfProvidedDeps(runtimeDeps, providedDeps []string) []string {
 	providedDepsMap := map[string]bool{}
 
 	for _, versionedDep := range providedDeps {
-		dep := strings.Split(versionedDep, "=")[0]
-		providedDepsMap[dep] = true
+		providedDepsMap[dependencyName(versionedDep)] = true
 	}
 
 	newRuntimeDeps := []string{}
 	for _, dep := range runtimeDeps {
-		_, ok := providedDepsMap[dep]
+		// Ignore any version constraint, like in pc:glib-2.0>=2.70.
+		_, ok := providedDepsMap[dependencyName(dep)]
 		if ok {
 			continue
 		}
@@ -675,19 +778,108 @@ func removeSelfProvidedDeps(runtimeDeps, providedDeps []string) []string {
 	return newRuntimeDeps
 }
 
+type dependencyGenerator struct {
+	Name             string
+	Generator        DependencyGenerator
+	EnabledByDefault bool
+}
+
+var (
+	dependencyGeneratorsMu sync.RWMutex
+	// dependencyGenerators are run in the order they were registered.
+	dependencyGenerators = []dependencyGenerator{
+		{Name: "shared-objects", Generator: generateSharedObjectNameDeps, EnabledByDefault: true},
+		{Name: "commands", Generator: generateCmdProviders, EnabledByDefault: true},
+		{Name: "shebangs", Generator: generateShebangDeps, EnabledByDefault: true},
+		{Name: "pkg-config", Generator: generatePkgConfigDeps, EnabledByDefault: true},
+		{Name: "python", Generator: generatePythonDeps},
+	}
+)
+
+// RegisterDependencyGenerator adds a dependency generator which packages can
+// turn on and off by name with options.dependency-generators.  Generators
+// which are not enabled by default only run for packages which enable them.
+func RegisterDependencyGenerator(name string, gen DependencyGenerator, enabledByDefault bool) error {
+	dependencyGeneratorsMu.Lock()
+	defer dependencyGeneratorsMu.Unlock()
+
+	for _, g := range dependencyGenerators {
+		if g.Name == name {
+			return fmt.Errorf("dependency generator %s is already registered", name)
+		}
+	}
+
+	dependencyGenerators = append(dependencyGenerators, dependencyGenerator{
+		Name:             name,
+		Generator:        gen,
+		EnabledByDefault: enabledByDefault,
+	})
+
+	return nil
+}
+
+// DependencyGenerators returns the names of the registered dependency
+// generators.
+func DependencyGenerators() []string {
+	dependencyGeneratorsMu.RLock()
+	defer dependencyGeneratorsMu.RUnlock()
+
+	names := []string{}
+	for _, g := range dependencyGenerators {
+		names = append(names, g.Name)
+	}
+
+	return names
+}
+
+// enabledDependencyGenerators returns the dependency generators selected by
+// the options of the package.
+func (pc *PackageBuild) enabledDependencyGenerators() ([]dependencyGenerator, error) {
+	dependencyGeneratorsMu.RLock()
+	defer dependencyGeneratorsMu.RUnlock()
+
+	known := map[string]bool{}
+	for _, g := range dependencyGenerators {
+		known[g.Name] = true
+	}
+
+	opts := pc.Options.DependencyGenerators
+	for _, name := range append(slices.Clone(opts.Enabled), opts.Disabled...) {
+		if !known[name] {
+			return nil, fmt.Errorf("dependency generator %s is unknown", name)
+		}
+	}
+
+	generators := []dependencyGenerator{}
+	for _, g := range dependencyGenerators {
+		enabled := g.EnabledByDefault || slices.Contains(opts.Enabled, g.Name)
+		if enabled && !slices.Contains(opts.Disabled, g.Name) {
+			generators = append(generators, g)
+		}
+	}
+
+	return generators, nil
+}
+
 func (pc *PackageBuild) GenerateDependencies() error {
 	generated := config.Dependencies{}
-	generators := []DependencyGenerator{
-		generateSharedObjectNameDeps,
-		generateCmdProviders,
-		generatePkgConfigDeps,
+	generators, err := pc.enabledDependencyGenerators()
+	if err != nil {
+		return err
 	}
 
-	for _, gen := range generators {
-		if err := gen(pc, &generated); err != nil {
+	pc.provenance = nil
+	pc.recordConfigured()
+
+	for _, g := range generators {
+		before := generated
+		pc.generator = g.Name
+		if err := g.Generator(pc, &generated); err != nil {
 			return err
 		}
+		pc.recordUnattributed(before, generated)
 	}
+	pc.generator = ""
 
 	// Only consider vendored deps for self-provided generated runtime deps.
 	// If a runtime dep is explicitly configured, assume we actually do need it.
@@ -707,6 +899,8 @@ func (pc *PackageBuild) GenerateDependencies() error {
 	pc.Dependencies.Vendored = generated.Vendored
 
 	pc.Dependencies.Summarize(pc.Logger)
+	pc.pruneProvenance()
+	pc.dependenciesGenerated = true
 
 	return nil
 }
@@ -721,7 +915,6 @@ func combine(out io.Writer, inputs ...io.Reader) error {
 	return nil
 }
 
-// TODO(kaniini): generate APKv3 packages
 func (pc *PackageBuild) calculateInstalledSize(fsys fs.FS) error {
 	if err := fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
@@ -780,7 +973,7 @@ func (pc *PackageBuild) emitDataSection(ctx context.Context, fsys fs.FS, w io.Wr
 }
 
 func (pc *PackageBuild) wantSignature() bool {
-	return pc.Build.SigningKey != ""
+	return pc.Build.SigningKey != "" || pc.Build.SigningHelper != "" || pc.Build.Keyless || len(pc.Build.ExtraSigningKeys) != 0
 }
 
 func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
@@ -795,8 +988,10 @@ func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
 	fsys := readlinkFS(pc.WorkspaceSubdir())
 
 	// generate so:/cmd: virtuals for the filesystem
-	if err := pc.GenerateDependencies(); err != nil {
-		return fmt.Errorf("unable to build final dependencies set: %w", err)
+	if !pc.dependenciesGenerated {
+		if err := pc.GenerateDependencies(); err != nil {
+			return fmt.Errorf("unable to build final dependencies set: %w", err)
+		}
 	}
 
 	// walk the filesystem to calculate the installed-size
@@ -806,6 +1001,30 @@ func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
 
 	pc.Logger.Printf("  installed-size: %d", pc.InstalledSize)
 
+	if pc.Build.emitsV2() {
+		if err := pc.emitPackageV2(ctx, fsys); err != nil {
+			return err
+		}
+	}
+
+	if pc.Build.emitsV3() {
+		if err := pc.emitPackageV3(ctx, fsys); err != nil {
+			return err
+		}
+	}
+
+	// add the package to the build log if requested
+	if err := pc.AppendBuildLog(""); err != nil {
+		pc.Logger.Warnf("unable to append package log: %s", err)
+	}
+
+	return nil
+}
+
+// emitPackageV2 writes the package as an APKv2 package: the signature, if a
+// signing key is set, and the control and data sections as concatenated
+// gzipped tarballs.
+func (pc *PackageBuild) emitPackageV2(ctx context.Context, fsys fs.FS) error {
 	// prepare data.tar.gz
 	dataTarGz, err := os.CreateTemp("", "melange-data-*.tar.gz")
 	if err != nil {
@@ -826,7 +1045,7 @@ func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
 	combinedParts := []io.Reader{bytes.NewReader(controlSectionData), dataTarGz}
 
 	if pc.wantSignature() {
-		signatureData, err := EmitSignature(ctx, pc.Signer(), controlSectionData, pc.Build.SourceDateEpoch)
+		signatureData, err := EmitSignatures(ctx, pc.Signers(), controlSectionData, pc.Build.SourceDateEpoch)
 		if err != nil {
 			return fmt.Errorf("emitting signature: %v", err)
 		}
@@ -851,23 +1070,49 @@ func (pc *PackageBuild) EmitPackage(ctx context.Context) error {
 
 	pc.Logger.Printf("wrote %s", outFile.Name())
 
-	// add the package to the build log if requested
-	if err := pc.AppendBuildLog(""); err != nil {
-		pc.Logger.Warnf("unable to append package log: %s", err)
-	}
-
 	return nil
 }
 
 func (pc *PackageBuild) Signer() ApkSigner {
+	return pc.Build.signer()
+}
+
+// Signers returns the signers of the package: its signer and the extra
+// signing keys.
+func (pc *PackageBuild) Signers() []ApkSigner {
+	return pc.Build.signers()
+}
+
+func (b *Build) signers() []ApkSigner {
+	signers := []ApkSigner{}
+	if b.SigningKey != "" || b.SigningHelper != "" || b.Keyless {
+		signers = append(signers, b.signer())
+	}
+	for _, key := range b.ExtraSigningKeys {
+		signers = append(signers, &KeyApkSigner{
+			KeyFile:       key,
+			KeyPassphrase: b.SigningPassphrase,
+			Algorithm:     b.SigningAlgorithm,
+		})
+	}
+	return signers
+}
+
+// signer returns the signer of the packages and index of the build: the
+// signing key if set, or else the signing helper, or else keyless signing.
+func (b *Build) signer() ApkSigner {
 	var signer ApkSigner
-	if pc.Build.SigningKey == "" {
-		signer = &FulcioApkSigner{}
-	} else {
+	switch {
+	case b.SigningKey != "":
 		signer = &KeyApkSigner{
-			KeyFile:       pc.Build.SigningKey,
-			KeyPassphrase: pc.Build.SigningPassphrase,
+			KeyFile:       b.SigningKey,
+			KeyPassphrase: b.SigningPassphrase,
+			Algorithm:     b.SigningAlgorithm,
 		}
+	case b.SigningHelper != "":
+		signer = &HelperApkSigner{Path: b.SigningHelper, Algorithm: b.SigningAlgorithm, Timeout: b.SigningHelperTimeout}
+	default:
+		signer = b.keylessSigner()
 	}
 	return signer
 }
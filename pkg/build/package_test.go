@@ -16,10 +16,17 @@ package build
 
 import (
 	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	apko_log "chainguard.dev/apko/pkg/log"
+
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/index"
 
 	"github.com/stretchr/testify/require"
 )
@@ -141,3 +148,239 @@ datahash = baadf00d
 		})
 	}
 }
+
+func Test_GenerateDependencies_Python(t *testing.T) {
+	pkgctx, err := NewPackageContext(&config.Package{Name: "py3-foo", Version: "1.2.3"})
+	require.NoError(t, err)
+
+	workspace := t.TempDir()
+	files := map[string]string{
+		"usr/lib/python3.11/site-packages/Foo_Bar-1.2.3.dist-info/METADATA": `Metadata-Version: 2.1
+Name: Foo_Bar
+Version: 1.2.3
+Requires-Dist: requests (>=2.0)
+Requires-Dist: typing.extensions>=4; python_version < "3.8"
+Requires-Dist: pysocks!=1.5.7,>=1.5.6; extra == "socks"
+Requires-Dist: Foo-Bar-Core[cli]<2
+
+Foo Bar does things.
+`,
+		"usr/lib/python3/dist-packages/baz-0.1.dist-info/METADATA": "Name: baz\nVersion: 0.1\nRequires-Dist: foo.bar\n",
+		"usr/lib/python3/dist-packages/baz-0.1.dist-info/RECORD":   "baz/__init__.py,,\nbaz/__pycache__/__init__.cpython-312.pyc,,\n",
+
+		// PEP 440 versions are converted to apk versions, or dropped.
+		"usr/lib/python3.11/site-packages/qux-2.0rc1.dist-info/METADATA": "Name: qux\nVersion: 2.0rc1\n",
+		"usr/lib/python3.11/site-packages/quux-2.0.dist-info/METADATA":   "Name: quux\nVersion: 1!2.0\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(workspace, "melange-out", "py3-foo", name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	}
+
+	pb := &PackageBuild{
+		Build:       &Build{WorkspaceDir: workspace},
+		Origin:      pkgctx,
+		PackageName: "py3-foo",
+		Logger:      &apko_log.Adapter{Out: io.Discard, Level: apko_log.InfoLevel},
+	}
+
+	// The python generator is not enabled by default.
+	require.NoError(t, pb.GenerateDependencies())
+	require.Empty(t, pb.Dependencies.Provides)
+
+	pb.Options.DependencyGenerators.Enabled = []string{"python"}
+	require.NoError(t, pb.GenerateDependencies())
+	require.Equal(t, []string{"py3.11:foo-bar=1.2.3", "py3.11:quux", "py3.11:qux=2.0_rc1", "py3.12:baz=0.1"}, pb.Dependencies.Provides)
+	require.Equal(t, []string{"py3.11:foo-bar-core", "py3.11:requests", "py3.12:foo-bar"}, pb.Dependencies.Runtime)
+
+	pb.Options.DependencyGenerators.Disabled = []string{"pip"}
+	require.ErrorContains(t, pb.GenerateDependencies(), "dependency generator pip is unknown")
+}
+
+func Test_apkPythonVersion(t *testing.T) {
+	for _, tt := range []struct {
+		version string
+		want    string
+		err     string
+	}{
+		{version: "1.2.3", want: "1.2.3"},
+		{version: "v1.0", want: "1.0"},
+		{version: "0!1.0", want: "1.0"},
+		{version: "1.0a1", want: "1.0_alpha1"},
+		{version: "1.0.alpha.2", want: "1.0_alpha2"},
+		{version: "1.0b", want: "1.0_beta0"},
+		{version: "1.0rc1", want: "1.0_rc1"},
+		{version: "1.0c1", want: "1.0_rc1"},
+		{version: "1.0-preview2", want: "1.0_rc2"},
+		{version: "2.0.post1", want: "2.0_p1"},
+		{version: "2.0post", want: "2.0_p0"},
+		{version: "2.0-3", want: "2.0_p3"},
+		{version: "2.0.rev4", want: "2.0_p4"},
+		{version: "3.0.dev2", want: "3.0_pre2"},
+		{version: "3.0.dev", want: "3.0_pre0"},
+		{version: "1.0rc1.post2.dev3", want: "1.0_rc1_p2_pre3"},
+		{version: "1.0RC1", want: "1.0_rc1"},
+		{version: "1!2.0", err: "epoch 1 cannot be expressed"},
+		{version: "2.0+cpu", err: "local version cpu cannot be expressed"},
+		{version: "2.0-beta-final", err: "not a PEP 440 version"},
+		{version: "latest", err: "not a PEP 440 version"},
+	} {
+		got, err := apkPythonVersion(tt.version)
+		if tt.err != "" {
+			require.ErrorContains(t, err, tt.err, tt.version)
+			continue
+		}
+		require.NoError(t, err, tt.version)
+		require.Equal(t, tt.want, got, tt.version)
+	}
+
+	// The converted versions sort the way PEP 440 orders them.
+	ordered := []string{"1.0a1.dev1", "1.0a1", "1.0b2", "1.0rc1.dev1", "1.0rc1", "1.0", "1.0.post1.dev1", "1.0.post1", "1.1.dev1", "1.1"}
+	for i := 1; i < len(ordered); i++ {
+		a, err := apkPythonVersion(ordered[i-1])
+		require.NoError(t, err)
+		b, err := apkPythonVersion(ordered[i])
+		require.NoError(t, err)
+		require.Equal(t, -1, index.CompareVersions(a, b), "%s (%s) < %s (%s)", ordered[i-1], a, ordered[i], b)
+	}
+}
+
+func Test_RegisterDependencyGenerator(t *testing.T) {
+	gen := func(_ *PackageBuild, generated *config.Dependencies) error {
+		generated.Provides = append(generated.Provides, "test:registered=1")
+		return nil
+	}
+	require.NoError(t, RegisterDependencyGenerator("test-registered", gen, false))
+	require.Error(t, RegisterDependencyGenerator("test-registered", gen, false))
+	require.Contains(t, DependencyGenerators(), "test-registered")
+
+	pkgctx, err := NewPackageContext(&config.Package{Name: "foo", Version: "1.0"})
+	require.NoError(t, err)
+
+	pb := &PackageBuild{
+		Build:       &Build{WorkspaceDir: t.TempDir()},
+		Origin:      pkgctx,
+		PackageName: "foo",
+		Logger:      &apko_log.Adapter{Out: io.Discard, Level: apko_log.InfoLevel},
+		Options: config.PackageOption{DependencyGenerators: config.DependencyGenerators{
+			Enabled:  []string{"test-registered"},
+			Disabled: []string{"shared-objects", "commands", "shebangs", "pkg-config"},
+		}},
+	}
+	require.NoError(t, os.MkdirAll(pb.WorkspaceSubdir(), 0755))
+	require.NoError(t, pb.GenerateDependencies())
+	require.Equal(t, []string{"test:registered=1"}, pb.Dependencies.Provides)
+}
+
+func Test_shebangInterpreter(t *testing.T) {
+	for script, want := range map[string]string{
+		"#!/bin/sh\necho hello\n":                     "sh",
+		"#! /usr/bin/python3 -u\n":                    "python3",
+		"#!/usr/bin/env perl\n":                       "perl",
+		"#!/usr/bin/env -S PYTHONPATH=/opt python3\n": "python3",
+		"#!/usr/bin/env\n":                            "",
+		"echo hello\n":                                "",
+		"\x7fELF\x02\x01\x01":                         "",
+	} {
+		require.Equal(t, want, shebangInterpreter(strings.NewReader(script)), script)
+	}
+}
+
+func Test_GenerateDependencies_Shebangs(t *testing.T) {
+	pkgctx, err := NewPackageContext(&config.Package{Name: "foo", Version: "1.0"})
+	require.NoError(t, err)
+
+	workspace := t.TempDir()
+	files := map[string]string{
+		"usr/bin/foo":          "#!/usr/bin/env foo-helper\n",
+		"usr/bin/foo-helper":   "#!/usr/bin/python3\n",
+		"usr/libexec/foo/hook": "#!/bin/sh\n",
+		"usr/share/foo/tmpl":   "#!/usr/bin/perl\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(workspace, "melange-out", "foo", name)
+		mode := os.FileMode(0755)
+		if strings.HasPrefix(name, "usr/share/") {
+			mode = 0644
+		}
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), mode))
+	}
+
+	pb := &PackageBuild{
+		Build:       &Build{WorkspaceDir: workspace},
+		Origin:      pkgctx,
+		PackageName: "foo",
+		Logger:      &apko_log.Adapter{Out: io.Discard, Level: apko_log.InfoLevel},
+	}
+
+	// foo-helper is provided by the package itself, and the template is not
+	// executable.
+	require.NoError(t, pb.GenerateDependencies())
+	require.Equal(t, []string{"cmd:python3", "cmd:sh"}, pb.Dependencies.Runtime)
+
+	pb.Dependencies = config.Dependencies{}
+	pb.Options.NoDepends = true
+	require.NoError(t, pb.GenerateDependencies())
+	require.Empty(t, pb.Dependencies.Runtime)
+}
+
+func Test_GenerateDependencies_PkgConfig(t *testing.T) {
+	pkgctx, err := NewPackageContext(&config.Package{Name: "foo", Version: "1.0"})
+	require.NoError(t, err)
+
+	workspace := t.TempDir()
+	files := map[string]string{
+		"usr/lib/pkgconfig/foo.pc": `prefix=/usr
+libdir=${prefix}/lib
+
+Name: foo
+Description: The foo library
+Version: 1.0.0
+Requires: glib-2.0 >= 2.70, gobject-2.0, foo-core = 1.0.0
+Requires.private: zlib > 1.2.11-rc1, libffi <= 3.5
+Libs: -L${libdir} -lfoo
+`,
+		"usr/lib/pkgconfig/foo-core.pc": `Name: foo-core
+Description: The core of the foo library
+Version: 1.0.0
+`,
+	}
+	for name, content := range files {
+		p := filepath.Join(workspace, "melange-out", "foo-dev", name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	}
+
+	pb := &PackageBuild{
+		Build:       &Build{WorkspaceDir: workspace},
+		Origin:      pkgctx,
+		PackageName: "foo-dev",
+		Logger:      &apko_log.Adapter{Out: io.Discard, Level: apko_log.InfoLevel},
+	}
+
+	// Runtime dependencies are only generated when enabled.
+	require.NoError(t, pb.GenerateDependencies())
+	require.Equal(t, []string{"pc:foo-core=1.0.0", "pc:foo=1.0.0"}, pb.Dependencies.Provides)
+	require.Empty(t, pb.Dependencies.Runtime)
+
+	pb.Dependencies = config.Dependencies{}
+	pb.Options.PkgConfigDepends = true
+	require.NoError(t, pb.GenerateDependencies())
+	require.Equal(t, []string{
+		"pc:glib-2.0>=2.70",
+		"pc:gobject-2.0",
+		"pc:libffi<=3.5",
+		"pc:zlib>1.2.11_rc1",
+	}, pb.Dependencies.Runtime)
+}
+
+func Test_removeSelfProvidedDeps_WithConstraints(t *testing.T) {
+	provides := []string{"pc:glib-2.0=2.78", "cmd:foo"}
+	depends := []string{"pc:glib-2.0>=2.70", "cmd:foo@local", "so:libbaz.so.4"}
+
+	final := removeSelfProvidedDeps(depends, provides)
+
+	require.Equal(t, []string{"so:libbaz.so.4"}, final)
+}
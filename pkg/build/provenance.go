@@ -0,0 +1,191 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+// The kinds of dependency recorded in a dependency log.
+const (
+	DependencyRuntime  = "runtime"
+	DependencyProvides = "provides"
+	DependencyVendored = "vendored"
+)
+
+// ConfiguredDependency is the generator recorded for dependencies which are
+// set in the configuration file rather than generated.
+const ConfiguredDependency = "configuration"
+
+// DependencyProvenance records why a dependency was added to a package.
+type DependencyProvenance struct {
+	// Kind is one of runtime, provides or vendored.
+	Kind       string `json:"kind"`
+	Dependency string `json:"dependency"`
+	// File is the file in the package which caused the dependency, if known.
+	File string `json:"file,omitempty"`
+	// Generator is the name of the dependency generator which added the
+	// dependency, or "configuration".
+	Generator string `json:"generator"`
+}
+
+// PackageDependencyLog is the dependency log of a single package.
+type PackageDependencyLog struct {
+	Version      string                 `json:"version"`
+	Dependencies []DependencyProvenance `json:"dependencies"`
+}
+
+// DependencyLog is written by --dependency-log for every architecture, and
+// records the provenance of the dependencies of each package of the build.
+type DependencyLog struct {
+	Arch     string                          `json:"arch"`
+	Packages map[string]PackageDependencyLog `json:"packages"`
+}
+
+// ReadDependencyLog reads a dependency log written by a build.
+func ReadDependencyLog(path string) (*DependencyLog, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var depLog DependencyLog
+	if err := json.Unmarshal(data, &depLog); err != nil {
+		return nil, fmt.Errorf("parsing dependency log %s: %w", path, err)
+	}
+
+	return &depLog, nil
+}
+
+// Why returns the records of the package's dependencies which match dep,
+// either exactly or by name, ignoring version constraints.
+func (l PackageDependencyLog) Why(dep string) []DependencyProvenance {
+	matches := []DependencyProvenance{}
+	for _, p := range l.Dependencies {
+		if p.Dependency == dep || dependencyName(p.Dependency) == dependencyName(dep) {
+			matches = append(matches, p)
+		}
+	}
+	return matches
+}
+
+// addGenerated adds a generated dependency of the given kind, recording the
+// file which caused it.  Dependency generators should use it rather than
+// appending to generated directly, so that the dependency log can explain
+// where the dependency came from.
+func (pc *PackageBuild) addGenerated(generated *config.Dependencies, kind, dep, file string) {
+	switch kind {
+	case DependencyRuntime:
+		generated.Runtime = append(generated.Runtime, dep)
+	case DependencyProvides:
+		generated.Provides = append(generated.Provides, dep)
+	case DependencyVendored:
+		generated.Vendored = append(generated.Vendored, dep)
+	}
+
+	pc.provenance = append(pc.provenance, DependencyProvenance{
+		Kind:       kind,
+		Dependency: dep,
+		File:       file,
+		Generator:  pc.generator,
+	})
+}
+
+// recordConfigured records the dependencies set in the configuration.
+func (pc *PackageBuild) recordConfigured() {
+	for _, dep := range pc.Dependencies.Runtime {
+		pc.provenance = append(pc.provenance, DependencyProvenance{Kind: DependencyRuntime, Dependency: dep, Generator: ConfiguredDependency})
+	}
+	for _, dep := range pc.Dependencies.Provides {
+		pc.provenance = append(pc.provenance, DependencyProvenance{Kind: DependencyProvides, Dependency: dep, Generator: ConfiguredDependency})
+	}
+}
+
+// recordUnattributed records the dependencies which a generator appended to
+// generated directly, without a file, so that every generated dependency is
+// in the log.
+func (pc *PackageBuild) recordUnattributed(before, after config.Dependencies) {
+	for _, l := range []struct {
+		kind          string
+		before, after []string
+	}{
+		{DependencyRuntime, before.Runtime, after.Runtime},
+		{DependencyProvides, before.Provides, after.Provides},
+		{DependencyVendored, before.Vendored, after.Vendored},
+	} {
+		if len(l.after) < len(l.before) {
+			continue
+		}
+		for _, dep := range l.after[len(l.before):] {
+			recorded := slices.ContainsFunc(pc.provenance, func(p DependencyProvenance) bool {
+				return p.Kind == l.kind && p.Dependency == dep && p.Generator == pc.generator
+			})
+			if !recorded {
+				pc.provenance = append(pc.provenance, DependencyProvenance{Kind: l.kind, Dependency: dep, Generator: pc.generator})
+			}
+		}
+	}
+}
+
+// pruneProvenance drops the records of dependencies which did not make it
+// into the final set, such as those provided by the package itself, and
+// duplicate records.
+func (pc *PackageBuild) pruneProvenance() {
+	final := map[string][]string{
+		DependencyRuntime:  pc.Dependencies.Runtime,
+		DependencyProvides: pc.Dependencies.Provides,
+		DependencyVendored: pc.Dependencies.Vendored,
+	}
+
+	pruned := []DependencyProvenance{}
+	for _, p := range pc.provenance {
+		if slices.Contains(final[p.Kind], p.Dependency) && !slices.Contains(pruned, p) {
+			pruned = append(pruned, p)
+		}
+	}
+
+	pc.provenance = pruned
+}
+
+// writeDependencyLog writes the provenance of the dependencies of the
+// packages to the dependency log for the architecture being built.
+func (b *Build) writeDependencyLog(pkgs []*PackageBuild) error {
+	depLog := DependencyLog{
+		Arch:     b.Arch.ToAPK(),
+		Packages: map[string]PackageDependencyLog{},
+	}
+
+	for _, pc := range pkgs {
+		depLog.Packages[pc.PackageName] = PackageDependencyLog{
+			Version:      fmt.Sprintf("%s-r%d", pc.Origin.Package.Version, pc.Origin.Package.Epoch),
+			Dependencies: pc.provenance,
+		}
+	}
+
+	f, err := os.Create(fmt.Sprintf("%s.%s", b.DependencyLog, b.Arch.ToAPK()))
+	if err != nil {
+		return fmt.Errorf("creating dependency log: %w", err)
+	}
+	defer f.Close()
+
+	enc := json.NewEncoder(f)
+	enc.SetIndent("", "  ")
+	return enc.Encode(depLog)
+}
@@ -0,0 +1,80 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	apko_log "chainguard.dev/apko/pkg/log"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestDependencyLog(t *testing.T) {
+	pkgctx, err := NewPackageContext(&config.Package{Name: "foo", Version: "1.0", Epoch: 2})
+	require.NoError(t, err)
+
+	workspace := t.TempDir()
+	files := map[string]string{
+		"usr/bin/foo":        "#!/usr/bin/env foo-helper\n",
+		"usr/bin/foo-helper": "#!/bin/sh\n",
+	}
+	for name, content := range files {
+		p := filepath.Join(workspace, "melange-out", "foo", name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0755))
+	}
+
+	b := &Build{
+		WorkspaceDir:  workspace,
+		Arch:          apko_types.ParseArchitecture("x86_64"),
+		DependencyLog: filepath.Join(t.TempDir(), "deps.json"),
+	}
+	pb := &PackageBuild{
+		Build:        b,
+		Origin:       pkgctx,
+		PackageName:  "foo",
+		Logger:       &apko_log.Adapter{Out: io.Discard, Level: apko_log.InfoLevel},
+		Dependencies: config.Dependencies{Runtime: []string{"bar"}},
+	}
+
+	require.NoError(t, pb.GenerateDependencies())
+
+	// cmd:foo-helper is provided by the package itself, so it is not logged.
+	require.Equal(t, []DependencyProvenance{
+		{Kind: DependencyRuntime, Dependency: "bar", Generator: ConfiguredDependency},
+		{Kind: DependencyProvides, Dependency: "cmd:foo=1.0-r2", File: "usr/bin/foo", Generator: "commands"},
+		{Kind: DependencyProvides, Dependency: "cmd:foo-helper=1.0-r2", File: "usr/bin/foo-helper", Generator: "commands"},
+		{Kind: DependencyRuntime, Dependency: "cmd:sh", File: "usr/bin/foo-helper", Generator: "shebangs"},
+	}, pb.provenance)
+
+	require.NoError(t, b.writeDependencyLog([]*PackageBuild{pb}))
+
+	depLog, err := ReadDependencyLog(b.DependencyLog + ".x86_64")
+	require.NoError(t, err)
+	require.Equal(t, "x86_64", depLog.Arch)
+	require.Equal(t, "1.0-r2", depLog.Packages["foo"].Version)
+
+	require.Equal(t, []DependencyProvenance{
+		{Kind: DependencyRuntime, Dependency: "cmd:sh", File: "usr/bin/foo-helper", Generator: "shebangs"},
+	}, depLog.Packages["foo"].Why("cmd:sh"))
+	require.Len(t, depLog.Packages["foo"].Why("cmd:foo>=1.0"), 1)
+	require.Empty(t, depLog.Packages["foo"].Why("so:libfoo.so.1"))
+}
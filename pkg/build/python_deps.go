@@ -0,0 +1,206 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/mail"
+	"path"
+	"regexp"
+	"strings"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+var (
+	// pythonDistInfoRegexp matches the METADATA of an installed distribution,
+	// capturing the minor version of Python from the site-packages path.
+	pythonDistInfoRegexp = regexp.MustCompile(`^(?:usr/)?lib(?:64)?/python3(?:\.(\d+))?/(?:site|dist)-packages/[^/]+\.dist-info/METADATA$`)
+
+	// pythonBytecodeRegexp matches the bytecode files listed in a RECORD,
+	// capturing the minor version of Python they were compiled for.
+	pythonBytecodeRegexp = regexp.MustCompile(`\.cpython-3(\d+)[^/]*\.(?:pyc|so)$`)
+
+	pythonRequirementRegexp = regexp.MustCompile(`^\s*([A-Za-z0-9](?:[A-Za-z0-9._-]*[A-Za-z0-9])?)`)
+	pythonNameSeparators    = regexp.MustCompile(`[-_.]+`)
+
+	// pythonVersionRegexp matches PEP 440 versions, in any of the spellings
+	// PEP 440 normalizes.
+	pythonVersionRegexp = regexp.MustCompile(`^v?(?:(?P<epoch>[0-9]+)!)?(?P<release>[0-9]+(?:\.[0-9]+)*)` +
+		`(?:[-_.]?(?P<pre>a|alpha|b|beta|c|rc|pre|preview)[-_.]?(?P<preN>[0-9]*))?` +
+		`(?:-(?P<postImplicitN>[0-9]+)|[-_.]?(?P<post>post|rev|r)[-_.]?(?P<postN>[0-9]*))?` +
+		`(?:[-_.]?(?P<dev>dev)[-_.]?(?P<devN>[0-9]*))?` +
+		`(?:\+(?P<local>[a-z0-9]+(?:[-_.][a-z0-9]+)*))?$`)
+
+	// pythonPreReleases maps the PEP 440 pre-release spellings to the apk
+	// version suffixes.
+	pythonPreReleases = map[string]string{
+		"a":       "alpha",
+		"alpha":   "alpha",
+		"b":       "beta",
+		"beta":    "beta",
+		"c":       "rc",
+		"rc":      "rc",
+		"pre":     "rc",
+		"preview": "rc",
+	}
+)
+
+// apkPythonVersion converts a PEP 440 version to an apk version which sorts
+// the same way: pre-releases become _alpha, _beta or _rc suffixes,
+// post-releases _p suffixes and development releases _pre suffixes, which
+// sort before the release they lead to, but after its alpha and beta
+// releases, as apk has no suffix sorting before _alpha.  Versions with an
+// epoch or a local version cannot be expressed as apk versions.
+func apkPythonVersion(version string) (string, error) {
+	m := pythonVersionRegexp.FindStringSubmatch(strings.ToLower(strings.TrimSpace(version)))
+	if m == nil {
+		return "", errors.New("not a PEP 440 version")
+	}
+	group := func(name string) string {
+		return m[pythonVersionRegexp.SubexpIndex(name)]
+	}
+	// The numbers of the suffixes are optional, and default to 0.
+	number := func(name string) string {
+		if n := group(name); n != "" {
+			return n
+		}
+		return "0"
+	}
+
+	if epoch := group("epoch"); strings.Trim(epoch, "0") != "" {
+		return "", fmt.Errorf("epoch %s cannot be expressed in an apk version", epoch)
+	}
+	if local := group("local"); local != "" {
+		return "", fmt.Errorf("local version %s cannot be expressed in an apk version", local)
+	}
+
+	v := group("release")
+	if pre := group("pre"); pre != "" {
+		v += "_" + pythonPreReleases[pre] + number("preN")
+	}
+	if n := group("postImplicitN"); n != "" {
+		v += "_p" + n
+	} else if group("post") != "" {
+		v += "_p" + number("postN")
+	}
+	if group("dev") != "" {
+		v += "_pre" + number("devN")
+	}
+
+	return v, nil
+}
+
+// normalizePythonName normalizes a distribution name as described in PEP 503.
+func normalizePythonName(name string) string {
+	return strings.ToLower(pythonNameSeparators.ReplaceAllString(name, "-"))
+}
+
+// pythonVersionFromRecord returns the minor version of Python the files in a
+// RECORD were compiled for, or an empty string if there are none.
+func pythonVersionFromRecord(fsys fs.FS, distInfo string) string {
+	f, err := fsys.Open(path.Join(distInfo, "RECORD"))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		file, _, _ := strings.Cut(s.Text(), ",")
+		if m := pythonBytecodeRegexp.FindStringSubmatch(file); m != nil {
+			return m[1]
+		}
+	}
+
+	return ""
+}
+
+// generatePythonDeps generates py3.X:<name> provides for the Python
+// distributions installed by the package, and runtime dependencies for their
+// unconditional requirements.  Requirements guarded by an environment marker,
+// such as those of extras, are skipped as they cannot be evaluated here.
+func generatePythonDeps(pc *PackageBuild, generated *config.Dependencies) error {
+	pc.Logger.Printf("scanning for python distributions...")
+
+	fsys := readlinkFS(pc.WorkspaceSubdir())
+	return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		m := pythonDistInfoRegexp.FindStringSubmatch(p)
+		if m == nil || !d.Type().IsRegular() {
+			return nil
+		}
+
+		distInfo := path.Dir(p)
+		minor := m[1]
+		if minor == "" {
+			minor = pythonVersionFromRecord(fsys, distInfo)
+		}
+		if minor == "" {
+			pc.Logger.Warnf("unable to determine the python version of %s", distInfo)
+			return nil
+		}
+
+		f, err := fsys.Open(p)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		msg, err := mail.ReadMessage(bufio.NewReader(f))
+		if err != nil {
+			pc.Logger.Warnf("unable to parse %s: %v", p, err)
+			return nil
+		}
+
+		name := msg.Header.Get("Name")
+		version := msg.Header.Get("Version")
+		if name == "" || version == "" {
+			pc.Logger.Warnf("%s does not declare a name and version", p)
+			return nil
+		}
+
+		prefix := fmt.Sprintf("py3.%s:", minor)
+		if !pc.Options.NoProvides {
+			provide := prefix + normalizePythonName(name)
+			if apkVersion, err := apkPythonVersion(version); err != nil {
+				pc.Logger.Warnf("%s: providing %s without a version, as version %s is not usable: %v", p, provide, version, err)
+			} else {
+				provide += "=" + apkVersion
+			}
+			pc.addGenerated(generated, DependencyProvides, provide, p)
+		}
+
+		if !pc.Options.NoDepends {
+			for _, req := range msg.Header["Requires-Dist"] {
+				if strings.Contains(req, ";") {
+					continue
+				}
+
+				if rm := pythonRequirementRegexp.FindStringSubmatch(req); rm != nil {
+					pc.addGenerated(generated, DependencyRuntime, prefix+normalizePythonName(rm[1]), p)
+				}
+			}
+		}
+
+		return nil
+	})
+}
@@ -0,0 +1,163 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/apkdiff"
+)
+
+// verifyReproducible builds the package a second time in a fresh workspace,
+// using the same SOURCE_DATE_EPOCH, and compares the contents of the resulting
+// apks with the ones emitted by the first build.
+func (b *Build) verifyReproducible(ctx context.Context) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "verifyReproducible")
+	defer span.End()
+
+	workspaceDir, err := os.MkdirTemp(b.Runner.TempDir(), "melange-workspace-*")
+	if err != nil {
+		return fmt.Errorf("unable to create workspace dir: %w", err)
+	}
+	defer os.RemoveAll(workspaceDir)
+
+	outDir, err := os.MkdirTemp("", "melange-reproducible-*")
+	if err != nil {
+		return fmt.Errorf("unable to create output dir: %w", err)
+	}
+	defer os.RemoveAll(outDir)
+
+	rb := *b
+	rb.WorkspaceDir = workspaceDir
+	rb.GuestDir = ""
+	rb.OutDir = outDir
+	rb.GenerateIndex = false
+	rb.CreateBuildLog = false
+	rb.DependencyLog = ""
+	rb.VerifyReproducible = false
+	rb.containerConfig = nil
+	rb.imgRef = ""
+	rb.ignorePatterns = nil
+
+	b.Logger.Printf("rebuilding package in %s to verify reproducibility", workspaceDir)
+	if err := rb.BuildPackage(ctx); err != nil {
+		return fmt.Errorf("unable to rebuild package: %w", err)
+	}
+
+	arch := b.Arch.ToAPK()
+	built, err := b.emittedPackages(filepath.Join(b.OutDir, arch))
+	if err != nil {
+		return err
+	}
+	rebuilt, err := b.emittedPackages(filepath.Join(outDir, arch))
+	if err != nil {
+		return err
+	}
+
+	// A package emitted by only one of the builds, such as a conditional
+	// subpackage, makes the build unreproducible.
+	if missing := packageSetDiff(built, rebuilt); len(missing) != 0 {
+		for _, m := range missing {
+			b.Logger.Warnf("  %s", m)
+		}
+		return fmt.Errorf("%d packages were emitted by only one of the builds", len(missing))
+	}
+
+	unreproducible := 0
+	for _, name := range rebuilt {
+		first := filepath.Join(b.OutDir, arch, name)
+		second := filepath.Join(outDir, arch, name)
+
+		// The signatures are not compared: the rebuild is signed by the same
+		// signer, but keyless and signing helper signatures can differ for
+		// the same contents.  The control section they sign is compared.
+		diffs, err := apkdiff.CompareFiles(ctx, first, second, apkdiff.ContentSections...)
+		if err != nil {
+			return fmt.Errorf("unable to compare %s: %w", name, err)
+		}
+
+		if len(diffs) == 0 {
+			b.Logger.Printf("  %s: reproducible", name)
+			continue
+		}
+
+		unreproducible++
+		for _, d := range diffs {
+			b.Logger.Warnf("  %s: %s", name, d)
+		}
+	}
+
+	if unreproducible != 0 {
+		return fmt.Errorf("%d of %d packages differ between builds", unreproducible, len(rebuilt))
+	}
+
+	return nil
+}
+
+// emittedPackages returns the file names of the packages of the configuration,
+// the package and its subpackages, which are in the directory.  Other files in
+// the directory, such as packages from other builds, are ignored.
+func (b *Build) emittedPackages(dir string) ([]string, error) {
+	names := []string{b.Configuration.Package.Name}
+	for _, sp := range b.Configuration.Subpackages {
+		names = append(names, sp.Name)
+	}
+
+	emitted := []string{}
+	for _, name := range names {
+		file := fmt.Sprintf("%s-%s-r%d.apk", name, b.Configuration.Package.Version, b.Configuration.Package.Epoch)
+		if _, err := os.Stat(filepath.Join(dir, file)); errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		emitted = append(emitted, file)
+	}
+
+	return emitted, nil
+}
+
+// packageSetDiff describes the packages which are in only one of the first
+// and the second build.
+func packageSetDiff(first, second []string) []string {
+	inFirst := map[string]bool{}
+	for _, f := range first {
+		inFirst[f] = true
+	}
+	inSecond := map[string]bool{}
+	for _, s := range second {
+		inSecond[s] = true
+	}
+
+	diffs := []string{}
+	for _, f := range first {
+		if !inSecond[f] {
+			diffs = append(diffs, fmt.Sprintf("%s: missing from the rebuild", f))
+		}
+	}
+	for _, s := range second {
+		if !inFirst[s] {
+			diffs = append(diffs, fmt.Sprintf("%s: only emitted by the rebuild", s))
+		}
+	}
+
+	return diffs
+}
@@ -0,0 +1,49 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+)
+
+func TestEmittedPackages(t *testing.T) {
+	b := &Build{Configuration: config.Configuration{
+		Package:     config.Package{Name: "hello", Version: "1.0", Epoch: 2},
+		Subpackages: []config.Subpackage{{Name: "hello-doc"}, {Name: "hello-dev"}},
+	}}
+
+	dir := t.TempDir()
+	for _, f := range []string{"hello-1.0-r2.apk", "hello-dev-1.0-r2.apk", "other-1.0-r0.apk"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, f), nil, 0o644))
+	}
+
+	emitted, err := b.emittedPackages(dir)
+	require.NoError(t, err)
+	require.Equal(t, []string{"hello-1.0-r2.apk", "hello-dev-1.0-r2.apk"}, emitted)
+}
+
+func TestPackageSetDiff(t *testing.T) {
+	require.Empty(t, packageSetDiff([]string{"a.apk", "b.apk"}, []string{"b.apk", "a.apk"}))
+	require.Equal(t, []string{
+		"b.apk: missing from the rebuild",
+		"c.apk: only emitted by the rebuild",
+	}, packageSetDiff([]string{"a.apk", "b.apk"}, []string{"a.apk", "c.apk"}))
+}
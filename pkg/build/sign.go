@@ -4,6 +4,9 @@ import (
 	"archive/tar"
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/sha256"
 	"fmt"
@@ -14,6 +17,9 @@ import (
 	sign "github.com/chainguard-dev/go-apk/pkg/signature"
 	"github.com/klauspost/compress/gzip"
 	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/adb"
+	"chainguard.dev/melange/pkg/index"
 )
 
 type ApkSigner interface {
@@ -22,37 +28,55 @@ type ApkSigner interface {
 	SignatureName() string
 }
 
+// The digest algorithms of RSA signatures.  SHA-1 signatures are named
+// .SIGN.RSA.<key>.pub and are understood by all versions of apk-tools, SHA-256
+// signatures are named .SIGN.RSA256.<key>.pub.
+const (
+	SignatureSHA1   = "sha1"
+	SignatureSHA256 = "sha256"
+)
+
 func EmitSignature(ctx context.Context, signer ApkSigner, controlData []byte, sde time.Time) ([]byte, error) {
+	return EmitSignatures(ctx, []ApkSigner{signer}, controlData, sde)
+}
+
+// EmitSignatures returns the signature tarball holding the signatures of each
+// of the signers.  apk-tools accepts a package or index with any of the
+// signatures made by a trusted key, which allows rotating keys by signing
+// with both the old and new keys.
+func EmitSignatures(ctx context.Context, signers []ApkSigner, controlData []byte, sde time.Time) ([]byte, error) {
 	_, span := otel.Tracer("melange").Start(ctx, "EmitSignature")
 	defer span.End()
 
-	sig, err := signer.Sign(controlData)
-	if err != nil {
-		return nil, err
-	}
-
 	var sigbuf bytes.Buffer
 
 	zw := gzip.NewWriter(&sigbuf)
 	tw := tar.NewWriter(zw)
 
-	// The signature tarball only contains a single file
-	if err := tw.WriteHeader(&tar.Header{
-		Name:     signer.SignatureName(),
-		Typeflag: tar.TypeReg,
-		Size:     int64(len(sig)),
-		Mode:     int64(os.ModePerm),
-		Uid:      0,
-		Gid:      0,
-		Uname:    "root",
-		Gname:    "root",
-		ModTime:  sde,
-	}); err != nil {
-		return nil, err
-	}
-
-	if _, err := tw.Write(sig); err != nil {
-		return nil, err
+	// The signature tarball only contains the signature files
+	for _, signer := range signers {
+		sig, err := signer.Sign(controlData)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := tw.WriteHeader(&tar.Header{
+			Name:     signer.SignatureName(),
+			Typeflag: tar.TypeReg,
+			Size:     int64(len(sig)),
+			Mode:     int64(os.ModePerm),
+			Uid:      0,
+			Gid:      0,
+			Uname:    "root",
+			Gname:    "root",
+			ModTime:  sde,
+		}); err != nil {
+			return nil, err
+		}
+
+		if _, err := tw.Write(sig); err != nil {
+			return nil, err
+		}
 	}
 
 	// Don't Close(), we don't want to include the end-of-archive markers since this signature gets prepended to other tarballs
@@ -67,13 +91,25 @@ func EmitSignature(ctx context.Context, signer ApkSigner, controlData []byte, sd
 	return sigbuf.Bytes(), nil
 }
 
-// Key base signature (normal) uses a SHA-1 hash on the control digest.
+// Key base signature (normal) uses a SHA-1 hash on the control digest, or a
+// SHA-256 hash if the algorithm is SignatureSHA256.
 type KeyApkSigner struct {
 	KeyFile       string
 	KeyPassphrase string
+	Algorithm     string
 }
 
 func (s KeyApkSigner) Sign(control []byte) ([]byte, error) {
+	if s.Algorithm == SignatureSHA256 {
+		key, err := adb.LoadPrivateKey(s.KeyFile, s.KeyPassphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		digest := sha256.Sum256(control)
+		return rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	}
+
 	digest := sha1.New()
 
 	_, err := digest.Write(control)
@@ -85,28 +121,33 @@ func (s KeyApkSigner) Sign(control []byte) ([]byte, error) {
 }
 
 func (s KeyApkSigner) SignatureName() string {
-	return fmt.Sprintf(".SIGN.RSA.%s.pub", filepath.Base(s.KeyFile))
+	return rsaSignatureName(s.Algorithm, filepath.Base(s.KeyFile)+".pub")
 }
 
-// APKv2+Fulcio style signature is an SHA-256 hash on the control
-// digest.
-// TODO(kaniini): Emit fulcio signature if signing key not configured.
-type FulcioApkSigner struct{}
-
-// Sign implements ApkSigner.
-func (*FulcioApkSigner) Sign(control []byte) ([]byte, error) {
-	digest := sha256.New()
-
-	_, err := digest.Write(control)
-	if err != nil {
-		return nil, err
+// rsaSignatureName returns the name of the RSA signature made with the
+// digest algorithm by the key installed as keyName.
+func rsaSignatureName(algorithm, keyName string) string {
+	if algorithm == SignatureSHA256 {
+		return fmt.Sprintf(".SIGN.RSA256.%s", keyName)
 	}
+	return fmt.Sprintf(".SIGN.RSA.%s", keyName)
+}
 
-	// TODO: Do the signing
-	return nil, fmt.Errorf("APKv2+Fulcio style signature is not yet supported")
+// IndexSigner returns a function signing an APKINDEX with the signers, for
+// use with index.WithSigner.
+func IndexSigner(sde time.Time, signers ...ApkSigner) index.SignFunc {
+	return func(ctx context.Context, indexData []byte) ([]byte, error) {
+		return EmitSignatures(ctx, signers, indexData, sde)
+	}
 }
 
-// SignatureName implements ApkSigner.
-func (*FulcioApkSigner) SignatureName() string {
-	panic("unimplemented")
+// indexSigner returns the function signing the APKv2 index, or nil if it is
+// not signed or only signed with the signing key, which the index signs with
+// itself.
+func (b *Build) indexSigner() index.SignFunc {
+	signers := b.signers()
+	if len(signers) == 0 || (b.SigningKey != "" && len(signers) == 1 && b.SigningAlgorithm != SignatureSHA256) {
+		return nil
+	}
+	return IndexSigner(b.SourceDateEpoch, signers...)
 }
@@ -5,8 +5,16 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
 	"io"
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -89,6 +97,92 @@ func TestEmitSignature(t *testing.T) {
 	}
 }
 
+func TestEmitSignatures(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+
+	keys := map[string]*rsa.PrivateKey{}
+	for _, name := range []string{"old.rsa", "new.rsa"} {
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key
+
+		if err := os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{
+			Type:  "RSA PRIVATE KEY",
+			Bytes: x509.MarshalPKCS1PrivateKey(key),
+		}), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pb := &build.PackageBuild{
+		Build: &build.Build{
+			SigningKey:       filepath.Join(dir, "old.rsa"),
+			SigningAlgorithm: build.SignatureSHA256,
+			ExtraSigningKeys: []string{filepath.Join(dir, "new.rsa")},
+		},
+	}
+
+	controlData := []byte("donkey")
+	sig, err := build.EmitSignatures(ctx, pb.Signers(), controlData, time.Unix(12345678, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gr, err := gzip.NewReader(bytes.NewReader(sig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+
+	sha256Digest := sha256.Sum256(controlData)
+	sha1Digest := sha1.Sum(controlData)
+	for _, want := range []struct {
+		name   string
+		key    *rsa.PrivateKey
+		hash   crypto.Hash
+		digest []byte
+	}{
+		{".SIGN.RSA256.old.rsa.pub", keys["old.rsa"], crypto.SHA256, sha256Digest[:]},
+		{".SIGN.RSA256.new.rsa.pub", keys["new.rsa"], crypto.SHA256, sha256Digest[:]},
+	} {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Name != want.name {
+			t.Errorf("Unexpected tar header name: got %v want %v", hdr.Name, want.name)
+		}
+
+		got, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rsa.VerifyPKCS1v15(&want.key.PublicKey, want.hash, want.digest, got); err != nil {
+			t.Errorf("%s: %v", want.name, err)
+		}
+	}
+
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("Expected tar EOF")
+	}
+
+	// The default algorithm is SHA-1.
+	signer := build.KeyApkSigner{KeyFile: filepath.Join(dir, "new.rsa")}
+	if name := signer.SignatureName(); name != ".SIGN.RSA.new.rsa.pub" {
+		t.Errorf("Unexpected signature name: got %v", name)
+	}
+	got, err := signer.Sign(controlData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(&keys["new.rsa"].PublicKey, crypto.SHA1, sha1Digest[:], got); err != nil {
+		t.Error(err)
+	}
+}
+
 type mockSigner struct{}
 
 // Sign implements build.ApkSigner.
@@ -0,0 +1,144 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultSigningHelperTimeout is how long a signing helper may take to sign a
+// digest before it is killed.
+const DefaultSigningHelperTimeout = 60 * time.Second
+
+// SigningHelperRequest is written as JSON to the standard input of a signing
+// helper.  The helper signs the digest with RSA PKCS #1 v1.5, for the hash
+// algorithm (SignatureSHA1 or SignatureSHA256) the digest was made with.
+type SigningHelperRequest struct {
+	Algorithm string `json:"algorithm"`
+	Digest    []byte `json:"digest"`
+}
+
+// SigningHelperResponse is read as JSON from the standard output of a signing
+// helper.  KeyName is the file name the public key is installed as in
+// /etc/apk/keys, such as "builder.rsa.pub".
+type SigningHelperResponse struct {
+	Signature []byte `json:"signature"`
+	KeyName   string `json:"keyName"`
+}
+
+// RunSigningHelper runs the signing helper at path to sign the digest.  The
+// helper is run without arguments, once per signature, and fails by exiting
+// with a non-zero status and an error message on its standard error.
+func RunSigningHelper(ctx context.Context, path, algorithm string, digest []byte) (*SigningHelperResponse, error) {
+	req, err := json.Marshal(SigningHelperRequest{Algorithm: algorithm, Digest: digest})
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, path)
+	cmd.Stdin = bytes.NewReader(req)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	// Do not wait on processes the helper started, and which still hold its
+	// output open, once it has been killed.
+	cmd.WaitDelay = time.Second
+
+	if err := cmd.Run(); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, fmt.Errorf("running signing helper: %w", ctxErr)
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("running signing helper: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("running signing helper: %w", err)
+	}
+
+	var resp SigningHelperResponse
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("parsing signing helper response: %w", err)
+	}
+	if len(resp.Signature) == 0 {
+		return nil, errors.New("signing helper returned no signature")
+	}
+	if resp.KeyName == "" || strings.ContainsAny(resp.KeyName, "/\x00") {
+		return nil, fmt.Errorf("signing helper returned an invalid key name %q", resp.KeyName)
+	}
+
+	return &resp, nil
+}
+
+// HelperApkSigner makes the same signatures as KeyApkSigner, with a key held
+// by an external signing helper, such as a front end to an HSM or KMS, rather
+// than in a file.
+type HelperApkSigner struct {
+	Path      string
+	Algorithm string
+	// Timeout is how long the helper may take for each signature, or
+	// DefaultSigningHelperTimeout if zero.
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	keyName string
+}
+
+// Sign implements ApkSigner.
+func (s *HelperApkSigner) Sign(control []byte) ([]byte, error) {
+	algorithm, digest := SignatureSHA1, sha1.Sum(control)
+	dgst := digest[:]
+	if s.Algorithm == SignatureSHA256 {
+		sum := sha256.Sum256(control)
+		algorithm, dgst = SignatureSHA256, sum[:]
+	}
+
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = DefaultSigningHelperTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	resp, err := RunSigningHelper(ctx, s.Path, algorithm, dgst)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil, fmt.Errorf("signing helper did not respond within %s: %w", timeout, err)
+	} else if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	s.keyName = resp.KeyName
+	s.mu.Unlock()
+
+	return resp.Signature, nil
+}
+
+// SignatureName implements ApkSigner.  The name of the key is the one the
+// helper returned with the last signature.
+func (s *HelperApkSigner) SignatureName() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return rsaSignatureName(s.Algorithm, s.keyName)
+}
@@ -0,0 +1,159 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package build_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/adb"
+	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/index"
+)
+
+// TestSigningHelperProcess is not a test, but the signing helper run by
+// TestSigningHelper, signing with the key in MELANGE_TEST_SIGNING_KEY.
+func TestSigningHelperProcess(t *testing.T) {
+	keyFile := os.Getenv("MELANGE_TEST_SIGNING_KEY")
+	if keyFile == "" {
+		return
+	}
+
+	var req build.SigningHelperRequest
+	if err := json.NewDecoder(os.Stdin).Decode(&req); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if req.Algorithm != "sha1" {
+		fmt.Fprintf(os.Stderr, "unsupported algorithm %s\n", req.Algorithm)
+		os.Exit(1)
+	}
+
+	key, err := adb.LoadPrivateKey(keyFile, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA1, req.Digest)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	_ = json.NewEncoder(os.Stdout).Encode(build.SigningHelperResponse{Signature: sig, KeyName: "test.rsa.pub"})
+	os.Exit(0)
+}
+
+func writeHelper(t *testing.T, script string) string {
+	helper := filepath.Join(t.TempDir(), "helper")
+	require.NoError(t, os.WriteFile(helper, []byte("#!/bin/sh\n"+script+"\n"), 0755))
+	return helper
+}
+
+func readSignature(t *testing.T, r io.Reader) (string, []byte) {
+	gr, err := gzip.NewReader(r)
+	require.NoError(t, err)
+	tr := tar.NewReader(gr)
+	hdr, err := tr.Next()
+	require.NoError(t, err)
+	sig, err := io.ReadAll(tr)
+	require.NoError(t, err)
+	return hdr.Name, sig
+}
+
+func TestSigningHelper(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "test.rsa")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600))
+	t.Setenv("MELANGE_TEST_SIGNING_KEY", keyFile)
+
+	helper := writeHelper(t, fmt.Sprintf("exec %q -test.run='^TestSigningHelperProcess$'", os.Args[0]))
+	signer := &build.HelperApkSigner{Path: helper}
+
+	control := []byte("control section")
+	sigData, err := build.EmitSignature(context.Background(), signer, control, time.Unix(0, 0))
+	require.NoError(t, err)
+
+	name, sig := readSignature(t, bytes.NewReader(sigData))
+	require.Equal(t, ".SIGN.RSA.test.rsa.pub", name)
+	digest := sha1.Sum(control)
+	require.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA1, digest[:], sig))
+
+	// The index is signed by the helper as well.
+	indexFile := filepath.Join(t.TempDir(), "APKINDEX.tar.gz")
+	idx, err := index.New(
+		index.WithIndexFile(indexFile),
+		index.WithSigner(build.IndexSigner(time.Unix(0, 0), signer)),
+	)
+	require.NoError(t, err)
+	require.NoError(t, idx.WriteArchiveIndex(context.Background(), indexFile))
+
+	f, err := os.Open(indexFile)
+	require.NoError(t, err)
+	defer f.Close()
+	name, _ = readSignature(t, f)
+	require.Equal(t, ".SIGN.RSA.test.rsa.pub", name)
+}
+
+func TestSigningHelperErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name, script, want string
+	}{
+		{"failure", "echo key is locked >&2; exit 1", "key is locked"},
+		{"invalid response", "echo signed", "parsing signing helper response"},
+		{"no signature", `echo '{"keyName":"test.rsa.pub"}'`, "no signature"},
+		{"invalid key name", `echo '{"signature":"c2ln","keyName":"../test.rsa.pub"}'`, "invalid key name"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			signer := &build.HelperApkSigner{Path: writeHelper(t, "cat >/dev/null; "+tt.script)}
+			_, err := signer.Sign([]byte("control section"))
+			require.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestSigningHelperTimeout(t *testing.T) {
+	signer := &build.HelperApkSigner{
+		Path:    writeHelper(t, "cat >/dev/null; sleep 30"),
+		Timeout: 100 * time.Millisecond,
+	}
+
+	start := time.Now()
+	_, err := signer.Sign([]byte("control section"))
+	require.ErrorContains(t, err, "signing helper did not respond within 100ms")
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 10*time.Second)
+}
@@ -0,0 +1,71 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package cache implements the stores of cached source artifacts, which are
+// named after their digest, such as sha256:<hex>.
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ErrReadOnly is returned when storing an object in a read-only backend.
+var ErrReadOnly = errors.New("cache backend is read-only")
+
+// Backend is a store of cached source artifacts.
+type Backend interface {
+	// Get returns the content of the object.  The error wraps
+	// fs.ErrNotExist if the object is not in the backend.
+	Get(ctx context.Context, name string) (io.ReadCloser, error)
+
+	// Put stores the object, of the given size.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+
+	// String returns the location of the backend.
+	String() string
+}
+
+// NewBackend returns the backend for the location, which is either:
+//   - a local directory,
+//   - an http:// or https:// URL of a read-only mirror,
+//   - a gs://bucket/prefix URL of a Google Cloud Storage bucket,
+//   - an s3://bucket/prefix URL of an S3 compatible bucket, see NewS3.
+func NewBackend(ctx context.Context, location string) (Backend, error) {
+	switch {
+	case strings.HasPrefix(location, "gs://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "gs://"), "/")
+		return NewGCS(ctx, bucket, prefix)
+	case strings.HasPrefix(location, "s3://"):
+		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(location, "s3://"), "/")
+		return NewS3(bucket, prefix)
+	case strings.HasPrefix(location, "http://"), strings.HasPrefix(location, "https://"):
+		return NewHTTP(location), nil
+	case strings.Contains(location, "://"):
+		return nil, fmt.Errorf("unsupported cache location %s", location)
+	}
+	return NewLocal(location), nil
+}
+
+// validName returns an error if the name of the object is not a plain file
+// name, as the names of objects are appended to paths and URLs.
+func validName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, "/\\") {
+		return fmt.Errorf("invalid cache object name %q", name)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/option"
+)
+
+// GCS is a backend storing the objects in a Google Cloud Storage bucket,
+// under a prefix.
+type GCS struct {
+	Bucket string
+	Prefix string
+
+	client *storage.Client
+}
+
+// NewGCS returns a GCS backend.  Without credentials, the bucket is accessed
+// anonymously.
+func NewGCS(ctx context.Context, bucket, prefix string) (*GCS, error) {
+	client, err := storage.NewClient(ctx)
+	if err != nil {
+		client, err = storage.NewClient(ctx, option.WithoutAuthentication())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get storage client: %w", err)
+		}
+	}
+
+	return &GCS{Bucket: bucket, Prefix: prefix, client: client}, nil
+}
+
+// Get implements Backend.
+func (g *GCS) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	rc, err := g.client.Bucket(g.Bucket).Object(path.Join(g.Prefix, name)).NewReader(ctx)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, fmt.Errorf("fetching %s/%s: %w", g, name, fs.ErrNotExist)
+	} else if err != nil {
+		return nil, fmt.Errorf("fetching %s/%s: %w", g, name, err)
+	}
+	return rc, nil
+}
+
+// Put implements Backend.
+func (g *GCS) Put(ctx context.Context, name string, r io.Reader, _ int64) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+
+	w := g.client.Bucket(g.Bucket).Object(path.Join(g.Prefix, name)).NewWriter(ctx)
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return fmt.Errorf("storing %s/%s: %w", g, name, err)
+	}
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("storing %s/%s: %w", g, name, err)
+	}
+	return nil
+}
+
+func (g *GCS) String() string {
+	return "gs://" + path.Join(g.Bucket, g.Prefix)
+}
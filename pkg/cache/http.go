@@ -0,0 +1,77 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// HTTP is a read-only backend fetching the objects from a mirror, at the URL
+// of the mirror followed by the name of the object.
+type HTTP struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewHTTP(u string) *HTTP {
+	return &HTTP{URL: strings.TrimSuffix(u, "/"), Client: http.DefaultClient}
+}
+
+// Get implements Backend.
+func (h *HTTP) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	u := h.URL + "/" + url.PathEscape(name)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s: %w", u, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound, http.StatusGone:
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: %w", u, fs.ErrNotExist)
+	case http.StatusUnauthorized, http.StatusForbidden:
+		// Not a missing object but missing or rejected credentials, which
+		// would otherwise silently disable the cache.
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: access denied (%s), check the credentials of the mirror", u, resp.Status)
+	}
+	resp.Body.Close()
+	return nil, fmt.Errorf("fetching %s: unexpected status %s", u, resp.Status)
+}
+
+// Put implements Backend.  HTTP mirrors are read-only.
+func (h *HTTP) Put(context.Context, string, io.Reader, int64) error {
+	return fmt.Errorf("storing in %s: %w", h.URL, ErrReadOnly)
+}
+
+func (h *HTTP) String() string {
+	return h.URL
+}
@@ -0,0 +1,73 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Local is a backend storing the objects as files of a directory.
+type Local struct {
+	Dir string
+}
+
+func NewLocal(dir string) *Local {
+	return &Local{Dir: dir}
+}
+
+// Get implements Backend.
+func (l *Local) Get(_ context.Context, name string) (io.ReadCloser, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+	return os.Open(filepath.Join(l.Dir, name))
+}
+
+// Put implements Backend.  The object is written to a temporary file which is
+// renamed, so that a partially written object is never read.
+func (l *Local) Put(_ context.Context, name string, r io.Reader, _ int64) error {
+	if err := validName(name); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(l.Dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(l.Dir, ".tmp-"+name+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), filepath.Join(l.Dir, name))
+}
+
+func (l *Local) String() string {
+	return l.Dir
+}
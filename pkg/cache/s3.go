@@ -0,0 +1,264 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cache
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	emptyPayloadHash    = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	unsignedPayloadHash = "UNSIGNED-PAYLOAD"
+)
+
+// S3 is a backend storing the objects in a bucket of an S3 compatible object
+// store, such as MinIO, under a prefix.
+type S3 struct {
+	Bucket string
+	Prefix string
+
+	// Endpoint is the URL of the object store.  The bucket is addressed in
+	// the path of the endpoint, rather than in its host name as with AWS.
+	// Empty addresses AWS in the region.
+	Endpoint string
+	Region   string
+
+	// AccessKeyID, SecretAccessKey and SessionToken are the credentials.
+	// Requests are anonymous without an access key.
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	Client *http.Client
+}
+
+// NewS3 returns an S3 backend configured as the AWS tools are: the endpoint
+// is read from AWS_ENDPOINT_URL_S3 or AWS_ENDPOINT_URL, the region from
+// AWS_REGION or AWS_DEFAULT_REGION (default us-east-1), and the credentials
+// from AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+func NewS3(bucket, prefix string) (*S3, error) {
+	if bucket == "" {
+		return nil, fmt.Errorf("no bucket given")
+	}
+
+	s := &S3{
+		Bucket:          bucket,
+		Prefix:          prefix,
+		Endpoint:        firstEnv("AWS_ENDPOINT_URL_S3", "AWS_ENDPOINT_URL"),
+		Region:          firstEnv("AWS_REGION", "AWS_DEFAULT_REGION"),
+		AccessKeyID:     os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretAccessKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken:    os.Getenv("AWS_SESSION_TOKEN"),
+		Client:          http.DefaultClient,
+	}
+	if s.Region == "" {
+		s.Region = "us-east-1"
+	}
+
+	return s, nil
+}
+
+func firstEnv(keys ...string) string {
+	for _, k := range keys {
+		if v := os.Getenv(k); v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// objectURL returns the URL of the object.
+func (s *S3) objectURL(name string) (*url.URL, error) {
+	key := path.Join(s.Prefix, name)
+
+	if s.Endpoint == "" {
+		return url.Parse(fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.Bucket, s.Region, escapePath(key)))
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(s.Endpoint, "/") + "/" + escapePath(s.Bucket+"/"+key))
+	if err != nil {
+		return nil, fmt.Errorf("parsing endpoint %s: %w", s.Endpoint, err)
+	}
+	return u, nil
+}
+
+// escapePath escapes the segments of the path as S3 does.
+func escapePath(p string) string {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		segments[i] = escape(s)
+	}
+	return strings.Join(segments, "/")
+}
+
+// escape escapes all the characters except the unreserved ones of RFC 3986.
+func escape(s string) string {
+	var sb strings.Builder
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' {
+			sb.WriteByte(c)
+		} else {
+			fmt.Fprintf(&sb, "%%%02X", c)
+		}
+	}
+	return sb.String()
+}
+
+func (s *S3) do(ctx context.Context, method, name string, body io.Reader, size int64, payloadHash string) (*http.Response, error) {
+	if err := validName(name); err != nil {
+		return nil, err
+	}
+
+	u, err := s.objectURL(name)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+
+	if s.AccessKeyID != "" {
+		if s.SessionToken != "" {
+			req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+		}
+		s.sign(req, payloadHash, time.Now())
+	}
+
+	return s.Client.Do(req)
+}
+
+// Get implements Backend.
+func (s *S3) Get(ctx context.Context, name string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, name, nil, 0, emptyPayloadHash)
+	if err != nil {
+		return nil, fmt.Errorf("fetching %s/%s: %w", s, name, err)
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.Body, nil
+	case http.StatusNotFound:
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s/%s: %w", s, name, fs.ErrNotExist)
+	}
+	defer resp.Body.Close()
+	return nil, fmt.Errorf("fetching %s/%s: %w", s, name, responseError(resp))
+}
+
+// Put implements Backend.  The payload is not signed, so that it is streamed
+// rather than read twice.
+func (s *S3) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	resp, err := s.do(ctx, http.MethodPut, name, r, size, unsignedPayloadHash)
+	if err != nil {
+		return fmt.Errorf("storing %s/%s: %w", s, name, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("storing %s/%s: %w", s, name, responseError(resp))
+	}
+	return nil
+}
+
+func (s *S3) String() string {
+	return "s3://" + path.Join(s.Bucket, s.Prefix)
+}
+
+func responseError(resp *http.Response) error {
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if len(msg) == 0 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign signs the request, which has no query, with AWS Signature Version 4,
+// covering the host and all the headers of the request.
+func (s *S3) sign(req *http.Request, payloadHash string, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", k, headers[k])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"", // the requests have no query
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, s.Region)
+	digest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		hex.EncodeToString(digest[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+s.SecretAccessKey), date)
+	key = hmacSHA256(key, s.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKeyID, scope, signedHeaders, signature))
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"log"
 	"path/filepath"
+	"time"
 
 	apko_types "chainguard.dev/apko/pkg/build/types"
 	"chainguard.dev/melange/pkg/build"
@@ -61,6 +62,18 @@ func Build() *cobra.Command {
 	var debugRunner bool
 	var runner string
 	var failOnLintWarning bool
+	var verifyReproducible bool
+	var conflictIndex string
+	var failOnFileConflict bool
+	var verifyDependencies string
+	var apkFormat string
+	var extraSigningKeys []string
+	var signingAlgorithm string
+	var signingHelper string
+	var signingHelperTimeout time.Duration
+	var keyless bool
+	var fulcioURL string
+	var oidcTokenFile string
 
 	cmd := &cobra.Command{
 		Use:     "build",
@@ -99,6 +112,18 @@ func Build() *cobra.Command {
 				build.WithLogPolicy(logPolicy),
 				build.WithRunner(runner),
 				build.WithFailOnLintWarning(failOnLintWarning),
+				build.WithVerifyReproducible(verifyReproducible),
+				build.WithConflictIndex(conflictIndex),
+				build.WithFailOnFileConflict(failOnFileConflict),
+				build.WithVerifyDependencies(verifyDependencies),
+				build.WithApkFormat(apkFormat),
+				build.WithExtraSigningKeys(extraSigningKeys),
+				build.WithSigningAlgorithm(signingAlgorithm),
+				build.WithSigningHelper(signingHelper),
+				build.WithSigningHelperTimeout(signingHelperTimeout),
+				build.WithKeyless(keyless),
+				build.WithFulcioURL(fulcioURL),
+				build.WithOIDCTokenFile(oidcTokenFile),
 			}
 
 			if len(args) > 0 {
@@ -122,17 +147,24 @@ func Build() *cobra.Command {
 	cmd.Flags().StringVar(&pipelineDir, "pipeline-dir", "", "directory used to extend defined built-in pipelines")
 	cmd.Flags().StringVar(&sourceDir, "source-dir", "", "directory used for included sources")
 	cmd.Flags().StringVar(&cacheDir, "cache-dir", "./melange-cache/", "directory used for cached inputs")
-	cmd.Flags().StringVar(&cacheSource, "cache-source", "", "directory or bucket used for preloading the cache")
+	cmd.Flags().StringVar(&cacheSource, "cache-source", "", "directory, http(s) mirror, or gs:// or s3:// bucket used for preloading the cache")
 	cmd.Flags().StringVar(&apkCacheDir, "apk-cache-dir", "", "directory used for cached apk packages (default is system-defined cache directory)")
 	cmd.Flags().StringVar(&guestDir, "guest-dir", "", "directory used for the build environment guest")
 	cmd.Flags().StringVar(&signingKey, "signing-key", "", "key to use for signing")
+	cmd.Flags().StringSliceVar(&extraSigningKeys, "extra-signing-key", []string{}, "additional keys to sign APKv2 packages and the index with, such as the new key while rotating keys")
+	cmd.Flags().StringVar(&signingAlgorithm, "signing-algorithm", build.SignatureSHA1, "digest algorithm of RSA signatures (sha1, or sha256 for .SIGN.RSA256 signatures)")
+	cmd.Flags().StringVar(&signingHelper, "signing-helper", "", "external command signing packages and the index when no signing key is set, for keys which cannot be exported such as in an HSM")
+	cmd.Flags().DurationVar(&signingHelperTimeout, "signing-helper-timeout", build.DefaultSigningHelperTimeout, "how long the signing helper may take for each signature")
+	cmd.Flags().BoolVar(&keyless, "keyless", false, "sign packages and the index with a short-lived certificate issued for an OIDC identity when no signing key is set")
+	cmd.Flags().StringVar(&fulcioURL, "fulcio-url", build.DefaultFulcioURL, "URL of the Fulcio compatible certificate authority used for keyless signing")
+	cmd.Flags().StringVar(&oidcTokenFile, "oidc-token-file", "", "file to read the OIDC token for keyless signing from (default is SIGSTORE_ID_TOKEN or the GitHub Actions token)")
 	cmd.Flags().StringVar(&envFile, "env-file", "", "file to use for preloaded environment variables")
 	cmd.Flags().StringVar(&varsFile, "vars-file", "", "file to use for preloaded build configuration variables")
 	cmd.Flags().BoolVar(&generateIndex, "generate-index", true, "whether to generate APKINDEX.tar.gz")
 	cmd.Flags().BoolVar(&emptyWorkspace, "empty-workspace", false, "whether the build workspace should be empty")
 	cmd.Flags().BoolVar(&stripOriginName, "strip-origin-name", false, "whether origin names should be stripped (for bootstrap)")
 	cmd.Flags().StringVar(&outDir, "out-dir", "./packages/", "directory where packages will be output")
-	cmd.Flags().StringVar(&dependencyLog, "dependency-log", "", "log dependencies to a specified file")
+	cmd.Flags().StringVar(&dependencyLog, "dependency-log", "", "write the provenance of the generated dependencies of each package as JSON to this file, suffixed with the architecture")
 	cmd.Flags().StringVar(&overlayBinSh, "overlay-binsh", "", "use specified file as /bin/sh overlay in build environment")
 	cmd.Flags().StringVar(&breakpointLabel, "breakpoint-label", "", "stop build execution at the specified label")
 	cmd.Flags().StringVar(&continueLabel, "continue-label", "", "continue build execution at the specified label")
@@ -147,6 +179,11 @@ func Build() *cobra.Command {
 	cmd.Flags().BoolVar(&debug, "debug", false, "enables debug logging of build pipelines")
 	cmd.Flags().BoolVar(&debugRunner, "debug-runner", false, "when enabled, the builder pod will persist after the build succeeds or fails")
 	cmd.Flags().BoolVar(&failOnLintWarning, "fail-on-lint-warning", false, "turns linter warnings into failures")
+	cmd.Flags().StringVar(&conflictIndex, "conflict-index", "", "APKINDEX.tar.gz of a repository whose packages must not ship the same files as the packages being built")
+	cmd.Flags().BoolVar(&failOnFileConflict, "fail-on-file-conflict", false, "fail the build when files are shipped by more than one package, or when packages of --conflict-index cannot be checked, rather than warning")
+	cmd.Flags().StringVar(&verifyDependencies, "verify-dependencies", build.VerifyDependenciesOff, "check that runtime dependencies are provided by the environment repositories or the output directory before emitting packages (off, warn or error)")
+	cmd.Flags().StringVar(&apkFormat, "apk-format", build.ApkFormatV2, "format of the packages to emit (v2, v3 or both); with both, the v3 packages and their Packages.adb index are written under the v3 subdirectory of the output directory")
+	cmd.Flags().BoolVar(&verifyReproducible, "verify-reproducible", false, "build the package a second time in a separate workspace and fail if the resulting packages differ")
 
 	return cmd
 }
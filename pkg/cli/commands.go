@@ -46,6 +46,14 @@ func New() *cobra.Command {
 	cmd.AddCommand(Convert())
 	cmd.AddCommand(PackageVersion())
 	cmd.AddCommand(Query())
+	cmd.AddCommand(Diff())
+	cmd.AddCommand(Inspect())
+	cmd.AddCommand(Lint())
+	cmd.AddCommand(LintConfig())
+	cmd.AddCommand(WhyDepends())
+	cmd.AddCommand(Verify())
+	cmd.AddCommand(ServeRepo())
+	cmd.AddCommand(Publish())
 	cmd.AddCommand(version.Version())
 	return cmd
 }
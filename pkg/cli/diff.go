@@ -0,0 +1,64 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/apkdiff"
+)
+
+// Diff is a constructor for a cobra.Command which wraps the DiffCmd function.
+func Diff() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "diff",
+		Short: "Compare two APK packages",
+		Long: `Compare two APK packages.
+
+Reports added, removed and changed files with their size deltas, mode and
+ownership changes, .PKGINFO field differences and scriptlet differences.`,
+		Example: `  melange diff foo-1.0.0-r0.apk foo-1.1.0-r0.apk`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return DiffCmd(cmd.Context(), os.Stdout, args[0], args[1])
+		},
+	}
+
+	return cmd
+}
+
+// DiffCmd is the backend implementation of the "melange diff" command.
+func DiffCmd(ctx context.Context, w io.Writer, oldApk, newApk string) error {
+	from, err := apkdiff.Open(ctx, oldApk)
+	if err != nil {
+		return err
+	}
+
+	to, err := apkdiff.Open(ctx, newApk)
+	if err != nil {
+		return err
+	}
+
+	report, err := apkdiff.Diff(from, to)
+	if err != nil {
+		return err
+	}
+
+	return report.Write(w)
+}
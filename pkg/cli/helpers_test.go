@@ -0,0 +1,137 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	apko_log "chainguard.dev/apko/pkg/log"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/config"
+)
+
+// testKey writes an RSA key named name to dir, and its public key to the
+// keyring directory.  It returns the path of the private key.
+func testKey(t *testing.T, dir, keyring, name string) string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	keyFile := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0o600))
+
+	if keyring != "" {
+		pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+		require.NoError(t, err)
+		require.NoError(t, os.MkdirAll(keyring, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(keyring, name+".pub"), pem.EncodeToMemory(&pem.Block{
+			Type:  "PUBLIC KEY",
+			Bytes: pub,
+		}), 0o644))
+	}
+
+	return keyFile
+}
+
+// emitTestPackage builds an x86_64 package of the name and version holding
+// the files, in outDir/x86_64, and returns its path.  configure sets the
+// signing options of the build.
+func emitTestPackage(t *testing.T, outDir, name, version string, files map[string]string, configure func(*build.Build)) string {
+	pkgctx, err := build.NewPackageContext(&config.Package{
+		Name:      name,
+		Version:   version,
+		Copyright: []config.Copyright{{License: "Apache-2.0"}},
+	})
+	require.NoError(t, err)
+
+	workspace := t.TempDir()
+	for path, content := range files {
+		p := filepath.Join(workspace, "melange-out", name, path)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0o755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0o755))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(workspace, "melange-out", name), 0o755))
+
+	b := &build.Build{
+		WorkspaceDir:    workspace,
+		OutDir:          outDir,
+		Arch:            apko_types.ParseArchitecture("x86_64"),
+		SourceDateEpoch: time.Unix(1700000000, 0),
+	}
+	if configure != nil {
+		configure(b)
+	}
+
+	pb := &build.PackageBuild{
+		Build:       b,
+		Origin:      pkgctx,
+		PackageName: name,
+		OriginName:  name,
+		OutDir:      filepath.Join(outDir, "x86_64"),
+		Arch:        "x86_64",
+		Logger:      &apko_log.Adapter{Out: io.Discard, Level: apko_log.InfoLevel},
+	}
+	require.NoError(t, pb.EmitPackage(context.Background()))
+
+	return pb.Filename()
+}
+
+// withSigningKey signs the test package with the key.
+func withSigningKey(keyFile string) func(*build.Build) {
+	return func(b *build.Build) {
+		b.SigningKey = keyFile
+	}
+}
+
+// spliceApk writes an apk made of the signature and control sections of
+// the first apk, and the data section of the second, to dest.  Its datahash
+// does not match its data section.
+func spliceApk(t *testing.T, first, second, dest string) {
+	sections := func(path string) *expandapk.APKExpanded {
+		f, err := os.Open(path)
+		require.NoError(t, err)
+		defer f.Close()
+		eapk, err := expandapk.ExpandApk(context.Background(), f, "")
+		require.NoError(t, err)
+		t.Cleanup(func() { eapk.Close() })
+		return eapk
+	}
+	a, b := sections(first), sections(second)
+
+	out, err := os.Create(dest)
+	require.NoError(t, err)
+	defer out.Close()
+	for _, section := range []string{a.SignatureFile, a.ControlFile, b.PackageFile} {
+		data, err := os.ReadFile(section)
+		require.NoError(t, err)
+		_, err = out.Write(data)
+		require.NoError(t, err)
+	}
+}
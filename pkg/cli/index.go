@@ -16,7 +16,10 @@ package cli
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	"chainguard.dev/melange/pkg/build"
 	"chainguard.dev/melange/pkg/index"
 	"github.com/spf13/cobra"
 )
@@ -27,22 +30,56 @@ func Index() *cobra.Command {
 	var sourceIndexFilename string
 	var expectedArch string
 	var signingKey string
+	var signingHelper string
+	var signingHelperTimeout time.Duration
 	var mergeIndexEntries bool
+	var apkFormat string
+	var removePackages []string
+	var keepLatest int
+	var pruneMissing bool
+	var failOnConflict bool
 
 	cmd := &cobra.Command{
-		Use:     "index",
-		Short:   "Creates a repository index from a list of package files",
-		Long:    `Creates a repository index from a list of package files.`,
-		Example: `  melange index -o APKINDEX.tar.gz *.apk`,
-		Args:    cobra.MinimumNArgs(1),
+		Use:   "index",
+		Short: "Creates a repository index from a list of package files",
+		Long:  `Creates a repository index from a list of package files.`,
+		Example: `  melange index -o APKINDEX.tar.gz *.apk
+
+  # Remove a package from an index, and keep the latest 3 versions of the others
+  melange index -m -o APKINDEX.tar.gz --remove foo-1.0-r0 --keep-latest 3
+
+  # Drop the packages whose file was deleted
+  melange index -m -o packages/x86_64/APKINDEX.tar.gz -s packages/x86_64/APKINDEX.tar.gz --prune-missing`,
+		Args: cobra.ArbitraryArgs,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 && !mergeIndexEntries {
+				return fmt.Errorf("no packages given, and not merging an existing index")
+			}
+
+			if apkFormat == index.FormatV3 {
+				if !cmd.Flags().Changed("output") {
+					apkIndexFilename = index.IndexFileV3
+				}
+				if !cmd.Flags().Changed("source") {
+					sourceIndexFilename = index.IndexFileV3
+				}
+			}
+
 			options := []index.Option{
+				index.WithFormat(apkFormat),
 				index.WithIndexFile(apkIndexFilename),
 				index.WithSourceIndexFile(sourceIndexFilename),
 				index.WithExpectedArch(expectedArch),
 				index.WithMergeIndexFileFlag(mergeIndexEntries),
 				index.WithSigningKey(signingKey),
 				index.WithPackageFiles(args),
+				index.WithRemovePackages(removePackages),
+				index.WithKeepLatest(keepLatest),
+				index.WithPruneMissing(pruneMissing),
+				index.WithFailOnConflict(failOnConflict),
+			}
+			if signingHelper != "" && signingKey == "" {
+				options = append(options, index.WithSigner(build.IndexSigner(time.Now(), &build.HelperApkSigner{Path: signingHelper, Timeout: signingHelperTimeout})))
 			}
 
 			return IndexCmd(cmd.Context(), options...)
@@ -53,7 +90,14 @@ func Index() *cobra.Command {
 	cmd.Flags().StringVarP(&sourceIndexFilename, "source", "s", "APKINDEX.tar.gz", "Source FILE to use for pre-existing index entries")
 	cmd.Flags().StringVarP(&expectedArch, "arch", "a", "", "Index only packages which match the expected architecture")
 	cmd.Flags().StringVar(&signingKey, "signing-key", "", "Key to use for signing the index (optional)")
+	cmd.Flags().StringVar(&signingHelper, "signing-helper", "", "External command to sign the index with when no signing key is set (optional)")
+	cmd.Flags().DurationVar(&signingHelperTimeout, "signing-helper-timeout", build.DefaultSigningHelperTimeout, "How long the signing helper may take to sign the index")
 	cmd.Flags().BoolVarP(&mergeIndexEntries, "merge", "m", false, "Merge pre-existing index entries")
+	cmd.Flags().StringSliceVar(&removePackages, "remove", []string{}, "Remove the packages, given as name-version, from the index")
+	cmd.Flags().IntVar(&keepLatest, "keep-latest", 0, "Keep only the latest N versions of each package in the index (0 keeps all versions)")
+	cmd.Flags().BoolVar(&pruneMissing, "prune-missing", false, "Remove the packages whose file is missing from the directory of the index")
+	cmd.Flags().BoolVar(&failOnConflict, "fail-on-conflict", false, "Fail if a package has the name, version and architecture of a package in the index but a different checksum, rather than replacing it")
+	cmd.Flags().StringVar(&apkFormat, "apk-format", index.FormatV2, "Format of the packages and of the index (v2 or v3); the output and source default to Packages.adb for v3")
 
 	return cmd
 }
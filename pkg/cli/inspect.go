@@ -0,0 +1,432 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"archive/tar"
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	"chainguard.dev/apko/pkg/sbom/generator/spdx"
+	"github.com/chainguard-dev/go-apk/pkg/apk"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/klauspost/compress/gzip"
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/apkdiff"
+)
+
+// sbomDir is where melange stores the SPDX SBOM inside of a package.
+const sbomDir = "var/lib/db/sbom/"
+
+type inspectOpts struct {
+	format     string
+	repository string
+	arch       string
+	keys       []string
+}
+
+// InspectedFile describes a file in the data section of an inspected package.
+type InspectedFile struct {
+	Path     string `json:"path"`
+	Mode     string `json:"mode"`
+	Uid      int    `json:"uid"`
+	Gid      int    `json:"gid"`
+	Size     int64  `json:"size"`
+	Linkname string `json:"linkname,omitempty"`
+}
+
+// Inspection is the result of inspecting a package.
+type Inspection struct {
+	Path          string                     `json:"path"`
+	PkgInfo       apkdiff.PkgInfo            `json:"pkginfo"`
+	SignatureKey  string                     `json:"signatureKey,omitempty"`
+	SignatureType string                     `json:"signatureType,omitempty"`
+	DataHash      string                     `json:"datahash"`
+	DataHashValid bool                       `json:"datahashValid"`
+	Files         []InspectedFile            `json:"files"`
+	SBOMs         map[string]json.RawMessage `json:"sboms,omitempty"`
+}
+
+// Inspect is a constructor for a cobra.Command which wraps the InspectCmd function.
+func Inspect() *cobra.Command {
+	o := &inspectOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "inspect",
+		Short: "Inspect the contents of an APK package",
+		Long: `Inspect the contents of an APK package.
+
+Prints the .PKGINFO fields, the name of the key the package was signed with,
+whether the datahash recorded in .PKGINFO matches the data section, the files
+in the package and the SPDX SBOM embedded under var/lib/db/sbom.
+
+When --repository is given, the argument is a package name, optionally
+constrained as name=version, which is resolved against the APKINDEX of the
+repository.`,
+		Example: `  melange inspect foo-1.0.0-r0.apk
+  melange inspect --format json foo-1.0.0-r0.apk
+  melange inspect --repository ./packages --arch x86_64 foo=1.0.0-r0`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return InspectCmd(cmd.Context(), os.Stdout, args[0], o)
+		},
+	}
+
+	cmd.Flags().StringVar(&o.format, "format", "text", "output format (text or json)")
+	cmd.Flags().StringVar(&o.repository, "repository", "", "resolve the package against the APKINDEX of this repository (local directory or https URL)")
+	cmd.Flags().StringVar(&o.arch, "arch", apko_types.ParseArchitecture(runtime.GOARCH).ToAPK(), "architecture of the repository index to resolve the package against")
+	cmd.Flags().StringSliceVarP(&o.keys, "keyring-append", "k", []string{}, "path to extra keys to verify the repository index with; the signature is not checked if none are given")
+
+	return cmd
+}
+
+// InspectCmd is the backend implementation of the "melange inspect" command.
+func InspectCmd(ctx context.Context, w io.Writer, pkg string, o *inspectOpts) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "InspectCmd")
+	defer span.End()
+
+	if o.format != "text" && o.format != "json" {
+		return fmt.Errorf("unsupported format %q, must be text or json", o.format)
+	}
+
+	path := pkg
+	if o.repository != "" {
+		p, cleanup, err := resolveRepositoryPackage(ctx, o, pkg)
+		if err != nil {
+			return err
+		}
+		defer cleanup()
+		path = p
+	}
+
+	inspection, err := InspectApk(ctx, path)
+	if err != nil {
+		return err
+	}
+	if o.repository != "" {
+		inspection.Path = pkg
+	}
+
+	if o.format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(inspection); err != nil {
+			return err
+		}
+	} else if err := inspection.Write(w); err != nil {
+		return err
+	}
+
+	if !inspection.DataHashValid {
+		return fmt.Errorf("datahash of %s does not match its data section", path)
+	}
+
+	return nil
+}
+
+// resolveRepositoryPackage resolves pkg against the repository index and
+// returns the path to a local copy of the best match.
+func resolveRepositoryPackage(ctx context.Context, o *inspectOpts, pkg string) (string, func(), error) {
+	keys := map[string][]byte{}
+	for _, k := range o.keys {
+		data, err := os.ReadFile(k)
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to read key %s: %w", k, err)
+		}
+		keys[filepath.Base(k)] = data
+	}
+
+	indexes, err := apk.GetRepositoryIndexes(ctx, []string{o.repository}, keys, o.arch, apk.WithIgnoreSignatures(len(keys) == 0))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load repository index: %w", err)
+	}
+	if len(indexes) == 0 {
+		return "", nil, fmt.Errorf("no %s index found in %s", o.arch, o.repository)
+	}
+
+	pkgs, err := apk.NewPkgResolver(ctx, indexes).ResolvePackage(pkg)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to resolve %s: %w", pkg, err)
+	}
+	if len(pkgs) == 0 {
+		return "", nil, fmt.Errorf("%s not found in %s", pkg, o.repository)
+	}
+
+	u := pkgs[0].Url()
+	if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") {
+		return strings.TrimPrefix(u, "file://"), func() {}, nil
+	}
+
+	f, err := os.CreateTemp("", "melange-inspect-*.apk")
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() { os.Remove(f.Name()) }
+	defer f.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to download %s: %w", u, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to download %s: %s", u, resp.Status)
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to download %s: %w", u, err)
+	}
+
+	return f.Name(), cleanup, nil
+}
+
+// InspectApk reads the metadata, file list and SBOMs of the apk at path and
+// checks the datahash recorded in its .PKGINFO.
+func InspectApk(ctx context.Context, path string) (*Inspection, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	eapk, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return nil, fmt.Errorf("expanding apk %s: %w", path, err)
+	}
+	defer eapk.Close()
+
+	inspection := &Inspection{
+		Path:  path,
+		Files: []InspectedFile{},
+		SBOMs: map[string]json.RawMessage{},
+	}
+
+	if eapk.SignatureFile != "" {
+		if err := readSectionFiles(eapk.SignatureFile, func(hdr *tar.Header, _ io.Reader) error {
+			if typ, key, ok := parseSignatureName(hdr.Name); ok {
+				inspection.SignatureType, inspection.SignatureKey = typ, key
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("reading signature of %s: %w", path, err)
+		}
+	}
+
+	if err := readSectionFiles(eapk.ControlFile, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Name != ".PKGINFO" {
+			return nil
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		inspection.PkgInfo, err = apkdiff.ParsePkgInfo(data)
+		return err
+	}); err != nil {
+		return nil, fmt.Errorf("reading control section of %s: %w", path, err)
+	}
+	if inspection.PkgInfo == nil {
+		return nil, fmt.Errorf("%s has no .PKGINFO", path)
+	}
+
+	if v := inspection.PkgInfo["datahash"]; len(v) != 0 {
+		inspection.DataHash = v[0]
+	}
+	inspection.DataHashValid = inspection.DataHash == hex.EncodeToString(eapk.PackageHash)
+
+	if err := readSectionFiles(eapk.PackageFile, func(hdr *tar.Header, r io.Reader) error {
+		name := strings.TrimPrefix(hdr.Name, "./")
+		inspection.Files = append(inspection.Files, InspectedFile{
+			Path:     name,
+			Mode:     hdr.FileInfo().Mode().String(),
+			Uid:      hdr.Uid,
+			Gid:      hdr.Gid,
+			Size:     hdr.Size,
+			Linkname: hdr.Linkname,
+		})
+
+		if hdr.Typeflag == tar.TypeReg && strings.HasPrefix(name, sbomDir) && strings.HasSuffix(name, ".spdx.json") {
+			data, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			if !json.Valid(data) {
+				return fmt.Errorf("SBOM %s is not valid JSON", name)
+			}
+			inspection.SBOMs[name] = data
+		}
+		return nil
+	}); err != nil {
+		return nil, fmt.Errorf("reading data section of %s: %w", path, err)
+	}
+
+	return inspection, nil
+}
+
+// parseSignatureName splits the name of a signature file such as
+// .SIGN.RSA.foo.rsa.pub into the signature type and the key name.
+func parseSignatureName(name string) (string, string, bool) {
+	rest, ok := strings.CutPrefix(name, ".SIGN.")
+	if !ok {
+		return "", "", false
+	}
+	return strings.Cut(rest, ".")
+}
+
+// readSectionFiles calls fn for each entry of the gzipped tar section at path.
+func readSectionFiles(path string, fn func(*tar.Header, io.Reader) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// pkgInfoOrder lists the .PKGINFO fields shown first in text output.
+var pkgInfoOrder = []string{
+	"pkgname", "pkgver", "arch", "pkgdesc", "url", "license", "origin",
+	"commit", "builddate", "size", "depend", "provides", "replaces",
+}
+
+// Write renders the inspection as human-readable text.
+func (i *Inspection) Write(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "%s\n\n.PKGINFO:\n", i.Path)
+
+	fields := make([]string, 0, len(i.PkgInfo))
+	for k := range i.PkgInfo {
+		if k != "datahash" {
+			fields = append(fields, k)
+		}
+	}
+	sort.SliceStable(fields, func(a, b int) bool {
+		ra, rb := pkginfoFieldRank(pkgInfoOrder, fields[a]), pkginfoFieldRank(pkgInfoOrder, fields[b])
+		if ra != rb {
+			return ra < rb
+		}
+		return fields[a] < fields[b]
+	})
+	for _, k := range fields {
+		for _, v := range i.PkgInfo[k] {
+			fmt.Fprintf(bw, "  %s = %s\n", k, v)
+		}
+	}
+
+	fmt.Fprintln(bw)
+	if i.SignatureKey != "" {
+		fmt.Fprintf(bw, "signature: %s (%s)\n", i.SignatureKey, i.SignatureType)
+	} else {
+		fmt.Fprintln(bw, "signature: unsigned")
+	}
+	if i.DataHashValid {
+		fmt.Fprintf(bw, "datahash:  %s (ok)\n", i.DataHash)
+	} else {
+		fmt.Fprintf(bw, "datahash:  %s (MISMATCH)\n", i.DataHash)
+	}
+
+	fmt.Fprintf(bw, "\nfiles (%d):\n", len(i.Files))
+	for _, f := range i.Files {
+		line := fmt.Sprintf("  %s %5d:%-5d %10d %s", f.Mode, f.Uid, f.Gid, f.Size, f.Path)
+		if f.Linkname != "" {
+			line += " -> " + f.Linkname
+		}
+		fmt.Fprintln(bw, line)
+	}
+
+	names := make([]string, 0, len(i.SBOMs))
+	for name := range i.SBOMs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(bw, "\nSBOM %s:\n", name)
+
+		doc := spdx.Document{}
+		if err := json.Unmarshal(i.SBOMs[name], &doc); err != nil {
+			return fmt.Errorf("parsing SBOM %s: %w", name, err)
+		}
+
+		fmt.Fprintf(bw, "  document: %s (%s)\n", doc.Name, doc.Version)
+		if doc.CreationInfo.Created != "" {
+			fmt.Fprintf(bw, "  created:  %s\n", doc.CreationInfo.Created)
+		}
+		for _, p := range doc.Packages {
+			fmt.Fprintf(bw, "  - %s %s", p.Name, p.Version)
+			if p.LicenseDeclared != "" {
+				fmt.Fprintf(bw, " [%s]", p.LicenseDeclared)
+			}
+			for _, ref := range p.ExternalRefs {
+				if ref.Type == "purl" {
+					fmt.Fprintf(bw, " %s", ref.Locator)
+				}
+			}
+			fmt.Fprintln(bw)
+		}
+	}
+
+	return bw.Flush()
+}
+
+func pkginfoFieldRank(order []string, field string) int {
+	for i, f := range order {
+		if f == field {
+			return i
+		}
+	}
+	return len(order)
+}
@@ -0,0 +1,129 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testSBOM = `{
+  "name": "apk-hello-1.0-r0",
+  "spdxVersion": "SPDX-2.3",
+  "creationInfo": {"created": "2023-11-14T22:13:20Z"},
+  "packages": [{
+    "name": "hello",
+    "versionInfo": "1.0-r0",
+    "licenseDeclared": "Apache-2.0",
+    "externalRefs": [{"referenceType": "purl", "referenceLocator": "pkg:apk/wolfi/hello@1.0-r0?arch=x86_64"}]
+  }]
+}`
+
+func inspectFixture(t *testing.T) (string, string) {
+	dir := t.TempDir()
+	keyFile := testKey(t, dir, "", "test.rsa")
+	apk := emitTestPackage(t, t.TempDir(), "hello", "1.0", map[string]string{
+		"usr/bin/hello":                          "#!/bin/sh\necho hello\n",
+		"var/lib/db/sbom/hello-1.0-r0.spdx.json": testSBOM,
+	}, withSigningKey(keyFile))
+	return apk, keyFile
+}
+
+func TestInspectApk(t *testing.T) {
+	apk, _ := inspectFixture(t)
+
+	inspection, err := InspectApk(context.Background(), apk)
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"hello"}, inspection.PkgInfo["pkgname"])
+	require.Equal(t, []string{"1.0-r0"}, inspection.PkgInfo["pkgver"])
+	require.Equal(t, "RSA", inspection.SignatureType)
+	require.Equal(t, "test.rsa.pub", inspection.SignatureKey)
+	require.True(t, inspection.DataHashValid)
+	require.NotEmpty(t, inspection.DataHash)
+
+	paths := []string{}
+	for _, f := range inspection.Files {
+		paths = append(paths, f.Path)
+	}
+	require.Contains(t, paths, "usr/bin/hello")
+	require.Contains(t, inspection.SBOMs, "var/lib/db/sbom/hello-1.0-r0.spdx.json")
+}
+
+func TestInspectDataHashMismatch(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := testKey(t, dir, "", "test.rsa")
+	first := emitTestPackage(t, t.TempDir(), "hello", "1.0", map[string]string{"usr/bin/hello": "one"}, withSigningKey(keyFile))
+	second := emitTestPackage(t, t.TempDir(), "hello", "1.0", map[string]string{"usr/bin/hello": "two"}, withSigningKey(keyFile))
+	spliced := filepath.Join(dir, "hello-1.0-r0.apk")
+	spliceApk(t, first, second, spliced)
+
+	inspection, err := InspectApk(context.Background(), spliced)
+	require.NoError(t, err)
+	require.False(t, inspection.DataHashValid)
+
+	var out bytes.Buffer
+	err = InspectCmd(context.Background(), &out, spliced, &inspectOpts{format: "text"})
+	require.ErrorContains(t, err, "does not match its data section")
+	require.Contains(t, out.String(), "(MISMATCH)")
+}
+
+func TestInspectCmdOutput(t *testing.T) {
+	apk, _ := inspectFixture(t)
+
+	var out bytes.Buffer
+	require.NoError(t, InspectCmd(context.Background(), &out, apk, &inspectOpts{format: "json"}))
+	var inspection Inspection
+	require.NoError(t, json.Unmarshal(out.Bytes(), &inspection))
+	require.Equal(t, []string{"hello"}, inspection.PkgInfo["pkgname"])
+	require.True(t, inspection.DataHashValid)
+	require.JSONEq(t, testSBOM, string(inspection.SBOMs["var/lib/db/sbom/hello-1.0-r0.spdx.json"]))
+
+	out.Reset()
+	require.NoError(t, InspectCmd(context.Background(), &out, apk, &inspectOpts{format: "text"}))
+	text := out.String()
+	require.Contains(t, text, "  pkgname = hello\n  pkgver = 1.0-r0\n  arch = x86_64\n")
+	require.Contains(t, text, "signature: test.rsa.pub (RSA)\n")
+	require.Contains(t, text, "(ok)\n")
+	require.Contains(t, text, "SBOM var/lib/db/sbom/hello-1.0-r0.spdx.json:\n  document: apk-hello-1.0-r0 (SPDX-2.3)\n")
+	require.Contains(t, text, "  - hello 1.0-r0 [Apache-2.0] pkg:apk/wolfi/hello@1.0-r0?arch=x86_64\n")
+
+	require.ErrorContains(t, InspectCmd(context.Background(), &out, apk, &inspectOpts{format: "yaml"}), "unsupported format")
+}
+
+func TestParseSignatureName(t *testing.T) {
+	for _, tt := range []struct {
+		name, typ, key string
+		ok             bool
+	}{
+		{".SIGN.RSA.melange.rsa.pub", "RSA", "melange.rsa.pub", true},
+		{".SIGN.RSA256.melange.rsa.pub", "RSA256", "melange.rsa.pub", true},
+		{".SIGN.FULCIO.builder@example.com.pem", "FULCIO", "builder@example.com.pem", true},
+		{".PKGINFO", "", "", false},
+		{".SIGN.RSA", "RSA", "", false},
+	} {
+		typ, key, ok := parseSignatureName(tt.name)
+		require.Equal(t, tt.ok, ok, tt.name)
+		if ok {
+			require.Equal(t, tt.typ, typ, tt.name)
+			require.Equal(t, tt.key, key, tt.name)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
+	"sigs.k8s.io/release-utils/version"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/linter"
+)
+
+type lintOpts struct {
+	enabled  []string
+	disabled []string
+	severity map[string]string
+	dir      string
+	format   string
+	failOn   linter.Severity
+}
+
+// LintResult is a finding reported by a linter for a package.
+type LintResult struct {
+	Package string `json:"package"`
+	linter.Finding
+}
+
+// Lint is a constructor for a cobra.Command which wraps the LintCmd function.
+func Lint() *cobra.Command {
+	o := &lintOpts{}
+	var failOn string
+
+	cmd := &cobra.Command{
+		Use:   "lint",
+		Short: "Run the package linters against built APK packages",
+		Long: `Run the package linters against built APK packages.
+
+The default linters are run, adjusted by --enable and --disable, with the
+severities set by --severity.  Every finding is reported, and the command
+exits non-zero if any is an error, or with --fail-on warn if any is a
+warning.  Results can be printed as text, JSON or SARIF.`,
+		Example: `  melange lint foo-1.0.0-r0.apk
+  melange lint --enable empty --disable strip *.apk
+  melange lint --dir packages/x86_64 --format sarif > lint.sarif
+  melange lint --severity usrlocal=error --severity strip=off *.apk
+  melange lint --fail-on warn foo-1.0.0-r0.apk`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			o.failOn = linter.Severity(failOn)
+			return LintCmd(cmd.Context(), os.Stdout, args, o)
+		},
+	}
+
+	cmd.Flags().StringSliceVar(&o.enabled, "enable", []string{}, "linters to enable in addition to the defaults")
+	cmd.Flags().StringSliceVar(&o.disabled, "disable", []string{}, "linters to disable")
+	cmd.Flags().StringToStringVar(&o.severity, "severity", map[string]string{}, "severity of a linter (error, warn or off), as linter=severity")
+	cmd.Flags().StringVar(&o.dir, "dir", "", "lint every package in this directory")
+	cmd.Flags().StringVar(&o.format, "format", "text", "output format (text, json or sarif)")
+	cmd.Flags().StringVar(&failOn, "fail-on", string(linter.SeverityError), "lowest severity of the findings which fail the command (error or warn)")
+
+	return cmd
+}
+
+// LintCmd is the backend implementation of the "melange lint" command.
+func LintCmd(ctx context.Context, w io.Writer, apks []string, o *lintOpts) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "LintCmd")
+	defer span.End()
+
+	switch o.format {
+	case "text", "json", "sarif":
+	default:
+		return fmt.Errorf("unsupported format %q, must be text, json or sarif", o.format)
+	}
+
+	switch o.failOn {
+	case "":
+		o.failOn = linter.SeverityError
+	case linter.SeverityError, linter.SeverityWarning:
+	default:
+		return fmt.Errorf("unsupported severity %q, must be error or warn", o.failOn)
+	}
+	for name, sev := range o.severity {
+		switch linter.Severity(sev) {
+		case linter.SeverityError, linter.SeverityWarning, linter.SeverityOff:
+		default:
+			return fmt.Errorf("linter %s has invalid severity %q, must be error, warn or off", name, sev)
+		}
+	}
+
+	if o.dir != "" {
+		matches, err := filepath.Glob(filepath.Join(o.dir, "*.apk"))
+		if err != nil {
+			return err
+		}
+		sort.Strings(matches)
+		apks = append(apks, matches...)
+	}
+	if len(apks) == 0 {
+		return errors.New("no packages to lint, pass apk files or --dir")
+	}
+
+	checks := config.Checks{Enabled: o.enabled, Disabled: o.disabled, Severity: o.severity}
+
+	results := []LintResult{}
+	for _, apk := range apks {
+		findings, err := linter.LintApk(ctx, apk, checks)
+		if err != nil {
+			return fmt.Errorf("linting %s: %w", apk, err)
+		}
+
+		for _, f := range findings {
+			results = append(results, LintResult{Package: apk, Finding: f})
+		}
+	}
+
+	var err error
+	switch o.format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+	case "sarif":
+		err = writeLintSARIF(w, checks.GetLinters(), results)
+	default:
+		for _, r := range results {
+			if _, err = fmt.Fprintf(w, "%s: %s: %s\n", r.Package, r.Severity, r.Finding); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	for _, r := range results {
+		if r.Severity == linter.SeverityError || o.failOn == linter.SeverityWarning {
+			failures++
+		}
+	}
+	if failures != 0 {
+		return fmt.Errorf("linters reported %d problems in %d packages", failures, len(apks))
+	}
+
+	return nil
+}
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	Version        string      `json:"version,omitempty"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID   string       `json:"id"`
+	Help sarifMessage `json:"help"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Level     string          `json:"level"`
+	Message   sarifMessage    `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+// writeLintSARIF renders the results as a SARIF 2.1.0 log.
+func writeLintSARIF(w io.Writer, linters []string, results []LintResult) error {
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "melange",
+			Version:        version.GetVersionInfo().GitVersion,
+			InformationURI: "https://github.com/chainguard-dev/melange",
+			Rules:          []sarifRule{},
+		}},
+		Results: []sarifResult{},
+	}
+
+	for _, name := range linters {
+		run.Tool.Driver.Rules = append(run.Tool.Driver.Rules, sarifRule{
+			ID:   name,
+			Help: sarifMessage{Text: linter.Explain(name)},
+		})
+	}
+
+	for _, r := range results {
+		level := "warning"
+		if r.Severity == linter.SeverityError {
+			level = "error"
+		}
+
+		message := r.Message
+		if r.Path != "" {
+			message = r.Path + ": " + message
+		}
+
+		run.Results = append(run.Results, sarifResult{
+			RuleID:  r.Linter,
+			Level:   level,
+			Message: sarifMessage{Text: message},
+			Locations: []sarifLocation{{
+				PhysicalLocation: sarifPhysicalLocation{
+					ArtifactLocation: sarifArtifactLocation{URI: filepath.ToSlash(r.Package)},
+				},
+			}},
+		})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+}
@@ -0,0 +1,111 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/configlint"
+	"chainguard.dev/melange/pkg/renovate"
+)
+
+// LintConfig is a constructor for a cobra.Command which wraps the LintConfigCmd function.
+func LintConfig() *cobra.Command {
+	var fix bool
+
+	cmd := &cobra.Command{
+		Use:   "lint-config",
+		Short: "Check Melange YAML files for common mistakes",
+		Long: `Check Melange YAML files for common mistakes.
+
+Flags git-checkout steps without an expected-commit, fetch steps without a
+checksum, packages without a copyright or license, duplicate subpackage
+names, the deprecated target-architecture: [all] and update blocks which are
+enabled without a monitor.
+
+With --fix, issues which can be corrected automatically are fixed and the
+file is rewritten.`,
+		Example: `  melange lint-config config.yaml
+  melange lint-config --fix config.yaml`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return LintConfigCmd(cmd.Context(), os.Stdout, args, fix)
+		},
+	}
+
+	cmd.Flags().BoolVar(&fix, "fix", false, "fix the issues which can be corrected automatically")
+
+	return cmd
+}
+
+// LintConfigCmd is the backend implementation of the "melange lint-config" command.
+func LintConfigCmd(ctx context.Context, w io.Writer, configFiles []string, fix bool) error {
+	remaining := 0
+	for _, configFile := range configFiles {
+		c, err := renovate.New(renovate.WithConfig(configFile))
+		if err != nil {
+			return err
+		}
+
+		rc := renovate.RenovationContext{Context: c}
+		if err := rc.LoadConfig(); err != nil {
+			return err
+		}
+
+		findings := configlint.Lint(&rc)
+
+		if fix {
+			fixable := false
+			for _, f := range findings {
+				fixable = fixable || f.Fixable()
+			}
+
+			if fixable {
+				if err := configlint.Fix(ctx, &rc, findings); err != nil {
+					return fmt.Errorf("%s: %w", configFile, err)
+				}
+				if err := rc.WriteConfig(); err != nil {
+					return err
+				}
+			}
+		}
+
+		for _, f := range findings {
+			status := ""
+			switch {
+			case f.Fixed:
+				status = " (fixed)"
+			case f.Fixable():
+				status = " (fixable with --fix)"
+			}
+			fmt.Fprintf(w, "%s:%d: [%s] %s%s\n", configFile, f.Line, f.Check, f.Message, status)
+
+			if !f.Fixed {
+				remaining++
+			}
+		}
+	}
+
+	if remaining != 0 {
+		return fmt.Errorf("found %d issues", remaining)
+	}
+
+	return nil
+}
@@ -0,0 +1,135 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/linter"
+)
+
+// lintFixture returns a package with a file in /usr/local and one in /opt,
+// and options running only the usrlocal and opt linters.
+func lintFixture(t *testing.T) (string, *lintOpts) {
+	apk := emitTestPackage(t, t.TempDir(), "hello", "1.0", map[string]string{
+		"usr/local/share/hello": "hello",
+		"opt/hello/data":        "hello",
+	}, nil)
+	return apk, &lintOpts{
+		disabled: []string{"dev", "empty", "srv", "setuidgid", "strip", "tempdir", "varempty", "worldwrite"},
+		severity: map[string]string{},
+		format:   "text",
+	}
+}
+
+func TestLintCmdFailOn(t *testing.T) {
+	apk, o := lintFixture(t)
+	ctx := context.Background()
+
+	// Warnings are reported without failing.
+	var out bytes.Buffer
+	require.NoError(t, LintCmd(ctx, &out, []string{apk}, o))
+	require.Contains(t, out.String(), apk+": warn: ")
+
+	o.failOn = linter.SeverityWarning
+	require.ErrorContains(t, LintCmd(ctx, &out, []string{apk}, o), "linters reported")
+
+	// Only the errors are counted.
+	o.failOn = linter.SeverityError
+	o.severity["opt"] = "error"
+	out.Reset()
+	err := LintCmd(ctx, &out, []string{apk}, o)
+	require.ErrorContains(t, err, "linters reported")
+	require.Contains(t, out.String(), apk+": error: ")
+	require.Contains(t, out.String(), apk+": warn: ")
+
+	o.severity["opt"] = "off"
+	require.NoError(t, LintCmd(ctx, &out, []string{apk}, o))
+
+	o.failOn = "info"
+	require.ErrorContains(t, LintCmd(ctx, &out, []string{apk}, o), `unsupported severity "info"`)
+
+	o.failOn = linter.SeverityError
+	o.severity["opt"] = "fatal"
+	require.ErrorContains(t, LintCmd(ctx, &out, []string{apk}, o), `linter opt has invalid severity "fatal"`)
+}
+
+func TestLintCmdJSON(t *testing.T) {
+	apk, o := lintFixture(t)
+	o.format = "json"
+	o.severity["usrlocal"] = "error"
+
+	var out bytes.Buffer
+	require.Error(t, LintCmd(context.Background(), &out, []string{apk}, o))
+
+	var results []LintResult
+	require.NoError(t, json.Unmarshal(out.Bytes(), &results))
+	require.NotEmpty(t, results)
+
+	got := map[string]linter.Severity{}
+	for _, r := range results {
+		require.Equal(t, apk, r.Package)
+		require.NotEmpty(t, r.Message)
+		got[r.Linter+":"+r.Path] = r.Severity
+	}
+	require.Equal(t, linter.SeverityError, got["usrlocal:usr/local/share/hello"])
+	require.Equal(t, linter.SeverityWarning, got["opt:opt/hello/data"])
+
+	// A clean package is an empty list rather than null.
+	out.Reset()
+	o.disabled = append(o.disabled, "opt", "usrlocal")
+	require.NoError(t, LintCmd(context.Background(), &out, []string{apk}, o))
+	require.JSONEq(t, "[]", out.String())
+}
+
+func TestLintCmdSARIF(t *testing.T) {
+	apk, o := lintFixture(t)
+	o.format = "sarif"
+	o.severity["usrlocal"] = "error"
+
+	var out bytes.Buffer
+	require.Error(t, LintCmd(context.Background(), &out, []string{apk}, o))
+
+	var log sarifLog
+	require.NoError(t, json.Unmarshal(out.Bytes(), &log))
+	require.Equal(t, "2.1.0", log.Version)
+	require.Len(t, log.Runs, 1)
+
+	run := log.Runs[0]
+	require.Equal(t, "melange", run.Tool.Driver.Name)
+	rules := map[string]string{}
+	for _, r := range run.Tool.Driver.Rules {
+		rules[r.ID] = r.Help.Text
+	}
+	require.Equal(t, map[string]string{
+		"opt":      linter.Explain("opt"),
+		"usrlocal": linter.Explain("usrlocal"),
+	}, rules)
+
+	levels := map[string]string{}
+	for _, r := range run.Results {
+		require.Contains(t, rules, r.RuleID)
+		require.Len(t, r.Locations, 1)
+		require.Equal(t, apk, r.Locations[0].PhysicalLocation.ArtifactLocation.URI)
+		levels[r.Message.Text] = r.Level
+	}
+	require.Equal(t, "error", levels["usr/local/share/hello: /usr/local path found in non-compat package"])
+	require.Equal(t, "warning", levels["opt/hello/data: Package writes to /opt"])
+}
@@ -0,0 +1,89 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/publish"
+)
+
+type publishOpts struct {
+	signingOpts
+
+	To             string
+	FailOnConflict bool
+}
+
+// Publish is a constructor for a cobra.Command which wraps the PublishCmd function.
+func Publish() *cobra.Command {
+	o := &publishOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "publish",
+		Short: "Publish packages and their index to an OCI registry",
+		Long: `Publish packages and their index to an OCI registry.
+
+Each package is pushed as an artifact tagged <arch>-<name>-<version>.  The
+published index of each architecture, tagged APKINDEX-<arch>, is pulled,
+the packages are merged into it, and it is signed and pushed back.
+
+The registry credentials are read from the Docker configuration, as for
+docker login.`,
+		Example: `  melange publish --to oci://registry.example.com/packages --signing-key melange.rsa packages/*/*.apk`,
+		Args:    cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return o.PublishCmd(cmd.Context(), args...)
+		},
+	}
+
+	cmd.Flags().StringVar(&o.To, "to", "", "registry repository to publish to, such as oci://registry.example.com/packages")
+	cmd.Flags().BoolVar(&o.FailOnConflict, "fail-on-conflict", false, "fail if a package has the name, version and architecture of a published package but a different checksum, rather than replacing it")
+	cmd.Flags().StringVar(&o.Key, "signing-key", "", "the signing key to sign the indexes with (optional)")
+	cmd.Flags().StringSliceVar(&o.ExtraKeys, "extra-signing-key", []string{}, "additional signing keys to sign the indexes with, such as the new key while rotating keys")
+	cmd.Flags().StringVar(&o.Algorithm, "signing-algorithm", build.SignatureSHA1, "digest algorithm of RSA signatures (sha1, or sha256 for .SIGN.RSA256 signatures)")
+	cmd.Flags().StringVar(&o.SigningHelper, "signing-helper", "", "external command to sign with instead of the signing key, for keys which cannot be exported such as in an HSM")
+	cmd.Flags().DurationVar(&o.SigningHelperTimeout, "signing-helper-timeout", build.DefaultSigningHelperTimeout, "how long the signing helper may take for each signature")
+	cmd.Flags().BoolVar(&o.Keyless, "keyless", false, "sign with a short-lived certificate issued for an OIDC identity instead of the signing key")
+	cmd.Flags().StringVar(&o.FulcioURL, "fulcio-url", build.DefaultFulcioURL, "URL of the Fulcio compatible certificate authority used for keyless signing")
+	cmd.Flags().StringVar(&o.OIDCTokenFile, "oidc-token-file", "", "file to read the OIDC token for keyless signing from (default is SIGSTORE_ID_TOKEN or the GitHub Actions token)")
+	_ = cmd.MarkFlagRequired("to")
+
+	return cmd
+}
+
+// PublishCmd is the backend implementation of the "melange publish" command.
+func (o publishOpts) PublishCmd(ctx context.Context, packageFiles ...string) error {
+	options := []publish.Option{
+		publish.WithRepository(o.To),
+		publish.WithPackageFiles(packageFiles),
+		publish.WithFailOnConflict(o.FailOnConflict),
+	}
+	if o.simple() {
+		options = append(options, publish.WithSigningKey(o.Key))
+	} else {
+		options = append(options, publish.WithSigner(build.IndexSigner(time.Now(), o.signers()...)))
+	}
+
+	p, err := publish.New(options...)
+	if err != nil {
+		return err
+	}
+	return p.Publish(ctx)
+}
@@ -0,0 +1,451 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+
+	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/index"
+)
+
+type serveRepoOpts struct {
+	signingOpts
+
+	Dir            string
+	Addr           string
+	Interval       time.Duration
+	FailOnConflict bool
+	MaxUploadSize  int64
+	UploadToken    string
+}
+
+// defaultMaxUploadSize is the default limit of the size of uploaded packages.
+const defaultMaxUploadSize = 1 << 30
+
+// ServeRepo is a constructor for a cobra.Command which wraps the ServeRepoCmd function.
+func ServeRepo() *cobra.Command {
+	o := &serveRepoOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "serve-repo",
+		Short: "Serve a local package repository over HTTP",
+		Long: `Serve a local package repository over HTTP.
+
+The directory holds a directory per architecture, such as x86_64, with the
+packages of the architecture, as written by melange build.  The directories
+are watched for changes to their packages, and their APKINDEX.tar.gz is
+regenerated and signed when a package is added, replaced or removed.
+
+Packages are uploaded by POSTing them to /upload, which stores them in the
+directory of their architecture and regenerates its index.  When an upload
+token is set, uploads must carry it as a bearer token in their Authorization
+header.  Without a token, anyone who can reach the address can upload
+packages, so only listen on a loopback address without one.`,
+		Example: `  melange serve-repo --dir packages/ --signing-key melange.rsa
+
+  # Upload a package
+  curl --data-binary @foo-1.0-r0.apk http://localhost:8080/upload
+
+  # Serve on all interfaces, and only accept uploads carrying the token
+  melange serve-repo --addr :8080 --upload-token "$(cat token)" --signing-key melange.rsa
+  curl -H "Authorization: Bearer $(cat token)" --data-binary @foo-1.0-r0.apk http://repo.example.com:8080/upload
+
+  # Build against the served repository
+  melange build --repository-append http://localhost:8080 --keyring-append melange.rsa.pub foo.yaml`,
+		Args: cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return o.ServeRepoCmd(ctx)
+		},
+	}
+
+	cmd.Flags().StringVar(&o.Dir, "dir", "./packages/", "directory of the repository, holding a directory per architecture")
+	cmd.Flags().StringVar(&o.Addr, "addr", "localhost:8080", "address to listen on")
+	cmd.Flags().DurationVar(&o.Interval, "interval", 2*time.Second, "interval between checks of the directories for changed packages")
+	cmd.Flags().BoolVar(&o.FailOnConflict, "fail-on-conflict", false, "reject uploads of a package which has the name and version of a package in the repository but a different content")
+	cmd.Flags().Int64Var(&o.MaxUploadSize, "max-upload-size", defaultMaxUploadSize, "maximum size in bytes of an uploaded package")
+	cmd.Flags().StringVar(&o.UploadToken, "upload-token", "", "bearer token which uploads must carry in their Authorization header (uploads are not authenticated if unset)")
+	cmd.Flags().StringVar(&o.Key, "signing-key", "", "the signing key to sign the indexes with (the indexes are not signed if unset)")
+	cmd.Flags().StringSliceVar(&o.ExtraKeys, "extra-signing-key", []string{}, "additional signing keys to sign the indexes with")
+	cmd.Flags().StringVar(&o.Algorithm, "signing-algorithm", build.SignatureSHA1, "digest algorithm of RSA signatures (sha1, or sha256 for .SIGN.RSA256 signatures)")
+	cmd.Flags().StringVar(&o.SigningHelper, "signing-helper", "", "external command to sign with instead of the signing key, for keys which cannot be exported such as in an HSM")
+	cmd.Flags().DurationVar(&o.SigningHelperTimeout, "signing-helper-timeout", build.DefaultSigningHelperTimeout, "how long the signing helper may take for each signature")
+
+	return cmd
+}
+
+// ServeRepoCmd is the backend implementation of the "melange serve-repo"
+// command.  It serves the repository until the context is done.
+func (o serveRepoOpts) ServeRepoCmd(ctx context.Context) error {
+	if o.Interval <= 0 {
+		return fmt.Errorf("invalid interval %s, must be positive", o.Interval)
+	}
+
+	r, err := newRepoServer(o, LogDefault())
+	if err != nil {
+		return err
+	}
+
+	if o.UploadToken == "" {
+		loopback, err := isLoopback(o.Addr)
+		if err != nil {
+			return err
+		}
+		if !loopback {
+			r.logger.Printf("WARNING: %s is not a loopback address and no upload token is set, anyone who can reach it can upload packages", o.Addr)
+		}
+	}
+
+	if err := r.reindexChanged(ctx); err != nil {
+		return err
+	}
+
+	srv := &http.Server{
+		Addr:              o.Addr,
+		Handler:           r.handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		r.logger.Printf("serving %s at http://%s", o.Dir, o.Addr)
+		errCh <- srv.ListenAndServe()
+	}()
+
+	ticker := time.NewTicker(o.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-errCh:
+			return fmt.Errorf("serving repository: %w", err)
+		case <-ticker.C:
+			if err := r.reindexChanged(ctx); err != nil {
+				r.logger.Printf("ERROR: %v", err)
+			}
+		case <-ctx.Done():
+			shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			return srv.Shutdown(shutdownCtx)
+		}
+	}
+}
+
+// isLoopback returns whether the address only listens on a loopback
+// interface.  An address without a host listens on every interface.
+func isLoopback(addr string) (bool, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false, fmt.Errorf("invalid address %q: %w", addr, err)
+	}
+	if host == "localhost" {
+		return true, nil
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback(), nil
+}
+
+// repoServer regenerates the indexes of the repository and handles uploads.
+type repoServer struct {
+	opts    serveRepoOpts
+	logger  *logrus.Logger
+	signers []build.ApkSigner
+
+	// mu serializes the changes to the repository, and guards states, the
+	// state of the packages of each architecture when last indexed.
+	mu     sync.Mutex
+	states map[string]string
+}
+
+func newRepoServer(o serveRepoOpts, logger *logrus.Logger) (*repoServer, error) {
+	if o.MaxUploadSize <= 0 {
+		return nil, fmt.Errorf("invalid maximum upload size %d, must be positive", o.MaxUploadSize)
+	}
+	if err := os.MkdirAll(o.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("creating repository directory: %w", err)
+	}
+
+	r := &repoServer{
+		opts:   o,
+		logger: logger,
+		states: map[string]string{},
+	}
+	if o.Key != "" || o.SigningHelper != "" {
+		r.signers = o.signers()
+	} else {
+		r.logger.Printf("WARNING: no signing key given, the indexes will not be signed")
+	}
+
+	return r, nil
+}
+
+// handler returns the handler serving the repository and the uploads.
+func (r *repoServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/upload", r.upload)
+	mux.Handle("/", http.FileServer(http.Dir(r.opts.Dir)))
+	return mux
+}
+
+// archDirs returns the architecture directories of the repository: its
+// directories which hold packages or an index.
+func (r *repoServer) archDirs() ([]string, error) {
+	entries, err := os.ReadDir(r.opts.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing repository: %w", err)
+	}
+
+	archs := []string{}
+	for _, e := range entries {
+		if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(r.opts.Dir, e.Name(), "*.apk"))
+		if err != nil {
+			return nil, err
+		}
+		_, err = os.Stat(filepath.Join(r.opts.Dir, e.Name(), "APKINDEX.tar.gz"))
+		if len(matches) != 0 || err == nil {
+			archs = append(archs, e.Name())
+		}
+	}
+
+	return archs, nil
+}
+
+// packageState returns the names, sizes and modification times of the
+// packages of the architecture, which change when a package is added,
+// replaced or removed.
+func (r *repoServer) packageState(arch string) (string, error) {
+	matches, err := filepath.Glob(filepath.Join(r.opts.Dir, arch, "*.apk"))
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(matches)
+
+	var sb strings.Builder
+	for _, m := range matches {
+		fi, err := os.Stat(m)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "%s %d %d\n", filepath.Base(m), fi.Size(), fi.ModTime().UnixNano())
+	}
+
+	return sb.String(), nil
+}
+
+// reindexChanged regenerates the indexes of the architectures whose packages
+// changed since they were last indexed.
+func (r *repoServer) reindexChanged(ctx context.Context) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	archs, err := r.archDirs()
+	if err != nil {
+		return err
+	}
+
+	for _, arch := range archs {
+		state, err := r.packageState(arch)
+		if err != nil {
+			return fmt.Errorf("checking packages of %s: %w", arch, err)
+		}
+		if last, ok := r.states[arch]; ok && state == last {
+			continue
+		}
+		if err := r.reindex(ctx, arch); err != nil {
+			return err
+		}
+		r.states[arch] = state
+	}
+
+	return nil
+}
+
+// reindex regenerates the index of the architecture from its packages.  The
+// index is written next to the current one and renamed over it, so that it is
+// never served partially written.
+func (r *repoServer) reindex(ctx context.Context, arch string) error {
+	archDir := filepath.Join(r.opts.Dir, arch)
+
+	tmp, err := os.CreateTemp(archDir, ".APKINDEX-*.tar.gz")
+	if err != nil {
+		return fmt.Errorf("creating index of %s: %w", arch, err)
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	options := []index.Option{
+		index.WithIndexFile(tmp.Name()),
+		index.WithPackageDir(archDir),
+		index.WithExpectedArch(arch),
+	}
+	if len(r.signers) != 0 {
+		if r.opts.simple() {
+			options = append(options, index.WithSigningKey(r.opts.Key))
+		} else {
+			options = append(options, index.WithSigner(build.IndexSigner(time.Now(), r.signers...)))
+		}
+	}
+
+	idx, err := index.New(options...)
+	if err != nil {
+		return err
+	}
+	idx.Logger = r.logger
+	if err := idx.GenerateIndex(ctx); err != nil {
+		return fmt.Errorf("generating index of %s: %w", arch, err)
+	}
+
+	if err := os.Rename(tmp.Name(), filepath.Join(archDir, "APKINDEX.tar.gz")); err != nil {
+		return fmt.Errorf("replacing index of %s: %w", arch, err)
+	}
+
+	return nil
+}
+
+// upload stores the package in the request body in the directory of its
+// architecture, as name-version.apk, and regenerates the index.
+func (r *repoServer) upload(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost && req.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.opts.UploadToken != "" {
+		token, ok := strings.CutPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(r.opts.UploadToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "missing or invalid upload token", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(w, req.Body, r.opts.MaxUploadSize))
+	if err != nil {
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			http.Error(w, fmt.Sprintf("package is larger than %d bytes", maxErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("reading package: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	pkg, err := apkrepo.ParsePackage(bytes.NewReader(data))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("parsing package: %v", err), http.StatusBadRequest)
+		return
+	}
+	if pkg.Arch == "" || strings.ContainsAny(pkg.Arch, "/\\") || strings.HasPrefix(pkg.Arch, ".") {
+		http.Error(w, fmt.Sprintf("invalid package architecture %q", pkg.Arch), http.StatusBadRequest)
+		return
+	}
+	name := fmt.Sprintf("%s-%s.apk", pkg.Name, pkg.Version)
+	if strings.ContainsAny(name, "/\\") || strings.HasPrefix(name, ".") {
+		http.Error(w, fmt.Sprintf("invalid package file name %q", name), http.StatusBadRequest)
+		return
+	}
+
+	if err := r.store(req.Context(), pkg.Arch, name, data); err != nil {
+		if errors.Is(err, index.ErrConflict) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		r.logger.Printf("ERROR: uploading %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	r.logger.Printf("uploaded %s/%s", pkg.Arch, name)
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintf(w, "/%s/%s\n", pkg.Arch, name)
+}
+
+// store writes the package to the directory of the architecture and
+// regenerates its index, unless the same package is already there.
+func (r *repoServer) store(ctx context.Context, arch, name string, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	archDir := filepath.Join(r.opts.Dir, arch)
+	if err := os.MkdirAll(archDir, 0755); err != nil {
+		return fmt.Errorf("creating directory of %s: %w", arch, err)
+	}
+
+	dest := filepath.Join(archDir, name)
+	existing, err := os.ReadFile(dest)
+	if err == nil {
+		if bytes.Equal(existing, data) {
+			return nil
+		}
+		if r.opts.FailOnConflict {
+			return fmt.Errorf("%w: %s/%s has a different content than the one in the repository", index.ErrConflict, arch, name)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(archDir, ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return err
+	}
+
+	if err := r.reindex(ctx, arch); err != nil {
+		return err
+	}
+	state, err := r.packageState(arch)
+	if err != nil {
+		return err
+	}
+	r.states[arch] = state
+
+	return nil
+}
@@ -0,0 +1,307 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+
+	"chainguard.dev/melange/pkg/internal/apktest"
+)
+
+// testRepoServer returns a server of an empty repository in a temporary
+// directory, logging to log.
+func testRepoServer(t *testing.T, log io.Writer, configure func(*serveRepoOpts)) *repoServer {
+	o := serveRepoOpts{
+		Dir:           t.TempDir(),
+		Interval:      time.Second,
+		MaxUploadSize: defaultMaxUploadSize,
+	}
+	if configure != nil {
+		configure(&o)
+	}
+	r, err := newRepoServer(o, &logrus.Logger{Out: log, Formatter: &logrus.TextFormatter{}, Level: logrus.InfoLevel})
+	require.NoError(t, err)
+	return r
+}
+
+// uploadPackage POSTs the package to the server, and returns the status
+// and body of the response.
+func uploadPackage(t *testing.T, srv *httptest.Server, data []byte, token string) (int, string) {
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/upload", bytes.NewReader(data))
+	require.NoError(t, err)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return resp.StatusCode, string(body)
+}
+
+// indexedPackages returns the packages in the index of the architecture, as
+// name-version.
+func indexedPackages(t *testing.T, dir, arch string) []string {
+	f, err := os.Open(filepath.Join(dir, arch, "APKINDEX.tar.gz"))
+	require.NoError(t, err)
+	idx, err := apkrepo.IndexFromArchive(f)
+	require.NoError(t, err)
+
+	pkgs := []string{}
+	for _, p := range idx.Packages {
+		pkgs = append(pkgs, p.Name+"-"+p.Version)
+	}
+	sort.Strings(pkgs)
+	return pkgs
+}
+
+func readTestApk(t *testing.T, path string) []byte {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	return data
+}
+
+func TestServeRepoUpload(t *testing.T) {
+	r := testRepoServer(t, io.Discard, nil)
+	srv := httptest.NewServer(r.handler())
+	defer srv.Close()
+
+	hello := readTestApk(t, emitTestPackage(t, t.TempDir(), "hello", "1.0", map[string]string{"usr/bin/hello": "hello"}, nil))
+	status, body := uploadPackage(t, srv, hello, "")
+	require.Equal(t, http.StatusCreated, status, body)
+	require.Equal(t, "/x86_64/hello-1.0-r0.apk\n", body)
+	require.Equal(t, []string{"hello-1.0-r0"}, indexedPackages(t, r.opts.Dir, "x86_64"))
+
+	// The uploaded package and the index are served.
+	for _, path := range []string{"/x86_64/hello-1.0-r0.apk", "/x86_64/APKINDEX.tar.gz"} {
+		resp, err := srv.Client().Get(srv.URL + path)
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode, path)
+	}
+
+	world := readTestApk(t, emitTestPackage(t, t.TempDir(), "world", "2.0", map[string]string{"usr/bin/world": "world"}, nil))
+	status, body = uploadPackage(t, srv, world, "")
+	require.Equal(t, http.StatusCreated, status, body)
+	require.Equal(t, []string{"hello-1.0-r0", "world-2.0-r0"}, indexedPackages(t, r.opts.Dir, "x86_64"))
+
+	resp, err := srv.Client().Get(srv.URL + "/upload")
+	require.NoError(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestServeRepoUploadConflict(t *testing.T) {
+	original := readTestApk(t, emitTestPackage(t, t.TempDir(), "hello", "1.0", map[string]string{"usr/bin/hello": "hello"}, nil))
+	rebuilt := readTestApk(t, emitTestPackage(t, t.TempDir(), "hello", "1.0", map[string]string{"usr/bin/hello": "rebuilt"}, nil))
+	require.NotEqual(t, original, rebuilt)
+
+	for _, tt := range []struct {
+		name           string
+		failOnConflict bool
+		status         int
+		want           []byte
+	}{{
+		name:   "replace",
+		status: http.StatusCreated,
+		want:   rebuilt,
+	}, {
+		name:           "fail on conflict",
+		failOnConflict: true,
+		status:         http.StatusConflict,
+		want:           original,
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRepoServer(t, io.Discard, func(o *serveRepoOpts) {
+				o.FailOnConflict = tt.failOnConflict
+			})
+			srv := httptest.NewServer(r.handler())
+			defer srv.Close()
+
+			status, body := uploadPackage(t, srv, original, "")
+			require.Equal(t, http.StatusCreated, status, body)
+
+			// The same package again is not a conflict.
+			status, body = uploadPackage(t, srv, original, "")
+			require.Equal(t, http.StatusCreated, status, body)
+
+			status, body = uploadPackage(t, srv, rebuilt, "")
+			require.Equal(t, tt.status, status, body)
+			require.Equal(t, tt.want, readTestApk(t, filepath.Join(r.opts.Dir, "x86_64", "hello-1.0-r0.apk")))
+		})
+	}
+}
+
+func TestServeRepoUploadInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		data   []byte
+		status int
+		body   string
+	}{{
+		name:   "not a package",
+		data:   []byte("not a package"),
+		status: http.StatusBadRequest,
+		body:   "parsing package",
+	}, {
+		name:   "no architecture",
+		data:   apktest.Apk(t, "pkgname = hello\npkgver = 1.0-r0\n", nil, nil),
+		status: http.StatusBadRequest,
+		body:   `invalid package architecture ""`,
+	}, {
+		name:   "architecture outside the repository",
+		data:   apktest.Apk(t, "pkgname = hello\npkgver = 1.0-r0\narch = ../x86_64\n", nil, nil),
+		status: http.StatusBadRequest,
+		body:   `invalid package architecture "../x86_64"`,
+	}, {
+		name:   "hidden architecture",
+		data:   apktest.Apk(t, "pkgname = hello\npkgver = 1.0-r0\narch = .x86_64\n", nil, nil),
+		status: http.StatusBadRequest,
+		body:   `invalid package architecture ".x86_64"`,
+	}, {
+		name:   "name outside the architecture",
+		data:   apktest.Apk(t, "pkgname = ../hello\npkgver = 1.0-r0\narch = x86_64\n", nil, nil),
+		status: http.StatusBadRequest,
+		body:   `invalid package file name "../hello-1.0-r0.apk"`,
+	}, {
+		name:   "hidden name",
+		data:   apktest.Apk(t, "pkgname = .hello\npkgver = 1.0-r0\narch = x86_64\n", nil, nil),
+		status: http.StatusBadRequest,
+		body:   `invalid package file name ".hello-1.0-r0.apk"`,
+	}, {
+		name:   "too large",
+		data:   bytes.Repeat([]byte{0}, 2048),
+		status: http.StatusRequestEntityTooLarge,
+		body:   "package is larger than 1024 bytes",
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			r := testRepoServer(t, io.Discard, func(o *serveRepoOpts) {
+				o.MaxUploadSize = 1024
+			})
+			srv := httptest.NewServer(r.handler())
+			defer srv.Close()
+
+			status, body := uploadPackage(t, srv, tt.data, "")
+			require.Equal(t, tt.status, status, body)
+			require.Contains(t, body, tt.body)
+
+			// Nothing is written to the repository.
+			entries, err := os.ReadDir(r.opts.Dir)
+			require.NoError(t, err)
+			require.Empty(t, entries)
+		})
+	}
+
+	_, err := newRepoServer(serveRepoOpts{Dir: t.TempDir()}, LogDefault())
+	require.ErrorContains(t, err, "invalid maximum upload size 0, must be positive")
+}
+
+func TestServeRepoUploadToken(t *testing.T) {
+	r := testRepoServer(t, io.Discard, func(o *serveRepoOpts) {
+		o.UploadToken = "s3cret"
+	})
+	srv := httptest.NewServer(r.handler())
+	defer srv.Close()
+
+	hello := readTestApk(t, emitTestPackage(t, t.TempDir(), "hello", "1.0", map[string]string{"usr/bin/hello": "hello"}, nil))
+	for _, token := range []string{"", "wrong", "s3cret2"} {
+		status, body := uploadPackage(t, srv, hello, token)
+		require.Equal(t, http.StatusUnauthorized, status, body)
+	}
+	_, err := os.Stat(filepath.Join(r.opts.Dir, "x86_64"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	status, body := uploadPackage(t, srv, hello, "s3cret")
+	require.Equal(t, http.StatusCreated, status, body)
+}
+
+func TestServeRepoReindexChanged(t *testing.T) {
+	var log bytes.Buffer
+	r := testRepoServer(t, &log, nil)
+	ctx := context.Background()
+
+	// Directories without packages or an index are not architectures.
+	require.NoError(t, os.MkdirAll(filepath.Join(r.opts.Dir, "empty"), 0o755))
+	require.NoError(t, r.reindexChanged(ctx))
+	_, err := os.Stat(filepath.Join(r.opts.Dir, "empty", "APKINDEX.tar.gz"))
+	require.ErrorIs(t, err, os.ErrNotExist)
+
+	hello := emitTestPackage(t, r.opts.Dir, "hello", "1.0", map[string]string{"usr/bin/hello": "hello"}, nil)
+	require.NoError(t, r.reindexChanged(ctx))
+	require.Equal(t, []string{"hello-1.0-r0"}, indexedPackages(t, r.opts.Dir, "x86_64"))
+
+	// The index is not regenerated while the packages are unchanged.
+	indexFile := filepath.Join(r.opts.Dir, "x86_64", "APKINDEX.tar.gz")
+	past := time.Now().Add(-time.Hour)
+	require.NoError(t, os.Chtimes(indexFile, past, past))
+	require.NoError(t, r.reindexChanged(ctx))
+	fi, err := os.Stat(indexFile)
+	require.NoError(t, err)
+	require.True(t, fi.ModTime().Equal(past))
+
+	emitTestPackage(t, r.opts.Dir, "world", "2.0", map[string]string{"usr/bin/world": "world"}, nil)
+	require.NoError(t, r.reindexChanged(ctx))
+	require.Equal(t, []string{"hello-1.0-r0", "world-2.0-r0"}, indexedPackages(t, r.opts.Dir, "x86_64"))
+
+	require.NoError(t, os.Remove(hello))
+	require.NoError(t, r.reindexChanged(ctx))
+	require.Equal(t, []string{"world-2.0-r0"}, indexedPackages(t, r.opts.Dir, "x86_64"))
+
+	// No temporary files are left behind.
+	matches, err := filepath.Glob(filepath.Join(r.opts.Dir, "x86_64", ".*"))
+	require.NoError(t, err)
+	require.Empty(t, matches)
+	require.False(t, strings.Contains(log.String(), "ERROR"), log.String())
+}
+
+func TestServeRepoCmdOptions(t *testing.T) {
+	err := serveRepoOpts{Dir: t.TempDir(), Addr: "localhost:0"}.ServeRepoCmd(context.Background())
+	require.ErrorContains(t, err, "invalid interval 0s, must be positive")
+
+	for _, tt := range []struct {
+		addr     string
+		loopback bool
+	}{
+		{"localhost:8080", true},
+		{"127.0.0.1:8080", true},
+		{"[::1]:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"192.0.2.1:8080", false},
+		{"repo.example.com:8080", false},
+	} {
+		loopback, err := isLoopback(tt.addr)
+		require.NoError(t, err)
+		require.Equal(t, tt.loopback, loopback, tt.addr)
+	}
+
+	_, err = isLoopback("localhost")
+	require.ErrorContains(t, err, `invalid address "localhost"`)
+}
@@ -22,6 +22,8 @@ import (
 	"io"
 	"log"
 	"os"
+	"strings"
+	"time"
 
 	"github.com/chainguard-dev/go-apk/pkg/expandapk"
 	sign "github.com/chainguard-dev/go-apk/pkg/signature"
@@ -32,8 +34,51 @@ import (
 	"chainguard.dev/melange/pkg/build"
 )
 
+// signingOpts are the options selecting the signers of the sign and
+// sign-index commands.
+type signingOpts struct {
+	Key       string
+	ExtraKeys []string
+	Algorithm string
+
+	SigningHelper        string
+	SigningHelperTimeout time.Duration
+
+	Keyless       bool
+	FulcioURL     string
+	OIDCTokenFile string
+}
+
+// simple returns whether the only signature is the SHA-1 signature with the
+// signing key.
+func (o signingOpts) simple() bool {
+	return o.SigningHelper == "" && !o.Keyless && len(o.ExtraKeys) == 0 && o.Algorithm != build.SignatureSHA256
+}
+
+// signers returns the signers: the signing helper, or else the keyless
+// signer, or else the signing key, followed by the extra signing keys.
+func (o signingOpts) signers() []build.ApkSigner {
+	b := &build.Build{
+		SigningKey:           o.Key,
+		SigningHelper:        o.SigningHelper,
+		SigningHelperTimeout: o.SigningHelperTimeout,
+		SigningAlgorithm:     o.Algorithm,
+		ExtraSigningKeys:     o.ExtraKeys,
+		Keyless:              o.Keyless,
+		FulcioURL:            o.FulcioURL,
+		OIDCTokenFile:        o.OIDCTokenFile,
+	}
+	if o.SigningHelper != "" || o.Keyless {
+		b.SigningKey = ""
+	}
+
+	pc := &build.PackageBuild{Build: b}
+	return pc.Signers()
+}
+
 type signIndexOpts struct {
-	Key   string
+	signingOpts
+
 	Force bool
 }
 
@@ -51,6 +96,15 @@ func SignIndex() *cobra.Command {
 
     # Sign a new index with a new signature
     melange sign-index [--signing-key=key.rsa] <APKINDEX.tar.gz> --force
+
+    # Sign an index with both the old and the new key while rotating keys
+    melange sign-index --signing-key=old.rsa --extra-signing-key=new.rsa <APKINDEX.tar.gz>
+
+    # Sign an index with a key held by a signing helper
+    melange sign-index --signing-helper=/path/to/helper <APKINDEX.tar.gz>
+
+    # Sign an index keylessly with a certificate for the OIDC identity
+    melange sign-index --keyless [--oidc-token-file=token] <APKINDEX.tar.gz>
     `,
 		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -59,7 +113,14 @@ func SignIndex() *cobra.Command {
 	}
 
 	cmd.Flags().StringVar(&o.Key, "signing-key", "melange.rsa", "the signing key to use")
+	cmd.Flags().StringSliceVar(&o.ExtraKeys, "extra-signing-key", []string{}, "additional signing keys to sign with, such as the new key while rotating keys")
+	cmd.Flags().StringVar(&o.Algorithm, "signing-algorithm", build.SignatureSHA1, "digest algorithm of RSA signatures (sha1, or sha256 for .SIGN.RSA256 signatures)")
 	cmd.Flags().BoolVarP(&o.Force, "force", "f", false, "when toggled, overwrites the specified index with a new index using the provided signature")
+	cmd.Flags().StringVar(&o.SigningHelper, "signing-helper", "", "external command to sign with instead of the signing key, for keys which cannot be exported such as in an HSM")
+	cmd.Flags().DurationVar(&o.SigningHelperTimeout, "signing-helper-timeout", build.DefaultSigningHelperTimeout, "how long the signing helper may take for each signature")
+	cmd.Flags().BoolVar(&o.Keyless, "keyless", false, "sign with a short-lived certificate issued for an OIDC identity instead of the signing key")
+	cmd.Flags().StringVar(&o.FulcioURL, "fulcio-url", build.DefaultFulcioURL, "URL of the Fulcio compatible certificate authority used for keyless signing")
+	cmd.Flags().StringVar(&o.OIDCTokenFile, "oidc-token-file", "", "file to read the OIDC token for keyless signing from (default is SIGSTORE_ID_TOKEN or the GitHub Actions token)")
 
 	return cmd
 }
@@ -67,6 +128,10 @@ func SignIndex() *cobra.Command {
 func (o signIndexOpts) SignIndex(ctx context.Context, indexFile string) error {
 	logger := LogDefault()
 
+	if !o.simple() {
+		return o.signIndexWith(ctx, indexFile, o.signers())
+	}
+
 	if !o.Force {
 		return sign.SignIndex(ctx, logger, o.Key, indexFile)
 	}
@@ -101,6 +166,91 @@ func (o signIndexOpts) SignIndex(ctx context.Context, indexFile string) error {
 	return os.Rename(t.Name(), indexFile)
 }
 
+// signIndexWith signs the index with the signers.  As with key signatures,
+// an index which is already signed is left alone unless forced.
+func (o signIndexOpts) signIndexWith(ctx context.Context, indexFile string, signers []build.ApkSigner) error {
+	logger := LogDefault()
+
+	sigName, err := indexSignatureName(indexFile)
+	if err != nil {
+		return err
+	}
+
+	var idx []byte
+	switch {
+	case sigName == "":
+		idx, err = os.ReadFile(indexFile)
+	case o.Force:
+		idx, err = parseIndexWithoutSignature(ctx, indexFile)
+	default:
+		logger.Printf("index %s is already signed (%s), doing nothing", indexFile, sigName)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(indexFile)
+	if err != nil {
+		return err
+	}
+
+	sig, err := build.EmitSignatures(ctx, signers, idx, fi.ModTime())
+	if err != nil {
+		return fmt.Errorf("signing index: %w", err)
+	}
+
+	t, err := os.Create(fmt.Sprintf("%s.new", indexFile))
+	if err != nil {
+		return err
+	}
+	defer t.Close()
+
+	for _, b := range [][]byte{sig, idx} {
+		if _, err := t.Write(b); err != nil {
+			return err
+		}
+	}
+
+	if err := t.Close(); err != nil {
+		return err
+	}
+
+	names := []string{}
+	for _, signer := range signers {
+		names = append(names, signer.SignatureName())
+	}
+
+	logger.Printf("Replacing index (%s) with index signed by %s", indexFile, strings.Join(names, ", "))
+	return os.Rename(t.Name(), indexFile)
+}
+
+// indexSignatureName returns the name of the signature of the index, or the
+// empty string if it is not signed.
+func indexSignatureName(indexFile string) (string, error) {
+	f, err := os.Open(indexFile)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	gr, err := gzip.NewReader(f)
+	if err != nil {
+		return "", err
+	}
+	defer gr.Close()
+
+	hdr, err := tar.NewReader(gr).Next()
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(hdr.Name, ".SIGN.") {
+		return hdr.Name, nil
+	}
+	return "", nil
+}
+
 // parseIndexWithoutSignature takes in an index file and returns the unsigned []byte representation of it
 func parseIndexWithoutSignature(_ context.Context, indexFile string) ([]byte, error) {
 	orig, err := os.Open(indexFile)
@@ -152,9 +302,10 @@ func parseIndexWithoutSignature(_ context.Context, indexFile string) ([]byte, er
 }
 
 type signOpts struct {
-	Key string
+	signingOpts
 
-	logger *log.Logger
+	logger  *log.Logger
+	signers []build.ApkSigner
 }
 
 func Sign() *cobra.Command {
@@ -170,6 +321,12 @@ func Sign() *cobra.Command {
 		melange sign [--signing-key=key.rsa] package.apk
 
 		melange sign [--signing-key=key.rsa] *.apk
+
+		melange sign --signing-key=old.rsa --extra-signing-key=new.rsa *.apk
+
+		melange sign --signing-helper=/path/to/helper *.apk
+
+		melange sign --keyless [--oidc-token-file=token] *.apk
 		`,
 		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
@@ -179,11 +336,22 @@ func Sign() *cobra.Command {
 	}
 
 	cmd.Flags().StringVarP(&o.Key, "signing-key", "k", "local-melange.rsa", "The signing key to use.")
+	cmd.Flags().StringSliceVar(&o.ExtraKeys, "extra-signing-key", []string{}, "Additional signing keys to sign with, such as the new key while rotating keys.")
+	cmd.Flags().StringVar(&o.Algorithm, "signing-algorithm", build.SignatureSHA1, "Digest algorithm of RSA signatures (sha1, or sha256 for .SIGN.RSA256 signatures).")
+	cmd.Flags().StringVar(&o.SigningHelper, "signing-helper", "", "External command to sign with instead of the signing key, for keys which cannot be exported such as in an HSM.")
+	cmd.Flags().DurationVar(&o.SigningHelperTimeout, "signing-helper-timeout", build.DefaultSigningHelperTimeout, "How long the signing helper may take for each signature.")
+	cmd.Flags().BoolVar(&o.Keyless, "keyless", false, "Sign with a short-lived certificate issued for an OIDC identity instead of the signing key.")
+	cmd.Flags().StringVar(&o.FulcioURL, "fulcio-url", build.DefaultFulcioURL, "URL of the Fulcio compatible certificate authority used for keyless signing.")
+	cmd.Flags().StringVar(&o.OIDCTokenFile, "oidc-token-file", "", "File to read the OIDC token for keyless signing from (default is SIGSTORE_ID_TOKEN or the GitHub Actions token).")
 
 	return cmd
 }
 
 func (o signOpts) RunAllE(ctx context.Context, pkgs ...string) error {
+	// The packages share the signers, so keyless signing requests a single
+	// certificate.
+	o.signers = o.signingOpts.signers()
+
 	g, ctx := errgroup.WithContext(ctx)
 
 	for _, pkg := range pkgs {
@@ -226,19 +394,12 @@ func (o signOpts) run(ctx context.Context, pkg string) error {
 		return err
 	}
 
-	pc := &build.PackageBuild{
-		Build: &build.Build{
-			SigningKey:        o.Key,
-			SigningPassphrase: "",
-		},
-	}
-
 	cdata, err := os.ReadFile(eapk.ControlFile)
 	if err != nil {
 		return err
 	}
 
-	sigData, err := build.EmitSignature(ctx, pc.Signer(), cdata, cfinfo.ModTime())
+	sigData, err := build.EmitSignatures(ctx, o.signers, cdata, cfinfo.ModTime())
 	if err != nil {
 		return err
 	}
@@ -26,11 +26,18 @@ func UpdateCache() *cobra.Command {
 	var cacheDir string
 
 	cmd := &cobra.Command{
-		Use:     "update-cache",
-		Short:   "Update a source artifact cache",
-		Long:    `Update a source artifact cache.`,
-		Example: `  melange update-cache --cache-dir <cache-dir> <config.yaml>`,
-		Args:    cobra.MinimumNArgs(1),
+		Use:   "update-cache",
+		Short: "Update a source artifact cache",
+		Long: `Update a source artifact cache.
+
+The cache is either a local directory, or a gs:// or s3:// bucket.  S3
+compatible object stores such as MinIO are addressed with the
+AWS_ENDPOINT_URL environment variable, and the credentials are read from
+AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.`,
+		Example: `  melange update-cache --cache-dir <cache-dir> <config.yaml>
+
+  AWS_ENDPOINT_URL=https://minio.example.com melange update-cache --cache-dir s3://bucket/melange-cache <config.yaml>`,
+		Args: cobra.MinimumNArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx, err := renovate.New(renovate.WithConfig(args[0]))
 			if err != nil {
@@ -50,7 +57,7 @@ func UpdateCache() *cobra.Command {
 		},
 	}
 
-	cmd.Flags().StringVar(&cacheDir, "cache-dir", "/var/cache/melange", "directory used for cached inputs")
+	cmd.Flags().StringVar(&cacheDir, "cache-dir", "/var/cache/melange", "directory or bucket used for cached inputs")
 
 	return cmd
 }
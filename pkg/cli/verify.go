@@ -0,0 +1,427 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/klauspost/compress/gzip"
+	"github.com/spf13/cobra"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/apkdiff"
+	"chainguard.dev/melange/pkg/build"
+)
+
+type verifyOpts struct {
+	keyringDir  string
+	fulcioRoots string
+	identity    build.FulcioIdentity
+}
+
+// Verify is a constructor for a cobra.Command which wraps the VerifyCmd function.
+func Verify() *cobra.Command {
+	o := &verifyOpts{}
+
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Verify the integrity of packages and indexes",
+		Long: `Verify the integrity of packages and indexes.
+
+For each package, checks that it is signed by a key of the keyring, that
+the datahash of its control section matches its data section, and that its
+files match their checksums.
+
+For each APKINDEX.tar.gz, checks that it is signed by a key of the keyring,
+and that the checksum of every package it lists matches the package file in
+the directory of the index.
+
+Keyless signatures are only trusted when their certificate chains to one
+of the --fulcio-roots, and was issued to the --certificate-identity as
+authenticated by the --certificate-oidc-issuer.
+
+Directories are verified as a repository: every package and the
+APKINDEX.tar.gz in the directory.  All the files are verified, and the
+command fails if any of them is not valid.`,
+		Example: `  melange verify --keyring-dir keys/ packages/x86_64
+  melange verify --fulcio-roots fulcio.pem \
+    --certificate-identity builder@example.com \
+    --certificate-oidc-issuer https://accounts.google.com foo-1.0.0-r0.apk`,
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return VerifyCmd(cmd.Context(), os.Stdout, args, o)
+		},
+	}
+
+	cmd.Flags().StringVar(&o.keyringDir, "keyring-dir", "/etc/apk/keys", "directory holding the public keys trusted to sign packages and indexes")
+	cmd.Flags().StringVar(&o.fulcioRoots, "fulcio-roots", "", "PEM file holding the root certificates trusted to issue keyless signing certificates")
+	cmd.Flags().StringVar(&o.identity.Subject, "certificate-identity", "", "email address or URI keyless signing certificates must have been issued to")
+	cmd.Flags().StringVar(&o.identity.Issuer, "certificate-oidc-issuer", "", "URL of the OIDC issuer which must have authenticated the identity of keyless signing certificates")
+
+	return cmd
+}
+
+// verifier verifies packages and indexes, remembering the checksums of the
+// packages it verified so an index does not expand them again.
+type verifier struct {
+	keyringDir string
+	roots      *x509.CertPool
+	identity   build.FulcioIdentity
+	checksums  map[string][]byte
+}
+
+// VerifyCmd is the backend implementation of the "melange verify" command.
+func VerifyCmd(ctx context.Context, w io.Writer, paths []string, o *verifyOpts) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "VerifyCmd")
+	defer span.End()
+
+	v := &verifier{keyringDir: o.keyringDir, identity: o.identity, checksums: map[string][]byte{}}
+	if o.fulcioRoots != "" {
+		if o.identity.Subject == "" || o.identity.Issuer == "" {
+			return errors.New("--fulcio-roots requires --certificate-identity and --certificate-oidc-issuer, as any identity could otherwise sign")
+		}
+
+		data, err := os.ReadFile(o.fulcioRoots)
+		if err != nil {
+			return fmt.Errorf("reading Fulcio roots: %w", err)
+		}
+		v.roots = x509.NewCertPool()
+		if !v.roots.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificates found in %s", o.fulcioRoots)
+		}
+	}
+
+	files := []string{}
+	for _, path := range paths {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			files = append(files, path)
+			continue
+		}
+
+		apks, err := filepath.Glob(filepath.Join(path, "*.apk"))
+		if err != nil {
+			return err
+		}
+		sort.Strings(apks)
+		files = append(files, apks...)
+
+		if _, err := os.Stat(filepath.Join(path, "APKINDEX.tar.gz")); err == nil {
+			files = append(files, filepath.Join(path, "APKINDEX.tar.gz"))
+		}
+	}
+
+	failed := 0
+	for _, file := range files {
+		var err error
+		if strings.HasSuffix(file, ".apk") {
+			err = v.verifyApk(ctx, file)
+		} else {
+			err = v.verifyIndex(ctx, file)
+		}
+
+		if err != nil {
+			fmt.Fprintf(w, "FAIL %s: %s\n", file, err)
+			failed++
+			continue
+		}
+		fmt.Fprintf(w, "OK   %s\n", file)
+	}
+
+	if failed != 0 {
+		return fmt.Errorf("%d of %d files failed verification", failed, len(files))
+	}
+
+	return nil
+}
+
+// verifyApk verifies the signature, datahash and file checksums of a package.
+// The file checksums are verified while the package is expanded.
+func (v *verifier) verifyApk(ctx context.Context, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	eapk, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return fmt.Errorf("expanding apk: %w", err)
+	}
+	defer eapk.Close()
+
+	if eapk.SignatureFile == "" {
+		return errors.New("package is not signed")
+	}
+
+	sigs, err := readSignatures(eapk.SignatureFile)
+	if err != nil {
+		return fmt.Errorf("reading signature: %w", err)
+	}
+
+	control, err := os.ReadFile(eapk.ControlFile)
+	if err != nil {
+		return err
+	}
+	if err := v.verifySignatures(sigs, control); err != nil {
+		return err
+	}
+
+	var pkgInfo apkdiff.PkgInfo
+	if err := readSectionFiles(eapk.ControlFile, func(hdr *tar.Header, r io.Reader) error {
+		if hdr.Name != ".PKGINFO" {
+			return nil
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		pkgInfo, err = apkdiff.ParsePkgInfo(data)
+		return err
+	}); err != nil {
+		return fmt.Errorf("reading control section: %w", err)
+	}
+	if pkgInfo == nil {
+		return errors.New("package has no .PKGINFO")
+	}
+
+	datahash := ""
+	if v := pkgInfo["datahash"]; len(v) != 0 {
+		datahash = v[0]
+	}
+	if got := hex.EncodeToString(eapk.PackageHash); datahash != got {
+		return fmt.Errorf("datahash %q does not match the data section (%s)", datahash, got)
+	}
+
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	v.checksums[abs] = eapk.ControlHash
+
+	return nil
+}
+
+// verifyIndex verifies the signature of an index, and that the packages it
+// lists are the package files next to it.
+func (v *verifier) verifyIndex(ctx context.Context, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	// The signature is the first gzip stream of the index, and is made over
+	// the rest of the file as it is.  bytes.Reader is an io.ByteReader, so the
+	// gzip reader does not read past the end of the stream.
+	br := bytes.NewReader(data)
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return err
+	}
+	zr.Multistream(false)
+
+	sigs := map[string][]byte{}
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) || (err == nil && !strings.HasPrefix(hdr.Name, ".SIGN.")) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("reading signature: %w", err)
+		}
+		if sigs[hdr.Name], err = io.ReadAll(tr); err != nil {
+			return fmt.Errorf("reading signature: %w", err)
+		}
+	}
+	if len(sigs) == 0 {
+		return errors.New("index is not signed")
+	}
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return fmt.Errorf("reading signature: %w", err)
+	}
+
+	if err := v.verifySignatures(sigs, data[len(data)-br.Len():]); err != nil {
+		return err
+	}
+
+	unsigned, err := parseIndexWithoutSignature(ctx, path)
+	if err != nil {
+		return fmt.Errorf("parsing index: %w", err)
+	}
+	idx, err := apkrepo.IndexFromArchive(io.NopCloser(bytes.NewReader(unsigned)))
+	if err != nil {
+		return fmt.Errorf("parsing index: %w", err)
+	}
+
+	var errs []error
+	for _, pkg := range idx.Packages {
+		apk := filepath.Join(filepath.Dir(path), fmt.Sprintf("%s-%s.apk", pkg.Name, pkg.Version))
+		checksum, err := v.checksum(ctx, apk)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s-%s: %w", pkg.Name, pkg.Version, err))
+			continue
+		}
+		if !bytes.Equal(checksum, pkg.Checksum) {
+			errs = append(errs, fmt.Errorf("%s-%s: checksum in index does not match %s", pkg.Name, pkg.Version, apk))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// checksum returns the checksum of the control section of the package, as
+// listed in indexes.
+func (v *verifier) checksum(ctx context.Context, path string) ([]byte, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	if checksum, ok := v.checksums[abs]; ok {
+		return checksum, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	eapk, err := expandapk.ExpandApk(ctx, f, "")
+	if err != nil {
+		return nil, fmt.Errorf("expanding apk: %w", err)
+	}
+	defer eapk.Close()
+
+	v.checksums[abs] = eapk.ControlHash
+	return eapk.ControlHash, nil
+}
+
+// readSignatures returns the signatures in a signature section by name.
+func readSignatures(path string) (map[string][]byte, error) {
+	sigs := map[string][]byte{}
+	if err := readSectionFiles(path, func(hdr *tar.Header, r io.Reader) error {
+		sig, err := io.ReadAll(r)
+		sigs[hdr.Name] = sig
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	return sigs, nil
+}
+
+// verifySignatures checks that at least one of the signatures over data was
+// made by a trusted key, as apk-tools does.
+func (v *verifier) verifySignatures(sigs map[string][]byte, data []byte) error {
+	names := make([]string, 0, len(sigs))
+	for name := range sigs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var errs []error
+	for _, name := range names {
+		err := v.verifySignature(name, sigs[name], data)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+
+	return fmt.Errorf("no valid signature by a trusted key: %w", errors.Join(errs...))
+}
+
+func (v *verifier) verifySignature(name string, sig, data []byte) error {
+	typ, key, ok := parseSignatureName(name)
+	if !ok {
+		return errors.New("not a signature")
+	}
+
+	var hash crypto.Hash
+	var digest []byte
+	switch typ {
+	case "RSA":
+		sum := sha1.Sum(data)
+		hash, digest = crypto.SHA1, sum[:]
+	case "RSA256":
+		sum := sha256.Sum256(data)
+		hash, digest = crypto.SHA256, sum[:]
+	case "FULCIO":
+		if v.roots == nil {
+			return errors.New("keyless signature, but no Fulcio roots are trusted")
+		}
+		_, err := build.VerifyFulcioSignature(data, sig, v.roots, v.identity)
+		return err
+	default:
+		return fmt.Errorf("unsupported signature type %s", typ)
+	}
+
+	pub, err := v.publicKey(key)
+	if err != nil {
+		return err
+	}
+
+	return rsa.VerifyPKCS1v15(pub, hash, digest, sig)
+}
+
+// publicKey reads the public key installed as name in the keyring.
+func (v *verifier) publicKey(name string) (*rsa.PublicKey, error) {
+	if name != filepath.Base(name) {
+		return nil, fmt.Errorf("invalid key name %q", name)
+	}
+
+	data, err := os.ReadFile(filepath.Join(v.keyringDir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("key %s is not in the keyring", name)
+	} else if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in key %s", name)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("parsing key %s: %w", name, err)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("key %s is not an RSA key", name)
+	}
+
+	return rsaPub, nil
+}
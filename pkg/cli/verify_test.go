@@ -0,0 +1,211 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/index"
+)
+
+// verifyFixture holds a trusted key, whose public key is in the keyring, and
+// an untrusted one.
+type verifyFixture struct {
+	keyring   string
+	trusted   string
+	untrusted string
+}
+
+func newVerifyFixture(t *testing.T) *verifyFixture {
+	dir := t.TempDir()
+	keyring := filepath.Join(dir, "keys")
+	return &verifyFixture{
+		keyring:   keyring,
+		trusted:   testKey(t, dir, keyring, "trusted.rsa"),
+		untrusted: testKey(t, dir, "", "untrusted.rsa"),
+	}
+}
+
+func (f *verifyFixture) verify(t *testing.T, paths ...string) (string, error) {
+	var out bytes.Buffer
+	err := VerifyCmd(context.Background(), &out, paths, &verifyOpts{keyringDir: f.keyring})
+	return out.String(), err
+}
+
+// writeIndex writes an index of the packages next to them, signed with key.
+func writeIndex(t *testing.T, key string, apks ...string) string {
+	indexFile := filepath.Join(filepath.Dir(apks[0]), "APKINDEX.tar.gz")
+	idx, err := index.New(
+		index.WithIndexFile(indexFile),
+		index.WithPackageFiles(apks),
+		index.WithSigningKey(key),
+	)
+	require.NoError(t, err)
+	idx.Logger.Out = io.Discard
+	require.NoError(t, idx.GenerateIndex(context.Background()))
+	return indexFile
+}
+
+func TestVerifyPackages(t *testing.T) {
+	f := newVerifyFixture(t)
+	files := map[string]string{"usr/bin/hello": "hello"}
+
+	for _, tt := range []struct {
+		name      string
+		configure func(*build.Build)
+		sigs      []string
+		err       string
+	}{{
+		name:      "signed with a trusted key",
+		configure: withSigningKey(f.trusted),
+		sigs:      []string{".SIGN.RSA.trusted.rsa.pub"},
+	}, {
+		name: "signed with SHA-256",
+		configure: func(b *build.Build) {
+			b.SigningKey = f.trusted
+			b.SigningAlgorithm = build.SignatureSHA256
+		},
+		sigs: []string{".SIGN.RSA256.trusted.rsa.pub"},
+	}, {
+		name: "signed by a trusted key among others",
+		configure: func(b *build.Build) {
+			b.SigningKey = f.untrusted
+			b.ExtraSigningKeys = []string{f.trusted}
+		},
+		sigs: []string{".SIGN.RSA.trusted.rsa.pub", ".SIGN.RSA.untrusted.rsa.pub"},
+	}, {
+		name:      "signed with an unknown key",
+		configure: withSigningKey(f.untrusted),
+		err:       "key untrusted.rsa.pub is not in the keyring",
+	}, {
+		name: "signed by unknown keys only",
+		configure: func(b *build.Build) {
+			b.SigningKey = f.untrusted
+			b.SigningAlgorithm = build.SignatureSHA256
+			b.ExtraSigningKeys = []string{f.untrusted}
+		},
+		err: "no valid signature by a trusted key",
+	}, {
+		name: "unsigned",
+		err:  "package is not signed",
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			apk := emitTestPackage(t, t.TempDir(), "hello", "1.0", files, tt.configure)
+
+			out, err := f.verify(t, apk)
+			if tt.err == "" {
+				require.NoError(t, err)
+				require.Equal(t, "OK   "+apk+"\n", out)
+				require.ElementsMatch(t, tt.sigs, signatureNames(t, apk))
+				return
+			}
+			require.ErrorContains(t, err, "1 of 1 files failed verification")
+			require.Contains(t, out, "FAIL "+apk+": ")
+			require.Contains(t, out, tt.err)
+		})
+	}
+}
+
+// signatureNames returns the names of the signatures of the package.
+func signatureNames(t *testing.T, apk string) []string {
+	f, err := os.Open(apk)
+	require.NoError(t, err)
+	defer f.Close()
+	eapk, err := expandapk.ExpandApk(context.Background(), f, "")
+	require.NoError(t, err)
+	defer eapk.Close()
+
+	sigs, err := readSignatures(eapk.SignatureFile)
+	require.NoError(t, err)
+	names := []string{}
+	for name := range sigs {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestVerifyTamperedData(t *testing.T) {
+	f := newVerifyFixture(t)
+	first := emitTestPackage(t, t.TempDir(), "hello", "1.0", map[string]string{"usr/bin/hello": "hello"}, withSigningKey(f.trusted))
+	second := emitTestPackage(t, t.TempDir(), "hello", "1.0", map[string]string{"usr/bin/hello": "pwned"}, withSigningKey(f.trusted))
+	tampered := filepath.Join(t.TempDir(), "hello-1.0-r0.apk")
+	spliceApk(t, first, second, tampered)
+
+	out, err := f.verify(t, tampered)
+	require.Error(t, err)
+	require.Contains(t, out, "does not match the data section")
+}
+
+func TestVerifyRepository(t *testing.T) {
+	f := newVerifyFixture(t)
+	outDir := t.TempDir()
+	hello := emitTestPackage(t, outDir, "hello", "1.0", map[string]string{"usr/bin/hello": "hello"}, withSigningKey(f.trusted))
+	world := emitTestPackage(t, outDir, "world", "2.0", map[string]string{"usr/bin/world": "world"}, withSigningKey(f.trusted))
+	repo := filepath.Dir(hello)
+	indexFile := writeIndex(t, f.trusted, hello, world)
+
+	out, err := f.verify(t, repo)
+	require.NoError(t, err)
+	require.Equal(t, "OK   "+hello+"\nOK   "+world+"\nOK   "+indexFile+"\n", out)
+
+	// A package replaced after the index was written no longer matches its
+	// checksum in the index.
+	rebuilt := emitTestPackage(t, t.TempDir(), "world", "2.0", map[string]string{"usr/bin/world": "rebuilt"}, withSigningKey(f.trusted))
+	data, err := os.ReadFile(rebuilt)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(world, data, 0o644))
+
+	out, err = f.verify(t, repo)
+	require.ErrorContains(t, err, "1 of 3 files failed verification")
+	require.Contains(t, out, "OK   "+world+"\n")
+	require.Contains(t, out, "FAIL "+indexFile+": world-2.0-r0: checksum in index does not match "+world)
+
+	// An index signed by an unknown key is not trusted.
+	indexFile = writeIndex(t, f.untrusted, hello, world)
+	out, err = f.verify(t, indexFile)
+	require.Error(t, err)
+	require.Contains(t, out, "key untrusted.rsa.pub is not in the keyring")
+}
+
+func TestVerifyKeyless(t *testing.T) {
+	f := newVerifyFixture(t)
+	roots := filepath.Join(t.TempDir(), "fulcio.pem")
+	require.NoError(t, os.WriteFile(roots, []byte("not a certificate"), 0o644))
+	apk := emitTestPackage(t, t.TempDir(), "hello", "1.0", map[string]string{"usr/bin/hello": "hello"}, withSigningKey(f.trusted))
+
+	// Roots are not trusted for any identity.
+	err := VerifyCmd(context.Background(), io.Discard, []string{apk}, &verifyOpts{keyringDir: f.keyring, fulcioRoots: roots})
+	require.ErrorContains(t, err, "--fulcio-roots requires --certificate-identity and --certificate-oidc-issuer")
+
+	err = VerifyCmd(context.Background(), io.Discard, []string{apk}, &verifyOpts{
+		keyringDir:  f.keyring,
+		fulcioRoots: roots,
+		identity:    build.FulcioIdentity{Subject: "builder@example.com", Issuer: "https://oidc.example.com"},
+	})
+	require.ErrorContains(t, err, "no certificates found in "+roots)
+
+	// Without roots, keyless signatures are refused.
+	v := &verifier{keyringDir: f.keyring}
+	require.ErrorContains(t, v.verifySignature(".SIGN.FULCIO.builder@example.com.pem", nil, nil), "no Fulcio roots are trusted")
+}
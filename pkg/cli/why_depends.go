@@ -0,0 +1,108 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package cli
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/spf13/cobra"
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/build"
+)
+
+// WhyDepends is a constructor for a cobra.Command which wraps the WhyDependsCmd function.
+func WhyDepends() *cobra.Command {
+	var dependencyLog string
+
+	cmd := &cobra.Command{
+		Use:   "why-depends",
+		Short: "Explain why a package has a dependency",
+		Long: `Explain why a package has a dependency.
+
+Looks the package up in the dependency log written by "melange build
+--dependency-log" and prints, for each matching runtime dependency, provide
+or vendored entry, the file which caused it and the generator which added it.
+
+The dependency matches either exactly or by name, ignoring any version
+constraint.  When the dependency log is given without the architecture
+suffix, the architecture of the package is appended.`,
+		Example: `  melange why-depends --dependency-log deps.json foo-1.0.0-r0.apk so:libfoo.so.1`,
+		Args:    cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return WhyDependsCmd(cmd.Context(), os.Stdout, args[0], args[1], dependencyLog)
+		},
+	}
+
+	cmd.Flags().StringVar(&dependencyLog, "dependency-log", "", "the dependency log written by melange build")
+	_ = cmd.MarkFlagRequired("dependency-log")
+
+	return cmd
+}
+
+// WhyDependsCmd is the backend implementation of the "melange why-depends" command.
+func WhyDependsCmd(ctx context.Context, w io.Writer, apkPath, dep, logPath string) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "WhyDependsCmd")
+	defer span.End()
+
+	inspection, err := InspectApk(ctx, apkPath)
+	if err != nil {
+		return err
+	}
+
+	field := func(name string) string {
+		if v := inspection.PkgInfo[name]; len(v) != 0 {
+			return v[0]
+		}
+		return ""
+	}
+	pkgname, pkgver, arch := field("pkgname"), field("pkgver"), field("arch")
+
+	depLog, err := build.ReadDependencyLog(logPath)
+	if errors.Is(err, fs.ErrNotExist) && arch != "" {
+		depLog, err = build.ReadDependencyLog(fmt.Sprintf("%s.%s", logPath, arch))
+	}
+	if err != nil {
+		return fmt.Errorf("reading dependency log: %w", err)
+	}
+
+	pkgLog, ok := depLog.Packages[pkgname]
+	if !ok {
+		return fmt.Errorf("%s is not in the dependency log", pkgname)
+	}
+	if pkgLog.Version != pkgver {
+		return fmt.Errorf("the dependency log is for %s-%s, not %s-%s", pkgname, pkgLog.Version, pkgname, pkgver)
+	}
+
+	matches := pkgLog.Why(dep)
+	if len(matches) == 0 {
+		return fmt.Errorf("%s-%s has no dependency on %s", pkgname, pkgver, dep)
+	}
+
+	for _, m := range matches {
+		line := fmt.Sprintf("%s (%s)", m.Dependency, m.Kind)
+		if m.File != "" {
+			line += " from " + m.File
+		}
+		fmt.Fprintf(w, "%s [%s]\n", line, m.Generator)
+	}
+
+	return nil
+}
@@ -20,6 +20,7 @@ import (
 	"fmt"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
 	"slices"
@@ -76,6 +77,18 @@ type PackageOption struct {
 	NoDepends bool `yaml:"no-depends"`
 	// Optional: Mark this package as not providing any executables
 	NoCommands bool `yaml:"no-commands"`
+	// Optional: Generate pc: runtime dependencies, with their version
+	// constraints, from the requirements of the pkg-config files in this package
+	PkgConfigDepends bool `yaml:"pkg-config-depends,omitempty"`
+	// Optional: Turn dependency generators on or off
+	DependencyGenerators DependencyGenerators `yaml:"dependency-generators,omitempty"`
+}
+
+type DependencyGenerators struct {
+	// Optional: enable these dependency generators that are not enabled by default.
+	Enabled []string `yaml:"enabled,omitempty"`
+	// Optional: disable these dependency generators.
+	Disabled []string `yaml:"disabled,omitempty"`
 }
 
 type Checks struct {
@@ -83,6 +96,13 @@ type Checks struct {
 	Enabled []string `yaml:"enabled,omitempty"`
 	// Optional: disable these linters that are not enabled by default.
 	Disabled []string `yaml:"disabled,omitempty"`
+	// Optional: override the severity of linters, one of error, warn or off.
+	// Linters set to off are disabled.
+	Severity map[string]string `yaml:"severity,omitempty"`
+	// Optional: paths, as globs relative to the package root, which the named
+	// linters should not report.  A pattern matching a directory exempts
+	// everything below it.
+	Exemptions map[string][]string `yaml:"exemptions,omitempty"`
 }
 
 type Package struct {
@@ -207,7 +227,7 @@ func (p *Package) FullCopyright() string {
 // Computes the list of package or subpackage linters, taking into account default linters.
 // This includes the default linters as well, unless disabled.
 func (chk *Checks) GetLinters() []string {
-	linters := defaultLinters
+	linters := slices.Clone(defaultLinters)
 
 	// Enable non-default linters
 	for _, v := range chk.Enabled {
@@ -218,7 +238,9 @@ func (chk *Checks) GetLinters() []string {
 	}
 
 	// Filter linters
-	linters = slices.DeleteFunc(linters, func(n string) bool { return slices.Contains(chk.Disabled, n) })
+	linters = slices.DeleteFunc(linters, func(n string) bool {
+		return slices.Contains(chk.Disabled, n) || chk.Severity[n] == "off"
+	})
 
 	return linters
 }
@@ -353,6 +375,27 @@ type Configuration struct {
 	root *yaml.Node
 }
 
+// validate checks the severity overrides and exemption patterns.
+func (chk *Checks) validate() error {
+	for name, severity := range chk.Severity {
+		switch severity {
+		case "error", "warn", "off":
+		default:
+			return fmt.Errorf("linter %s has invalid severity %q, must be error, warn or off", name, severity)
+		}
+	}
+
+	for name, patterns := range chk.Exemptions {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("linter %s has invalid exemption %q: %w", name, pattern, err)
+			}
+		}
+	}
+
+	return nil
+}
+
 // Name returns a name for the configuration, using the package name.
 func (cfg Configuration) Name() string {
 	return cfg.Package.Name
@@ -700,6 +743,7 @@ func ParseConfiguration(configurationFilePath string, opts ...ConfigurationParsi
 				Options: sp.Options,
 				URL:     replacer.Replace(sp.URL),
 				If:      replacer.Replace(sp.If),
+				Checks:  sp.Checks,
 			}
 			for _, p := range sp.Pipeline {
 				// take a copy of the with map, so we can replace the values
@@ -860,10 +904,17 @@ func (cfg Configuration) validate() error {
 
 	// TODO: try to validate value of .package.version
 
+	if err := cfg.Package.Checks.validate(); err != nil {
+		return ErrInvalidConfiguration{Problem: fmt.Errorf("package checks: %w", err)}
+	}
+
 	for i, sp := range cfg.Subpackages {
 		if !packageNameRegex.MatchString(sp.Name) {
 			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage name %q (subpackages index: %d) must match regex %q", sp.Name, i, packageNameRegex)}
 		}
+		if err := sp.Checks.validate(); err != nil {
+			return ErrInvalidConfiguration{Problem: fmt.Errorf("subpackage %q checks: %w", sp.Name, err)}
+		}
 	}
 
 	return nil
@@ -189,3 +189,61 @@ pipeline:
 	require.Equal(t, "/home/build/baz", cfg.Pipeline[1].Pipeline[0].Pipeline[1].WorkDir)
 	require.Equal(t, "/home/build/baz", cfg.Pipeline[1].Pipeline[0].Pipeline[2].WorkDir)
 }
+
+func Test_checks(t *testing.T) {
+	fp := filepath.Join(t.TempDir(), "melange-test-checks")
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: checks
+  version: 0.0.1
+  epoch: 0
+  checks:
+    disabled:
+      - strip
+    severity:
+      usrlocal: error
+      opt: off
+    exemptions:
+      setuidgid:
+        - usr/bin/sudo
+
+data:
+  - name: flavours
+    items:
+      a: A
+
+subpackages:
+  - range: flavours
+    name: checks-${{range.key}}
+    checks:
+      severity:
+        dev: error
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ParseConfiguration(fp)
+	if err != nil {
+		t.Fatalf("failed to parse configuration: %s", err)
+	}
+
+	linters := cfg.Package.Checks.GetLinters()
+	require.NotContains(t, linters, "strip")
+	require.NotContains(t, linters, "opt")
+	require.Contains(t, linters, "usrlocal")
+	require.Equal(t, []string{"usr/bin/sudo"}, cfg.Package.Checks.Exemptions["setuidgid"])
+	require.Equal(t, map[string]string{"dev": "error"}, cfg.Subpackages[0].Checks.Severity)
+
+	if err := os.WriteFile(fp, []byte(`
+package:
+  name: checks
+  version: 0.0.1
+  epoch: 0
+  checks:
+    severity:
+      usrlocal: fatal
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err = ParseConfiguration(fp)
+	require.ErrorContains(t, err, `invalid severity "fatal"`)
+}
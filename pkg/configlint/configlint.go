@@ -0,0 +1,365 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package configlint checks melange configuration files for common mistakes
+// by inspecting the YAML node tree, and fixes the ones it can.
+package configlint
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+
+	"github.com/dprotaso/go-yit"
+	"gopkg.in/yaml.v3"
+
+	"chainguard.dev/melange/pkg/renovate"
+	"chainguard.dev/melange/pkg/util"
+)
+
+// fixFunc corrects a finding by editing the YAML node tree.
+type fixFunc func(ctx context.Context, rc *renovate.RenovationContext) error
+
+// Finding is a problem found in a configuration file.
+type Finding struct {
+	// Check is the name of the check which reported the finding.
+	Check string
+	// Line is the line of the configuration file the finding refers to.
+	Line    int
+	Message string
+	// Fixed is set once the finding has been corrected by Fix.
+	Fixed bool
+
+	fix fixFunc
+}
+
+// Fixable reports whether the finding can be corrected automatically.
+func (f Finding) Fixable() bool {
+	return f.fix != nil
+}
+
+type check struct {
+	Name  string
+	Check func(root *yaml.Node) []Finding
+}
+
+var checks = []check{
+	{Name: "git-checkout-expected-commit", Check: checkGitCheckout},
+	{Name: "fetch-checksum", Check: checkFetch},
+	{Name: "copyright", Check: checkCopyright},
+	{Name: "duplicate-subpackage", Check: checkDuplicateSubpackages},
+	{Name: "target-architecture-all", Check: checkTargetArchitecture},
+	{Name: "update-monitor", Check: checkUpdateMonitor},
+}
+
+// Lint runs every check against the configuration loaded into rc.
+func Lint(rc *renovate.RenovationContext) []Finding {
+	root := rc.Configuration.Root().Content[0]
+
+	findings := []Finding{}
+	for _, c := range checks {
+		for _, f := range c.Check(root) {
+			f.Check = c.Name
+			findings = append(findings, f)
+		}
+	}
+
+	sort.SliceStable(findings, func(i, j int) bool {
+		return findings[i].Line < findings[j].Line
+	})
+
+	return findings
+}
+
+// Fix corrects the fixable findings in the YAML node tree of rc.  The caller
+// is responsible for writing the configuration back with rc.WriteConfig.
+func Fix(ctx context.Context, rc *renovate.RenovationContext, findings []Finding) error {
+	for i := range findings {
+		if !findings[i].Fixable() {
+			continue
+		}
+
+		if err := findings[i].fix(ctx, rc); err != nil {
+			return fmt.Errorf("fixing %s at line %d: %w", findings[i].Check, findings[i].Line, err)
+		}
+		findings[i].Fixed = true
+	}
+
+	return nil
+}
+
+// mapValue returns the value for key in a mapping node, or nil.
+func mapValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return nil
+}
+
+// removeKey removes key and its value from a mapping node.
+func removeKey(node *yaml.Node, key string) {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content = append(node.Content[:i], node.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// setKey sets key to value in a mapping node, adding it if necessary.
+func setKey(node *yaml.Node, key, value string) {
+	if v := mapValue(node, key); v != nil {
+		v.Value = value
+		return
+	}
+
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value},
+	)
+}
+
+// pipelineSteps returns every step which uses the named pipeline.
+func pipelineSteps(root *yaml.Node, uses string) []*yaml.Node {
+	it := yit.FromNode(root).
+		RecurseNodes().
+		Filter(yit.WithMapKeyValue(yit.WithValue("uses"), yit.WithValue(uses)))
+
+	steps := []*yaml.Node{}
+	for node, ok := it(); ok; node, ok = it() {
+		steps = append(steps, node)
+	}
+
+	return steps
+}
+
+func checkGitCheckout(root *yaml.Node) []Finding {
+	findings := []Finding{}
+	for _, step := range pipelineSteps(root, "git-checkout") {
+		with := mapValue(step, "with")
+		if v := mapValue(with, "expected-commit"); v != nil && v.Value != "" {
+			continue
+		}
+
+		f := Finding{Line: step.Line, Message: "git-checkout does not set expected-commit"}
+		if mapValue(with, "repository") != nil && mapValue(with, "tag") != nil {
+			f.fix = fixGitCheckout(with)
+		}
+		findings = append(findings, f)
+	}
+
+	return findings
+}
+
+// fixGitCheckout resolves the tag of a git-checkout step to the commit it
+// points at.
+func fixGitCheckout(with *yaml.Node) fixFunc {
+	return func(ctx context.Context, rc *renovate.RenovationContext) error {
+		repository, err := util.MutateStringFromMap(rc.Vars, mapValue(with, "repository").Value)
+		if err != nil {
+			return err
+		}
+		tag, err := util.MutateStringFromMap(rc.Vars, mapValue(with, "tag").Value)
+		if err != nil {
+			return err
+		}
+
+		commit, err := resolveTag(ctx, repository, tag)
+		if err != nil {
+			return err
+		}
+
+		setKey(with, "expected-commit", commit)
+		return nil
+	}
+}
+
+// resolveTag returns the commit a tag in a remote repository points at,
+// peeling annotated tags.
+func resolveTag(ctx context.Context, repository, tag string) (string, error) {
+	ref := "refs/tags/" + tag
+	out, err := exec.CommandContext(ctx, "git", "ls-remote", repository, ref, ref+"^{}").Output()
+	if err != nil {
+		return "", fmt.Errorf("listing %s in %s: %w", ref, repository, err)
+	}
+
+	commit := ""
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		sha, name, ok := strings.Cut(s.Text(), "\t")
+		if !ok {
+			continue
+		}
+		if name == ref+"^{}" {
+			return sha, nil
+		}
+		if name == ref {
+			commit = sha
+		}
+	}
+
+	if commit == "" {
+		return "", fmt.Errorf("tag %s not found in %s", tag, repository)
+	}
+
+	return commit, nil
+}
+
+func checkFetch(root *yaml.Node) []Finding {
+	findings := []Finding{}
+	for _, step := range pipelineSteps(root, "fetch") {
+		with := mapValue(step, "with")
+		if v := mapValue(with, "expected-sha256"); v != nil && v.Value != "" {
+			continue
+		}
+		if v := mapValue(with, "expected-sha512"); v != nil && v.Value != "" {
+			continue
+		}
+
+		f := Finding{Line: step.Line, Message: "fetch sets neither expected-sha256 nor expected-sha512"}
+		if mapValue(with, "uri") != nil {
+			f.fix = fixFetch(with)
+		}
+		findings = append(findings, f)
+	}
+
+	return findings
+}
+
+// fixFetch downloads the artifact of a fetch step and records its SHA256.
+func fixFetch(with *yaml.Node) fixFunc {
+	return func(ctx context.Context, rc *renovate.RenovationContext) error {
+		uri, err := util.MutateStringFromMap(rc.Vars, mapValue(with, "uri").Value)
+		if err != nil {
+			return err
+		}
+
+		downloadedFile, err := util.DownloadFile(ctx, uri)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(downloadedFile)
+
+		digest, err := util.HashFile(downloadedFile, sha256.New())
+		if err != nil {
+			return err
+		}
+
+		setKey(with, "expected-sha256", digest)
+		return nil
+	}
+}
+
+func checkCopyright(root *yaml.Node) []Finding {
+	pkg := mapValue(root, "package")
+	if pkg == nil {
+		return nil
+	}
+
+	copyright := mapValue(pkg, "copyright")
+	if copyright == nil || copyright.Kind != yaml.SequenceNode || len(copyright.Content) == 0 {
+		return []Finding{{Line: pkg.Line, Message: "package does not declare a copyright"}}
+	}
+
+	findings := []Finding{}
+	for _, cp := range copyright.Content {
+		if v := mapValue(cp, "license"); v == nil || v.Value == "" {
+			findings = append(findings, Finding{Line: cp.Line, Message: "copyright entry does not declare a license"})
+		}
+	}
+
+	return findings
+}
+
+func checkDuplicateSubpackages(root *yaml.Node) []Finding {
+	seen := map[string]int{}
+	if name := mapValue(mapValue(root, "package"), "name"); name != nil {
+		seen[name.Value] = name.Line
+	}
+
+	subpackages := mapValue(root, "subpackages")
+	if subpackages == nil {
+		return nil
+	}
+
+	findings := []Finding{}
+	for _, sp := range subpackages.Content {
+		// Names of ranged subpackages are templates which are expanded
+		// when the configuration is parsed.
+		if mapValue(sp, "range") != nil {
+			continue
+		}
+
+		name := mapValue(sp, "name")
+		if name == nil {
+			continue
+		}
+
+		if line, ok := seen[name.Value]; ok {
+			findings = append(findings, Finding{
+				Line:    name.Line,
+				Message: fmt.Sprintf("package name %q is already used at line %d", name.Value, line),
+			})
+			continue
+		}
+		seen[name.Value] = name.Line
+	}
+
+	return findings
+}
+
+func checkTargetArchitecture(root *yaml.Node) []Finding {
+	pkg := mapValue(root, "package")
+	archs := mapValue(pkg, "target-architecture")
+	if archs == nil || archs.Kind != yaml.SequenceNode || len(archs.Content) != 1 || archs.Content[0].Value != "all" {
+		return nil
+	}
+
+	return []Finding{{
+		Line:    archs.Line,
+		Message: "target-architecture: [all] is deprecated; remove it to build for all architectures",
+		fix: func(context.Context, *renovate.RenovationContext) error {
+			removeKey(pkg, "target-architecture")
+			return nil
+		},
+	}}
+}
+
+func checkUpdateMonitor(root *yaml.Node) []Finding {
+	update := mapValue(root, "update")
+	if v := mapValue(update, "enabled"); v == nil || v.Value != "true" {
+		return nil
+	}
+	if v := mapValue(update, "manual"); v != nil && v.Value == "true" {
+		return nil
+	}
+	if mapValue(update, "release-monitor") != nil || mapValue(update, "github") != nil {
+		return nil
+	}
+
+	return []Finding{{Line: update.Line, Message: "update is enabled but neither release-monitor nor github is configured"}}
+}
@@ -0,0 +1,105 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package configlint
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/renovate"
+)
+
+func loadConfig(t *testing.T, path string) *renovate.RenovationContext {
+	t.Helper()
+
+	c, err := renovate.New(renovate.WithConfig(path))
+	require.NoError(t, err)
+
+	rc := &renovate.RenovationContext{Context: c}
+	require.NoError(t, rc.LoadConfig())
+	return rc
+}
+
+func TestLint_clean(t *testing.T) {
+	rc := loadConfig(t, filepath.Join("testdata", "clean.yaml"))
+	require.Empty(t, Lint(rc))
+}
+
+func TestLint_fix(t *testing.T) {
+	tarball, err := os.ReadFile(filepath.Join("testdata", "cheese-7.0.1.tar.gz"))
+	require.NoError(t, err)
+
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		require.Equal(t, "/wine/cheese/cheese-7.0.1.tar.gz", req.URL.String())
+		_, err := rw.Write(tarball)
+		require.NoError(t, err)
+	}))
+	defer server.Close()
+
+	data, err := os.ReadFile(filepath.Join("testdata", "problems.yaml"))
+	require.NoError(t, err)
+
+	path := filepath.Join(t.TempDir(), "problems.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(strings.Replace(string(data), "REPLACE_ME", server.URL, 1)), 0644))
+
+	rc := loadConfig(t, path)
+	findings := Lint(rc)
+
+	got := map[string]int{}
+	fixable := map[string]bool{}
+	for _, f := range findings {
+		got[f.Check] = f.Line
+		fixable[f.Check] = f.Fixable()
+	}
+	require.Equal(t, map[string]int{
+		"git-checkout-expected-commit": 14,
+		"fetch-checksum":               10,
+		"copyright":                    2,
+		"duplicate-subpackage":         24,
+		"target-architecture-all":      7,
+		"update-monitor":               29,
+	}, got)
+	require.Equal(t, map[string]bool{
+		"git-checkout-expected-commit": false,
+		"fetch-checksum":               true,
+		"copyright":                    false,
+		"duplicate-subpackage":         false,
+		"target-architecture-all":      true,
+		"update-monitor":               false,
+	}, fixable)
+
+	require.NoError(t, Fix(context.Background(), rc, findings))
+	require.NoError(t, rc.WriteConfig())
+
+	cfg, err := config.ParseConfiguration(path)
+	require.NoError(t, err)
+	require.Empty(t, cfg.Package.TargetArchitecture)
+	require.Equal(t, "cc2c52929ace57623ff517408a577e783e10042655963b2c8f0633e109337d7a", cfg.Pipeline[0].With["expected-sha256"])
+
+	rc = loadConfig(t, path)
+	remaining := []string{}
+	for _, f := range Lint(rc) {
+		remaining = append(remaining, f.Check)
+	}
+	require.ElementsMatch(t, []string{"git-checkout-expected-commit", "copyright", "duplicate-subpackage", "update-monitor"}, remaining)
+}
@@ -15,6 +15,7 @@
 package index
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
@@ -39,13 +40,24 @@ type Index struct {
 	SourceIndexFile    string
 	MergeIndexFileFlag bool
 	SigningKey         string
+	Signer             SignFunc
 	Logger             *logrus.Logger
 	ExpectedArch       string
+	Format             string
+	RemovePackages     []string
+	KeepLatest         int
+	PruneMissing       bool
+	FailOnConflict     bool
 	Index              apkrepo.ApkIndex
 }
 
 type Option func(*Index) error
 
+// ErrConflict is returned when a package file has the name, version and
+// architecture of a package in the index but a different checksum, and
+// conflicts are not allowed.
+var ErrConflict = errors.New("package conflicts with the index")
+
 func WithMergeIndexFileFlag(mergeFlag bool) Option {
 	return func(idx *Index) error {
 		idx.MergeIndexFileFlag = mergeFlag
@@ -101,6 +113,31 @@ func WithSigningKey(signingKey string) Option {
 	}
 }
 
+// SignFunc returns the signature of the index, as the gzipped tarball which
+// is prepended to it.
+type SignFunc func(ctx context.Context, indexData []byte) ([]byte, error)
+
+// WithSigner sets the function signing the index, for signatures other than
+// the SHA-1 signature made with a signing key, such as keyless signatures or
+// signatures with several keys.  It takes precedence over the signing key for
+// APKv2 indexes.
+func WithSigner(signer SignFunc) Option {
+	return func(idx *Index) error {
+		idx.Signer = signer
+		return nil
+	}
+}
+
+// WithFailOnConflict sets whether adding a package which has the name,
+// version and architecture of a package in the index but a different checksum
+// fails, rather than replacing the package in the index.
+func WithFailOnConflict(failOnConflict bool) Option {
+	return func(idx *Index) error {
+		idx.FailOnConflict = failOnConflict
+		return nil
+	}
+}
+
 // WithExpectedArch sets the expected package architecture.  Any packages with
 // an unexpected architecture will not be indexed.
 func WithExpectedArch(expectedArch string) Option {
@@ -141,7 +178,12 @@ func (idx *Index) LoadIndex(sourceFile string) error {
 	}
 	defer f.Close()
 
-	index, err := apkrepo.IndexFromArchive(f)
+	var index *apkrepo.ApkIndex
+	if idx.Format == FormatV3 {
+		index, err = readIndexV3(f)
+	} else {
+		index, err = apkrepo.IndexFromArchive(f)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to read apkindex from archive file: %w", err)
 	}
@@ -171,7 +213,12 @@ func (idx *Index) UpdateIndex() error {
 				return
 			}
 			defer f.Close()
-			pkg, err := apkrepo.ParsePackage(f)
+			var pkg *apkrepo.Package
+			if idx.Format == FormatV3 {
+				pkg, err = parsePackageV3(f)
+			} else {
+				pkg, err = apkrepo.ParsePackage(f)
+			}
 			if err != nil {
 				// nolint:errcheck
 				g.FirstErrorStore(fmt.Errorf("failed to parse package %s: %w", apkFile, err))
@@ -206,29 +253,48 @@ func (idx *Index) UpdateIndex() error {
 	}
 
 	for _, pkg := range packages {
-		found := false
-
-		for _, p := range idx.Index.Packages {
-			if pkg.Name == p.Name && pkg.Version == p.Version {
-				found = true
-				p = pkg
-			}
+		if pkg == nil {
+			continue
 		}
-
-		if !found {
-			idx.Index.Packages = append(idx.Index.Packages, pkg)
+		if err := idx.addPackage(pkg); err != nil {
+			return err
 		}
 	}
 
 	pkgNames := make([]string, 0, len(packages))
+	added := map[string]bool{}
 	for _, p := range packages {
 		if p != nil {
-			pkgNames = append(pkgNames, fmt.Sprintf("%s-%s", p.Name, p.Version))
+			pkgNames = append(pkgNames, packageID(p))
+			added[packageID(p)] = true
 		}
 	}
 
 	idx.Logger.Printf("updating index at %s with new packages: %v", idx.IndexFile, pkgNames)
 
+	return idx.applyRetention(added)
+}
+
+// addPackage adds the package to the index, replacing the package with the
+// same name, version and architecture if there is one.
+func (idx *Index) addPackage(pkg *apkrepo.Package) error {
+	for i, p := range idx.Index.Packages {
+		if pkg.Name != p.Name || pkg.Version != p.Version || pkg.Arch != p.Arch {
+			continue
+		}
+
+		if !bytes.Equal(pkg.Checksum, p.Checksum) {
+			if idx.FailOnConflict {
+				return fmt.Errorf("%w: %s (%s) has a different checksum than the one in the index", ErrConflict, packageID(pkg), pkg.Arch)
+			}
+			idx.Logger.Printf("WARNING: replacing %s (%s) in the index with a different package", packageID(pkg), pkg.Arch)
+		}
+
+		idx.Index.Packages[i] = pkg
+		return nil
+	}
+
+	idx.Index.Packages = append(idx.Index.Packages, pkg)
 	return nil
 }
 
@@ -248,10 +314,26 @@ func (idx *Index) GenerateIndex(ctx context.Context) error {
 }
 
 func (idx *Index) WriteArchiveIndex(ctx context.Context, destinationFile string) error {
+	if idx.Format == FormatV3 {
+		return idx.writeIndexV3(destinationFile)
+	}
+
 	archive, err := apkrepo.ArchiveFromIndex(&idx.Index)
 	if err != nil {
 		return fmt.Errorf("failed to create archive from index object: %w", err)
 	}
+	if idx.Signer != nil {
+		data, err := io.ReadAll(archive)
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		idx.Logger.Printf("signing apk index at %s", destinationFile)
+		sig, err := idx.Signer(ctx, data)
+		if err != nil {
+			return fmt.Errorf("failed to sign apk index: %w", err)
+		}
+		archive = io.MultiReader(bytes.NewReader(sig), bytes.NewReader(data))
+	}
 	outFile, err := os.Create(destinationFile)
 	if err != nil {
 		return fmt.Errorf("failed to create archive file: %w", err)
@@ -261,7 +343,7 @@ func (idx *Index) WriteArchiveIndex(ctx context.Context, destinationFile string)
 		return fmt.Errorf("failed to write contents to archive file: %w", err)
 	}
 
-	if idx.SigningKey != "" {
+	if idx.SigningKey != "" && idx.Signer == nil {
 		idx.Logger.Printf("signing apk index at %s", idx.IndexFile)
 		if err := sign.SignIndex(ctx, idx.Logger, idx.SigningKey, idx.IndexFile); err != nil {
 			return fmt.Errorf("failed to sign apk index: %w", err)
@@ -0,0 +1,88 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func parseTestApk(t *testing.T, path string) *apkrepo.Package {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	pkg, err := apkrepo.ParsePackage(f)
+	require.NoError(t, err)
+	return pkg
+}
+
+func TestAddPackage(t *testing.T) {
+	dir := t.TempDir()
+	original := parseTestApk(t, writeTestApk(t, dir, "foo", "1.0-r0", "x86_64", "original"))
+	rebuilt := parseTestApk(t, writeTestApk(t, t.TempDir(), "foo", "1.0-r0", "x86_64", "rebuilt"))
+	aarch64 := parseTestApk(t, writeTestApk(t, t.TempDir(), "foo", "1.0-r0", "aarch64", "original"))
+	bar := parseTestApk(t, writeTestApk(t, dir, "bar", "1.0-r0", "x86_64", "bar"))
+	require.NotEqual(t, original.Checksum, rebuilt.Checksum)
+
+	var log bytes.Buffer
+	idx, err := testIndex(&log)
+	require.NoError(t, err)
+	for _, pkg := range []*apkrepo.Package{original, bar} {
+		require.NoError(t, idx.addPackage(pkg))
+	}
+
+	// The same name, version and architecture replaces the entry in place.
+	require.NoError(t, idx.addPackage(rebuilt))
+	require.Equal(t, []string{"foo-1.0-r0 (x86_64)", "bar-1.0-r0 (x86_64)"}, packageList(idx))
+	require.Equal(t, rebuilt.Checksum, idx.Index.Packages[0].Checksum)
+	require.Contains(t, log.String(), "replacing foo-1.0-r0 (x86_64) in the index with a different package")
+
+	// The same package again is not a conflict.
+	log.Reset()
+	idx.FailOnConflict = true
+	require.NoError(t, idx.addPackage(rebuilt))
+	require.NotContains(t, log.String(), "replacing")
+
+	// Another architecture is another entry.
+	require.NoError(t, idx.addPackage(aarch64))
+	require.Equal(t, []string{"foo-1.0-r0 (x86_64)", "bar-1.0-r0 (x86_64)", "foo-1.0-r0 (aarch64)"}, packageList(idx))
+
+	// A different package is a conflict, which leaves the index as it is.
+	err = idx.addPackage(original)
+	require.ErrorIs(t, err, ErrConflict)
+	require.ErrorContains(t, err, "foo-1.0-r0 (x86_64) has a different checksum than the one in the index")
+	require.Equal(t, rebuilt.Checksum, idx.Index.Packages[0].Checksum)
+	require.Len(t, idx.Index.Packages, 3)
+}
+
+func TestUpdateIndexFailOnConflict(t *testing.T) {
+	original := writeTestApk(t, t.TempDir(), "foo", "1.0-r0", "x86_64", "original")
+	rebuilt := writeTestApk(t, t.TempDir(), "foo", "1.0-r0", "x86_64", "rebuilt")
+
+	idx, err := testIndex(io.Discard, WithPackageFiles([]string{original, rebuilt}), WithFailOnConflict(true))
+	require.NoError(t, err)
+	require.ErrorIs(t, idx.UpdateIndex(), ErrConflict)
+
+	idx, err = testIndex(io.Discard, WithPackageFiles([]string{original, rebuilt}))
+	require.NoError(t, err)
+	require.NoError(t, idx.UpdateIndex())
+	require.Len(t, idx.Index.Packages, 1)
+	require.Equal(t, parseTestApk(t, rebuilt).Checksum, idx.Index.Packages[0].Checksum)
+}
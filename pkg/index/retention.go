@@ -0,0 +1,152 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+// WithRemovePackages sets the packages, given as name-version, to remove from
+// the index.
+func WithRemovePackages(packages []string) Option {
+	return func(idx *Index) error {
+		idx.RemovePackages = append(idx.RemovePackages, packages...)
+		return nil
+	}
+}
+
+// WithKeepLatest sets the number of versions of each package to keep in the
+// index, removing older versions.  Zero keeps all versions.
+func WithKeepLatest(keepLatest int) Option {
+	return func(idx *Index) error {
+		if keepLatest < 0 {
+			return fmt.Errorf("invalid number of versions to keep %d", keepLatest)
+		}
+		idx.KeepLatest = keepLatest
+		return nil
+	}
+}
+
+// WithPruneMissing sets whether packages whose file is missing from the
+// directory of the index are removed from the index.  Packages added to the
+// index from package files elsewhere are kept.
+func WithPruneMissing(pruneMissing bool) Option {
+	return func(idx *Index) error {
+		idx.PruneMissing = pruneMissing
+		return nil
+	}
+}
+
+func packageID(pkg *apkrepo.Package) string {
+	return fmt.Sprintf("%s-%s", pkg.Name, pkg.Version)
+}
+
+// applyRetention removes the packages to remove, the missing packages if
+// pruning, and the older versions of each package beyond the number to keep
+// from the index.  added are the IDs of the packages added from package files.
+func (idx *Index) applyRetention(added map[string]bool) error {
+	if len(idx.RemovePackages) != 0 {
+		remove := map[string]bool{}
+		for _, id := range idx.RemovePackages {
+			remove[id] = true
+		}
+
+		// Every entry of a package is removed, such as one per architecture.
+		removed := map[string]bool{}
+		idx.filterPackages(func(pkg *apkrepo.Package) (bool, string) {
+			if !remove[packageID(pkg)] {
+				return true, ""
+			}
+			removed[packageID(pkg)] = true
+			return false, "requested"
+		})
+
+		for _, id := range idx.RemovePackages {
+			if !removed[id] {
+				idx.Logger.Printf("WARNING: %s is not in the index, not removing it", id)
+				removed[id] = true
+			}
+		}
+	}
+
+	if idx.PruneMissing {
+		dir := filepath.Dir(idx.IndexFile)
+
+		var statErr error
+		idx.filterPackages(func(pkg *apkrepo.Package) (bool, string) {
+			if added[packageID(pkg)] {
+				return true, ""
+			}
+			_, err := os.Stat(filepath.Join(dir, packageID(pkg)+".apk"))
+			if errors.Is(err, os.ErrNotExist) {
+				return false, "missing from " + dir
+			} else if err != nil && statErr == nil {
+				statErr = err
+			}
+			return true, ""
+		})
+		if statErr != nil {
+			return fmt.Errorf("pruning missing packages: %w", statErr)
+		}
+	}
+
+	if idx.KeepLatest > 0 {
+		versions := map[string][]string{}
+		for _, pkg := range idx.Index.Packages {
+			versions[pkg.Name] = append(versions[pkg.Name], pkg.Version)
+		}
+
+		keep := map[string]bool{}
+		for name, vs := range versions {
+			sort.Slice(vs, func(i, j int) bool {
+				return CompareVersions(vs[i], vs[j]) > 0
+			})
+			for i, v := range vs {
+				if i < idx.KeepLatest {
+					keep[name+"-"+v] = true
+				}
+			}
+		}
+
+		idx.filterPackages(func(pkg *apkrepo.Package) (bool, string) {
+			if keep[packageID(pkg)] {
+				return true, ""
+			}
+			return false, fmt.Sprintf("older than the latest %d versions", idx.KeepLatest)
+		})
+	}
+
+	return nil
+}
+
+// filterPackages keeps the packages of the index for which keep returns
+// true, and logs why the others are removed.
+func (idx *Index) filterPackages(keep func(*apkrepo.Package) (bool, string)) {
+	kept := make([]*apkrepo.Package, 0, len(idx.Index.Packages))
+	for _, pkg := range idx.Index.Packages {
+		if ok, reason := keep(pkg); !ok {
+			idx.Logger.Printf("removing %s from index: %s", packageID(pkg), reason)
+			continue
+		}
+		kept = append(kept, pkg)
+	}
+	idx.Index.Packages = kept
+}
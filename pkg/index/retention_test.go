@@ -0,0 +1,149 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+
+	"chainguard.dev/melange/pkg/internal/apktest"
+)
+
+// writeTestApk writes an unsigned package of the name, version and
+// architecture to dir, and returns its path.  The content is the description
+// of the package, so packages of different content have different checksums.
+func writeTestApk(t *testing.T, dir, name, version, arch, content string) string {
+	path := filepath.Join(dir, name+"-"+version+".apk")
+	pkginfo := "pkgname = " + name + "\npkgver = " + version + "\npkgdesc = " + content + "\narch = " + arch + "\n"
+	apktest.WriteApk(t, path, pkginfo, apktest.Files("usr/share/"+name), nil)
+	return path
+}
+
+// testIndex returns an index logging to log.
+func testIndex(log io.Writer, opts ...Option) (*Index, error) {
+	idx, err := New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	idx.Logger = &logrus.Logger{Out: log, Formatter: &logrus.TextFormatter{}, Level: logrus.InfoLevel}
+	return idx, nil
+}
+
+// packageList returns the packages of the index as name-version (arch).
+func packageList(idx *Index) []string {
+	pkgs := []string{}
+	for _, p := range idx.Index.Packages {
+		pkgs = append(pkgs, packageID(p)+" ("+p.Arch+")")
+	}
+	return pkgs
+}
+
+func TestApplyRetention(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"foo-1.2-r0.apk", "bar-2.0-r0.apk"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), nil, 0644))
+	}
+
+	for _, tt := range []struct {
+		name  string
+		opts  []Option
+		added map[string]bool
+		want  []string
+		log   string
+	}{{
+		name: "remove every entry of a package",
+		opts: []Option{WithRemovePackages([]string{"foo-1.0-r0", "baz-1.0-r0"})},
+		want: []string{"foo-1.2-r0 (x86_64)", "foo-1.10-r0 (x86_64)", "bar-2.0-r0 (x86_64)"},
+		log:  "baz-1.0-r0 is not in the index",
+	}, {
+		name: "keep the latest version",
+		opts: []Option{WithKeepLatest(1)},
+		want: []string{"foo-1.10-r0 (x86_64)", "bar-2.0-r0 (x86_64)"},
+	}, {
+		name: "keep the latest versions",
+		opts: []Option{WithKeepLatest(2)},
+		want: []string{"foo-1.2-r0 (x86_64)", "foo-1.10-r0 (x86_64)", "bar-2.0-r0 (x86_64)"},
+	}, {
+		name:  "prune missing packages",
+		opts:  []Option{WithPruneMissing(true)},
+		added: map[string]bool{"foo-1.10-r0": true},
+		want:  []string{"foo-1.2-r0 (x86_64)", "foo-1.10-r0 (x86_64)", "bar-2.0-r0 (x86_64)"},
+		log:   "removing foo-1.0-r0 from index: missing from " + dir,
+	}, {
+		name: "remove and keep the latest version",
+		opts: []Option{WithRemovePackages([]string{"foo-1.10-r0"}), WithKeepLatest(1)},
+		want: []string{"foo-1.2-r0 (x86_64)", "bar-2.0-r0 (x86_64)"},
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			var log bytes.Buffer
+			idx, err := testIndex(&log, append(tt.opts, WithIndexFile(filepath.Join(dir, "APKINDEX.tar.gz")))...)
+			require.NoError(t, err)
+			idx.Index.Packages = []*apkrepo.Package{
+				{Name: "foo", Version: "1.0-r0", Arch: "x86_64"},
+				{Name: "foo", Version: "1.0-r0", Arch: "aarch64"},
+				{Name: "foo", Version: "1.2-r0", Arch: "x86_64"},
+				{Name: "foo", Version: "1.10-r0", Arch: "x86_64"},
+				{Name: "bar", Version: "2.0-r0", Arch: "x86_64"},
+			}
+
+			require.NoError(t, idx.applyRetention(tt.added))
+			require.Equal(t, tt.want, packageList(idx))
+			require.Contains(t, log.String(), tt.log)
+		})
+	}
+
+	_, err := New(WithKeepLatest(-1))
+	require.ErrorContains(t, err, "invalid number of versions to keep -1")
+}
+
+func TestRetentionWithMerge(t *testing.T) {
+	repo := t.TempDir()
+	writeTestApk(t, repo, "foo", "1.0-r0", "x86_64", "1.0")
+	writeTestApk(t, repo, "foo", "1.1-r0", "x86_64", "1.1")
+	writeTestApk(t, repo, "foo", "1.1_rc1-r0", "x86_64", "1.1_rc1")
+	indexFile := filepath.Join(repo, "APKINDEX.tar.gz")
+
+	idx, err := testIndex(io.Discard,
+		WithIndexFile(indexFile),
+		WithPackageDir(repo),
+	)
+	require.NoError(t, err)
+	require.NoError(t, idx.UpdateIndex())
+	require.NoError(t, idx.WriteArchiveIndex(context.Background(), indexFile))
+
+	// foo-1.0 is gone from the repository, and foo-1.2 is built elsewhere.
+	require.NoError(t, os.Remove(filepath.Join(repo, "foo-1.0-r0.apk")))
+	added := writeTestApk(t, t.TempDir(), "foo", "1.2-r0", "x86_64", "1.2")
+
+	idx, err = testIndex(io.Discard,
+		WithIndexFile(indexFile),
+		WithSourceIndexFile(indexFile),
+		WithMergeIndexFileFlag(true),
+		WithPackageFiles([]string{added}),
+		WithPruneMissing(true),
+		WithKeepLatest(2),
+	)
+	require.NoError(t, err)
+	require.NoError(t, idx.UpdateIndex())
+	require.ElementsMatch(t, []string{"foo-1.1-r0 (x86_64)", "foo-1.2-r0 (x86_64)"}, packageList(idx))
+}
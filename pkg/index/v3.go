@@ -0,0 +1,231 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+
+	"chainguard.dev/melange/pkg/adb"
+)
+
+const (
+	// FormatV2 indexes APKv2 packages into an APKINDEX.tar.gz.
+	FormatV2 = "v2"
+	// FormatV3 indexes APKv3 packages into a Packages.adb.
+	FormatV3 = "v3"
+
+	// IndexFileV3 is the name apk-tools 3 expects the index of a repository
+	// to have.
+	IndexFileV3 = "Packages.adb"
+)
+
+// WithFormat sets the format of the packages and of the index, one of "v2"
+// or "v3".
+func WithFormat(format string) Option {
+	return func(idx *Index) error {
+		switch format {
+		case "", FormatV2, FormatV3:
+		default:
+			return fmt.Errorf("invalid index format %q, must be v2 or v3", format)
+		}
+		idx.Format = format
+		return nil
+	}
+}
+
+func packageFromInfo(pi *adb.PackageInfo) *apkrepo.Package {
+	return &apkrepo.Package{
+		Name:             pi.Name,
+		Version:          pi.Version,
+		Arch:             pi.Arch,
+		Description:      pi.Description,
+		License:          pi.License,
+		Origin:           pi.Origin,
+		Maintainer:       pi.Maintainer,
+		URL:              pi.URL,
+		Checksum:         pi.UniqueID,
+		Dependencies:     pi.Depends,
+		Provides:         pi.Provides,
+		InstallIf:        pi.InstallIf,
+		Size:             pi.FileSize,
+		InstalledSize:    pi.InstalledSize,
+		ProviderPriority: pi.ProviderPriority,
+		BuildTime:        time.Unix(int64(pi.BuildTime), 0).UTC(),
+		BuildDate:        int64(pi.BuildTime),
+		RepoCommit:       pi.RepoCommit,
+		Replaces:         strings.Join(pi.Replaces, " "),
+	}
+}
+
+func infoFromPackage(p *apkrepo.Package) *adb.PackageInfo {
+	return &adb.PackageInfo{
+		Name:             p.Name,
+		Version:          p.Version,
+		Arch:             p.Arch,
+		Description:      p.Description,
+		License:          p.License,
+		Origin:           p.Origin,
+		Maintainer:       p.Maintainer,
+		URL:              p.URL,
+		UniqueID:         p.Checksum,
+		Depends:          p.Dependencies,
+		Provides:         p.Provides,
+		InstallIf:        p.InstallIf,
+		FileSize:         p.Size,
+		InstalledSize:    p.InstalledSize,
+		ProviderPriority: p.ProviderPriority,
+		BuildTime:        uint64(p.BuildDate),
+		RepoCommit:       p.RepoCommit,
+		Replaces:         strings.Fields(p.Replaces),
+	}
+}
+
+// parsePackageV3 reads the metadata of an APKv3 package.  The checksum of the
+// package is the SHA-256 digest of its ADB block, which apk-tools 3 uses as
+// the unique ID of the package.
+func parsePackageV3(f *os.File) (*apkrepo.Package, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := adb.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	if r.Schema != adb.SchemaPackage {
+		return nil, fmt.Errorf("not an APKv3 package")
+	}
+
+	adbBlock, err := r.ReadADB()
+	if err != nil {
+		return nil, err
+	}
+
+	pi, err := adb.UnmarshalPackageInfo(adbBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(adbBlock)
+	pi.UniqueID = sum[:]
+	pi.FileSize = uint64(fi.Size())
+
+	return packageFromInfo(pi), nil
+}
+
+// readIndexV3 reads a Packages.adb index.  Its signatures are not verified.
+func readIndexV3(f *os.File) (*apkrepo.ApkIndex, error) {
+	r, err := adb.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	if r.Schema != adb.SchemaIndex {
+		return nil, fmt.Errorf("not an APKv3 index")
+	}
+
+	adbBlock, err := r.ReadADB()
+	if err != nil {
+		return nil, err
+	}
+
+	ndx, err := adb.UnmarshalIndex(adbBlock)
+	if err != nil {
+		return nil, err
+	}
+
+	index := &apkrepo.ApkIndex{Description: ndx.Description}
+	for _, pi := range ndx.Packages {
+		index.Packages = append(index.Packages, packageFromInfo(pi))
+	}
+
+	return index, nil
+}
+
+// sortedPackages returns the packages sorted by name, and by version as apk
+// orders them, skipping nil entries.
+func sortedPackages(packages []*apkrepo.Package) []*apkrepo.Package {
+	pkgs := make([]*apkrepo.Package, 0, len(packages))
+	for _, p := range packages {
+		if p != nil {
+			pkgs = append(pkgs, p)
+		}
+	}
+	sort.SliceStable(pkgs, func(i, j int) bool {
+		if pkgs[i].Name != pkgs[j].Name {
+			return pkgs[i].Name < pkgs[j].Name
+		}
+		return CompareVersions(pkgs[i].Version, pkgs[j].Version) < 0
+	})
+	return pkgs
+}
+
+// writeIndexV3 writes the index as a Packages.adb, signed with the signing
+// key if one is set.  Packages are sorted by name and version.
+func (idx *Index) writeIndexV3(destinationFile string) error {
+	ndx := &adb.Index{Description: idx.Index.Description}
+	for _, p := range sortedPackages(idx.Index.Packages) {
+		ndx.Packages = append(ndx.Packages, infoFromPackage(p))
+	}
+
+	adbBlock, err := ndx.Marshal()
+	if err != nil {
+		return fmt.Errorf("failed to encode index: %w", err)
+	}
+
+	if idx.SigningKey == "" && idx.Signer != nil {
+		return fmt.Errorf("APKv3 indexes can only be signed with a signing key")
+	}
+
+	var sig []byte
+	if idx.SigningKey != "" {
+		idx.Logger.Printf("signing apk index at %s", destinationFile)
+		key, err := adb.LoadPrivateKey(idx.SigningKey, "")
+		if err != nil {
+			return fmt.Errorf("failed to load signing key: %w", err)
+		}
+		if sig, err = adb.Sign(adb.SchemaIndex, adbBlock, key); err != nil {
+			return fmt.Errorf("failed to sign apk index: %w", err)
+		}
+	}
+
+	outFile, err := os.Create(destinationFile)
+	if err != nil {
+		return fmt.Errorf("failed to create index file: %w", err)
+	}
+	defer outFile.Close()
+
+	w, err := adb.NewWriter(outFile, adb.SchemaIndex)
+	if err != nil {
+		return fmt.Errorf("failed to write index file: %w", err)
+	}
+	if err := w.WriteBlock(adb.BlockADB, adbBlock); err != nil {
+		return fmt.Errorf("failed to write index file: %w", err)
+	}
+	if sig != nil {
+		if err := w.WriteBlock(adb.BlockSig, sig); err != nil {
+			return fmt.Errorf("failed to write index file: %w", err)
+		}
+	}
+
+	return w.Close()
+}
@@ -0,0 +1,47 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+)
+
+func TestSortedPackages(t *testing.T) {
+	pkgs := sortedPackages([]*apkrepo.Package{
+		{Name: "foo", Version: "1.10-r0"},
+		nil,
+		{Name: "bar", Version: "2.0-r0"},
+		{Name: "foo", Version: "1.9-r1"},
+		{Name: "foo", Version: "1.9-r10"},
+		{Name: "foo", Version: "1.9-r2"},
+		{Name: "foo", Version: "1.9_rc1-r0"},
+	})
+
+	got := []string{}
+	for _, p := range pkgs {
+		got = append(got, p.Name+"-"+p.Version)
+	}
+	require.Equal(t, []string{
+		"bar-2.0-r0",
+		"foo-1.9_rc1-r0",
+		"foo-1.9-r1",
+		"foo-1.9-r2",
+		"foo-1.9-r10",
+		"foo-1.10-r0",
+	}, got)
+}
@@ -0,0 +1,154 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// versionRegex matches apk versions: numbers separated by dots, an optional
+// letter, suffixes such as _rc1 or _p2, and the release, such as -r3.
+var versionRegex = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+)*)([a-z]?)((?:_[a-z]+[0-9]*)*)(?:-r([0-9]+))?$`)
+
+// suffixRanks orders the version suffixes, relative to a version without a
+// suffix: pre-releases sort before it, and the others after.
+var suffixRanks = map[string]int{
+	"alpha": -4,
+	"beta":  -3,
+	"pre":   -2,
+	"rc":    -1,
+	"cvs":   1,
+	"svn":   2,
+	"git":   3,
+	"hg":    4,
+	"p":     5,
+}
+
+var suffixRegex = regexp.MustCompile(`^([a-z]+)([0-9]*)$`)
+
+type versionSuffix struct {
+	rank   int
+	number uint64
+}
+
+type packageVersion struct {
+	numbers  []uint64
+	letter   string
+	suffixes []versionSuffix
+	release  uint64
+}
+
+func parseVersion(version string) (packageVersion, bool) {
+	m := versionRegex.FindStringSubmatch(version)
+	if m == nil {
+		return packageVersion{}, false
+	}
+
+	v := packageVersion{letter: m[2]}
+	for _, n := range strings.Split(m[1], ".") {
+		num, err := strconv.ParseUint(n, 10, 64)
+		if err != nil {
+			return packageVersion{}, false
+		}
+		v.numbers = append(v.numbers, num)
+	}
+
+	if m[3] != "" {
+		for _, s := range strings.Split(m[3][1:], "_") {
+			sm := suffixRegex.FindStringSubmatch(s)
+			rank, ok := suffixRanks[sm[1]]
+			if !ok {
+				return packageVersion{}, false
+			}
+			suffix := versionSuffix{rank: rank}
+			if sm[2] != "" {
+				num, err := strconv.ParseUint(sm[2], 10, 64)
+				if err != nil {
+					return packageVersion{}, false
+				}
+				suffix.number = num
+			}
+			v.suffixes = append(v.suffixes, suffix)
+		}
+	}
+
+	if m[4] != "" {
+		release, err := strconv.ParseUint(m[4], 10, 64)
+		if err != nil {
+			return packageVersion{}, false
+		}
+		v.release = release
+	}
+
+	return v, true
+}
+
+func compareUint(a, b uint64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// CompareVersions compares two apk versions, returning -1, 0 or 1 if a is
+// older than, the same as or newer than b.  Versions which cannot be parsed
+// are compared as strings.
+func CompareVersions(a, b string) int {
+	va, oka := parseVersion(a)
+	vb, okb := parseVersion(b)
+	if !oka || !okb {
+		return strings.Compare(a, b)
+	}
+
+	for i := 0; i < len(va.numbers) && i < len(vb.numbers); i++ {
+		if c := compareUint(va.numbers[i], vb.numbers[i]); c != 0 {
+			return c
+		}
+	}
+	if c := compareUint(uint64(len(va.numbers)), uint64(len(vb.numbers))); c != 0 {
+		return c
+	}
+
+	if c := strings.Compare(va.letter, vb.letter); c != 0 {
+		return c
+	}
+
+	for i := 0; i < len(va.suffixes) || i < len(vb.suffixes); i++ {
+		// A missing suffix ranks as a version without a suffix.
+		var sa, sb versionSuffix
+		if i < len(va.suffixes) {
+			sa = va.suffixes[i]
+		}
+		if i < len(vb.suffixes) {
+			sb = vb.suffixes[i]
+		}
+		if sa.rank != sb.rank {
+			if sa.rank < sb.rank {
+				return -1
+			}
+			return 1
+		}
+		if c := compareUint(sa.number, sb.number); c != 0 {
+			return c
+		}
+	}
+
+	return compareUint(va.release, vb.release)
+}
@@ -0,0 +1,69 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package index
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.0-r0", 0},
+		{"1.10", "1.9", 1},
+		{"2.0", "1.99.99", 1},
+
+		// Differing numbers of components.
+		{"1.2.0", "1.2", 1},
+		{"1.2", "1.2.0.1", -1},
+
+		// Letters.
+		{"1.2a", "1.2", 1},
+		{"1.2b", "1.2a", 1},
+		{"1.2.1", "1.2a", 1},
+
+		// Pre-release suffixes sort before the release, the others after.
+		{"1.0_rc1", "1.0", -1},
+		{"1.0_rc2", "1.0_rc1", 1},
+		{"1.0_rc10", "1.0_rc9", 1},
+		{"1.0_alpha", "1.0_beta", -1},
+		{"1.0_beta2", "1.0_pre1", -1},
+		{"1.0_pre1", "1.0_rc1", -1},
+		{"1.0_p1", "1.0", 1},
+		{"1.0_p2", "1.0_p1", 1},
+		{"1.0_rc1", "1.0_p1", -1},
+		{"1.0_git20230101", "1.0_p1", -1},
+		{"1.0_rc1_p1", "1.0_rc1", 1},
+		{"1.0_rc1", "0.9_p9", 1},
+
+		// Releases.
+		{"1.0-r1", "1.0-r0", 1},
+		{"1.0-r10", "1.0-r9", 1},
+		{"1.0-r9", "1.1-r0", -1},
+		{"1.0_rc1-r5", "1.0-r0", -1},
+
+		// Versions which cannot be parsed are compared as strings.
+		{"abc", "abd", -1},
+		{"1.0_unknown", "1.0", 1},
+	} {
+		require.Equal(t, tt.want, CompareVersions(tt.a, tt.b), "%s <=> %s", tt.a, tt.b)
+		require.Equal(t, -tt.want, CompareVersions(tt.b, tt.a), "%s <=> %s", tt.b, tt.a)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package apktest writes apk packages for tests, including packages melange
+// would not build.
+package apktest
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// WriteSection writes a gzipped tar section of an apk with the entries to w.
+// The size of each entry is the length of its content in contents.  The
+// signature and control sections are followed by the next section, so they
+// are written without an end-of-archive marker unless terminate is set.
+func WriteSection(t testing.TB, w io.Writer, hdrs []*tar.Header, contents map[string]string, terminate bool) {
+	t.Helper()
+
+	zw := gzip.NewWriter(w)
+	tw := tar.NewWriter(zw)
+	for _, hdr := range hdrs {
+		h := *hdr
+		h.Size = int64(len(contents[h.Name]))
+		require.NoError(t, tw.WriteHeader(&h))
+		_, err := tw.Write([]byte(contents[h.Name]))
+		require.NoError(t, err)
+	}
+	if terminate {
+		require.NoError(t, tw.Close())
+	} else {
+		require.NoError(t, tw.Flush())
+	}
+	require.NoError(t, zw.Close())
+}
+
+// Apk returns an unsigned apk with the .PKGINFO and the data section entries.
+func Apk(t testing.TB, pkginfo string, hdrs []*tar.Header, contents map[string]string) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	WriteSection(t, &buf, []*tar.Header{
+		{Name: ".PKGINFO", Typeflag: tar.TypeReg, Mode: 0o644},
+	}, map[string]string{".PKGINFO": pkginfo}, false)
+	WriteSection(t, &buf, hdrs, contents, true)
+	return buf.Bytes()
+}
+
+// WriteApk writes an unsigned apk with the .PKGINFO and the data section
+// entries to path.
+func WriteApk(t testing.TB, path, pkginfo string, hdrs []*tar.Header, contents map[string]string) {
+	t.Helper()
+
+	require.NoError(t, os.WriteFile(path, Apk(t, pkginfo, hdrs, contents), 0o644))
+}
+
+// Files returns the headers of regular files at the paths.
+func Files(paths ...string) []*tar.Header {
+	hdrs := []*tar.Header{}
+	for _, p := range paths {
+		hdrs = append(hdrs, &tar.Header{Name: p, Typeflag: tar.TypeReg, Mode: 0o644})
+	}
+	return hdrs
+}
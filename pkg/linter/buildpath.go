@@ -0,0 +1,112 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linter
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"regexp"
+	"strings"
+
+	"chainguard.dev/melange/pkg/container"
+)
+
+// isWorkspacePathRegex matches absolute references to the build workspace,
+// but not to other paths which merely start with the same characters.
+var isWorkspacePathRegex = regexp.MustCompile(regexp.QuoteMeta(container.DefaultWorkspaceDir) + `([^A-Za-z0-9_.-]|$)`)
+
+// sniffLen is how much of a file is read to decide whether it is text.
+const sniffLen = 8000
+
+func buildPathLinter(lctx LinterContext, path string, d fs.DirEntry) error {
+	if !d.Type().IsRegular() || strings.HasPrefix(path, "usr/lib/debug/") {
+		return nil
+	}
+
+	f, err := lctx.fsys.Open(path)
+	if err != nil {
+		return fmt.Errorf("Could not open file for reading: %v", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReaderSize(f, sniffLen)
+	head, err := r.Peek(sniffLen)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("Could not read file: %v", err)
+	}
+
+	if bytes.HasPrefix(head, elfMagic) {
+		return elfBuildPathLinter(lctx, path, d)
+	}
+
+	// Other binary files are not scanned.
+	if bytes.IndexByte(head, 0) != -1 {
+		return nil
+	}
+
+	for line := 1; ; line++ {
+		text, err := r.ReadBytes('\n')
+		if isWorkspacePathRegex.Match(text) {
+			return fmt.Errorf("File references the build workspace %s on line %d", container.DefaultWorkspaceDir, line)
+		}
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Could not read file: %v", err)
+		}
+	}
+}
+
+// elfBuildPathLinter scans the string and data sections of an ELF file for
+// references to the build workspace.  Debug information is expected to
+// contain build paths, so it is ignored.
+func elfBuildPathLinter(lctx LinterContext, path string, d fs.DirEntry) error {
+	file, err := lctx.openELF(path, d)
+	if err != nil || file == nil {
+		return err
+	}
+	defer file.Close()
+
+	sections := []string{}
+	for _, s := range file.Sections {
+		if s.Type != elf.SHT_PROGBITS && s.Type != elf.SHT_STRTAB {
+			continue
+		}
+		if s.Flags&elf.SHF_EXECINSTR != 0 || strings.HasPrefix(s.Name, ".debug") ||
+			strings.HasPrefix(s.Name, ".zdebug") || s.Name == ".gnu_debuglink" {
+			continue
+		}
+
+		data, err := s.Data()
+		if err != nil {
+			continue
+		}
+		if isWorkspacePathRegex.Match(data) {
+			sections = append(sections, s.Name)
+		}
+	}
+
+	if len(sections) != 0 {
+		return fmt.Errorf("ELF sections %s reference the build workspace %s", strings.Join(sections, ", "), container.DefaultWorkspaceDir)
+	}
+
+	return nil
+}
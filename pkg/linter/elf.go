@@ -0,0 +1,327 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linter
+
+import (
+	"bytes"
+	"debug/elf"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"chainguard.dev/melange/pkg/container"
+)
+
+var elfMagic = []byte("\x7fELF")
+
+// elfFile is an ELF file opened from a package filesystem.
+type elfFile struct {
+	*elf.File
+	closer io.Closer
+}
+
+func (f *elfFile) Close() error {
+	f.File.Close()
+	return f.closer.Close()
+}
+
+// openELF opens the file at path as an ELF file.  It returns nil without an
+// error for files which are not executables or libraries, or are not ELF.
+func (lctx LinterContext) openELF(path string, d fs.DirEntry) (*elfFile, error) {
+	if !d.Type().IsRegular() {
+		return nil, nil
+	}
+
+	info, err := d.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	if info.Mode()&0111 == 0 && !isObjectFileRegex.MatchString(filepath.Ext(path)) {
+		// Not an executable or library
+		return nil, nil
+	}
+
+	f, err := lctx.fsys.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not open file for reading: %v", err)
+	}
+
+	magic := make([]byte, len(elfMagic))
+	if _, err := io.ReadFull(f, magic); err != nil || !bytes.Equal(magic, elfMagic) {
+		f.Close()
+		return nil, nil
+	}
+
+	// Files from os.DirFS support ReaderAt, anything else is copied to a
+	// temporary file first.
+	ra, ok := f.(io.ReaderAt)
+	closer := io.Closer(f)
+	if !ok {
+		f.Close()
+
+		tempfile, err := lctx.copyToTemp(path)
+		if err != nil {
+			return nil, err
+		}
+		ra, closer = tempfile, tempfile
+	}
+
+	file, err := elf.NewFile(ra)
+	if err != nil {
+		closer.Close()
+		return nil, nil
+	}
+
+	return &elfFile{File: file, closer: closer}, nil
+}
+
+// tempFile is removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+func (t tempFile) Close() error {
+	defer os.Remove(t.Name())
+	return t.File.Close()
+}
+
+func (lctx LinterContext) copyToTemp(path string) (tempFile, error) {
+	reader, err := lctx.fsys.Open(path)
+	if err != nil {
+		return tempFile{}, fmt.Errorf("Could not open file for reading: %v", err)
+	}
+	defer reader.Close()
+
+	f, err := os.CreateTemp("", "melange.XXXXX")
+	if err != nil {
+		return tempFile{}, fmt.Errorf("Could not create temporary file: %v", err)
+	}
+	t := tempFile{f}
+
+	if _, err := io.Copy(t, reader); err != nil {
+		t.Close()
+		return tempFile{}, fmt.Errorf("Could not write to temporary file: %v", err)
+	}
+
+	return t, nil
+}
+
+// fortifiable lists libc functions which have a checked __<name>_chk variant
+// used when building with _FORTIFY_SOURCE.
+var fortifiable = map[string]bool{
+	"memcpy": true, "memmove": true, "mempcpy": true, "memset": true,
+	"stpcpy": true, "stpncpy": true, "strcat": true, "strcpy": true,
+	"strncat": true, "strncpy": true, "sprintf": true, "snprintf": true,
+	"vsprintf": true, "vsnprintf": true, "printf": true, "fprintf": true,
+	"vprintf": true, "vfprintf": true, "dprintf": true, "vdprintf": true,
+	"gets": true, "fgets": true, "read": true, "pread": true, "pread64": true,
+	"readlink": true, "realpath": true, "getcwd": true, "wcscpy": true,
+	"wmemcpy": true, "wmemset": true, "recv": true, "recvfrom": true,
+	"poll": true, "ppoll": true, "fread": true, "confstr": true,
+	"getgroups": true, "ttyname_r": true, "getlogin_r": true,
+	"gethostname": true, "getdomainname": true,
+}
+
+func hardeningLinter(lctx LinterContext, path string, d fs.DirEntry) error {
+	// Separate debug information files are not loaded.
+	if strings.HasPrefix(path, "usr/lib/debug/") {
+		return nil
+	}
+
+	file, err := lctx.openELF(path, d)
+	if err != nil || file == nil {
+		return err
+	}
+	defer file.Close()
+
+	if file.Type != elf.ET_EXEC && file.Type != elf.ET_DYN {
+		return nil
+	}
+
+	var hasRelro, hasDynamic, hasStack, execStack bool
+	for _, p := range file.Progs {
+		switch p.Type {
+		case elf.PT_GNU_RELRO:
+			hasRelro = true
+		case elf.PT_DYNAMIC:
+			hasDynamic = true
+		case elf.PT_GNU_STACK:
+			hasStack = true
+			execStack = p.Flags&elf.PF_X != 0
+		}
+	}
+
+	dynFlags := dynValue(file, elf.DT_FLAGS)
+	dynFlags1 := dynValue(file, elf.DT_FLAGS_1)
+
+	missing := []string{}
+
+	// ET_EXEC files are executables linked at a fixed address.  PIE
+	// executables and shared libraries are both ET_DYN and both position
+	// independent, so they need not be told apart.
+	if file.Type == elf.ET_EXEC {
+		missing = append(missing, "not PIE")
+	}
+
+	if hasDynamic {
+		bindNow := len(dynValues(file, elf.DT_BIND_NOW)) != 0 ||
+			dynFlags&uint64(elf.DF_BIND_NOW) != 0 ||
+			dynFlags1&uint64(elf.DF_1_NOW) != 0
+		if !hasRelro || !bindNow {
+			missing = append(missing, "no full RELRO")
+		}
+	}
+
+	if !hasStack || execStack {
+		missing = append(missing, "executable stack")
+	}
+
+	if len(dynValues(file, elf.DT_TEXTREL)) != 0 || dynFlags&uint64(elf.DF_TEXTREL) != 0 {
+		missing = append(missing, "text relocations")
+	}
+
+	// Go does not use stack protectors or fortified libc functions, so the
+	// remaining checks do not apply to Go binaries.
+	if file.Section(".go.buildinfo") == nil {
+		symbols := elfSymbolNames(file)
+
+		// Without symbols, for example in stripped static binaries, there is
+		// nothing to check.
+		if len(symbols) != 0 {
+			if !symbols["__stack_chk_fail"] && !symbols["__stack_chk_guard"] {
+				missing = append(missing, "no stack protector")
+			}
+
+			fortified, unfortified := false, false
+			for name := range symbols {
+				if strings.HasPrefix(name, "__") && strings.HasSuffix(name, "_chk") && name != "__stack_chk_fail" {
+					fortified = true
+				} else if fortifiable[name] {
+					unfortified = true
+				}
+			}
+			if unfortified && !fortified {
+				missing = append(missing, "not fortified")
+			}
+		}
+	}
+
+	if len(missing) != 0 {
+		return fmt.Errorf("ELF file is not hardened: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// dynValues returns the values of the dynamic section entries with tag.
+func dynValues(file *elfFile, tag elf.DynTag) []uint64 {
+	vals, err := file.DynValue(tag)
+	if err != nil {
+		return nil
+	}
+	return vals
+}
+
+// dynValue returns the first value of the dynamic section entry with tag, or 0.
+func dynValue(file *elfFile, tag elf.DynTag) uint64 {
+	if vals := dynValues(file, tag); len(vals) != 0 {
+		return vals[0]
+	}
+	return 0
+}
+
+// elfSymbolNames returns the names of the dynamic and static symbols of file,
+// with any symbol version stripped.
+func elfSymbolNames(file *elfFile) map[string]bool {
+	names := map[string]bool{}
+
+	for _, load := range []func() ([]elf.Symbol, error){file.DynamicSymbols, file.Symbols} {
+		symbols, err := load()
+		if err != nil {
+			continue
+		}
+		for _, s := range symbols {
+			name, _, _ := strings.Cut(s.Name, "@")
+			names[name] = true
+		}
+	}
+
+	return names
+}
+
+// standardLibDirs are the directories a RPATH or RUNPATH may point into.
+var standardLibDirs = []string{"/lib", "/lib64", "/usr/lib", "/usr/lib64"}
+
+func rpathLinter(lctx LinterContext, path string, d fs.DirEntry) error {
+	file, err := lctx.openELF(path, d)
+	if err != nil || file == nil {
+		return err
+	}
+	defer file.Close()
+
+	problems := []string{}
+	for _, tag := range []elf.DynTag{elf.DT_RPATH, elf.DT_RUNPATH} {
+		entries, err := file.DynString(tag)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			for _, dir := range strings.Split(entry, ":") {
+				if problem := checkRunpathEntry(dir); problem != "" {
+					problems = append(problems, fmt.Sprintf("%s entry %q %s", strings.TrimPrefix(tag.String(), "DT_"), dir, problem))
+				}
+			}
+		}
+	}
+
+	if len(problems) != 0 {
+		return fmt.Errorf("ELF file has a bad search path: %s", strings.Join(problems, ", "))
+	}
+
+	return nil
+}
+
+// checkRunpathEntry describes what is wrong with a single directory of a
+// RPATH or RUNPATH, or returns an empty string if it is fine.
+func checkRunpathEntry(dir string) string {
+	// Paths relative to the object itself are relocatable.
+	if dir == "$ORIGIN" || dir == "${ORIGIN}" ||
+		strings.HasPrefix(dir, "$ORIGIN/") || strings.HasPrefix(dir, "${ORIGIN}/") {
+		return ""
+	}
+
+	if dir == container.DefaultWorkspaceDir || strings.HasPrefix(dir, container.DefaultWorkspaceDir+"/") {
+		return "points at the build workspace"
+	}
+
+	// An empty entry is the current directory.
+	if !filepath.IsAbs(dir) {
+		return "is relative"
+	}
+
+	dir = filepath.Clean(dir)
+	for _, libdir := range standardLibDirs {
+		if dir == libdir || strings.HasPrefix(dir, libdir+"/") {
+			return ""
+		}
+	}
+
+	return "is outside the standard library directories"
+}
@@ -0,0 +1,109 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package linter
+
+import (
+	"fmt"
+	"io/fs"
+	"regexp"
+	"strings"
+)
+
+var isLibtoolArchiveRegex = regexp.MustCompile(`^(usr/)?lib(64)?/.*\.la$`)
+var isHeaderRegex = regexp.MustCompile(`^usr/include/`)
+var isPkgConfigRegex = regexp.MustCompile(`^usr/(lib|lib64|share)/pkgconfig/[^/]+\.pc$`)
+var isUnversionedSharedLibRegex = regexp.MustCompile(`^(usr/)?lib(64)?/[^/]+\.so$`)
+var isStaticLibRegex = regexp.MustCompile(`\.a$`)
+var isDocRegex = regexp.MustCompile(`^usr/share/(man|info|doc)/`)
+var isPycacheRegex = regexp.MustCompile(`^usr/lib/python3\.(\d+)/.*__pycache__/[^/]+\.cpython-3(\d+)[^/]*\.pyc$`)
+
+// sibling returns the output of another package built from the same
+// configuration, if the linter context knows where the outputs are.
+func (lctx LinterContext) sibling(name string) (fs.FS, bool) {
+	if lctx.outfs == nil {
+		return nil, false
+	}
+
+	info, err := fs.Stat(lctx.outfs, name)
+	if err != nil || !info.IsDir() {
+		return nil, false
+	}
+
+	sub, err := fs.Sub(lctx.outfs, name)
+	if err != nil {
+		return nil, false
+	}
+
+	return sub, true
+}
+
+func libtoolLinter(_ LinterContext, path string, d fs.DirEntry) error {
+	if d.IsDir() || !isLibtoolArchiveRegex.MatchString(path) {
+		return nil
+	}
+
+	return fmt.Errorf("Package contains a libtool archive")
+}
+
+func devFilesLinter(lctx LinterContext, path string, d fs.DirEntry) error {
+	if d.IsDir() || strings.HasSuffix(lctx.pkgname, "-dev") {
+		return nil
+	}
+
+	var what string
+	switch {
+	case isHeaderRegex.MatchString(path):
+		what = "header"
+	case isPkgConfigRegex.MatchString(path):
+		what = "pkg-config file"
+	case isUnversionedSharedLibRegex.MatchString(path) && d.Type()&fs.ModeSymlink != 0:
+		what = "unversioned shared library symlink"
+	default:
+		return nil
+	}
+
+	// Development files are only misplaced if there is somewhere better
+	// to put them.
+	if _, ok := lctx.sibling(lctx.pkgname + "-dev"); !ok {
+		return nil
+	}
+
+	return fmt.Errorf("Package contains a %s but %s-dev exists", what, lctx.pkgname)
+}
+
+func staticLibLinter(lctx LinterContext, path string, d fs.DirEntry) error {
+	if d.IsDir() || strings.HasSuffix(lctx.pkgname, "-static") || !isStaticLibRegex.MatchString(path) {
+		return nil
+	}
+
+	return fmt.Errorf("Static library found outside a -static package")
+}
+
+func docLinter(lctx LinterContext, path string, d fs.DirEntry) error {
+	if d.IsDir() || strings.HasSuffix(lctx.pkgname, "-doc") || !isDocRegex.MatchString(path) {
+		return nil
+	}
+
+	return fmt.Errorf("Documentation found outside a -doc package")
+}
+
+func pycacheLinter(_ LinterContext, path string, _ fs.DirEntry) error {
+	m := isPycacheRegex.FindStringSubmatch(path)
+	if m == nil || m[1] == m[2] {
+		return nil
+	}
+
+	return fmt.Errorf("Bytecode for Python 3.%s found in the site-packages of Python 3.%s", m[2], m[1])
+}
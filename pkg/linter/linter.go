@@ -15,98 +15,188 @@
 package linter
 
 import (
+	"archive/tar"
 	"context"
 	"debug/elf"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"strings"
 
-	apkofs "github.com/chainguard-dev/go-apk/pkg/fs"
+	"github.com/chainguard-dev/go-apk/pkg/expandapk"
+	"github.com/klauspost/compress/gzip"
 
 	"gopkg.in/ini.v1"
+
+	"chainguard.dev/melange/pkg/config"
 )
 
 type LinterContext struct {
 	pkgname string
 	fsys    fs.FS
+	// outfs holds the outputs of every package built from the same
+	// configuration, keyed by package name, if known.
+	outfs fs.FS
 }
 
 func NewLinterContext(name string, fsys fs.FS) LinterContext {
-	return LinterContext{name, fsys}
+	return LinterContext{pkgname: name, fsys: fsys}
+}
+
+// WithOutputFS returns a copy of the context which can look at the outputs of
+// sibling packages, such as the melange-out directory of a build.
+func (lctx LinterContext) WithOutputFS(outfs fs.FS) LinterContext {
+	lctx.outfs = outfs
+	return lctx
+}
+
+// Severity controls how a finding affects the build.
+type Severity string
+
+const (
+	// SeverityError findings fail the build.
+	SeverityError Severity = "error"
+	// SeverityWarning findings are reported, and only fail the build when
+	// warnings are treated as errors.
+	SeverityWarning Severity = "warn"
+	// SeverityOff disables the linter.
+	SeverityOff Severity = "off"
+)
+
+// Finding is a problem reported by a linter.
+type Finding struct {
+	Linter string `json:"linter"`
+	// Path is the file the finding refers to, relative to the package root.
+	// It is empty for findings about the package as a whole.
+	Path       string   `json:"path,omitempty"`
+	Message    string   `json:"message"`
+	Suggestion string   `json:"suggestion,omitempty"`
+	Severity   Severity `json:"severity"`
+}
+
+func (f Finding) String() string {
+	where := f.Linter
+	if f.Path != "" {
+		where += ": " + f.Path
+	}
+
+	return fmt.Sprintf("%s: %s; suggest: %s", where, f.Message, f.Suggestion)
 }
 
 type linterFunc func(lctx LinterContext, path string, d fs.DirEntry) error
 
 type linter struct {
-	LinterFunc  linterFunc
-	FailOnError bool
-	Explain     string
+	LinterFunc linterFunc
+	Severity   Severity
+	Explain    string
 }
 
 type postLinterFunc func(lctx LinterContext, fsys fs.FS) error
 
 type postLinter struct {
-	LinterFunc  postLinterFunc
-	FailOnError bool
-	Explain     string
+	LinterFunc postLinterFunc
+	Severity   Severity
+	Explain    string
 }
 
 var linterMap = map[string]linter{
 	"dev": linter{
-		LinterFunc:  devLinter,
-		FailOnError: false,
-		Explain:     "If this package is creating /dev nodes, it should use udev instead; otherwise, remove any files in /dev",
+		LinterFunc: devLinter,
+		Severity:   SeverityWarning,
+		Explain:    "If this package is creating /dev nodes, it should use udev instead; otherwise, remove any files in /dev",
 	},
 	"opt": linter{
-		LinterFunc:  optLinter,
-		FailOnError: false,
-		Explain:     "This package should be a -compat package",
+		LinterFunc: optLinter,
+		Severity:   SeverityWarning,
+		Explain:    "This package should be a -compat package",
 	},
 	"setuidgid": linter{
-		LinterFunc:  isSetUidOrGidLinter,
-		FailOnError: false,
-		Explain:     "Unset the setuid/setgid bit on the relevant files, or remove this linter",
+		LinterFunc: isSetUidOrGidLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Unset the setuid/setgid bit on the relevant files, or remove this linter",
 	},
 	"srv": linter{
-		LinterFunc:  srvLinter,
-		FailOnError: false,
-		Explain:     "This package should be a -compat package",
+		LinterFunc: srvLinter,
+		Severity:   SeverityWarning,
+		Explain:    "This package should be a -compat package",
 	},
 	"tempdir": linter{
-		LinterFunc:  tempDirLinter,
-		FailOnError: false,
-		Explain:     "Remove any offending files in temporary dirs in the pipeline",
+		LinterFunc: tempDirLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Remove any offending files in temporary dirs in the pipeline",
 	},
 	"usrlocal": linter{
-		LinterFunc:  usrLocalLinter,
-		FailOnError: false,
-		Explain:     "This package should be a -compat package",
+		LinterFunc: usrLocalLinter,
+		Severity:   SeverityWarning,
+		Explain:    "This package should be a -compat package",
 	},
 	"varempty": linter{
-		LinterFunc:  varEmptyLinter,
-		FailOnError: false,
-		Explain:     "Remove any offending files in /var/empty in the pipeline",
+		LinterFunc: varEmptyLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Remove any offending files in /var/empty in the pipeline",
 	},
 	"worldwrite": linter{
-		LinterFunc:  worldWriteableLinter,
-		FailOnError: false,
-		Explain:     "Change the permissions of any world-writeable files in the package, disable the linter, or make this a -compat package",
+		LinterFunc: worldWriteableLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Change the permissions of any world-writeable files in the package, disable the linter, or make this a -compat package",
+	},
+	"hardening": linter{
+		LinterFunc: hardeningLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Build with -fPIE -pie, -Wl,-z,relro,-z,now, -Wl,-z,noexecstack, -fstack-protector-strong and -D_FORTIFY_SOURCE=2, and compile with -fPIC to avoid text relocations",
+	},
+	"rpath": linter{
+		LinterFunc: rpathLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Remove the RPATH/RUNPATH or make it relative to $ORIGIN, for example with -Wl,-rpath,'$ORIGIN/../lib' or patchelf --remove-rpath",
+	},
+	"buildpath": linter{
+		LinterFunc: buildPathLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Replace references to the build workspace with the installed paths, for example by setting --prefix=/usr or rewriting the files in the pipeline",
+	},
+	"libtool": linter{
+		LinterFunc: libtoolLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Remove the libtool .la archives in the pipeline",
+	},
+	"devfiles": linter{
+		LinterFunc: devFilesLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Move headers, pkg-config files and unversioned .so symlinks to the -dev subpackage, for example with the split/dev pipeline",
+	},
+	"staticlib": linter{
+		LinterFunc: staticLibLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Move static libraries to a -static subpackage with the split/static pipeline, or remove them",
+	},
+	"docs": linter{
+		LinterFunc: docLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Move man pages, info pages and documentation to a -doc subpackage, for example with the split/manpages and split/infodir pipelines",
+	},
+	"pycache": linter{
+		LinterFunc: pycacheLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Compile the bytecode with the Python version the package is installed for, or remove the __pycache__ directories",
 	},
 	"strip": linter{
-		LinterFunc:  strippedLinter,
-		FailOnError: false,
-		Explain:     "Properly strip all binaries in the pipeline",
+		LinterFunc: strippedLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Properly strip all binaries in the pipeline",
 	},
 }
 
 var postLinterMap = map[string]postLinter{
 	"empty": postLinter{
-		LinterFunc:  emptyPostLinter,
-		FailOnError: false,
-		Explain:     "Verify that this package is supposed to be empty; if it is, disable this linter; otherwise check the build",
+		LinterFunc: emptyPostLinter,
+		Severity:   SeverityWarning,
+		Explain:    "Verify that this package is supposed to be empty; if it is, disable this linter; otherwise check the build",
 	},
 }
 
@@ -252,7 +342,7 @@ func strippedLinter(lctx LinterContext, path string, d fs.DirEntry) error {
 	file, err := elf.NewFile(tempfile)
 	if err != nil {
 		// We don't particularly care if this fails, it means it's probably not an ELF file
-		fmt.Printf("WARNING: Could not open file %q as executable: %v\n", path, err)
+		fmt.Fprintf(os.Stderr, "WARNING: Could not open file %q as executable: %v\n", path, err)
 		return nil
 	}
 	defer file.Close()
@@ -294,37 +384,74 @@ func emptyPostLinter(_ LinterContext, fsys fs.FS) error {
 	return fmt.Errorf("Package is empty but no-provides is not set")
 }
 
-func (lctx LinterContext) LintPackageFs(fsys fs.FS, warn func(error), linters []string) error {
+// severity returns the severity of the named linter, taking the overrides in
+// checks into account.
+func severity(name string, checks config.Checks) Severity {
+	if s, ok := checks.Severity[name]; ok {
+		return Severity(s)
+	}
+	if l, ok := linterMap[name]; ok {
+		return l.Severity
+	}
+	return postLinterMap[name].Severity
+}
+
+// exempt reports whether file is exempted from the named linter, either
+// because a pattern matches it or one of its parent directories.
+func exempt(name, file string, checks config.Checks) bool {
+	for _, pattern := range checks.Exemptions[name] {
+		for p := file; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+			if ok, _ := path.Match(pattern, p); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LintPackageFs runs the linters selected by checks against fsys and returns
+// what they found.  An error is only returned if the linters could not be
+// run; the caller decides what to do with the findings based on their
+// severity.
+func (lctx LinterContext) LintPackageFs(fsys fs.FS, checks config.Checks) ([]Finding, error) {
+	findings := []Finding{}
+
 	// If this is a compat package, do nothing.
 	if isCompatPackageRegex.MatchString(lctx.pkgname) {
-		return nil
+		return findings, nil
 	}
 
+	linters := []string{}
 	postLinters := []string{}
+	for _, linterName := range checks.GetLinters() {
+		if _, present := linterMap[linterName]; present {
+			linters = append(linters, linterName)
+		} else if _, present := postLinterMap[linterName]; present {
+			postLinters = append(postLinters, linterName)
+		} else {
+			return nil, fmt.Errorf("Linter %s is unknown", linterName)
+		}
+	}
+
 	walkCb := func(path string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return fmt.Errorf("Error traversing tree at %s: %w", path, err)
 		}
 
 		for _, linterName := range linters {
-			linter, present := linterMap[linterName]
-			if !present {
-				// Check if it's a post linter instead
-				_, present = postLinterMap[linterName]
-				if !present {
-					return fmt.Errorf("Linter %s is unknown", linterName)
-				}
-
-				postLinters = append(postLinters, linterName)
+			if exempt(linterName, path, checks) {
 				continue
 			}
 
-			err = linter.LinterFunc(lctx, path, d)
-			if err != nil {
-				if linter.FailOnError {
-					return fmt.Errorf("Linter %s failed at path %q: %w; suggest: %s", linterName, path, err, linter.Explain)
-				}
-				warn(err)
+			linter := linterMap[linterName]
+			if err := linter.LinterFunc(lctx, path, d); err != nil {
+				findings = append(findings, Finding{
+					Linter:     linterName,
+					Path:       path,
+					Message:    err.Error(),
+					Suggestion: linter.Explain,
+					Severity:   severity(linterName, checks),
+				})
 			}
 		}
 
@@ -332,53 +459,257 @@ func (lctx LinterContext) LintPackageFs(fsys fs.FS, warn func(error), linters []
 	}
 
 	if err := fs.WalkDir(fsys, ".", walkCb); err != nil {
-		return err
+		return nil, err
 	}
 
 	// Run post-walking linters
 	for _, linterName := range postLinters {
 		linter := postLinterMap[linterName]
-		err := linter.LinterFunc(lctx, fsys)
-		if err != nil {
-			if linter.FailOnError {
-				return fmt.Errorf("Linter %s failed; suggest: %s", linterName, linter.Explain)
-			}
-			warn(err)
+		if err := linter.LinterFunc(lctx, fsys); err != nil {
+			findings = append(findings, Finding{
+				Linter:     linterName,
+				Message:    err.Error(),
+				Suggestion: linter.Explain,
+				Severity:   severity(linterName, checks),
+			})
 		}
 	}
 
-	return nil
+	return findings, nil
 }
 
-func LintApk(ctx context.Context, path string, warn func(error), linters []string) error {
-	apkfs, err := apkofs.NewAPKFS(ctx, path)
+// LintApk runs the linters selected by checks against the contents of the apk
+// at path.  The data section is extracted to a temporary directory so that the
+// linters see the same tree they would during a build.
+func LintApk(ctx context.Context, path string, checks config.Checks) ([]Finding, error) {
+	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer f.Close()
 
-	// Get the package name
-	f, err := apkfs.Open("./.PKGINFO")
+	eapk, err := expandapk.ExpandApk(ctx, f, "")
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("expanding apk %s: %w", path, err)
 	}
-	defer f.Close()
+	defer eapk.Close()
 
-	data, err := io.ReadAll(f)
+	data, err := readControlFile(eapk.ControlFile, ".PKGINFO")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	cfg, err := ini.Load(data)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	pkgname := cfg.Section("").Key("pkgname").MustString("")
 	if pkgname == "" {
-		return fmt.Errorf("pkgname is nonexistent")
+		return nil, fmt.Errorf("pkgname is nonexistent")
 	}
 
-	lctx := NewLinterContext(pkgname, apkfs)
+	dir, err := os.MkdirTemp("", "melange-lint-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
 
-	return lctx.LintPackageFs(apkfs, warn, linters)
+	if err := extractPackageData(eapk, dir); err != nil {
+		return nil, fmt.Errorf("extracting %s: %w", path, err)
+	}
+
+	fsys := os.DirFS(dir)
+	lctx := NewLinterContext(pkgname, fsys)
+
+	return lctx.LintPackageFs(fsys, checks)
+}
+
+// readControlFile returns the contents of name from the gzipped control
+// section at path.
+func readControlFile(path, name string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s not found in control section", name)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimPrefix(hdr.Name, "./") == name {
+			return io.ReadAll(tr)
+		}
+	}
+}
+
+// extractPackageData writes the data section of the package into dir.  The
+// owner is always given read and write access so the tree can be walked and
+// removed, and special files are replaced with empty regular files.  Entries
+// are never written through symlinks, and symlinks never point outside dir.
+func extractPackageData(eapk *expandapk.APKExpanded, dir string) error {
+	rc, err := eapk.PackageData()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if name == "." {
+			continue
+		}
+		target, err := extractTarget(dir, name)
+		if err != nil {
+			return fmt.Errorf("invalid path %q in package: %w", hdr.Name, err)
+		}
+
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+
+		// Replace whatever an earlier entry of the same name left, so that
+		// the entry is not written through it.
+		if fi, err := os.Lstat(target); err == nil && (hdr.Typeflag != tar.TypeDir || !fi.IsDir()) {
+			if err := os.RemoveAll(target); err != nil {
+				return err
+			}
+		}
+
+		mode := hdr.FileInfo().Mode()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0o700); err != nil {
+				return err
+			}
+			if err := os.Chmod(target, mode.Perm()|mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)|0o700); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeSymlink:
+			link, err := symlinkTarget(name, hdr.Linkname)
+			if err != nil {
+				return fmt.Errorf("invalid symlink %q in package: %w", hdr.Name, err)
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			continue
+		case tar.TypeLink:
+			source, err := extractTarget(dir, filepath.Clean(strings.TrimPrefix(hdr.Linkname, "./")))
+			if err != nil {
+				return fmt.Errorf("invalid hard link %q to %q in package: %w", hdr.Name, hdr.Linkname, err)
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+			continue
+		}
+
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+		}
+		if err := out.Close(); err != nil {
+			return err
+		}
+		if err := os.Chmod(target, mode.Perm()|mode&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky)|0o600); err != nil {
+			return err
+		}
+	}
+}
+
+// extractTarget returns the path of the cleaned package path name in dir.
+// It fails if the name escapes dir, or if any of its parent directories
+// already extracted is a symlink, as the entry would then be written
+// wherever the symlink points.
+func extractTarget(dir, name string) (string, error) {
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("path escapes the package root")
+	}
+
+	parent := dir
+	for _, elem := range strings.Split(filepath.Dir(name), string(filepath.Separator)) {
+		if elem == "." {
+			break
+		}
+		parent = filepath.Join(parent, elem)
+		fi, err := os.Lstat(parent)
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		} else if err != nil {
+			return "", err
+		}
+		if fi.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is a symlink", strings.TrimPrefix(parent, dir+string(filepath.Separator)))
+		}
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+// symlinkTarget returns the target to give the symlink name.  The target is
+// resolved relative to the directory of the symlink, or to the package root
+// if absolute, and must not leave the package root.  The symlink is given the
+// resolved target relative to its directory, which only climbs through the
+// directories of the symlink before descending: a ".." following a symlink in
+// the target as written would not resolve where it reads.
+func symlinkTarget(name, linkname string) (string, error) {
+	if linkname == "" {
+		return "", fmt.Errorf("empty target")
+	}
+
+	var resolved string
+	if filepath.IsAbs(linkname) {
+		resolved = strings.TrimPrefix(filepath.Clean(linkname), "/")
+		if resolved == "" {
+			resolved = "."
+		}
+	} else {
+		resolved = filepath.Join(filepath.Dir(name), linkname)
+		if resolved != "." && !filepath.IsLocal(resolved) {
+			return "", fmt.Errorf("target %q escapes the package root", linkname)
+		}
+	}
+
+	return filepath.Rel(filepath.Dir(name), resolved)
+}
+
+// Explain returns the suggested remediation for the named linter, or an
+// empty string if the linter is unknown.
+func Explain(name string) string {
+	if l, ok := linterMap[name]; ok {
+		return l.Explain
+	}
+	if l, ok := postLinterMap[name]; ok {
+		return l.Explain
+	}
+	return ""
 }
@@ -15,14 +15,19 @@
 package linter
 
 import (
+	"archive/tar"
+	"context"
 	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"sort"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
 	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/internal/apktest"
 )
 
 func Test_emptyLinter(t *testing.T) {
@@ -46,11 +51,9 @@ func Test_emptyLinter(t *testing.T) {
 	assert.Equal(t, linters, []string{"empty"})
 	fsys := os.DirFS(dir)
 	lctx := NewLinterContext(cfg.Package.Name, fsys)
-	called := false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.True(t, called)
+	findings, err := lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, findings)
 }
 
 func Test_usrLocalLinter(t *testing.T) {
@@ -79,11 +82,9 @@ func Test_usrLocalLinter(t *testing.T) {
 	assert.Equal(t, linters, []string{"usrlocal"})
 	fsys := os.DirFS(dir)
 	lctx := NewLinterContext(cfg.Package.Name, fsys)
-	called := false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.True(t, called)
+	findings, err := lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, findings)
 }
 
 func Test_varEmptyLinter(t *testing.T) {
@@ -113,11 +114,9 @@ func Test_varEmptyLinter(t *testing.T) {
 	assert.Equal(t, linters, []string{"varempty"})
 	fsys := os.DirFS(dir)
 	lctx := NewLinterContext(cfg.Package.Name, fsys)
-	called := false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.True(t, called)
+	findings, err := lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, findings)
 }
 
 func Test_devLinter(t *testing.T) {
@@ -147,11 +146,9 @@ func Test_devLinter(t *testing.T) {
 	assert.Equal(t, linters, []string{"dev"})
 	fsys := os.DirFS(dir)
 	lctx := NewLinterContext(cfg.Package.Name, fsys)
-	called := false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.True(t, called)
+	findings, err := lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, findings)
 }
 
 func Test_optLinter(t *testing.T) {
@@ -181,11 +178,9 @@ func Test_optLinter(t *testing.T) {
 	assert.Equal(t, linters, []string{"opt"})
 	fsys := os.DirFS(dir)
 	lctx := NewLinterContext(cfg.Package.Name, fsys)
-	called := false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.True(t, called)
+	findings, err := lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, findings)
 }
 
 func Test_srvLinter(t *testing.T) {
@@ -215,11 +210,9 @@ func Test_srvLinter(t *testing.T) {
 	assert.Equal(t, linters, []string{"srv"})
 	fsys := os.DirFS(dir)
 	lctx := NewLinterContext(cfg.Package.Name, fsys)
-	called := false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.True(t, called)
+	findings, err := lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, findings)
 }
 
 func Test_tempDirLinter(t *testing.T) {
@@ -261,11 +254,9 @@ func Test_tempDirLinter(t *testing.T) {
 	_, err = os.Create(filename)
 	assert.NoError(t, err)
 	lctx := NewLinterContext(cfg.Package.Name, fsys)
-	called := false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.True(t, called)
+	findings, err := lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, findings)
 	os.Remove(filename)
 
 	// Test /var/tmp check
@@ -320,11 +311,9 @@ func Test_setUidGidLinter(t *testing.T) {
 	assert.Equal(t, linters, []string{"setuidgid"})
 	fsys := os.DirFS(dir)
 	lctx := NewLinterContext(cfg.Package.Name, fsys)
-	called := false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.True(t, called)
+	findings, err := lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, findings)
 }
 
 func Test_worldWriteLinter(t *testing.T) {
@@ -353,11 +342,9 @@ func Test_worldWriteLinter(t *testing.T) {
 	assert.Equal(t, linters, []string{"worldwrite"})
 	fsys := os.DirFS(dir)
 	lctx := NewLinterContext(cfg.Package.Name, fsys)
-	called := false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.False(t, called)
+	findings, err := lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.Empty(t, findings)
 
 	// Create test file
 	filePath := filepath.Join(usrLocalDirPath, "test.txt")
@@ -369,33 +356,27 @@ func Test_worldWriteLinter(t *testing.T) {
 	assert.NoError(t, err)
 
 	// Linter should not trigger
-	called = false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.False(t, called)
+	findings, err = lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.Empty(t, findings)
 
 	// Set writeable bit (but not executable bit)
 	err = os.Chmod(filePath, 0776)
 	assert.NoError(t, err)
 
 	// Linter should trigger
-	called = false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.True(t, called)
+	findings, err = lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, findings)
 
 	// Set writeable and executable bit
 	err = os.Chmod(filePath, 0777)
 	assert.NoError(t, err)
 
 	// Linter should trigger
-	called = false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.True(t, called)
+	findings, err = lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, findings)
 }
 
 func Test_disableDefaultLinter(t *testing.T) {
@@ -423,12 +404,376 @@ func Test_disableDefaultLinter(t *testing.T) {
 	_, err = os.Create(filepath.Join(filePath))
 	assert.NoError(t, err)
 
-	linters := cfg.Package.Checks.GetLinters()
 	fsys := os.DirFS(dir)
 	lctx := NewLinterContext(cfg.Package.Name, fsys)
-	called := false
-	assert.NoError(t, lctx.LintPackageFs(fsys, func(err error) {
-		called = true
-	}, linters))
-	assert.False(t, called)
+	findings, err := lctx.LintPackageFs(fsys, cfg.Package.Checks)
+	assert.NoError(t, err)
+	assert.Empty(t, findings)
+}
+
+func Test_lintApk(t *testing.T) {
+	path := writeTestApk(t, t.TempDir(), []*tar.Header{
+		{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/local/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "usr/local/test.txt", Typeflag: tar.TypeReg, Mode: 0644},
+		{Name: "usr/bin/", Typeflag: tar.TypeDir, Mode: 0555},
+		{Name: "usr/bin/test", Typeflag: tar.TypeReg, Mode: 0755 | 04000},
+	}, map[string]string{"usr/bin/test": "#!/bin/sh\n"})
+
+	findings, err := LintApk(context.Background(), path, config.Checks{
+		Enabled:  []string{"usrlocal", "empty"},
+		Disabled: []string{"dev", "opt", "setuidgid", "srv", "strip", "tempdir", "varempty", "worldwrite"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []Finding{{
+		Linter:     "usrlocal",
+		Path:       "usr/local/test.txt",
+		Message:    "/usr/local path found in non-compat package",
+		Suggestion: "This package should be a -compat package",
+		Severity:   SeverityWarning,
+	}}, findings)
+
+	findings, err = LintApk(context.Background(), path, config.Checks{
+		Enabled:  []string{"setuidgid"},
+		Disabled: []string{"dev", "empty", "opt", "srv", "strip", "tempdir", "usrlocal", "varempty", "worldwrite"},
+	})
+	assert.NoError(t, err)
+	assert.Len(t, findings, 1)
+	assert.Equal(t, "usr/bin/test", findings[0].Path)
+	assert.Equal(t, "File is setuid", findings[0].Message)
+}
+
+// writeTestApk writes an apk with the data section entries to dir and
+// returns its path.
+func writeTestApk(t *testing.T, dir string, hdrs []*tar.Header, contents map[string]string) string {
+	path := filepath.Join(dir, "testapk-4.2.0-r0.apk")
+	apktest.WriteApk(t, path, "pkgname = testapk\npkgver = 4.2.0-r0\n", hdrs, contents)
+	return path
+}
+
+func Test_extractPackageData(t *testing.T) {
+	victim := t.TempDir()
+	checks := config.Checks{Disabled: []string{"dev", "empty", "opt", "setuidgid", "srv", "strip", "tempdir", "usrlocal", "varempty", "worldwrite"}}
+
+	for _, tt := range []struct {
+		name     string
+		hdrs     []*tar.Header
+		contents map[string]string
+		err      string
+	}{{
+		name: "file through an absolute symlink",
+		hdrs: []*tar.Header{
+			{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: victim, Mode: 0777},
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		contents: map[string]string{"etc/passwd": "root::0:0::/root:/bin/sh\n"},
+		err:      "etc is a symlink",
+	}, {
+		name: "file through a relative symlink",
+		hdrs: []*tar.Header{
+			{Name: "etc", Typeflag: tar.TypeSymlink, Linkname: "../../../../../../../../.." + victim, Mode: 0777},
+			{Name: "etc/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		contents: map[string]string{"etc/passwd": "root::0:0::/root:/bin/sh\n"},
+		err:      "escapes the package root",
+	}, {
+		name: "symlink climbing through a symlink",
+		hdrs: []*tar.Header{
+			{Name: "usr/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "usr/root", Typeflag: tar.TypeSymlink, Linkname: "..", Mode: 0777},
+			{Name: "usr/escape", Typeflag: tar.TypeSymlink, Linkname: "root/../root/../root/..", Mode: 0777},
+			{Name: "usr/escape/passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+		contents: map[string]string{"usr/escape/passwd": "root::0:0::/root:/bin/sh\n"},
+		err:      "usr/escape is a symlink",
+	}, {
+		name: "symlink through parent directories inside the package",
+		hdrs: []*tar.Header{
+			{Name: "usr/lib/", Typeflag: tar.TypeDir, Mode: 0755},
+			{Name: "usr/lib/libfoo.so.1", Typeflag: tar.TypeReg, Mode: 0755},
+			{Name: "usr/lib/libfoo.so", Typeflag: tar.TypeSymlink, Linkname: "../lib/./libfoo.so.1", Mode: 0777},
+			{Name: "usr/bin/foo", Typeflag: tar.TypeSymlink, Linkname: "../share/../lib/libfoo.so.1", Mode: 0777},
+		},
+		contents: map[string]string{"usr/lib/libfoo.so.1": "ELF"},
+	}, {
+		name: "symlink replaced by a file",
+		hdrs: []*tar.Header{
+			{Name: "passwd", Typeflag: tar.TypeSymlink, Linkname: filepath.Join(victim, "passwd"), Mode: 0777},
+			{Name: "passwd", Typeflag: tar.TypeReg, Mode: 0644},
+		},
+	}, {
+		name: "hard link outside the package",
+		hdrs: []*tar.Header{
+			{Name: "passwd", Typeflag: tar.TypeLink, Linkname: "../../../../../../../.." + victim + "/secret", Mode: 0644},
+		},
+		err: "invalid hard link",
+	}} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := writeTestApk(t, t.TempDir(), tt.hdrs, tt.contents)
+			_, err := LintApk(context.Background(), path, checks)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			entries, err := os.ReadDir(victim)
+			assert.NoError(t, err)
+			assert.Empty(t, entries)
+		})
+	}
+}
+
+func Test_symlinkTarget(t *testing.T) {
+	for _, tt := range []struct {
+		name, linkname, want string
+	}{
+		{"usr/lib/libfoo.so", "libfoo.so.1", "libfoo.so.1"},
+		{"usr/lib/libfoo.so", "../../lib/libfoo.so.1", "../../lib/libfoo.so.1"},
+		{"usr/lib/libfoo.so", "/lib/libfoo.so.1", "../../lib/libfoo.so.1"},
+		{"bin/sh", "/", "../"},
+		{"usr/lib/libfoo.so", "/../../lib/libfoo.so.1", "../../lib/libfoo.so.1"},
+		{"usr/lib/libfoo.so", "sub/../libfoo.so.1", "libfoo.so.1"},
+		{"usr/lib/libfoo.so", "../../usr/share/../lib/libfoo.so.1", "libfoo.so.1"},
+		{"usr/lib/libfoo.so", "root/../..", ".."},
+		{"libfoo.so", "/", "."},
+		{"usr/lib/libfoo.so", "../../../lib/libfoo.so.1", ""},
+		{"usr/lib/libfoo.so", "sub/../../../../lib/libfoo.so.1", ""},
+	} {
+		got, err := symlinkTarget(tt.name, tt.linkname)
+		if tt.want == "" {
+			assert.Error(t, err, tt.linkname)
+			continue
+		}
+		assert.NoError(t, err, tt.linkname)
+		assert.Equal(t, filepath.Clean(tt.want), got, tt.linkname)
+	}
+}
+
+func Test_severityAndExemptions(t *testing.T) {
+	dir := t.TempDir()
+
+	for _, p := range []string{"usr/local/bin/foo", "usr/local/share/foo/data", "opt/foo/bin/foo"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, filepath.Dir(p)), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, p), nil, 0644))
+	}
+
+	checks := config.Checks{
+		Enabled:  []string{"usrlocal", "opt"},
+		Disabled: []string{"dev", "empty", "setuidgid", "srv", "strip", "tempdir", "varempty", "worldwrite"},
+		Severity: map[string]string{"usrlocal": "error"},
+		Exemptions: map[string][]string{
+			"usrlocal": {"usr/local/share"},
+			"opt":      {"opt/*/bin/*"},
+		},
+	}
+
+	fsys := os.DirFS(dir)
+	lctx := NewLinterContext("testseverity", fsys)
+	findings, err := lctx.LintPackageFs(fsys, checks)
+	assert.NoError(t, err)
+
+	got := map[string]Severity{}
+	for _, f := range findings {
+		got[f.Linter+":"+f.Path] = f.Severity
+	}
+	assert.Equal(t, map[string]Severity{
+		"usrlocal:usr/local/bin":     SeverityError,
+		"usrlocal:usr/local/bin/foo": SeverityError,
+		"opt:opt/foo":                SeverityWarning,
+		"opt:opt/foo/bin":            SeverityWarning,
+	}, got)
+
+	// Linters turned off through their severity are not run at all.
+	checks.Severity["opt"] = "off"
+	findings, err = lctx.LintPackageFs(fsys, checks)
+	assert.NoError(t, err)
+	for _, f := range findings {
+		assert.Equal(t, "usrlocal", f.Linter)
+	}
+}
+
+func Test_hardeningLinter(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler available")
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	assert.NoError(t, os.WriteFile(src, []byte(`#include <stdio.h>
+#include <string.h>
+
+int main(int argc, char **argv) {
+	char buf[64];
+	strcpy(buf, argc > 1 ? argv[1] : "hello");
+	printf("%s\n", buf);
+	return 0;
+}
+`), 0644))
+
+	for _, d := range []string{"usr/bin", "usr/lib"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(dir, "pkg", d), 0755))
+	}
+
+	// A hardened shared library is ET_DYN like a PIE executable, and is not
+	// reported either.
+	for name, flags := range map[string][]string{
+		"usr/bin/hardened":       {"-O2", "-fPIE", "-pie", "-Wl,-z,relro,-z,now", "-Wl,-z,noexecstack", "-fstack-protector-all", "-D_FORTIFY_SOURCE=2"},
+		"usr/bin/unhardened":     {"-O0", "-no-pie", "-Wl,-z,norelro", "-Wl,-z,execstack", "-fno-stack-protector", "-U_FORTIFY_SOURCE"},
+		"usr/lib/libhardened.so": {"-O2", "-fPIC", "-shared", "-Wl,-z,relro,-z,now", "-Wl,-z,noexecstack", "-fstack-protector-all", "-D_FORTIFY_SOURCE=2"},
+	} {
+		args := append(flags, "-o", filepath.Join(dir, "pkg", name), src)
+		if out, err := exec.Command(cc, args...).CombinedOutput(); err != nil {
+			t.Skipf("compiling %s: %v: %s", name, err, out)
+		}
+	}
+
+	checks := config.Checks{
+		Enabled:  []string{"hardening"},
+		Disabled: []string{"dev", "empty", "opt", "setuidgid", "srv", "strip", "tempdir", "usrlocal", "varempty", "worldwrite"},
+	}
+
+	fsys := os.DirFS(filepath.Join(dir, "pkg"))
+	lctx := NewLinterContext("testhardening", fsys)
+	findings, err := lctx.LintPackageFs(fsys, checks)
+	assert.NoError(t, err)
+
+	assert.Len(t, findings, 1)
+	assert.Equal(t, "hardening", findings[0].Linter)
+	assert.Equal(t, "usr/bin/unhardened", findings[0].Path)
+	for _, want := range []string{"not PIE", "no full RELRO", "executable stack", "no stack protector", "not fortified"} {
+		assert.Contains(t, findings[0].Message, want)
+	}
+}
+
+func Test_rpathAndBuildPathLinters(t *testing.T) {
+	cc, err := exec.LookPath("cc")
+	if err != nil {
+		t.Skip("no C compiler available")
+	}
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "main.c")
+	assert.NoError(t, os.WriteFile(src, []byte(`#include <stdio.h>
+
+int main(void) {
+	puts(CONFIG);
+	return 0;
+}
+`), 0644))
+
+	pkgdir := filepath.Join(dir, "pkg")
+	for _, d := range []string{"usr/bin", "usr/lib/pkgconfig", "usr/libexec"} {
+		assert.NoError(t, os.MkdirAll(filepath.Join(pkgdir, d), 0755))
+	}
+
+	for name, flags := range map[string][]string{
+		"good":     {`-DCONFIG="/etc/foo.conf"`, "-Wl,-rpath,$ORIGIN/../lib:/usr/lib/foo"},
+		"leaky":    {`-DCONFIG="/home/build/etc/foo.conf"`, "-Wl,--enable-new-dtags,-rpath,/home/build/output/lib:lib:/opt/foo/lib"},
+		"buildlog": {`-DCONFIG="/home/buildkite/foo.conf"`},
+	} {
+		args := append(flags, "-o", filepath.Join(pkgdir, "usr/bin", name), src)
+		if out, err := exec.Command(cc, args...).CombinedOutput(); err != nil {
+			t.Skipf("compiling %s: %v: %s", name, err, out)
+		}
+	}
+
+	assert.NoError(t, os.WriteFile(filepath.Join(pkgdir, "usr/lib/pkgconfig/foo.pc"),
+		[]byte("prefix=/usr\nlibdir=${prefix}/lib\nincludedir=/home/build/output/usr/include\n"), 0644))
+	assert.NoError(t, os.WriteFile(filepath.Join(pkgdir, "usr/libexec/foo.sh"),
+		[]byte("#!/bin/sh\nexec /usr/bin/good \"$@\"\n"), 0755))
+
+	checks := config.Checks{
+		Enabled:  []string{"rpath", "buildpath"},
+		Disabled: []string{"dev", "empty", "opt", "setuidgid", "srv", "strip", "tempdir", "usrlocal", "varempty", "worldwrite"},
+	}
+
+	fsys := os.DirFS(pkgdir)
+	lctx := NewLinterContext("testbuildpath", fsys)
+	findings, err := lctx.LintPackageFs(fsys, checks)
+	assert.NoError(t, err)
+
+	got := map[string]string{}
+	for _, f := range findings {
+		got[f.Linter+":"+f.Path] = f.Message
+	}
+	assert.Len(t, got, 3)
+	assert.Contains(t, got["buildpath:usr/lib/pkgconfig/foo.pc"], "on line 3")
+	assert.Contains(t, got["buildpath:usr/bin/leaky"], ".rodata")
+
+	rpath := got["rpath:usr/bin/leaky"]
+	assert.Contains(t, rpath, `RUNPATH entry "/home/build/output/lib" points at the build workspace`)
+	assert.Contains(t, rpath, `RUNPATH entry "lib" is relative`)
+	assert.Contains(t, rpath, `RUNPATH entry "/opt/foo/lib" is outside the standard library directories`)
+}
+
+func Test_hygieneLinters(t *testing.T) {
+	outdir := t.TempDir()
+
+	files := []string{
+		"foo/usr/lib/libfoo.so.1.0.0",
+		"foo/usr/lib/libfoo.la",
+		"foo/usr/lib/libfoo.a",
+		"foo/usr/lib/pkgconfig/foo.pc",
+		"foo/usr/include/foo.h",
+		"foo/usr/share/man/man1/foo.1",
+		"foo/usr/lib/python3.11/site-packages/foo/__pycache__/__init__.cpython-311.pyc",
+		"foo/usr/lib/python3.11/site-packages/foo/__pycache__/bar.cpython-312.pyc",
+		"foo-dev/usr/include/bar.h",
+		"foo-static/usr/lib/libbar.a",
+		"foo-doc/usr/share/doc/foo/README",
+	}
+	for _, p := range files {
+		assert.NoError(t, os.MkdirAll(filepath.Join(outdir, filepath.Dir(p)), 0755))
+		assert.NoError(t, os.WriteFile(filepath.Join(outdir, p), nil, 0644))
+	}
+	assert.NoError(t, os.Symlink("libfoo.so.1.0.0", filepath.Join(outdir, "foo/usr/lib/libfoo.so")))
+
+	checks := config.Checks{
+		Enabled:  []string{"libtool", "devfiles", "staticlib", "docs", "pycache"},
+		Disabled: []string{"dev", "empty", "opt", "setuidgid", "srv", "strip", "tempdir", "usrlocal", "varempty", "worldwrite"},
+	}
+
+	lint := func(name string, outfs fs.FS) []string {
+		fsys := os.DirFS(filepath.Join(outdir, name))
+		lctx := NewLinterContext(name, fsys)
+		if outfs != nil {
+			lctx = lctx.WithOutputFS(outfs)
+		}
+
+		findings, err := lctx.LintPackageFs(fsys, checks)
+		assert.NoError(t, err)
+
+		got := []string{}
+		for _, f := range findings {
+			got = append(got, f.Linter+":"+f.Path)
+		}
+		sort.Strings(got)
+		return got
+	}
+
+	outfs := os.DirFS(outdir)
+	assert.Equal(t, []string{
+		"devfiles:usr/include/foo.h",
+		"devfiles:usr/lib/libfoo.so",
+		"devfiles:usr/lib/pkgconfig/foo.pc",
+		"docs:usr/share/man/man1/foo.1",
+		"libtool:usr/lib/libfoo.la",
+		"pycache:usr/lib/python3.11/site-packages/foo/__pycache__/bar.cpython-312.pyc",
+		"staticlib:usr/lib/libfoo.a",
+	}, lint("foo", outfs))
+
+	// Without the outputs of the other packages there is no -dev package
+	// to move the development files to.
+	assert.Equal(t, []string{
+		"docs:usr/share/man/man1/foo.1",
+		"libtool:usr/lib/libfoo.la",
+		"pycache:usr/lib/python3.11/site-packages/foo/__pycache__/bar.cpython-312.pyc",
+		"staticlib:usr/lib/libfoo.a",
+	}, lint("foo", nil))
+
+	for _, name := range []string{"foo-dev", "foo-static", "foo-doc"} {
+		assert.Empty(t, lint(name, outfs), name)
+	}
 }
@@ -0,0 +1,411 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Package publish publishes packages and their indexes to an OCI registry.
+//
+// Each package is pushed as an artifact tagged <arch>-<name>-<version>, and
+// the index of each architecture as an artifact tagged APKINDEX-<arch>.  Both
+// hold the file as their single layer, with the package name, version and
+// architecture as annotations of packages.
+package publish
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	apko_log "chainguard.dev/apko/pkg/log"
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/sirupsen/logrus"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+	"go.opentelemetry.io/otel"
+
+	"chainguard.dev/melange/pkg/index"
+)
+
+const (
+	// ArtifactMediaType is the media type of the config of the artifacts.
+	ArtifactMediaType types.MediaType = "application/vnd.dev.chainguard.melange.artifact.v1+json"
+
+	// PackageMediaType is the media type of the layer of package artifacts.
+	PackageMediaType types.MediaType = "application/vnd.alpinelinux.apk.v2+gzip"
+
+	// IndexMediaType is the media type of the layer of index artifacts.
+	IndexMediaType types.MediaType = "application/vnd.alpinelinux.apkindex.v2+gzip"
+
+	// AnnotationPackageName, AnnotationPackageVersion and
+	// AnnotationPackageArch annotate the package of package artifacts, and
+	// the architecture of index artifacts.
+	AnnotationPackageName    = "dev.chainguard.melange.package.name"
+	AnnotationPackageVersion = "dev.chainguard.melange.package.version"
+	AnnotationPackageArch    = "dev.chainguard.melange.package.arch"
+
+	// IndexTagPrefix prefixes the architecture in the tags of index
+	// artifacts.
+	IndexTagPrefix = "APKINDEX-"
+)
+
+// Scheme is the scheme of the registry repositories packages are published to.
+const Scheme = "oci://"
+
+type Publisher struct {
+	Repository     name.Repository
+	PackageFiles   []string
+	SigningKey     string
+	Signer         index.SignFunc
+	FailOnConflict bool
+	RemoteOptions  []remote.Option
+	Logger         *logrus.Logger
+}
+
+type Option func(*Publisher) error
+
+// WithRepository sets the registry repository to publish to, such as
+// oci://registry.example.com/packages.
+func WithRepository(repo string) Option {
+	return func(p *Publisher) error {
+		if !strings.HasPrefix(repo, Scheme) {
+			return fmt.Errorf("repository %s must start with %s", repo, Scheme)
+		}
+		r, err := name.NewRepository(strings.TrimPrefix(repo, Scheme))
+		if err != nil {
+			return fmt.Errorf("parsing repository %s: %w", repo, err)
+		}
+		p.Repository = r
+		return nil
+	}
+}
+
+func WithPackageFiles(packageFiles []string) Option {
+	return func(p *Publisher) error {
+		p.PackageFiles = append(p.PackageFiles, packageFiles...)
+		return nil
+	}
+}
+
+func WithSigningKey(signingKey string) Option {
+	return func(p *Publisher) error {
+		p.SigningKey = signingKey
+		return nil
+	}
+}
+
+// WithSigner sets the function signing the indexes, as index.WithSigner.
+func WithSigner(signer index.SignFunc) Option {
+	return func(p *Publisher) error {
+		p.Signer = signer
+		return nil
+	}
+}
+
+// WithFailOnConflict sets whether publishing a package which has the name,
+// version and architecture of a package in the published index but a
+// different checksum fails, rather than replacing it.
+func WithFailOnConflict(failOnConflict bool) Option {
+	return func(p *Publisher) error {
+		p.FailOnConflict = failOnConflict
+		return nil
+	}
+}
+
+// WithRemoteOptions sets the options of the requests to the registry, such
+// as the transport.  The default keychain authenticates the requests.
+func WithRemoteOptions(opts ...remote.Option) Option {
+	return func(p *Publisher) error {
+		p.RemoteOptions = append(p.RemoteOptions, opts...)
+		return nil
+	}
+}
+
+func New(opts ...Option) (*Publisher, error) {
+	p := Publisher{
+		Logger: &logrus.Logger{
+			Out:       os.Stderr,
+			Formatter: &apko_log.Formatter{},
+			Hooks:     make(logrus.LevelHooks),
+			Level:     logrus.InfoLevel,
+		},
+	}
+
+	for _, opt := range opts {
+		if err := opt(&p); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Repository.RepositoryStr() == "" {
+		return nil, errors.New("no repository to publish to")
+	}
+
+	return &p, nil
+}
+
+func (p *Publisher) remoteOptions(ctx context.Context) []remote.Option {
+	return append([]remote.Option{
+		remote.WithContext(ctx),
+		remote.WithAuthFromKeychain(authn.DefaultKeychain),
+	}, p.RemoteOptions...)
+}
+
+var invalidTagChars = regexp.MustCompile(`[^A-Za-z0-9_.-]`)
+
+// PackageTag returns the tag of the artifact of the package.  Characters
+// which are not allowed in tags are replaced by underscores, and tags which
+// are too long are replaced by a digest of the package name and version.
+func PackageTag(pkg *apkrepo.Package) string {
+	tag := invalidTagChars.ReplaceAllString(fmt.Sprintf("%s-%s-%s", pkg.Arch, pkg.Name, pkg.Version), "_")
+	if len(tag) > 128 {
+		sum := sha256.Sum256([]byte(pkg.Name + "-" + pkg.Version))
+		tag = invalidTagChars.ReplaceAllString(pkg.Arch, "_") + "-" + hex.EncodeToString(sum[:])[:32]
+	}
+	return tag
+}
+
+// IndexTag returns the tag of the artifact of the index of the architecture.
+func IndexTag(arch string) string {
+	return IndexTagPrefix + invalidTagChars.ReplaceAllString(arch, "_")
+}
+
+// artifact returns an artifact holding the file as its single layer.
+func artifact(data []byte, mediaType types.MediaType, filename string, annotations map[string]string) (v1.Image, error) {
+	img := mutate.ConfigMediaType(mutate.MediaType(empty.Image, types.OCIManifestSchema1), ArtifactMediaType)
+	img, err := mutate.Append(img, mutate.Addendum{
+		Layer: static.NewLayer(data, mediaType),
+		Annotations: map[string]string{
+			"org.opencontainers.image.title": filename,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return mutate.Annotations(img, annotations).(v1.Image), nil
+}
+
+// Publish merges the packages into the published index of their
+// architecture, then pushes the packages and the signed indexes.
+func (p *Publisher) Publish(ctx context.Context) error {
+	ctx, span := otel.Tracer("melange").Start(ctx, "Publish")
+	defer span.End()
+
+	byArch := map[string][]string{}
+	pkgs := map[string]*apkrepo.Package{}
+	for _, file := range p.PackageFiles {
+		pkg, err := parsePackage(file)
+		if err != nil {
+			return err
+		}
+		byArch[pkg.Arch] = append(byArch[pkg.Arch], file)
+		pkgs[file] = pkg
+	}
+
+	archs := make([]string, 0, len(byArch))
+	for arch := range byArch {
+		archs = append(archs, arch)
+	}
+	sort.Strings(archs)
+
+	tmp, err := os.MkdirTemp("", "melange-publish-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	// The indexes are all merged before anything is pushed, so that a
+	// conflict leaves the registry untouched.
+	indexes := map[string]string{}
+	for _, arch := range archs {
+		indexFile, err := p.mergeIndex(ctx, filepath.Join(tmp, arch), arch, byArch[arch])
+		if err != nil {
+			return fmt.Errorf("merging index of %s: %w", arch, err)
+		}
+		indexes[arch] = indexFile
+	}
+
+	for _, file := range p.PackageFiles {
+		if err := p.pushPackage(ctx, file, pkgs[file]); err != nil {
+			return err
+		}
+	}
+
+	for _, arch := range archs {
+		if err := p.pushIndex(ctx, indexes[arch], arch); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func parsePackage(file string) (*apkrepo.Package, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open package %s: %w", file, err)
+	}
+	defer f.Close()
+
+	pkg, err := apkrepo.ParsePackage(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse package %s: %w", file, err)
+	}
+	return pkg, nil
+}
+
+// FetchIndex writes the published index of the architecture to the file.  It
+// returns false if no index is published for the architecture.
+func (p *Publisher) FetchIndex(ctx context.Context, arch, file string) (bool, error) {
+	ref := p.Repository.Tag(IndexTag(arch))
+	img, err := remote.Image(ref, p.remoteOptions(ctx)...)
+	if err != nil {
+		var terr *transport.Error
+		if errors.As(err, &terr) && terr.StatusCode == http.StatusNotFound {
+			return false, nil
+		}
+		return false, fmt.Errorf("fetching index %s: %w", ref, err)
+	}
+
+	layers, err := img.Layers()
+	if err != nil {
+		return false, fmt.Errorf("fetching index %s: %w", ref, err)
+	}
+	if len(layers) != 1 {
+		return false, fmt.Errorf("index %s has %d layers, expecting 1", ref, len(layers))
+	}
+	if mt, err := layers[0].MediaType(); err != nil || mt != IndexMediaType {
+		return false, fmt.Errorf("index %s has media type %s, expecting %s", ref, mt, IndexMediaType)
+	}
+
+	rc, err := layers[0].Compressed()
+	if err != nil {
+		return false, fmt.Errorf("fetching index %s: %w", ref, err)
+	}
+	defer rc.Close()
+
+	f, err := os.Create(file)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, rc); err != nil {
+		return false, fmt.Errorf("fetching index %s: %w", ref, err)
+	}
+
+	return true, nil
+}
+
+// mergeIndex fetches the published index of the architecture, and merges the
+// packages into it, returning the signed index file.
+func (p *Publisher) mergeIndex(ctx context.Context, dir, arch string, files []string) (string, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	sourceFile := filepath.Join(dir, "APKINDEX.source.tar.gz")
+	found, err := p.FetchIndex(ctx, arch, sourceFile)
+	if err != nil {
+		return "", err
+	}
+	if found {
+		p.Logger.Printf("merging %d packages into the published index of %s", len(files), arch)
+	} else {
+		p.Logger.Printf("no published index for %s, creating one", arch)
+	}
+
+	indexFile := filepath.Join(dir, "APKINDEX.tar.gz")
+	options := []index.Option{
+		index.WithIndexFile(indexFile),
+		index.WithSourceIndexFile(sourceFile),
+		index.WithMergeIndexFileFlag(true),
+		index.WithPackageFiles(files),
+		index.WithExpectedArch(arch),
+		index.WithFailOnConflict(p.FailOnConflict),
+		index.WithSigningKey(p.SigningKey),
+	}
+	if p.Signer != nil {
+		options = append(options, index.WithSigner(p.Signer))
+	}
+
+	idx, err := index.New(options...)
+	if err != nil {
+		return "", err
+	}
+	idx.Logger = p.Logger
+	if err := idx.GenerateIndex(ctx); err != nil {
+		return "", err
+	}
+
+	return indexFile, nil
+}
+
+func (p *Publisher) pushPackage(ctx context.Context, file string, pkg *apkrepo.Package) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	img, err := artifact(data, PackageMediaType, filepath.Base(file), map[string]string{
+		AnnotationPackageName:    pkg.Name,
+		AnnotationPackageVersion: pkg.Version,
+		AnnotationPackageArch:    pkg.Arch,
+	})
+	if err != nil {
+		return fmt.Errorf("creating artifact of %s: %w", file, err)
+	}
+
+	ref := p.Repository.Tag(PackageTag(pkg))
+	p.Logger.Printf("pushing %s to %s", file, ref)
+	if err := remote.Write(ref, img, p.remoteOptions(ctx)...); err != nil {
+		return fmt.Errorf("pushing %s: %w", file, err)
+	}
+
+	return nil
+}
+
+func (p *Publisher) pushIndex(ctx context.Context, file, arch string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	img, err := artifact(data, IndexMediaType, "APKINDEX.tar.gz", map[string]string{
+		AnnotationPackageArch: arch,
+	})
+	if err != nil {
+		return fmt.Errorf("creating artifact of index of %s: %w", arch, err)
+	}
+
+	ref := p.Repository.Tag(IndexTag(arch))
+	p.Logger.Printf("pushing index of %s to %s", arch, ref)
+	if err := remote.Write(ref, img, p.remoteOptions(ctx)...); err != nil {
+		return fmt.Errorf("pushing index of %s: %w", arch, err)
+	}
+
+	return nil
+}
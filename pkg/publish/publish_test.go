@@ -0,0 +1,214 @@
+// Copyright 2023 Chainguard, Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package publish
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"log"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	apko_types "chainguard.dev/apko/pkg/build/types"
+	apko_log "chainguard.dev/apko/pkg/log"
+	"github.com/google/go-containerregistry/pkg/registry"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/require"
+	apkrepo "gitlab.alpinelinux.org/alpine/go/repository"
+
+	"chainguard.dev/melange/pkg/build"
+	"chainguard.dev/melange/pkg/config"
+	"chainguard.dev/melange/pkg/index"
+)
+
+// emitPackage builds a hello package of the version, with the content as
+// its single file.
+func emitPackage(t *testing.T, keyFile, version, content string) string {
+	pkgctx, err := build.NewPackageContext(&config.Package{
+		Name:      "hello",
+		Version:   version,
+		Copyright: []config.Copyright{{License: "Apache-2.0"}},
+	})
+	require.NoError(t, err)
+
+	workspace := t.TempDir()
+	bin := filepath.Join(workspace, "melange-out", "hello", "usr", "bin")
+	require.NoError(t, os.MkdirAll(bin, 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(bin, "hello"), []byte(content), 0755))
+
+	outDir := t.TempDir()
+	pb := &build.PackageBuild{
+		Build: &build.Build{
+			WorkspaceDir:    workspace,
+			OutDir:          outDir,
+			Arch:            apko_types.ParseArchitecture("x86_64"),
+			SourceDateEpoch: time.Unix(1700000000, 0),
+			SigningKey:      keyFile,
+		},
+		Origin:      pkgctx,
+		PackageName: "hello",
+		OriginName:  "hello",
+		OutDir:      filepath.Join(outDir, "x86_64"),
+		Arch:        "x86_64",
+		Logger:      &apko_log.Adapter{Out: io.Discard, Level: apko_log.InfoLevel},
+	}
+	require.NoError(t, pb.EmitPackage(context.Background()))
+
+	return pb.Filename()
+}
+
+func publish(t *testing.T, repo string, failOnConflict bool, keyFile string, files ...string) error {
+	p, err := New(
+		WithRepository(repo),
+		WithPackageFiles(files),
+		WithSigningKey(keyFile),
+		WithFailOnConflict(failOnConflict),
+	)
+	require.NoError(t, err)
+	p.Logger.Out = io.Discard
+	return p.Publish(context.Background())
+}
+
+func fetchIndex(t *testing.T, repo string) (*apkrepo.ApkIndex, string) {
+	p, err := New(WithRepository(repo))
+	require.NoError(t, err)
+
+	file := filepath.Join(t.TempDir(), "APKINDEX.tar.gz")
+	found, err := p.FetchIndex(context.Background(), "x86_64", file)
+	require.NoError(t, err)
+	require.True(t, found)
+
+	f, err := os.Open(file)
+	require.NoError(t, err)
+	defer f.Close()
+
+	// The signature is the first entry of the index.
+	gr, err := gzip.NewReader(f)
+	require.NoError(t, err)
+	gr.Multistream(false)
+	hdr, err := tar.NewReader(gr).Next()
+	require.NoError(t, err)
+
+	_, err = f.Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	idx, err := apkrepo.IndexFromArchive(f)
+	require.NoError(t, err)
+
+	return idx, hdr.Name
+}
+
+func TestPublish(t *testing.T) {
+	s := httptest.NewServer(registry.New(registry.Logger(log.New(io.Discard, "", 0))))
+	defer s.Close()
+	repo := Scheme + strings.TrimPrefix(s.URL, "http://") + "/packages"
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	keyFile := filepath.Join(t.TempDir(), "test.rsa")
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(key),
+	}), 0600))
+
+	hello10 := emitPackage(t, keyFile, "1.0", "hello 1.0")
+	require.NoError(t, publish(t, repo, false, keyFile, hello10))
+
+	// The package is pushed with its annotations and media types.
+	p, err := New(WithRepository(repo))
+	require.NoError(t, err)
+	img, err := remote.Image(p.Repository.Tag("x86_64-hello-1.0-r0"))
+	require.NoError(t, err)
+	manifest, err := img.Manifest()
+	require.NoError(t, err)
+	require.Equal(t, ArtifactMediaType, manifest.Config.MediaType)
+	require.Equal(t, map[string]string{
+		AnnotationPackageName:    "hello",
+		AnnotationPackageVersion: "1.0-r0",
+		AnnotationPackageArch:    "x86_64",
+	}, manifest.Annotations)
+	require.Len(t, manifest.Layers, 1)
+	require.Equal(t, PackageMediaType, manifest.Layers[0].MediaType)
+	require.Equal(t, "hello-1.0-r0.apk", manifest.Layers[0].Annotations["org.opencontainers.image.title"])
+
+	layers, err := img.Layers()
+	require.NoError(t, err)
+	rc, err := layers[0].Compressed()
+	require.NoError(t, err)
+	pushed, err := io.ReadAll(rc)
+	require.NoError(t, err)
+	want, err := os.ReadFile(hello10)
+	require.NoError(t, err)
+	require.Equal(t, want, pushed)
+
+	idx, sigName := fetchIndex(t, repo)
+	require.Equal(t, ".SIGN.RSA.test.rsa.pub", sigName)
+	require.Len(t, idx.Packages, 1)
+
+	// A new version is merged into the published index.
+	hello11 := emitPackage(t, keyFile, "1.1", "hello 1.1")
+	require.NoError(t, publish(t, repo, false, keyFile, hello11))
+	idx, _ = fetchIndex(t, repo)
+	require.Len(t, idx.Packages, 2)
+
+	// A different package under a published version is rejected, and
+	// leaves the registry untouched.
+	rebuilt := emitPackage(t, keyFile, "1.0", "hello 1.0 rebuilt")
+	require.ErrorIs(t, publish(t, repo, true, keyFile, rebuilt), index.ErrConflict)
+	after, err := remote.Image(p.Repository.Tag("x86_64-hello-1.0-r0"))
+	require.NoError(t, err)
+	digest, err := img.Digest()
+	require.NoError(t, err)
+	afterDigest, err := after.Digest()
+	require.NoError(t, err)
+	require.Equal(t, digest, afterDigest)
+
+	// Without failing on conflicts, it replaces the published package.
+	require.NoError(t, publish(t, repo, false, keyFile, rebuilt))
+	idx, _ = fetchIndex(t, repo)
+	require.Len(t, idx.Packages, 2)
+	p10, err := parsePackage(rebuilt)
+	require.NoError(t, err)
+	for _, pkg := range idx.Packages {
+		if pkg.Version == "1.0-r0" {
+			require.Equal(t, p10.Checksum, pkg.Checksum)
+		}
+	}
+}
+
+func TestPackageTag(t *testing.T) {
+	require.Equal(t, "x86_64-libstdc__-13.2.0-r0", PackageTag(&apkrepo.Package{Name: "libstdc++", Version: "13.2.0-r0", Arch: "x86_64"}))
+
+	long := PackageTag(&apkrepo.Package{Name: strings.Repeat("a", 130), Version: "1.0-r0", Arch: "aarch64"})
+	require.Len(t, long, len("aarch64-")+32)
+	require.True(t, strings.HasPrefix(long, "aarch64-"))
+}
+
+func TestWithRepository(t *testing.T) {
+	_, err := New(WithRepository("registry.example.com/packages"))
+	require.ErrorContains(t, err, "must start with oci://")
+
+	_, err = New()
+	require.ErrorContains(t, err, "no repository")
+}
@@ -19,16 +19,14 @@ import (
 	"crypto/sha256"
 	"crypto/sha512"
 	"fmt"
-	"io"
 	"log"
 	"os"
-	"path"
 	"strings"
 
-	"cloud.google.com/go/storage"
 	"github.com/dprotaso/go-yit"
 	"gopkg.in/yaml.v3"
 
+	cachebackend "chainguard.dev/melange/pkg/cache"
 	"chainguard.dev/melange/pkg/renovate"
 	"chainguard.dev/melange/pkg/util"
 )
@@ -39,13 +37,15 @@ type CacheConfig struct {
 	CacheDir       string
 	packageName    string
 	packageVersion string
+	backend        cachebackend.Backend
 }
 
 // Option sets a config option on a CacheConfig.
 type Option func(cfg *CacheConfig) error
 
 // WithCacheDir sets the desired target directory for cache
-// artifacts to be fetched to.
+// artifacts to be fetched to.  It is either a local directory, or a
+// gs:// or s3:// bucket.
 func WithCacheDir(cacheDir string) Option {
 	return func(cfg *CacheConfig) error {
 		cfg.CacheDir = cacheDir
@@ -72,6 +72,12 @@ func New(opts ...Option) renovate.Renovator {
 	}
 
 	return func(ctx context.Context, rc *renovate.RenovationContext) error {
+		backend, err := cachebackend.NewBackend(ctx, cfg.CacheDir)
+		if err != nil {
+			return fmt.Errorf("opening cache: %w", err)
+		}
+		cfg.backend = backend
+
 		// Find the package.name and package.version nodes.
 		packageNode, err := renovate.NodeFromMapping(rc.Configuration.Root().Content[0], "package")
 		if err != nil {
@@ -178,24 +184,6 @@ func addFileToCache(ctx context.Context, cfg CacheConfig, downloadedFile string,
 	}
 
 	filename := fmt.Sprintf("%s:%s", hashFamily, cfgHash)
-	destinationPath := path.Join(cfg.CacheDir, filename)
-
-	var destinationFile io.WriteCloser
-	if strings.HasPrefix(cfg.CacheDir, "gs://") {
-		bucket, prefix, _ := strings.Cut(strings.TrimPrefix(cfg.CacheDir, "gs://"), "/")
-		client, err := storage.NewClient(ctx)
-		if err != nil {
-			return err
-		}
-		destinationFile = client.Bucket(bucket).Object(path.Join(prefix, filename)).NewWriter(ctx)
-	} else {
-		var err error
-		destinationFile, err = os.Create(destinationPath)
-		if err != nil {
-			return err
-		}
-	}
-	defer destinationFile.Close()
 
 	sourceFile, err := os.Open(downloadedFile)
 	if err != nil {
@@ -203,11 +191,16 @@ func addFileToCache(ctx context.Context, cfg CacheConfig, downloadedFile string,
 	}
 	defer sourceFile.Close()
 
-	if _, err := io.Copy(destinationFile, sourceFile); err != nil {
+	fi, err := sourceFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	if err := cfg.backend.Put(ctx, filename, sourceFile, fi.Size()); err != nil {
 		return err
 	}
 
-	log.Printf("  wrote: %s", destinationPath)
+	log.Printf("  wrote: %s/%s", cfg.backend, filename)
 
 	return nil
 }